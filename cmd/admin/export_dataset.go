@@ -0,0 +1,86 @@
+package main
+
+import (
+	"batch-gpt/server/models"
+	"batch-gpt/services/export"
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+func runExportDataset(args []string) error {
+    flags := flag.NewFlagSet("export-dataset", flag.ExitOnError)
+    format := flags.String("format", export.FormatFineTune, "Dataset format: fine-tune or eval")
+    model := flags.String("model", "", "Only export responses to requests for this model")
+    tenant := flags.String("tenant", "", "Only export responses cached for this tenant")
+    from := flags.String("from", "", "Only export responses cached at or after this RFC 3339 timestamp")
+    to := flags.String("to", "", "Only export responses cached before this RFC 3339 timestamp")
+    finishReasons := flags.String("finish-reason", "", "Comma-separated finish reasons of the replies to export (default: all)")
+    tag := flags.String("tag", "", "Only export requests whose metadata has this key, or key=value")
+    dedupe := flags.Bool("dedupe", true, "Leave out conversations that were already exported")
+    scrubPII := flags.Bool("scrub-pii", false, "Replace email addresses, phone, card and social security numbers and IP addresses")
+    outPath := flags.String("out", "", "File to write the dataset to (default: standard output)")
+    flags.Parse(args)
+
+    if *format != export.FormatFineTune && *format != export.FormatEval {
+        return fmt.Errorf("--format must be %s or %s", export.FormatFineTune, export.FormatEval)
+    }
+    options := export.Options{
+        Format:   *format,
+        Filter:   models.CacheFilter{Model: *model, Tenant: *tenant},
+        Tag:      *tag,
+        Dedupe:   *dedupe,
+        ScrubPII: *scrubPII,
+    }
+    if *finishReasons != "" {
+        options.FinishReasons = strings.Split(*finishReasons, ",")
+    }
+    for _, bound := range []struct {
+        name  string
+        value string
+        into  *time.Time
+    }{{"from", *from, &options.Filter.From}, {"to", *to, &options.Filter.To}} {
+        if bound.value == "" {
+            continue
+        }
+        parsed, err := time.Parse(time.RFC3339, bound.value)
+        if err != nil {
+            return fmt.Errorf("--%s must be an RFC 3339 timestamp: %w", bound.name, err)
+        }
+        *bound.into = parsed
+    }
+
+    var out io.Writer = os.Stdout
+    if *outPath != "" {
+        file, err := os.Create(*outPath)
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        out = file
+    }
+    buffered := bufio.NewWriter(out)
+
+    store, err := openStore()
+    if err != nil {
+        return err
+    }
+    defer store.Close()
+
+    result, err := export.NewExporter(store).Export(context.Background(), buffered, options)
+    if flushErr := buffered.Flush(); err == nil {
+        err = flushErr
+    }
+    if err != nil {
+        return err
+    }
+
+    fmt.Fprintf(os.Stderr, "Exported %d examples: %d duplicates and %d replies left out\n",
+        result.Exported, result.Duplicates, result.Skipped)
+    return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"batch-gpt/services/batch"
+	"batch-gpt/services/budget"
+	"batch-gpt/services/cache"
+	"batch-gpt/services/client"
+	"batch-gpt/services/config"
+	"batch-gpt/services/fingerprint"
+	"batch-gpt/services/usage"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func runImportBatches(args []string) error {
+    flags := flag.NewFlagSet("import-batches", flag.ExitOnError)
+    tenant := flags.String("tenant", "", "Tenant to cache the responses for (default: the default tenant)")
+    flags.Usage = func() {
+        fmt.Fprintf(os.Stderr, "Usage: batch-admin import-batches [flags] <batch id>...\n\n")
+        flags.PrintDefaults()
+    }
+    flags.Parse(args)
+    if flags.NArg() == 0 {
+        flags.Usage()
+        return errors.New("no batch ids given")
+    }
+
+    store, err := openStore()
+    if err != nil {
+        return err
+    }
+    defer store.Close()
+
+    openAIClient := client.NewResilientClient(client.NewOpenAIClient(os.Getenv("OPENAI_API_KEY")), config.NewUpstreamConfig())
+    fingerprinter := fingerprint.NewFingerprinter(config.NewCacheKeyConfig())
+    cacheOrch := cache.NewOrchestrator(store, fingerprinter, config.NewCacheTTLConfig(), config.NewCacheSamplingConfig(), config.NewMemoryCacheConfig())
+    poller := batch.NewPoller(openAIClient, store, config.NewPollingConfig())
+    go poller.Start()
+    reconcileConfig := config.NewReconcileConfig()
+    pricingConfig := config.NewPricingConfig()
+    usageTracker := usage.NewTracker(store, pricingConfig)
+    batchOrch := batch.NewOrchestrator(
+        batch.NewProcessor(openAIClient, store, poller, config.NewBisectConfig(), reconcileConfig),
+        openAIClient,
+        store,
+        cacheOrch,
+        usageTracker,
+        budget.NewEnforcer(store, usageTracker, pricingConfig, config.NewBudgetConfig()),
+        config.NewServingMode("cache"),
+        config.NewResubmissionConfig(),
+        config.NewRetryConfig(),
+        reconcileConfig,
+        fingerprinter,
+        0,
+    )
+
+    failed := 0
+    for _, batchID := range flags.Args() {
+        // Batches that are still running are waited for, which may take up to their completion window
+        imported, err := batchOrch.ImportBatch(batchID, *tenant, true)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s: %v\n", batchID, err)
+            failed++
+            continue
+        }
+        fmt.Printf("%s: %s, cached %d of %d responses\n", batchID, imported.Status, imported.Cached, imported.Requests)
+    }
+
+    if failed > 0 {
+        return fmt.Errorf("%d of %d batches could not be imported", failed, flags.NArg())
+    }
+    return nil
+}
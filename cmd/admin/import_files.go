@@ -0,0 +1,82 @@
+package main
+
+import (
+	"batch-gpt/server/models"
+	"batch-gpt/services/cache"
+	"batch-gpt/services/config"
+	"batch-gpt/services/fingerprint"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func runImportFiles(args []string) error {
+    flags := flag.NewFlagSet("import-files", flag.ExitOnError)
+    inputPath := flags.String("input", "", "Batch input JSONL file")
+    outputPath := flags.String("output", "", "Batch output JSONL file with the responses to the input file")
+    tenant := flags.String("tenant", "", "Tenant to cache the responses for (default: the default tenant)")
+    source := flags.String("source", "", "Name of the files in the provenance of the cached responses (default: the file names)")
+    flags.Parse(args)
+    if *inputPath == "" || *outputPath == "" {
+        flags.Usage()
+        return errors.New("both --input and --output are required")
+    }
+
+    input, err := os.Open(*inputPath)
+    if err != nil {
+        return err
+    }
+    defer input.Close()
+    inputInfo, err := input.Stat()
+    if err != nil {
+        return err
+    }
+    output, err := os.Open(*outputPath)
+    if err != nil {
+        return err
+    }
+    defer output.Close()
+    outputInfo, err := output.Stat()
+    if err != nil {
+        return err
+    }
+    if *source == "" {
+        *source = filepath.Base(*inputPath) + "+" + filepath.Base(*outputPath)
+    }
+
+    store, err := openStore()
+    if err != nil {
+        return err
+    }
+    defer store.Close()
+
+    fingerprinter := fingerprint.NewFingerprinter(config.NewCacheKeyConfig())
+    cacheOrch := cache.NewOrchestrator(store, fingerprinter, config.NewCacheTTLConfig(), config.NewCacheSamplingConfig(), config.NewMemoryCacheConfig())
+    result, err := cacheOrch.Import(context.Background(), cache.ImportFiles{
+        Input:      input,
+        InputSize:  inputInfo.Size(),
+        Output:     output,
+        OutputSize: outputInfo.Size(),
+        Source:     *source,
+        Tenant:     *tenant,
+    }, printImportProgress)
+    if err != nil {
+        return err
+    }
+
+    fmt.Printf("Cached %d responses from %s: %d already cached, %d unmatched, %d failed\n",
+        result.Imported, result.Source, result.Skipped, result.Unmatched, result.Failed)
+    return nil
+}
+
+func printImportProgress(progress models.CacheImport) {
+    percent := 100.0
+    if progress.TotalBytes > 0 {
+        percent = float64(progress.BytesRead) * 100 / float64(progress.TotalBytes)
+    }
+    fmt.Fprintf(os.Stderr, "%5.1f%%  %d lines, %d cached, %d skipped, %d unmatched, %d failed\n",
+        percent, progress.Lines, progress.Imported, progress.Skipped, progress.Unmatched, progress.Failed)
+}
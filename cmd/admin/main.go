@@ -0,0 +1,85 @@
+package main
+
+import (
+	"batch-gpt/server/db"
+	"fmt"
+	"os"
+)
+
+// command is a batch-admin subcommand. run receives the arguments following the subcommand name.
+type command struct {
+    name        string
+    description string
+    run         func(args []string) error
+}
+
+var commands = []command{
+    {
+        name:        "rehash-cache",
+        description: "Recompute cache keys stored with an outdated fingerprint version",
+        run:         runRehashCache,
+    },
+    {
+        name:        "migrate",
+        description: "Apply pending schema migrations, or list them with --status",
+        run:         runMigrate,
+    },
+    {
+        name:        "import-batches",
+        description: "Track batches created outside batch-gpt and cache their responses",
+        run:         runImportBatches,
+    },
+    {
+        name:        "import-files",
+        description: "Cache the responses of a pair of Batch API input and output files",
+        run:         runImportFiles,
+    },
+    {
+        name:        "export-dataset",
+        description: "Write cached conversations as a fine-tuning or evaluation dataset",
+        run:         runExportDataset,
+    },
+}
+
+// openStore opens the storage backend without migrating it; only the server and the migrate
+// command change the schema.
+func openStore() (db.Store, error) {
+    store, err := db.NewUnmigratedStore()
+    if err != nil {
+        return nil, err
+    }
+    if err := db.CheckMigrations(store); err != nil {
+        store.Close()
+        return nil, err
+    }
+    return store, nil
+}
+
+func printUsage() {
+    fmt.Fprintf(os.Stderr, "Usage: batch-admin <command> [flags]\n\nCommands:\n")
+    for _, cmd := range commands {
+        fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.description)
+    }
+    fmt.Fprintf(os.Stderr, "\nRun 'batch-admin <command> -h' for the flags of a command.\n")
+}
+
+func main() {
+    if len(os.Args) < 2 {
+        printUsage()
+        os.Exit(2)
+    }
+
+    for _, cmd := range commands {
+        if cmd.name == os.Args[1] {
+            if err := cmd.run(os.Args[2:]); err != nil {
+                fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+                os.Exit(1)
+            }
+            return
+        }
+    }
+
+    fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", os.Args[1])
+    printUsage()
+    os.Exit(2)
+}
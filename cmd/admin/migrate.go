@@ -0,0 +1,51 @@
+package main
+
+import (
+	"batch-gpt/server/db"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func runMigrate(args []string) error {
+    flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+    status := flags.Bool("status", false, "List the schema migrations and whether they are applied, without applying any")
+    flags.Parse(args)
+
+    store, err := db.NewUnmigratedStore()
+    if err != nil {
+        return err
+    }
+    defer store.Close()
+
+    if *status {
+        migrations, err := store.GetMigrations()
+        if err != nil {
+            return err
+        }
+        writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+        fmt.Fprintln(writer, "VERSION\tAPPLIED\tDESCRIPTION")
+        for _, migration := range migrations {
+            applied := "pending"
+            if !migration.AppliedAt.IsZero() {
+                applied = migration.AppliedAt.Format(time.RFC3339)
+            }
+            fmt.Fprintf(writer, "%d\t%s\t%s\n", migration.Version, applied, migration.Description)
+        }
+        return writer.Flush()
+    }
+
+    applied, err := store.Migrate()
+    for _, migration := range applied {
+        fmt.Printf("Applied migration %d: %s\n", migration.Version, migration.Description)
+    }
+    if err != nil {
+        return err
+    }
+    if len(applied) == 0 {
+        fmt.Println("Schema is up to date")
+    }
+    return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"batch-gpt/services/config"
+	"batch-gpt/services/fingerprint"
+	"flag"
+	"fmt"
+)
+
+func runRehashCache(args []string) error {
+    flags := flag.NewFlagSet("rehash-cache", flag.ExitOnError)
+    dryRun := flags.Bool("dry-run", false, "Report how many entries would be rehashed without changing them")
+    all := flags.Bool("all", false, "Rehash every entry, not only those with an outdated fingerprint version, e.g. after changing CACHE_KEY_RULES_FILE")
+    flags.Parse(args)
+
+    store, err := openStore()
+    if err != nil {
+        return err
+    }
+    defer store.Close()
+
+    fingerprinter := fingerprint.NewFingerprinter(config.NewCacheKeyConfig())
+    result, err := store.RehashCachedResponses(fingerprint.CurrentVersion, fingerprinter.Fingerprint, *all, *dryRun)
+    if err != nil {
+        return err
+    }
+
+    action := "Rehashed"
+    if *dryRun {
+        action = "Would rehash"
+    }
+    fmt.Printf("%s %d of %d cached responses to fingerprint version %d (%d failed)\n",
+        action, result.Updated, result.Scanned, fingerprint.CurrentVersion, result.Failed)
+    return nil
+}
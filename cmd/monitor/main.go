@@ -3,6 +3,7 @@ package main
 import (
 	"batch-gpt/cmd/monitor/ui"
 	"batch-gpt/server/db"
+	"batch-gpt/services/config"
 	"fmt"
 	"os"
 
@@ -10,11 +11,20 @@ import (
 )
 
 func main() {
-    // Initialize MongoDB connection
-    db.InitMongoDB()
+    // Open the same storage backend as the server, leaving its schema to the server
+    store, err := db.NewUnmigratedStore()
+    if err != nil {
+        fmt.Printf("Error opening storage: %v\n", err)
+        os.Exit(1)
+    }
+    defer store.Close()
+    if err := db.CheckMigrations(store); err != nil {
+        fmt.Printf("Error opening storage: %v\n", err)
+        os.Exit(1)
+    }
 
     p := tea.NewProgram(
-        ui.NewModel(),
+        ui.NewModel(store, config.NewPricingConfig()),
         tea.WithAltScreen(),
         tea.WithMouseCellMotion(),
     )
@@ -2,6 +2,8 @@ package ui
 
 import (
 	"batch-gpt/server/db" // for getting batch data
+	"batch-gpt/services/config"
+	"batch-gpt/services/usage"
 	"fmt"
 	"time"
 
@@ -89,9 +91,14 @@ const (
 	completedTab
 	failedTab
 	expiredTab
+	usageTab
 )
 
 type Model struct {
+	store         db.BatchStore
+	usageStore    db.UsageStore
+	pricingConfig config.PricingConfig
+	usage         usage.Report
 	tabs          []string
 	currentTab    tab
 	batches       []batchItem
@@ -104,21 +111,24 @@ type Model struct {
 	lastUpdate    time.Time
 }
 
-func NewModel() Model {
+func NewModel(store db.Store, pricingConfig config.PricingConfig) Model {
 	return Model{
-		tabs:       []string{"Active Batches", "Completed Batches", "Failed Batches", "Expired Batches"},
-		currentTab: activeTab,
-		help:       true,
-		lastUpdate: time.Now(),
+		store:         store,
+		usageStore:    store,
+		pricingConfig: pricingConfig,
+		tabs:          []string{"Active Batches", "Completed Batches", "Failed Batches", "Expired Batches", "Usage"},
+		currentTab:    activeTab,
+		help:          true,
+		lastUpdate:    time.Now(),
 	}
 }
 
 func (m Model) Init() tea.Cmd {
-	return fetchBatches
+	return tea.Batch(m.fetchBatches, m.fetchUsage)
 }
 
-func fetchBatches() tea.Msg {
-	batches, err := db.GetAllBatchStatuses()
+func (m Model) fetchBatches() tea.Msg {
+	batches, err := m.store.GetAllBatchStatuses()
 	if err != nil {
 		return errMsg{err}
 	}
@@ -140,13 +150,17 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case key.Matches(msg, keys.Quit):
 			return m, tea.Quit
 		case key.Matches(msg, keys.Tab), key.Matches(msg, keys.Right):
-			m.currentTab = (m.currentTab + 1) % 4
+			m.currentTab = (m.currentTab + 1) % tab(len(m.tabs))
 			m.cursor = 0
 			m.offset = 0
 		case key.Matches(msg, keys.Left):
-			m.currentTab = (m.currentTab - 1 + 4) % 4
+			m.currentTab = (m.currentTab - 1 + tab(len(m.tabs))) % tab(len(m.tabs))
 			m.cursor = 0
 			m.offset = 0
+		case key.Matches(msg, keys.Up) && m.currentTab == usageTab:
+			if m.offset > 0 {
+				m.offset--
+			}
 		case key.Matches(msg, keys.Up):
 			if m.cursor > 0 {
 				m.cursor--
@@ -155,6 +169,10 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					m.offset = m.cursor
 				}
 			}
+		case key.Matches(msg, keys.Down) && m.currentTab == usageTab:
+			if m.offset < len(m.usage.Data)-m.maxVisibleUsageRows() {
+				m.offset++
+			}
 		case key.Matches(msg, keys.Down):
 			filteredBatches := m.filterBatches()
 			if m.cursor < len(filteredBatches)-1 {
@@ -178,7 +196,7 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.help = !m.help
 		case key.Matches(msg, keys.Refresh):
 			m.loading = true
-			return m, fetchBatches
+			return m, tea.Batch(m.fetchBatches, m.fetchUsage)
 		}
 
 	case tea.WindowSizeMsg:
@@ -190,6 +208,9 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.loading = false
 		m.lastUpdate = time.Now()
 
+	case usageMsg:
+		m.usage = msg.report
+
 	case errMsg:
 		m.error = msg.err
 		m.loading = false
@@ -238,7 +259,9 @@ func (m Model) View() string {
 		style := tabStyle
 		if tab(i) == m.currentTab {
 			style = activeTabStyle
-			t = fmt.Sprintf("%s (%d)", t, totalBatches)
+			if m.currentTab != usageTab {
+				t = fmt.Sprintf("%s (%d)", t, totalBatches)
+			}
 		}
 		tabs = append(tabs, style.Render(t))
 	}
@@ -246,7 +269,9 @@ func (m Model) View() string {
 
 	// Build batch list with scroll indicators
 	var content string
-	if totalBatches > 0 {
+	if m.currentTab == usageTab {
+		content = m.renderUsage()
+	} else if totalBatches > 0 {
 		visibleBatches := m.visibleBatches()
 		content = m.renderBatches(visibleBatches)
 
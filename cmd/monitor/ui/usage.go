@@ -0,0 +1,86 @@
+package ui
+
+import (
+	"batch-gpt/server/models"
+	"batch-gpt/services/usage"
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// usageDays is how many days back the usage tab reports on, today included.
+const usageDays = 30
+
+type usageMsg struct {
+	report usage.Report
+}
+
+func (m Model) fetchUsage() tea.Msg {
+	from := time.Now().UTC().AddDate(0, 0, -(usageDays - 1)).Format(usage.DayFormat)
+	records, err := m.usageStore.GetUsage(models.UsageFilter{From: from})
+	if err != nil {
+		return errMsg{err}
+	}
+	return usageMsg{usage.Summarize(records, m.pricingConfig)}
+}
+
+func (m Model) renderUsage() string {
+	total := m.usage.Total
+	summary := lipgloss.JoinHorizontal(
+		lipgloss.Left,
+		fmt.Sprintf("Last %d days:  spend ", usageDays),
+		batchIDStyle.Render(formatDollars(total.Spend)),
+		"  •  batch savings ",
+		statusStyle["completed"].Render(formatDollars(total.BatchSavings)),
+		"  •  cache savings ",
+		statusStyle["completed"].Render(formatDollars(total.CacheSavings)),
+		fmt.Sprintf("  •  %d batch requests, %d cache hits", total.BatchRequests, total.CacheHits),
+	)
+	if len(m.usage.UnpricedModels) > 0 {
+		summary += "\n" + statusStyle["in_progress"].Render("No price for: "+strings.Join(m.usage.UnpricedModels, ", "))
+	}
+	if len(m.usage.Data) == 0 {
+		return summary + "\n\nNo usage recorded"
+	}
+
+	row := "%-10s  %-16s  %-24s  %10s  %10s  %10s  %12s  %12s"
+	separator := lipgloss.NewStyle().
+		Foreground(primaryColor).
+		Render(strings.Repeat("─", m.width-4))
+	rendered := []string{
+		summary,
+		"",
+		batchIDStyle.Render(fmt.Sprintf(row, "Day", "Tenant", "Model", "Requests", "Cache hits", "Spend", "Batch saved", "Cache saved")),
+		separator,
+	}
+
+	// Most recent days first
+	visible := m.maxVisibleUsageRows()
+	for i := len(m.usage.Data) - 1 - m.offset; i >= 0 && visible > 0; i-- {
+		s := m.usage.Data[i]
+		rendered = append(rendered, fmt.Sprintf(row,
+			s.Day, truncate(s.Tenant, 16), truncate(s.Model, 24), fmt.Sprint(s.BatchRequests), fmt.Sprint(s.CacheHits),
+			formatDollars(s.Spend), formatDollars(s.BatchSavings), formatDollars(s.CacheSavings)))
+		visible--
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, rendered...)
+}
+
+func (m Model) maxVisibleUsageRows() int {
+	// Subtract space for header (3), tabs (3), summary and table header (5) and footer (1)
+	return max(1, m.height-12)
+}
+
+func formatDollars(amount float64) string {
+	return fmt.Sprintf("$%.2f", amount)
+}
+
+func truncate(text string, width int) string {
+	if len(text) <= width {
+		return text
+	}
+	return text[:width-1] + "…"
+}
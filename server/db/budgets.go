@@ -0,0 +1,86 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "context"
+    "fmt"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type budgetDocument struct {
+    Tenant            string    `bson:"_id"`
+    DailyTokens       int64     `bson:"daily_tokens"`
+    MonthlyTokens     int64     `bson:"monthly_tokens"`
+    DailyUSD          float64   `bson:"daily_usd"`
+    MonthlyUSD        float64   `bson:"monthly_usd"`
+    RequestsPerMinute int       `bson:"requests_per_minute"`
+    UpdatedAt         time.Time `bson:"updated_at"`
+}
+
+func (s *mongoStore) GetBudgets() ([]models.Budget, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    cursor, err := s.budgetsCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+    if err != nil {
+        return nil, fmt.Errorf("failed to find budgets: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    var documents []budgetDocument
+    if err = cursor.All(ctx, &documents); err != nil {
+        return nil, fmt.Errorf("failed to decode budgets: %w", err)
+    }
+
+    budgets := make([]models.Budget, 0, len(documents))
+    for _, document := range documents {
+        budgets = append(budgets, models.Budget(document))
+    }
+    return budgets, nil
+}
+
+func (s *mongoStore) GetBudget(tenant string) (models.Budget, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    var document budgetDocument
+    err := s.budgetsCollection.FindOne(ctx, bson.M{"_id": tenant}).Decode(&document)
+    if err == mongo.ErrNoDocuments {
+        return models.Budget{}, ErrNotFound
+    }
+    if err != nil {
+        return models.Budget{}, err
+    }
+    return models.Budget(document), nil
+}
+
+func (s *mongoStore) SaveBudget(budget models.Budget) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    _, err := s.budgetsCollection.ReplaceOne(
+        ctx,
+        bson.M{"_id": budget.Tenant},
+        budgetDocument(budget),
+        options.Replace().SetUpsert(true),
+    )
+    return err
+}
+
+func (s *mongoStore) DeleteBudget(tenant string) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    result, err := s.budgetsCollection.DeleteOne(ctx, bson.M{"_id": tenant})
+    if err != nil {
+        return err
+    }
+    if result.DeletedCount == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
@@ -0,0 +1,320 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migrateCacheToSamples turns cached responses stored one document per response into one
+// document per hash holding all of its responses as samples, and drops the non-unique hash index
+// if there is one. Caches already converted have a unique hash index and are left alone.
+func (s *mongoStore) migrateCacheToSamples(ctx context.Context) error {
+    specifications, err := s.cachedResponsesCollection.Indexes().ListSpecifications(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to list cached_responses indexes: %w", err)
+    }
+    dropHashIndex := false
+    for _, specification := range specifications {
+        if specification.Name == "hash_1" {
+            if specification.Unique != nil && *specification.Unique {
+                return nil
+            }
+            dropHashIndex = true
+        }
+    }
+    log.Println("Converting cached responses to one entry per request hash")
+
+    _, err = s.cachedResponsesCollection.UpdateMany(
+        ctx,
+        bson.M{"response": bson.M{"$exists": true}},
+        mongo.Pipeline{
+            {{Key: "$set", Value: bson.M{
+                "responses": bson.A{bson.M{"response": "$response", "timestamp": "$timestamp"}},
+                "sampled":   1,
+            }}},
+            {{Key: "$unset", Value: "response"}},
+        },
+    )
+    if err != nil {
+        return fmt.Errorf("failed to convert cached responses to samples: %w", err)
+    }
+
+    cursor, err := s.cachedResponsesCollection.Aggregate(
+        ctx,
+        mongo.Pipeline{
+            {{Key: "$sort", Value: bson.M{"timestamp": 1}}},
+            {{Key: "$group", Value: bson.M{
+                "_id":   "$hash",
+                "ids":   bson.M{"$push": "$_id"},
+                "count": bson.M{"$sum": 1},
+            }}},
+            {{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+        },
+        options.Aggregate().SetAllowDiskUse(true),
+    )
+    if err != nil {
+        return fmt.Errorf("failed to find duplicate cached responses: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    merged := 0
+    for cursor.Next(ctx) {
+        var group struct {
+            IDs []primitive.ObjectID `bson:"ids"`
+        }
+        if err := cursor.Decode(&group); err != nil {
+            return fmt.Errorf("failed to decode duplicate cached responses: %w", err)
+        }
+        if err := s.mergeCachedResponses(ctx, group.IDs[0], group.IDs[1:]); err != nil {
+            return err
+        }
+        merged += len(group.IDs) - 1
+    }
+    if err := cursor.Err(); err != nil {
+        return fmt.Errorf("failed to iterate duplicate cached responses: %w", err)
+    }
+
+    if dropHashIndex {
+        if _, err := s.cachedResponsesCollection.Indexes().DropOne(ctx, "hash_1"); err != nil {
+            return fmt.Errorf("failed to drop the non-unique hash index: %w", err)
+        }
+    }
+    log.Printf("Merged %d duplicate cached responses", merged)
+    return nil
+}
+
+// mergeCachedResponses appends the samples of the entries in merge to the entry keep and
+// deletes them.
+func (s *mongoStore) mergeCachedResponses(ctx context.Context, keep primitive.ObjectID, merge []primitive.ObjectID) error {
+    cursor, err := s.cachedResponsesCollection.Find(
+        ctx,
+        bson.M{"_id": bson.M{"$in": merge}},
+        options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}),
+    )
+    if err != nil {
+        return fmt.Errorf("failed to find cached responses to merge: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    var documents []struct {
+        Responses []bson.Raw `bson:"responses"`
+        Sampled   int        `bson:"sampled"`
+    }
+    if err = cursor.All(ctx, &documents); err != nil {
+        return fmt.Errorf("failed to decode cached responses to merge: %w", err)
+    }
+
+    responses := bson.A{}
+    sampled := 0
+    for _, document := range documents {
+        for _, response := range document.Responses {
+            responses = append(responses, response)
+        }
+        sampled += document.Sampled
+    }
+
+    _, err = s.cachedResponsesCollection.UpdateByID(ctx, keep, bson.M{
+        "$push": bson.M{"responses": bson.M{"$each": responses}},
+        "$inc":  bson.M{"sampled": sampled},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to merge cached responses into %s: %w", keep.Hex(), err)
+    }
+    if _, err = s.cachedResponsesCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": merge}}); err != nil {
+        return fmt.Errorf("failed to delete merged cached responses: %w", err)
+    }
+    return nil
+}
+
+// sampleKey identifies the content of a response, so samples that repeat one are not stored twice.
+func sampleKey(response openai.ChatCompletionResponse) (string, error) {
+    choices, err := json.Marshal(response.Choices)
+    if err != nil {
+        return "", fmt.Errorf("failed to encode response choices: %w", err)
+    }
+    sum := sha256.Sum256(choices)
+    return hex.EncodeToString(sum[:]), nil
+}
+
+// EvictCachedResponses deletes the oldest cached responses until at most maxEntries are left.
+// It returns the number of deleted entries.
+func (s *mongoStore) EvictCachedResponses(maxEntries int64) (int64, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    count, err := s.cachedResponsesCollection.EstimatedDocumentCount(ctx)
+    if err != nil {
+        return 0, fmt.Errorf("failed to count cached responses: %w", err)
+    }
+    if count <= maxEntries {
+        return 0, nil
+    }
+
+    cursor, err := s.cachedResponsesCollection.Find(
+        ctx,
+        bson.M{},
+        options.Find().
+            SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+            SetLimit(count-maxEntries).
+            SetProjection(bson.M{"_id": 1}),
+    )
+    if err != nil {
+        return 0, fmt.Errorf("failed to find cached responses to evict: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    var documents []struct {
+        ID primitive.ObjectID `bson:"_id"`
+    }
+    if err = cursor.All(ctx, &documents); err != nil {
+        return 0, fmt.Errorf("failed to decode cached responses to evict: %w", err)
+    }
+    ids := make([]primitive.ObjectID, 0, len(documents))
+    for _, document := range documents {
+        ids = append(ids, document.ID)
+    }
+
+    result, err := s.cachedResponsesCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+    if err != nil {
+        return 0, fmt.Errorf("failed to evict cached responses: %w", err)
+    }
+    return result.DeletedCount, nil
+}
+
+// InvalidateCachedResponses deletes the cached responses matching filter and returns how many
+// were deleted. An empty filter deletes every cached response.
+func (s *mongoStore) InvalidateCachedResponses(filter models.CacheFilter) (int64, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    result, err := s.cachedResponsesCollection.DeleteMany(ctx, mongoCacheQuery(filter))
+    if err != nil {
+        return 0, fmt.Errorf("failed to invalidate cached responses: %w", err)
+    }
+    return result.DeletedCount, nil
+}
+
+// mongoCacheQuery turns a cache filter into a query on cached_responses.
+func mongoCacheQuery(filter models.CacheFilter) bson.M {
+    query := bson.M{}
+    if filter.Hash != "" {
+        query["hash"] = filter.Hash
+    }
+    if filter.Model != "" {
+        query["model"] = filter.Model
+    }
+    if filter.Tenant != "" {
+        query["tenant"] = filter.Tenant
+    }
+    timestamp := bson.M{}
+    if !filter.From.IsZero() {
+        timestamp["$gte"] = filter.From
+    }
+    if !filter.To.IsZero() {
+        timestamp["$lt"] = filter.To
+    }
+    if len(timestamp) > 0 {
+        query["timestamp"] = timestamp
+    }
+    return query
+}
+
+// ExportCachedResponses calls onEntry with every unexpired entry matching filter, in the order
+// the entries were cached.
+func (s *mongoStore) ExportCachedResponses(ctx context.Context, filter models.CacheFilter, onEntry func(models.CachedRequest) error) error {
+    query := mongoCacheQuery(filter)
+    query["expires_at"] = bson.M{"$not": bson.M{"$lte": time.Now()}}
+    query["responses.0"] = bson.M{"$exists": true}
+    findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(exportPageSize)
+
+    for {
+        var documents []struct {
+            ID          primitive.ObjectID `bson:"_id"`
+            Hash        string             `bson:"hash"`
+            Tenant      string             `bson:"tenant"`
+            Route       string             `bson:"route"`
+            RequestBody string             `bson:"request_body"`
+            Timestamp   time.Time          `bson:"timestamp"`
+            Responses   []struct {
+                Response openai.ChatCompletionResponse `bson:"response"`
+            } `bson:"responses"`
+        }
+        cursor, err := s.cachedResponsesCollection.Find(ctx, query, findOptions)
+        if err != nil {
+            return fmt.Errorf("failed to export cached responses: %w", err)
+        }
+        // All closes the cursor, so none is open while onEntry runs
+        if err := cursor.All(ctx, &documents); err != nil {
+            return fmt.Errorf("failed to read cached responses: %w", err)
+        }
+
+        for _, document := range documents {
+            entry := models.CachedRequest{
+                Hash:      document.Hash,
+                Tenant:    document.Tenant,
+                Route:     document.Route,
+                Body:      json.RawMessage(document.RequestBody),
+                CachedAt:  document.Timestamp,
+                Responses: make([]openai.ChatCompletionResponse, 0, len(document.Responses)),
+            }
+            for _, sample := range document.Responses {
+                entry.Responses = append(entry.Responses, sample.Response)
+            }
+            if err := onEntry(entry); err != nil {
+                return err
+            }
+        }
+        if len(documents) < exportPageSize {
+            return nil
+        }
+        query["_id"] = bson.M{"$gt": documents[len(documents)-1].ID}
+    }
+}
+
+// WatchCachedResponses calls onChange for every change to the cached responses until ctx is
+// done or the change stream ends. Change streams require MongoDB to run as a replica set.
+func (s *mongoStore) WatchCachedResponses(ctx context.Context, onChange func(models.CacheChange)) error {
+    stream, err := s.cachedResponsesCollection.Watch(ctx, mongo.Pipeline{
+        {{Key: "$project", Value: bson.M{"operationType": 1, "documentKey": 1, "fullDocument.hash": 1}}},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to watch cached responses: %w", err)
+    }
+    defer stream.Close(ctx)
+
+    for stream.Next(ctx) {
+        var event struct {
+            OperationType string `bson:"operationType"`
+            DocumentKey   struct {
+                ID primitive.ObjectID `bson:"_id"`
+            } `bson:"documentKey"`
+            FullDocument struct {
+                Hash string `bson:"hash"`
+            } `bson:"fullDocument"`
+        }
+        if err := stream.Decode(&event); err != nil {
+            return fmt.Errorf("failed to decode cached response change: %w", err)
+        }
+
+        switch event.OperationType {
+        case "insert", "update", "replace", "delete":
+            onChange(models.CacheChange{EntryID: event.DocumentKey.ID.Hex(), Hash: event.FullDocument.Hash})
+        default:
+            // drop, rename, dropDatabase and invalidate events can affect every entry
+            onChange(models.CacheChange{Reset: true})
+        }
+    }
+    return stream.Err()
+}
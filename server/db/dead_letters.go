@@ -0,0 +1,147 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "context"
+    "encoding/json"
+    "fmt"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+
+// deadLetterDocument stores the request body as a JSON string so it can be resubmitted unchanged;
+// decoding arbitrary request fields back out of BSON does not round-trip.
+type deadLetterDocument struct {
+    Hash       string    `bson:"_id"`
+    Request    string    `bson:"request"`
+    Tenant     string    `bson:"tenant"`
+    Route      string    `bson:"route"`
+    LastError  string    `bson:"last_error"`
+    ErrorClass string    `bson:"error_class"`
+    BatchIDs   []string  `bson:"batch_ids"`
+    Attempts   int       `bson:"attempts"`
+    CreatedAt  time.Time `bson:"created_at"`
+}
+
+func (d deadLetterDocument) toModel() (models.DeadLetter, error) {
+    if !json.Valid([]byte(d.Request)) {
+        return models.DeadLetter{}, fmt.Errorf("dead letter %s does not hold a valid JSON request", d.Hash)
+    }
+    return models.DeadLetter{
+        Hash:       d.Hash,
+        Request:    json.RawMessage(d.Request),
+        Tenant:     d.Tenant,
+        Route:      d.Route,
+        LastError:  d.LastError,
+        ErrorClass: d.ErrorClass,
+        BatchIDs:   d.BatchIDs,
+        Attempts:   d.Attempts,
+        CreatedAt:  d.CreatedAt,
+    }, nil
+}
+
+// SaveDeadLetter stores a dead letter, replacing any earlier one for the same request hash.
+func (s *mongoStore) SaveDeadLetter(deadLetter models.DeadLetter) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    document := deadLetterDocument{
+        Hash:       deadLetter.Hash,
+        Request:    string(deadLetter.Request),
+        Tenant:     deadLetter.Tenant,
+        Route:      deadLetter.Route,
+        LastError:  deadLetter.LastError,
+        ErrorClass: deadLetter.ErrorClass,
+        BatchIDs:   deadLetter.BatchIDs,
+        Attempts:   deadLetter.Attempts,
+        CreatedAt:  deadLetter.CreatedAt,
+    }
+
+    _, err := s.deadLettersCollection.ReplaceOne(
+        ctx,
+        bson.M{"_id": deadLetter.Hash},
+        document,
+        options.Replace().SetUpsert(true),
+    )
+    return err
+}
+
+func (s *mongoStore) GetDeadLetters(limit int64) ([]models.DeadLetter, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    cursor, err := s.deadLettersCollection.Find(
+        ctx,
+        bson.M{},
+        options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit),
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to find dead letters: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    var documents []deadLetterDocument
+    if err = cursor.All(ctx, &documents); err != nil {
+        return nil, fmt.Errorf("failed to decode dead letters: %w", err)
+    }
+
+    deadLetters := make([]models.DeadLetter, 0, len(documents))
+    for _, document := range documents {
+        deadLetter, err := document.toModel()
+        if err != nil {
+            return nil, err
+        }
+        deadLetters = append(deadLetters, deadLetter)
+    }
+    return deadLetters, nil
+}
+
+func (s *mongoStore) GetDeadLetter(hash string) (models.DeadLetter, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    var document deadLetterDocument
+    err := s.deadLettersCollection.FindOne(ctx, bson.M{"_id": hash}).Decode(&document)
+    if err == mongo.ErrNoDocuments {
+        return models.DeadLetter{}, ErrNotFound
+    }
+    if err != nil {
+        return models.DeadLetter{}, err
+    }
+    return document.toModel()
+}
+
+func (s *mongoStore) DeleteDeadLetter(hash string) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    result, err := s.deadLettersCollection.DeleteOne(ctx, bson.M{"_id": hash})
+    if err != nil {
+        return err
+    }
+    if result.DeletedCount == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+// PurgeDeadLetters deletes dead letters created before the given time, or all of them if before is zero.
+func (s *mongoStore) PurgeDeadLetters(before time.Time) (int64, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    filter := bson.M{}
+    if !before.IsZero() {
+        filter["created_at"] = bson.M{"$lt": before}
+    }
+
+    result, err := s.deadLettersCollection.DeleteMany(ctx, filter)
+    if err != nil {
+        return 0, fmt.Errorf("failed to purge dead letters: %w", err)
+    }
+    return result.DeletedCount, nil
+}
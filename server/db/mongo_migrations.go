@@ -0,0 +1,427 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoMigration is a schema migration of the MongoDB backend. MongoDB cannot apply index
+// changes in a transaction, so apply must leave an interrupted migration safe to run again.
+type mongoMigration struct {
+    description string
+    apply       func(s *mongoStore, ctx context.Context) error
+}
+
+// mongoMigrations are applied in order, each once, and recorded in the schema_migrations
+// collection. Databases created before migrations were recorded run all of them, so each must
+// also cope with its changes being there already. Never change a released migration; append a
+// new one instead.
+var mongoMigrations = []mongoMigration{
+    {"Index batch_logs by batch id and time, replacing the batch.id index", (*mongoStore).indexBatchLogsByID},
+    {"Index batch_logs by status and time", (*mongoStore).indexBatchLogsByStatus},
+    {"Store cached responses as one entry per request hash", (*mongoStore).migrateCacheToSamples},
+    {"Index cached_responses by unique hash, time and expiry", (*mongoStore).indexCachedResponses},
+    {"Index dead_letters by creation time", (*mongoStore).indexDeadLetters},
+    {"Index batches by status and creation time, and batch_history by batch id and time", (*mongoStore).indexBatches},
+    {"Move batch_logs into batches and batch_history", (*mongoStore).migrateBatchLogs},
+    {"Index batches by status and id, for paging through dangling batches", (*mongoStore).indexBatchesByStatusAndID},
+    {"Index daily_usage by unique day, tenant, model and source, and by tenant and day", (*mongoStore).indexDailyUsage},
+    {"Fill in the model and tenant of cached responses cached without them", (*mongoStore).fillCachedResponseModelAndTenant},
+    {"Index queued_requests by queue time", (*mongoStore).indexQueuedRequests},
+}
+
+const (
+    // migrationLockID is the schema_migrations document held while migrating
+    migrationLockID = "lock"
+    // migrationLockLease is how long a process may hold the lock before others may take it over
+    migrationLockLease = 30 * time.Minute
+)
+
+func (s *mongoStore) migrationsCollection() *mongo.Collection {
+    return s.database.Collection("schema_migrations")
+}
+
+// batchLogsCollection held a document per batch poll before batches and batch_history replaced it.
+func (s *mongoStore) batchLogsCollection() *mongo.Collection {
+    return s.database.Collection("batch_logs")
+}
+
+func (s *mongoStore) GetMigrations() ([]Migration, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    appliedAt, err := s.appliedMigrations(ctx)
+    if err != nil {
+        return nil, err
+    }
+    descriptions := make([]string, len(mongoMigrations))
+    for i, migration := range mongoMigrations {
+        descriptions[i] = migration.description
+    }
+    return listMigrations(descriptions, appliedAt), nil
+}
+
+func (s *mongoStore) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+    cursor, err := s.migrationsCollection().Find(ctx, bson.M{"_id": bson.M{"$type": "number"}})
+    if err != nil {
+        return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    var documents []struct {
+        Version   int       `bson:"_id"`
+        AppliedAt time.Time `bson:"applied_at"`
+    }
+    if err := cursor.All(ctx, &documents); err != nil {
+        return nil, fmt.Errorf("failed to decode schema_migrations: %w", err)
+    }
+    appliedAt := make(map[int]time.Time, len(documents))
+    for _, document := range documents {
+        appliedAt[document.Version] = document.AppliedAt
+    }
+    return appliedAt, nil
+}
+
+// Migrate applies the pending migrations one by one, recording each as soon as it is applied.
+// A lock keeps replicas starting at the same time from applying them twice.
+func (s *mongoStore) Migrate() ([]Migration, error) {
+    ctx := context.Background()
+    release, err := s.lockMigrations(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    appliedAt, err := s.appliedMigrations(ctx)
+    if err != nil {
+        return nil, err
+    }
+    for version := range appliedAt {
+        if version > len(mongoMigrations) {
+            return nil, fmt.Errorf("database schema version %d is newer than this release supports (%d)", version, len(mongoMigrations))
+        }
+    }
+
+    var applied []Migration
+    for i, migration := range mongoMigrations {
+        version := i + 1
+        if _, ok := appliedAt[version]; ok {
+            continue
+        }
+        if err := migration.apply(s, ctx); err != nil {
+            return applied, fmt.Errorf("failed to apply schema migration %d (%s): %w", version, migration.description, err)
+        }
+        now := time.Now()
+        if _, err := s.migrationsCollection().InsertOne(ctx, bson.M{"_id": version, "applied_at": now}); err != nil {
+            return applied, fmt.Errorf("failed to record schema migration %d: %w", version, err)
+        }
+        log.Printf("Applied MongoDB schema migration %d: %s", version, migration.description)
+        applied = append(applied, Migration{Version: version, Description: migration.description, AppliedAt: now})
+    }
+    return applied, nil
+}
+
+// lockMigrations takes a lease on the migration lock, waiting while another process holds it.
+// The lease expires, so a process that died while migrating does not block migrations for good.
+func (s *mongoStore) lockMigrations(ctx context.Context) (release func(), err error) {
+    owner := primitive.NewObjectID()
+    deadline := time.Now().Add(migrationLockLease)
+    for {
+        now := time.Now()
+        _, err := s.migrationsCollection().UpdateOne(
+            ctx,
+            bson.M{"_id": migrationLockID, "expires_at": bson.M{"$lt": now}},
+            bson.M{"$set": bson.M{"owner": owner, "expires_at": now.Add(migrationLockLease)}},
+            options.Update().SetUpsert(true),
+        )
+        if err == nil {
+            break
+        }
+        // The upsert collides with the lock document while someone else holds it
+        if !mongo.IsDuplicateKeyError(err) {
+            return nil, fmt.Errorf("failed to lock schema migrations: %w", err)
+        }
+        if now.After(deadline) {
+            return nil, fmt.Errorf("timed out waiting for another process to finish schema migrations")
+        }
+        log.Println("Waiting for another process to finish schema migrations")
+        time.Sleep(2 * time.Second)
+    }
+
+    return func() {
+        _, err := s.migrationsCollection().DeleteOne(context.Background(), bson.M{"_id": migrationLockID, "owner": owner})
+        if err != nil {
+            log.Printf("Failed to release the schema migration lock, it expires in %v: %v", migrationLockLease, err)
+        }
+    }, nil
+}
+
+// dropIndexIfExists drops the named index of a collection if it has one.
+func dropIndexIfExists(ctx context.Context, collection *mongo.Collection, name string) error {
+    specifications, err := collection.Indexes().ListSpecifications(ctx)
+    if err != nil {
+        return fmt.Errorf("failed to list %s indexes: %w", collection.Name(), err)
+    }
+    for _, specification := range specifications {
+        if specification.Name == name {
+            if _, err := collection.Indexes().DropOne(ctx, name); err != nil {
+                return fmt.Errorf("failed to drop index %s of %s: %w", name, collection.Name(), err)
+            }
+        }
+    }
+    return nil
+}
+
+// indexBatchLogsByID serves latest-status lookups, which sort a batch's logs by time. It covers
+// the batch.id index the collection was created with, which is dropped.
+func (s *mongoStore) indexBatchLogsByID(ctx context.Context) error {
+    _, err := s.batchLogsCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "batch.id", Value: 1}, {Key: "timestamp", Value: -1}},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to create the batch_logs index: %w", err)
+    }
+    return dropIndexIfExists(ctx, s.batchLogsCollection(), "batch.id_1")
+}
+
+func (s *mongoStore) indexBatchLogsByStatus(ctx context.Context) error {
+    _, err := s.batchLogsCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "batch.status", Value: 1}, {Key: "timestamp", Value: -1}},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to create the batch_logs status index: %w", err)
+    }
+    return nil
+}
+
+func (s *mongoStore) indexCachedResponses(ctx context.Context) error {
+    _, err := s.cachedResponsesCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+        {Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "timestamp", Value: 1}}},
+        // Documents without expires_at never expire
+        {Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to create cached_responses indexes: %w", err)
+    }
+    return nil
+}
+
+func (s *mongoStore) indexDeadLetters(ctx context.Context) error {
+    _, err := s.deadLettersCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "created_at", Value: -1}},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to create the dead_letters index: %w", err)
+    }
+    return nil
+}
+
+func (s *mongoStore) indexBatches(ctx context.Context) error {
+    _, err := s.batchCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+        {Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+        {Keys: bson.D{{Key: "created_at", Value: -1}}},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to create batches indexes: %w", err)
+    }
+    _, err = s.batchHistoryCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "batch_id", Value: 1}, {Key: "timestamp", Value: 1}},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to create the batch_history index: %w", err)
+    }
+    return nil
+}
+
+// migrateBatchLogs keeps the latest logged state of every batch in batches, and its transitions
+// in batch_history, then drops batch_logs. Transitions are written under ids derived from their
+// log entries, so running it again after an interruption does not duplicate them.
+func (s *mongoStore) migrateBatchLogs(ctx context.Context) error {
+    cursor, err := s.batchLogsCollection().Aggregate(
+        ctx,
+        mongo.Pipeline{{{Key: "$sort", Value: bson.D{{Key: "batch.id", Value: 1}, {Key: "timestamp", Value: 1}}}}},
+        options.Aggregate().SetAllowDiskUse(true),
+    )
+    if err != nil {
+        return fmt.Errorf("failed to read batch_logs: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    var latest *openai.Batch
+    var latestAt time.Time
+    var transitions []mongo.WriteModel
+    migrated := 0
+    flush := func() error {
+        if latest == nil {
+            return nil
+        }
+        // A batch already in batches was logged by a newer release and is left as it is
+        _, err := s.batchCollection.UpdateOne(
+            ctx,
+            bson.M{"_id": latest.ID},
+            bson.M{"$setOnInsert": newBatchDocument(*latest, latestAt)},
+            options.Update().SetUpsert(true),
+        )
+        if err != nil {
+            return fmt.Errorf("failed to save batch %s: %w", latest.ID, err)
+        }
+        if _, err := s.batchHistoryCollection.BulkWrite(ctx, transitions); err != nil {
+            return fmt.Errorf("failed to save the history of batch %s: %w", latest.ID, err)
+        }
+        migrated++
+        return nil
+    }
+
+    for cursor.Next(ctx) {
+        var entry struct {
+            ID        primitive.ObjectID `bson:"_id"`
+            Batch     openai.Batch       `bson:"batch"`
+            Timestamp time.Time          `bson:"timestamp"`
+        }
+        if err := cursor.Decode(&entry); err != nil {
+            return fmt.Errorf("failed to decode a batch_logs entry: %w", err)
+        }
+
+        if latest == nil || latest.ID != entry.Batch.ID {
+            if err := flush(); err != nil {
+                return err
+            }
+            latest, transitions = nil, nil
+        }
+        if latest == nil || isBatchTransition(*latest, entry.Batch) {
+            transition := batchTransitionDocument{
+                ID:            entry.ID,
+                BatchID:       entry.Batch.ID,
+                Status:        entry.Batch.Status,
+                RequestCounts: entry.Batch.RequestCounts,
+                Timestamp:     entry.Timestamp,
+            }
+            transitions = append(transitions, mongo.NewReplaceOneModel().
+                SetFilter(bson.M{"_id": entry.ID}).
+                SetReplacement(transition).
+                SetUpsert(true))
+        }
+        batch := entry.Batch
+        latest, latestAt = &batch, entry.Timestamp
+    }
+    if err := cursor.Err(); err != nil {
+        return fmt.Errorf("failed to iterate batch_logs: %w", err)
+    }
+    if err := flush(); err != nil {
+        return err
+    }
+
+    if err := s.batchLogsCollection().Drop(ctx); err != nil {
+        return fmt.Errorf("failed to drop batch_logs: %w", err)
+    }
+    if migrated > 0 {
+        log.Printf("Moved %d batches from batch_logs into batches and batch_history", migrated)
+    }
+    return nil
+}
+
+func (s *mongoStore) indexBatchesByStatusAndID(ctx context.Context) error {
+    _, err := s.batchCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to create the batches status index: %w", err)
+    }
+    return nil
+}
+
+func (s *mongoStore) indexDailyUsage(ctx context.Context) error {
+    _, err := s.dailyUsageCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+        {
+            Keys: bson.D{
+                {Key: "day", Value: 1},
+                {Key: "tenant", Value: 1},
+                {Key: "model", Value: 1},
+                {Key: "source", Value: 1},
+            },
+            Options: options.Index().SetUnique(true),
+        },
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "day", Value: 1}}},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to create daily_usage indexes: %w", err)
+    }
+    return nil
+}
+
+func (s *mongoStore) indexQueuedRequests(ctx context.Context) error {
+    _, err := s.queuedRequestsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+        Keys: bson.D{{Key: "queued_at", Value: 1}},
+    })
+    if err != nil {
+        return fmt.Errorf("failed to create the queued_requests index: %w", err)
+    }
+    return nil
+}
+
+// fillCachedResponseModelAndTenant gives cached responses cached before entries recorded their
+// model and tenant the model of their request and the default tenant, so the cache filters
+// by model and tenant find them.
+func (s *mongoStore) fillCachedResponseModelAndTenant(ctx context.Context) error {
+    _, err := s.cachedResponsesCollection.UpdateMany(
+        ctx,
+        bson.M{"tenant": bson.M{"$in": bson.A{nil, ""}}},
+        bson.M{"$set": bson.M{"tenant": models.DefaultTenant}},
+    )
+    if err != nil {
+        return fmt.Errorf("failed to fill in the tenant of cached responses: %w", err)
+    }
+
+    cursor, err := s.cachedResponsesCollection.Find(
+        ctx,
+        bson.M{"model": bson.M{"$in": bson.A{nil, ""}}},
+        options.Find().SetProjection(bson.M{"request_body": 1, "request.model": 1}),
+    )
+    if err != nil {
+        return fmt.Errorf("failed to find cached responses without a model: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    filled := 0
+    for cursor.Next(ctx) {
+        var document struct {
+            ID          primitive.ObjectID `bson:"_id"`
+            RequestBody string             `bson:"request_body"`
+            Request     struct {
+                Model string `bson:"model"`
+            } `bson:"request"`
+        }
+        if err := cursor.Decode(&document); err != nil {
+            return fmt.Errorf("failed to decode cached response: %w", err)
+        }
+        model := document.Request.Model
+        if document.RequestBody != "" {
+            model = requestModel(json.RawMessage(document.RequestBody))
+        }
+        if model == "" {
+            continue
+        }
+        if _, err := s.cachedResponsesCollection.UpdateByID(ctx, document.ID, bson.M{"$set": bson.M{"model": model}}); err != nil {
+            return fmt.Errorf("failed to fill in the model of cached response %s: %w", document.ID.Hex(), err)
+        }
+        filled++
+    }
+    if err := cursor.Err(); err != nil {
+        return fmt.Errorf("failed to iterate cached responses without a model: %w", err)
+    }
+    if filled > 0 {
+        log.Printf("Filled in the model of %d cached responses", filled)
+    }
+    return nil
+}
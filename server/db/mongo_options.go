@@ -0,0 +1,155 @@
+package db
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+// mongoClientOptions reads the MongoDB connection settings from the environment. MONGO_URI
+// takes any standard connection string (mongodb:// or mongodb+srv://, with authSource,
+// replicaSet, tls and other options); without it the URI is built from MONGO_HOST, MONGO_PORT,
+// MONGO_USER and MONGO_PASSWORD. The other variables override what the URI sets.
+func mongoClientOptions() (*options.ClientOptions, string, error) {
+    uri := os.Getenv("MONGO_URI")
+    if uri == "" {
+        uri = (&url.URL{
+            Scheme: "mongodb",
+            User:   url.UserPassword(getEnv("MONGO_USER", "admin"), getEnv("MONGO_PASSWORD", "password")),
+            Host:   getEnv("MONGO_HOST", "localhost") + ":" + getEnv("MONGO_PORT", "27017"),
+        }).String()
+    }
+
+    clientOptions := options.Client().ApplyURI(uri).SetAppName("batch-gpt")
+    if err := clientOptions.Validate(); err != nil {
+        return nil, "", fmt.Errorf("invalid MongoDB connection string, check MONGO_URI: %w", err)
+    }
+
+    // The database named in the URI is used unless MONGO_DATABASE says otherwise
+    database := getEnv("MONGO_DATABASE", uriDatabase(uri))
+    if database == "" {
+        database = "batchgpt"
+    }
+
+    tlsConfig, err := mongoTLSConfig(uri)
+    if err != nil {
+        return nil, "", err
+    }
+    if tlsConfig != nil {
+        clientOptions.SetTLSConfig(tlsConfig)
+    }
+
+    for _, setting := range []struct {
+        name  string
+        apply func(uint64)
+    }{
+        {"MONGO_MAX_POOL_SIZE", func(value uint64) { clientOptions.SetMaxPoolSize(value) }},
+        {"MONGO_MIN_POOL_SIZE", func(value uint64) { clientOptions.SetMinPoolSize(value) }},
+    } {
+        if value := os.Getenv(setting.name); value != "" {
+            size, err := strconv.ParseUint(value, 10, 64)
+            if err != nil {
+                return nil, "", fmt.Errorf("invalid %s %q, expected a non-negative integer", setting.name, value)
+            }
+            setting.apply(size)
+        }
+    }
+
+    for _, setting := range []struct {
+        name  string
+        apply func(time.Duration)
+    }{
+        {"MONGO_CONNECT_TIMEOUT_SECONDS", func(value time.Duration) { clientOptions.SetConnectTimeout(value) }},
+        {"MONGO_SERVER_SELECTION_TIMEOUT_SECONDS", func(value time.Duration) { clientOptions.SetServerSelectionTimeout(value) }},
+        {"MONGO_MAX_CONN_IDLE_TIME_SECONDS", func(value time.Duration) { clientOptions.SetMaxConnIdleTime(value) }},
+    } {
+        if value := os.Getenv(setting.name); value != "" {
+            seconds, err := strconv.Atoi(value)
+            if err != nil || seconds <= 0 {
+                return nil, "", fmt.Errorf("invalid %s %q, expected a positive number of seconds", setting.name, value)
+            }
+            setting.apply(time.Duration(seconds) * time.Second)
+        }
+    }
+
+    return clientOptions, database, nil
+}
+
+// uriDatabase returns the database in the path of a MongoDB connection string, if any.
+func uriDatabase(uri string) string {
+    _, rest, found := strings.Cut(uri, "://")
+    if !found {
+        return ""
+    }
+    _, path, found := strings.Cut(rest, "/")
+    if !found {
+        return ""
+    }
+    database, _, _ := strings.Cut(path, "?")
+    database, err := url.PathUnescape(database)
+    if err != nil {
+        return ""
+    }
+    return database
+}
+
+// mongoTLSConfig builds the TLS configuration for MONGO_TLS_CA_FILE, MONGO_TLS_CERT_FILE and
+// MONGO_TLS_KEY_FILE. It returns nil if none is set, leaving TLS to the connection string.
+// A TLS configuration turns TLS on, so it fails if the connection string turns it off.
+func mongoTLSConfig(uri string) (*tls.Config, error) {
+    caFile := os.Getenv("MONGO_TLS_CA_FILE")
+    certFile := os.Getenv("MONGO_TLS_CERT_FILE")
+    keyFile := getEnv("MONGO_TLS_KEY_FILE", certFile)
+    if caFile == "" && certFile == "" {
+        return nil, nil
+    }
+    if connString, err := connstring.Parse(uri); err == nil && connString.SSLSet && !connString.SSL {
+        return nil, fmt.Errorf("MONGO_URI turns TLS off, but MONGO_TLS_CA_FILE or MONGO_TLS_CERT_FILE is set; remove tls=false from MONGO_URI or unset them")
+    }
+
+    tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+    if caFile != "" {
+        ca, err := os.ReadFile(caFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read MONGO_TLS_CA_FILE: %w", err)
+        }
+        tlsConfig.RootCAs = x509.NewCertPool()
+        if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+            return nil, fmt.Errorf("MONGO_TLS_CA_FILE %s holds no PEM encoded certificates", caFile)
+        }
+    }
+    if certFile != "" {
+        // A single PEM file may hold both the client certificate and its key
+        certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to load the MongoDB client certificate from MONGO_TLS_CERT_FILE and MONGO_TLS_KEY_FILE: %w", err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{certificate}
+    }
+    return tlsConfig, nil
+}
+
+// describeMongoError explains a failure to reach MongoDB in terms of the settings to check.
+func describeMongoError(err error, hosts []string) error {
+    message := err.Error()
+    target := strings.Join(hosts, ",")
+    switch {
+    case strings.Contains(message, "AuthenticationFailed") || strings.Contains(message, "auth error"):
+        return fmt.Errorf("MongoDB at %s rejected the credentials; check MONGO_USER and MONGO_PASSWORD, or the user and authSource in MONGO_URI: %w", target, err)
+    case strings.Contains(message, "x509") || strings.Contains(message, "tls:"):
+        return fmt.Errorf("TLS handshake with MongoDB at %s failed; check MONGO_TLS_CA_FILE, MONGO_TLS_CERT_FILE and the tls options in MONGO_URI: %w", target, err)
+    case mongo.IsTimeout(err) || strings.Contains(message, "server selection"):
+        return fmt.Errorf("could not reach MongoDB at %s; check that it is running and reachable, MONGO_URI or MONGO_HOST and MONGO_PORT, and for replica sets the replicaSet option and member hostnames: %w", target, err)
+    default:
+        return fmt.Errorf("failed to connect to MongoDB at %s: %w", target, err)
+    }
+}
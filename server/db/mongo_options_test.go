@@ -0,0 +1,83 @@
+package db
+
+import (
+    "os"
+    "strings"
+    "testing"
+)
+
+func TestMongoClientOptions(t *testing.T) {
+    tests := []struct {
+        name     string
+        env      map[string]string
+        wantErr  string
+        wantTLS  bool
+        wantName string
+    }{
+        {
+            name:     "URI without TLS",
+            env:      map[string]string{"MONGO_URI": "mongodb://localhost:27017/cache?tls=false"},
+            wantName: "cache",
+        },
+        {
+            name:     "database overridden",
+            env:      map[string]string{"MONGO_URI": "mongodb://localhost:27017/cache", "MONGO_DATABASE": "other"},
+            wantName: "other",
+        },
+        {
+            name:     "TLS from the URI",
+            env:      map[string]string{"MONGO_URI": "mongodb://localhost:27017/?tls=true"},
+            wantTLS:  true,
+            wantName: "batchgpt",
+        },
+        {
+            name:    "CA file with tls=false",
+            env:     map[string]string{"MONGO_URI": "mongodb://localhost:27017/?tls=false", "MONGO_TLS_CA_FILE": "/missing/ca.pem"},
+            wantErr: "turns TLS off",
+        },
+        {
+            name:    "client certificate with ssl=false",
+            env:     map[string]string{"MONGO_URI": "mongodb://localhost:27017/?ssl=false", "MONGO_TLS_CERT_FILE": "/missing/client.pem"},
+            wantErr: "turns TLS off",
+        },
+        {
+            name:    "CA file with TLS on",
+            env:     map[string]string{"MONGO_URI": "mongodb://localhost:27017/?tls=true", "MONGO_TLS_CA_FILE": "/missing/ca.pem"},
+            wantErr: "failed to read MONGO_TLS_CA_FILE",
+        },
+        {
+            name:    "invalid pool size",
+            env:     map[string]string{"MONGO_URI": "mongodb://localhost:27017", "MONGO_MAX_POOL_SIZE": "-1"},
+            wantErr: "invalid MONGO_MAX_POOL_SIZE",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for _, name := range []string{"MONGO_URI", "MONGO_DATABASE", "MONGO_TLS_CA_FILE", "MONGO_TLS_CERT_FILE", "MONGO_TLS_KEY_FILE", "MONGO_MAX_POOL_SIZE"} {
+                // Setenv restores the variable after the test, even if it is unset here
+                t.Setenv(name, tt.env[name])
+                if _, set := tt.env[name]; !set {
+                    os.Unsetenv(name)
+                }
+            }
+
+            clientOptions, database, err := mongoClientOptions()
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("mongoClientOptions() error = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("mongoClientOptions() error = %v", err)
+            }
+            if database != tt.wantName {
+                t.Errorf("database = %q, want %q", database, tt.wantName)
+            }
+            if gotTLS := clientOptions.TLSConfig != nil; gotTLS != tt.wantTLS {
+                t.Errorf("TLS = %v, want %v", gotTLS, tt.wantTLS)
+            }
+        })
+    }
+}
@@ -1,7 +1,7 @@
 package db
 
 import (
-	"batch-gpt/server/logger"
+	"batch-gpt/server/models"
 
 	"context"
 	"fmt"
@@ -11,13 +11,23 @@ import (
 
 	openai "github.com/sashabaranov/go-openai"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var client *mongo.Client
-var batchCollection *mongo.Collection
-var cachedResponsesCollection *mongo.Collection
+// mongoStore is the MongoDB storage backend.
+type mongoStore struct {
+	client                    *mongo.Client
+	database                  *mongo.Database
+	batchCollection           *mongo.Collection
+	batchHistoryCollection    *mongo.Collection
+	cachedResponsesCollection *mongo.Collection
+	deadLettersCollection     *mongo.Collection
+	dailyUsageCollection      *mongo.Collection
+	budgetsCollection         *mongo.Collection
+	queuedRequestsCollection  *mongo.Collection
+}
 
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
@@ -26,99 +36,159 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func InitMongoDB() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func newMongoStore() (*mongoStore, error) {
+	clientOptions, mongoDatabase, err := mongoClientOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for a server at least as long as MONGO_SERVER_SELECTION_TIMEOUT_SECONDS allows
+	timeout := 10 * time.Second
+	if clientOptions.ServerSelectionTimeout != nil && *clientOptions.ServerSelectionTimeout > timeout {
+		timeout = *clientOptions.ServerSelectionTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	
-	// Get MongoDB connection details from environment variables
-	mongoHost := getEnv("MONGO_HOST", "localhost")
-	mongoPort := getEnv("MONGO_PORT", "27017")
-	mongoUser := getEnv("MONGO_USER", "admin")
-	mongoPassword := getEnv("MONGO_PASSWORD", "password")
-	mongoDatabase := getEnv("MONGO_DATABASE", "batchgpt")
-
-	// Construct the MongoDB connection URI
-	mongoURI := fmt.Sprintf("mongodb://%s:%s@%s:%s", mongoUser, mongoPassword, mongoHost, mongoPort)
-
-	var err error
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatal(err)
+		return nil, describeMongoError(err, clientOptions.Hosts)
 	}
 
 	err = client.Ping(ctx, nil)
 	if err != nil {
-		log.Fatal(err)
+		client.Disconnect(context.Background())
+		return nil, describeMongoError(err, clientOptions.Hosts)
 	}
 
 	database := client.Database(mongoDatabase)
-
-	// Check if the collection exists
-	collections, err := database.ListCollectionNames(ctx, bson.M{"name": "batch_logs"})
-	if err != nil {
-		log.Fatal(err)
+	s := &mongoStore{
+		client:                    client,
+		database:                  database,
+		batchCollection:           database.Collection("batches"),
+		batchHistoryCollection:    database.Collection("batch_history"),
+		cachedResponsesCollection: database.Collection("cached_responses"),
+		deadLettersCollection:     database.Collection("dead_letters"),
+		dailyUsageCollection:      database.Collection("daily_usage"),
+		budgetsCollection:         database.Collection("budgets"),
+		queuedRequestsCollection:  database.Collection("queued_requests"),
 	}
 
-	if len(collections) == 0 {
-		// Collection doesn't exist, so create it with the index
-		err = database.CreateCollection(ctx, "batch_logs")
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		batchCollection = database.Collection("batch_logs")
-
-		_, err = batchCollection.Indexes().CreateOne(
-			ctx,
-			mongo.IndexModel{
-				Keys:    bson.D{{Key: "batch.id", Value: 1}},
-				Options: options.Index().SetUnique(false),
-			},
-		)
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Println("Created 'batch_logs' collection with index on batch.id")
-	} else {
-		// Collection exists, assume index is present
-		batchCollection = database.Collection("batch_logs")
-		log.Println("'batch_logs' collection already exists, assuming index is present")
-	}
+	log.Println("Connected to MongoDB")
+	return s, nil
+}
 
-	cachedResponsesCollection = database.Collection("cached_responses")
+func (s *mongoStore) Close() error {
+	return s.client.Disconnect(context.Background())
+}
 
-	log.Println("Connected to MongoDB")
+// batchDocument is the latest state of a batch. Its status, creation time and request counts
+// are kept next to it under explicit names, since go-openai's types carry no bson tags.
+type batchDocument struct {
+    ID            string                    `bson:"_id,omitempty"`
+    Status        string                    `bson:"status"`
+    CreatedAt     int                       `bson:"created_at"`
+    RequestCounts openai.BatchRequestCounts `bson:"request_counts"`
+    Batch         openai.Batch              `bson:"batch"`
+    UpdatedAt     time.Time                 `bson:"updated_at"`
 }
 
-func LogBatchStatus(batchStatus openai.BatchResponse) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func newBatchDocument(batch openai.Batch, updatedAt time.Time) batchDocument {
+    return batchDocument{
+        Status:        batch.Status,
+        CreatedAt:     batch.CreatedAt,
+        RequestCounts: batch.RequestCounts,
+        Batch:         batch,
+        UpdatedAt:     updatedAt,
+    }
+}
 
-	document := bson.M{
-		"batch":     batchStatus.Batch,
-		"timestamp": time.Now(),
-	}
+// batchTransitionDocument is an entry of the batch_history collection.
+type batchTransitionDocument struct {
+    ID            any                       `bson:"_id,omitempty"`
+    BatchID       string                    `bson:"batch_id"`
+    Status        string                    `bson:"status"`
+    RequestCounts openai.BatchRequestCounts `bson:"request_counts"`
+    Timestamp     time.Time                 `bson:"timestamp"`
+}
+
+func (s *mongoStore) LogBatchStatus(batchStatus openai.BatchResponse) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    now := time.Now()
+    document := newBatchDocument(batchStatus.Batch, now)
+    update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+        "status":         document.Status,
+        "created_at":     document.CreatedAt,
+        "request_counts": document.RequestCounts,
+        "updated_at":     document.UpdatedAt,
+        // The metadata of the stored batch it lacks is kept, like keepMetadata does
+        "batch": bson.M{"$mergeObjects": bson.A{
+            bson.M{"$literal": document.Batch},
+            bson.M{"metadata": bson.M{"$mergeObjects": bson.A{"$batch.metadata", bson.M{"$literal": document.Batch.Metadata}}}},
+        }},
+    }}}}
+    var previous batchDocument
+    err := s.batchCollection.FindOneAndUpdate(
+        ctx,
+        bson.M{"_id": batchStatus.ID},
+        update,
+        options.FindOneAndUpdate().
+            SetUpsert(true).
+            SetReturnDocument(options.Before).
+            SetProjection(bson.M{"batch": 1}),
+    ).Decode(&previous)
+    isNew := err == mongo.ErrNoDocuments
+    if err != nil && !isNew {
+        return err
+    }
+    if !isNew && !isBatchTransition(previous.Batch, batchStatus.Batch) {
+        return nil
+    }
 
-	_, err := batchCollection.InsertOne(ctx, document)
-	return err
+    _, err = s.batchHistoryCollection.InsertOne(ctx, batchTransitionDocument{
+        BatchID:       batchStatus.ID,
+        Status:        batchStatus.Status,
+        RequestCounts: batchStatus.RequestCounts,
+        Timestamp:     now,
+    })
+    return err
 }
 
-func GetLatestBatchStatus(batchID string) (openai.Batch, error) {
+func (s *mongoStore) TrackBatch(batchStatus openai.BatchResponse) error {
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
     defer cancel()
 
-    var result struct {
-        Batch openai.Batch `bson:"batch"`
+    now := time.Now()
+    document := newBatchDocument(batchStatus.Batch, now)
+    document.ID = batchStatus.ID
+    _, err := s.batchCollection.InsertOne(ctx, document)
+    if mongo.IsDuplicateKeyError(err) {
+        return ErrAlreadyExists
+    }
+    if err != nil {
+        return err
     }
-    err := batchCollection.FindOne(
-        ctx,
-        bson.M{"batch.id": batchID},
-        options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}}),
-    ).Decode(&result)
 
+    _, err = s.batchHistoryCollection.InsertOne(ctx, batchTransitionDocument{
+        BatchID:       batchStatus.ID,
+        Status:        batchStatus.Status,
+        RequestCounts: batchStatus.RequestCounts,
+        Timestamp:     now,
+    })
+    return err
+}
+
+func (s *mongoStore) GetLatestBatchStatus(batchID string) (openai.Batch, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    var result batchDocument
+    err := s.batchCollection.FindOne(ctx, bson.M{"_id": batchID}).Decode(&result)
     if err != nil {
         if err == mongo.ErrNoDocuments {
-            return openai.Batch{}, mongo.ErrNoDocuments
+            return openai.Batch{}, ErrNotFound
         }
         return openai.Batch{}, err
     }
@@ -126,122 +196,195 @@ func GetLatestBatchStatus(batchID string) (openai.Batch, error) {
     return result.Batch, nil
 }
 
-func GetDanglingBatches() ([]string, error) {
-    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (s *mongoStore) GetBatchHistory(batchID string) ([]models.BatchTransition, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    // First, get all unique batch IDs
-    pipeline := mongo.Pipeline{
-        {{Key: "$group", Value: bson.D{{Key: "_id", Value: "$batch.id"}}}},
-    }
-
-    cursor, err := batchCollection.Aggregate(ctx, pipeline)
+    cursor, err := s.batchHistoryCollection.Find(
+        ctx,
+        bson.M{"batch_id": batchID},
+        options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}),
+    )
     if err != nil {
-        return nil, fmt.Errorf("failed to aggregate unique batch IDs: %w", err)
+        return nil, fmt.Errorf("failed to find the history of batch %s: %w", batchID, err)
     }
     defer cursor.Close(ctx)
 
-    var results []struct {
-        ID string `bson:"_id"`
+    var documents []batchTransitionDocument
+    if err := cursor.All(ctx, &documents); err != nil {
+        return nil, fmt.Errorf("failed to decode the history of batch %s: %w", batchID, err)
     }
-    if err = cursor.All(ctx, &results); err != nil {
-        return nil, fmt.Errorf("failed to decode aggregate results: %w", err)
+    if len(documents) == 0 {
+        return nil, ErrNotFound
     }
 
-    var danglingBatches []string
+    transitions := make([]models.BatchTransition, 0, len(documents))
+    for _, document := range documents {
+        transitions = append(transitions, models.BatchTransition{
+            BatchID:       document.BatchID,
+            Status:        document.Status,
+            RequestCounts: document.RequestCounts,
+            Timestamp:     document.Timestamp,
+        })
+    }
+    return transitions, nil
+}
 
-    for _, result := range results {
-        batchID := result.ID
-        latestStatus, err := GetLatestBatchStatus(batchID)
-        if err != nil {
-            logger.WarnLogger.Printf("Failed to get latest status for batch %s: %v", batchID, err)
-            continue
-        }
+func (s *mongoStore) GetDanglingBatches(after string, limit int) ([]openai.Batch, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
 
-        if latestStatus.Status != "completed" && latestStatus.Status != "failed" && latestStatus.Status != "cancelled" && latestStatus.Status != "expired" {
-            danglingBatches = append(danglingBatches, batchID)
-        }
+    filter := bson.M{"status": bson.M{"$nin": models.TerminalBatchStatuses}}
+    if after != "" {
+        filter["_id"] = bson.M{"$gt": after}
     }
+    cursor, err := s.batchCollection.Find(
+        ctx,
+        filter,
+        options.Find().
+            SetSort(bson.D{{Key: "_id", Value: 1}}).
+            SetLimit(int64(limit)).
+            SetProjection(bson.M{"batch": 1}),
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to find dangling batches: %w", err)
+    }
+    defer cursor.Close(ctx)
 
+    var documents []batchDocument
+    if err = cursor.All(ctx, &documents); err != nil {
+        return nil, fmt.Errorf("failed to decode dangling batches: %w", err)
+    }
+
+    danglingBatches := make([]openai.Batch, 0, len(documents))
+    for _, document := range documents {
+        danglingBatches = append(danglingBatches, document.Batch)
+    }
     return danglingBatches, nil
 }
 
-// func CacheResponses(batchID string, responses []openai.ChatCompletionResponse) error {
-//     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-//     defer cancel()
-
-//     var documents []interface{}
-//     for _, response := range responses {
-//         document := bson.M{
-//             "batch_id":  batchID,
-//             "response":  response,
-//             "timestamp": time.Now(),
-//         }
-//         documents = append(documents, document)
-//     }
-
-//     _, err := cachedResponsesCollection.InsertMany(ctx, documents)
-//     if err != nil {
-//         return fmt.Errorf("failed to insert cached responses: %w", err)
-//     }
-
-//     return nil
-// }
-
-func GetAllBatchStatuses() ([]openai.BatchResponse, error) {
+func (s *mongoStore) GetAllBatchStatuses() ([]openai.BatchResponse, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
     defer cancel()
 
-    pipeline := mongo.Pipeline{
-        {{Key: "$sort", Value: bson.D{
-            {Key: "batch.created_at", Value: -1},
-            {Key: "timestamp", Value: -1}, // Adding sort by status update timestamp
-        }}},
-        {{Key: "$group", Value: bson.D{
-            {Key: "_id", Value: "$batch.id"},
-            {Key: "batch", Value: bson.D{{Key: "$first", Value: "$batch"}}},
-        }}},
-    }
-
-    cursor, err := batchCollection.Aggregate(ctx, pipeline)
+    cursor, err := s.batchCollection.Find(
+        ctx,
+        bson.M{},
+        options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+    )
     if err != nil {
-        return nil, fmt.Errorf("failed to aggregate batch statuses: %w", err)
+        return nil, fmt.Errorf("failed to find batch statuses: %w", err)
     }
     defer cursor.Close(ctx)
 
-    var results []openai.BatchResponse
-    if err = cursor.All(ctx, &results); err != nil {
-        return nil, fmt.Errorf("failed to decode aggregate results: %w", err)
+    var documents []batchDocument
+    if err = cursor.All(ctx, &documents); err != nil {
+        return nil, fmt.Errorf("failed to decode batch statuses: %w", err)
     }
 
+    results := make([]openai.BatchResponse, 0, len(documents))
+    for _, document := range documents {
+        results = append(results, openai.BatchResponse{Batch: document.Batch})
+    }
     return results, nil
 }
 
-func GetCachedResponse(hash string) (openai.ChatCompletionResponse, error) {
+// GetCachedResponse returns the responses cached for a request hash.
+func (s *mongoStore) GetCachedResponse(hash string) (models.CachedSamples, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
     defer cancel()
 
     var result struct {
-        Response openai.ChatCompletionResponse `bson:"response"`
+        ID        primitive.ObjectID `bson:"_id"`
+        Responses []struct {
+            Response openai.ChatCompletionResponse `bson:"response"`
+        } `bson:"responses"`
+        Sampled int `bson:"sampled"`
+    }
+    // MongoDB removes expired entries about once a minute, so they are skipped here as well
+    err := s.cachedResponsesCollection.FindOne(ctx, bson.M{
+        "hash":       hash,
+        "expires_at": bson.M{"$not": bson.M{"$lte": time.Now()}},
+    }).Decode(&result)
+    if err == mongo.ErrNoDocuments {
+        return models.CachedSamples{}, ErrNotFound
     }
-    err := cachedResponsesCollection.FindOne(ctx, bson.M{"hash": hash}).Decode(&result)
     if err != nil {
-        return openai.ChatCompletionResponse{}, err
+        return models.CachedSamples{}, err
+    }
+
+    samples := models.CachedSamples{
+        EntryID:   result.ID.Hex(),
+        Responses: make([]openai.ChatCompletionResponse, 0, len(result.Responses)),
+        Sampled:   result.Sampled,
     }
-    return result.Response, nil
+    for _, sample := range result.Responses {
+        samples.Responses = append(samples.Responses, sample.Response)
+    }
+    if len(samples.Responses) == 0 {
+        return models.CachedSamples{}, ErrNotFound
+    }
+    return samples, nil
 }
 
-func CacheRequestResponse(hash string, request openai.ChatCompletionRequest, response openai.ChatCompletionResponse) error {
+// CacheRequestResponse adds a response to the samples cached under the hash of its request,
+// creating the entry with the request and the fingerprint version the hash was computed with
+// if there is none. The request body is stored as a JSON string in request_body so fields
+// go-openai does not know about are kept. A response whose choices match an already cached
+// sample is only counted, and no more than maxSamples responses are kept.
+// Entries with an ExpiresAt are removed by the TTL index once it has passed. An entry that
+// expired but was not removed yet is replaced, so its samples and expiry are not kept.
+func (s *mongoStore) CacheRequestResponse(entry models.CacheEntry, maxSamples int) error {
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
     defer cancel()
 
-    document := bson.M{
-        "hash":      hash,
-        "request":   request,
-        "response":  response,
-        "timestamp": time.Now(),
+    key, err := sampleKey(entry.Response)
+    if err != nil {
+        return err
     }
 
-    _, err := cachedResponsesCollection.InsertOne(ctx, document)
+    now := time.Now()
+    _, err = s.cachedResponsesCollection.DeleteOne(ctx, bson.M{"hash": entry.Hash, "expires_at": bson.M{"$lte": now}})
+    if err != nil {
+        return fmt.Errorf("failed to delete the expired cached response: %w", err)
+    }
+    onInsert := bson.M{
+        "hash_version": entry.HashVersion,
+        "request_body": string(entry.Request.Body),
+        "tenant":       entry.Request.Tenant,
+        "route":        entry.Request.Route,
+        "model":        entry.Request.Params.Model,
+        "responses":    bson.A{},
+        "timestamp":    now,
+    }
+    if !entry.ExpiresAt.IsZero() {
+        onInsert["expires_at"] = entry.ExpiresAt
+    }
+    if entry.Source != "" {
+        onInsert["source"] = entry.Source
+    }
+    _, err = s.cachedResponsesCollection.UpdateOne(
+        ctx,
+        bson.M{"hash": entry.Hash},
+        bson.M{"$setOnInsert": onInsert, "$inc": bson.M{"sampled": 1}},
+        options.Update().SetUpsert(true),
+    )
+    if err != nil {
+        return err
+    }
+
+    _, err = s.cachedResponsesCollection.UpdateOne(
+        ctx,
+        bson.M{
+            "hash":          entry.Hash,
+            "responses.key": bson.M{"$ne": key},
+            "$expr":         bson.M{"$lt": bson.A{bson.M{"$size": "$responses"}, maxSamples}},
+        },
+        bson.M{"$push": bson.M{"responses": bson.M{
+            "key":       key,
+            "response":  entry.Response,
+            "timestamp": now,
+        }}},
+    )
     return err
 }
@@ -0,0 +1,500 @@
+package db
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+
+    _ "github.com/jackc/pgx/v5/stdlib"
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// postgresMigrations are applied in order, each once, and recorded in schema_migrations.
+// Never change a released migration; append a new one instead.
+var postgresMigrations = []sqlMigration{
+    {"Create batch_logs, cached_responses, cached_samples and dead_letters", `
+    CREATE TABLE batch_logs (
+        id         BIGSERIAL PRIMARY KEY,
+        batch_id   TEXT NOT NULL,
+        status     TEXT NOT NULL,
+        created_at BIGINT NOT NULL,
+        batch      JSONB NOT NULL,
+        logged_at  TIMESTAMPTZ NOT NULL
+    );
+    CREATE INDEX batch_logs_batch_id ON batch_logs (batch_id, logged_at DESC);
+
+    CREATE TABLE cached_responses (
+        id           BIGSERIAL PRIMARY KEY,
+        hash         TEXT NOT NULL UNIQUE,
+        hash_version INTEGER NOT NULL,
+        request_body JSONB NOT NULL,
+        tenant       TEXT NOT NULL,
+        route        TEXT NOT NULL,
+        model        TEXT NOT NULL,
+        sampled      INTEGER NOT NULL,
+        cached_at    TIMESTAMPTZ NOT NULL,
+        expires_at   TIMESTAMPTZ
+    );
+    CREATE INDEX cached_responses_cached_at ON cached_responses (cached_at);
+    CREATE INDEX cached_responses_expires_at ON cached_responses (expires_at) WHERE expires_at IS NOT NULL;
+    CREATE INDEX cached_responses_model ON cached_responses (model);
+    CREATE INDEX cached_responses_tenant ON cached_responses (tenant);
+
+    CREATE TABLE cached_samples (
+        entry_id  BIGINT NOT NULL REFERENCES cached_responses (id) ON DELETE CASCADE,
+        key       TEXT NOT NULL,
+        response  JSONB NOT NULL,
+        cached_at TIMESTAMPTZ NOT NULL,
+        PRIMARY KEY (entry_id, key)
+    );
+
+    CREATE TABLE dead_letters (
+        hash        TEXT PRIMARY KEY,
+        request     JSONB NOT NULL,
+        tenant      TEXT NOT NULL,
+        route       TEXT NOT NULL,
+        last_error  TEXT NOT NULL,
+        error_class TEXT NOT NULL,
+        batch_ids   JSONB NOT NULL,
+        attempts    INTEGER NOT NULL,
+        created_at  TIMESTAMPTZ NOT NULL
+    );
+    CREATE INDEX dead_letters_created_at ON dead_letters (created_at);
+    `},
+    // Lets replicas drop changed cached responses from memory
+    {"Notify listeners of changed cached responses", `
+    CREATE FUNCTION notify_cached_response_change() RETURNS trigger AS $$
+    BEGIN
+        IF TG_OP = 'DELETE' THEN
+            PERFORM pg_notify('cached_responses', json_build_object('id', OLD.id, 'hash', OLD.hash)::text);
+            RETURN OLD;
+        END IF;
+        PERFORM pg_notify('cached_responses', json_build_object('id', NEW.id, 'hash', NEW.hash)::text);
+        RETURN NEW;
+    END;
+    $$ LANGUAGE plpgsql;
+
+    CREATE TRIGGER cached_responses_changed
+        AFTER INSERT OR UPDATE OR DELETE ON cached_responses
+        FOR EACH ROW EXECUTE FUNCTION notify_cached_response_change();
+    `},
+    // batch_logs held a row per poll; only the latest state and the transitions are kept
+    {"Move batch_logs into batches and batch_history", `
+    CREATE TABLE batches (
+        id         TEXT PRIMARY KEY,
+        status     TEXT NOT NULL,
+        created_at BIGINT NOT NULL,
+        batch      JSONB NOT NULL,
+        updated_at TIMESTAMPTZ NOT NULL
+    );
+    CREATE INDEX batches_status ON batches (status, created_at DESC);
+    CREATE INDEX batches_created_at ON batches (created_at DESC);
+
+    CREATE TABLE batch_history (
+        id          BIGSERIAL PRIMARY KEY,
+        batch_id    TEXT NOT NULL,
+        status      TEXT NOT NULL,
+        total       INTEGER NOT NULL,
+        completed   INTEGER NOT NULL,
+        failed      INTEGER NOT NULL,
+        recorded_at TIMESTAMPTZ NOT NULL
+    );
+    CREATE INDEX batch_history_batch_id ON batch_history (batch_id, recorded_at);
+
+    INSERT INTO batches (id, status, created_at, batch, updated_at)
+    SELECT DISTINCT ON (batch_id) batch_id, status, created_at, batch, logged_at
+    FROM batch_logs
+    ORDER BY batch_id, logged_at DESC, id DESC;
+
+    INSERT INTO batch_history (batch_id, status, total, completed, failed, recorded_at)
+    SELECT batch_id, status, total, completed, failed, logged_at FROM (
+        SELECT *,
+            LAG(status) OVER logs AS previous_status,
+            LAG(total) OVER logs AS previous_total,
+            LAG(completed) OVER logs AS previous_completed,
+            LAG(failed) OVER logs AS previous_failed
+        FROM (
+            SELECT id, batch_id, status, logged_at,
+                COALESCE((batch->'request_counts'->>'total')::INTEGER, 0) AS total,
+                COALESCE((batch->'request_counts'->>'completed')::INTEGER, 0) AS completed,
+                COALESCE((batch->'request_counts'->>'failed')::INTEGER, 0) AS failed
+            FROM batch_logs
+        ) counted
+        WINDOW logs AS (PARTITION BY batch_id ORDER BY logged_at, id)
+    ) transitions
+    WHERE previous_status IS NULL
+        OR status != previous_status
+        OR total != previous_total
+        OR completed != previous_completed
+        OR failed != previous_failed
+    ORDER BY logged_at, id;
+
+    DROP TABLE batch_logs;
+    `},
+    {"Index the dangling batches, for paging through them", `
+    CREATE INDEX batches_dangling ON batches (id) WHERE status NOT IN ('completed', 'failed', 'cancelled', 'expired');
+    `},
+    {"Record where cached responses came from", `
+    ALTER TABLE cached_responses ADD COLUMN source TEXT NOT NULL DEFAULT '';
+    `},
+    {"Create daily_usage", `
+    CREATE TABLE daily_usage (
+        day               DATE NOT NULL,
+        tenant            TEXT NOT NULL,
+        model             TEXT NOT NULL,
+        source            TEXT NOT NULL,
+        requests          BIGINT NOT NULL,
+        prompt_tokens     BIGINT NOT NULL,
+        completion_tokens BIGINT NOT NULL,
+        PRIMARY KEY (day, tenant, model, source)
+    );
+    CREATE INDEX daily_usage_tenant ON daily_usage (tenant, day);
+    `},
+    {"Create budgets", `
+    CREATE TABLE budgets (
+        tenant              TEXT PRIMARY KEY,
+        daily_tokens        BIGINT NOT NULL,
+        monthly_tokens      BIGINT NOT NULL,
+        daily_usd           DOUBLE PRECISION NOT NULL,
+        monthly_usd         DOUBLE PRECISION NOT NULL,
+        requests_per_minute INTEGER NOT NULL,
+        updated_at          TIMESTAMPTZ NOT NULL
+    );
+    `},
+    {"Create queued_requests", `
+    CREATE TABLE queued_requests (
+        hash            TEXT PRIMARY KEY,
+        request_body    JSONB NOT NULL,
+        tenant          TEXT NOT NULL,
+        route           TEXT NOT NULL,
+        cache_directive TEXT NOT NULL,
+        cache_ttl       BIGINT NOT NULL,
+        queued_at       TIMESTAMPTZ NOT NULL
+    );
+    CREATE INDEX queued_requests_queued_at ON queued_requests (queued_at);
+    `},
+}
+
+// postgresStore is the PostgreSQL storage backend.
+type postgresStore struct {
+    db   *sql.DB
+    url  string
+    done chan struct{}
+}
+
+func newPostgresStore(url string) (*postgresStore, error) {
+    database, err := sql.Open("pgx", url)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open PostgreSQL database: %w", err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    if err := database.PingContext(ctx); err != nil {
+        database.Close()
+        return nil, fmt.Errorf("failed to reach PostgreSQL: %w", err)
+    }
+
+    s := &postgresStore{
+        db:   database,
+        url:  url,
+        done: make(chan struct{}),
+    }
+    go s.deleteExpiredResponses()
+
+    log.Println("Connected to PostgreSQL")
+    return s, nil
+}
+
+func (s *postgresStore) Close() error {
+    close(s.done)
+    return s.db.Close()
+}
+
+func (s *postgresStore) GetMigrations() ([]Migration, error) {
+    var exists bool
+    if err := s.db.QueryRow(`SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+        return nil, fmt.Errorf("failed to look up schema_migrations: %w", err)
+    }
+    appliedAt := make(map[int]time.Time)
+    if exists {
+        rows, err := s.db.Query(`SELECT version, applied_at FROM schema_migrations`)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+        }
+        defer rows.Close()
+        for rows.Next() {
+            var version int
+            var at time.Time
+            if err := rows.Scan(&version, &at); err != nil {
+                return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+            }
+            appliedAt[version] = at
+        }
+        if err := rows.Err(); err != nil {
+            return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+        }
+    }
+
+    return listMigrations(describeSQLMigrations(postgresMigrations), appliedAt), nil
+}
+
+// Migrate applies the migrations that have not been applied yet, in a single transaction.
+// An advisory lock keeps replicas starting at the same time from applying them twice.
+func (s *postgresStore) Migrate() ([]Migration, error) {
+    ctx := context.Background()
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to start schema migration: %w", err)
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('batch-gpt schema_migrations'))`); err != nil {
+        return nil, fmt.Errorf("failed to lock schema migrations: %w", err)
+    }
+    _, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+        version    INTEGER PRIMARY KEY,
+        applied_at TIMESTAMPTZ NOT NULL
+    )`)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+    }
+
+    var current int
+    if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+        return nil, fmt.Errorf("failed to read the schema version: %w", err)
+    }
+    if current > len(postgresMigrations) {
+        return nil, fmt.Errorf("database schema version %d is newer than this release supports (%d)", current, len(postgresMigrations))
+    }
+
+    var applied []Migration
+    for version := current + 1; version <= len(postgresMigrations); version++ {
+        migration := postgresMigrations[version-1]
+        if _, err := tx.ExecContext(ctx, migration.statements); err != nil {
+            return nil, fmt.Errorf("failed to apply schema migration %d (%s): %w", version, migration.description, err)
+        }
+        now := time.Now()
+        if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, version, now); err != nil {
+            return nil, fmt.Errorf("failed to record schema migration %d: %w", version, err)
+        }
+        applied = append(applied, Migration{Version: version, Description: migration.description, AppliedAt: now})
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit schema migrations: %w", err)
+    }
+    for _, migration := range applied {
+        log.Printf("Applied PostgreSQL schema migration %d: %s", migration.Version, migration.Description)
+    }
+    return applied, nil
+}
+
+// deleteExpiredResponses removes expired cached responses once a minute, like the MongoDB TTL index.
+func (s *postgresStore) deleteExpiredResponses() {
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-s.done:
+            return
+        case <-ticker.C:
+            if _, err := s.db.Exec(`DELETE FROM cached_responses WHERE expires_at <= now()`); err != nil {
+                logger.WarnLogger.Printf("Failed to delete expired cached responses: %v", err)
+            }
+        }
+    }
+}
+
+func (s *postgresStore) LogBatchStatus(batchStatus openai.BatchResponse) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var previous []byte
+    err = tx.QueryRow(`SELECT batch FROM batches WHERE id = $1 FOR UPDATE`, batchStatus.ID).Scan(&previous)
+    isNew := errors.Is(err, sql.ErrNoRows)
+    if err != nil && !isNew {
+        return err
+    }
+
+    current := batchStatus.Batch
+    isTransition := true
+    if !isNew {
+        var previousBatch openai.Batch
+        if err := json.Unmarshal(previous, &previousBatch); err != nil {
+            return fmt.Errorf("failed to decode the previous status of batch %s: %w", batchStatus.ID, err)
+        }
+        current = keepMetadata(previousBatch, current)
+        isTransition = isBatchTransition(previousBatch, current)
+    }
+    batch, err := json.Marshal(current)
+    if err != nil {
+        return fmt.Errorf("failed to encode batch status: %w", err)
+    }
+
+    now := time.Now()
+    _, err = tx.Exec(
+        `INSERT INTO batches (id, status, created_at, batch, updated_at) VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (id) DO UPDATE SET
+            status = excluded.status,
+            created_at = excluded.created_at,
+            batch = excluded.batch,
+            updated_at = excluded.updated_at`,
+        current.ID, current.Status, current.CreatedAt, string(batch), now,
+    )
+    if err != nil {
+        return err
+    }
+
+    if isTransition {
+        if err := insertPostgresBatchTransition(tx, current, now); err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+func (s *postgresStore) TrackBatch(batchStatus openai.BatchResponse) error {
+    batch, err := json.Marshal(batchStatus.Batch)
+    if err != nil {
+        return fmt.Errorf("failed to encode batch status: %w", err)
+    }
+
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    now := time.Now()
+    result, err := tx.Exec(
+        `INSERT INTO batches (id, status, created_at, batch, updated_at) VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (id) DO NOTHING`,
+        batchStatus.ID, batchStatus.Status, batchStatus.CreatedAt, string(batch), now,
+    )
+    if err != nil {
+        return err
+    }
+    if inserted, err := result.RowsAffected(); err != nil {
+        return err
+    } else if inserted == 0 {
+        return ErrAlreadyExists
+    }
+
+    if err := insertPostgresBatchTransition(tx, batchStatus.Batch, now); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// insertPostgresBatchTransition adds the current status of a batch to its history.
+func insertPostgresBatchTransition(tx *sql.Tx, batch openai.Batch, now time.Time) error {
+    counts := batch.RequestCounts
+    _, err := tx.Exec(
+        `INSERT INTO batch_history (batch_id, status, total, completed, failed, recorded_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+        batch.ID, batch.Status, counts.Total, counts.Completed, counts.Failed, now,
+    )
+    return err
+}
+
+func (s *postgresStore) GetLatestBatchStatus(batchID string) (openai.Batch, error) {
+    var encoded []byte
+    err := s.db.QueryRow(`SELECT batch FROM batches WHERE id = $1`, batchID).Scan(&encoded)
+    if errors.Is(err, sql.ErrNoRows) {
+        return openai.Batch{}, ErrNotFound
+    }
+    if err != nil {
+        return openai.Batch{}, err
+    }
+
+    var batch openai.Batch
+    if err := json.Unmarshal(encoded, &batch); err != nil {
+        return openai.Batch{}, fmt.Errorf("failed to decode batch status: %w", err)
+    }
+    return batch, nil
+}
+
+func (s *postgresStore) GetBatchHistory(batchID string) ([]models.BatchTransition, error) {
+    rows, err := s.db.Query(
+        `SELECT status, total, completed, failed, recorded_at FROM batch_history WHERE batch_id = $1 ORDER BY recorded_at, id`,
+        batchID,
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to query the history of batch %s: %w", batchID, err)
+    }
+    defer rows.Close()
+
+    var transitions []models.BatchTransition
+    for rows.Next() {
+        transition := models.BatchTransition{BatchID: batchID}
+        counts := &transition.RequestCounts
+        if err := rows.Scan(&transition.Status, &counts.Total, &counts.Completed, &counts.Failed, &transition.Timestamp); err != nil {
+            return nil, fmt.Errorf("failed to read the history of batch %s: %w", batchID, err)
+        }
+        transitions = append(transitions, transition)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    if len(transitions) == 0 {
+        return nil, ErrNotFound
+    }
+    return transitions, nil
+}
+
+// postgresDanglingBatchesQuery matches the batches_dangling index, which only holds the dangling batches.
+var postgresDanglingBatchesQuery = `SELECT batch FROM batches WHERE status NOT IN (` + terminalBatchStatusesSQL + `) AND id > $1 ORDER BY id LIMIT $2`
+
+func (s *postgresStore) GetDanglingBatches(after string, limit int) ([]openai.Batch, error) {
+    rows, err := s.db.Query(postgresDanglingBatchesQuery, after, limit)
+    if err != nil {
+        return nil, fmt.Errorf("failed to query dangling batches: %w", err)
+    }
+    defer rows.Close()
+
+    danglingBatches := make([]openai.Batch, 0)
+    for rows.Next() {
+        var encoded []byte
+        if err := rows.Scan(&encoded); err != nil {
+            return nil, fmt.Errorf("failed to read dangling batch: %w", err)
+        }
+        var batch openai.Batch
+        if err := json.Unmarshal(encoded, &batch); err != nil {
+            return nil, fmt.Errorf("failed to decode dangling batch: %w", err)
+        }
+        danglingBatches = append(danglingBatches, batch)
+    }
+    return danglingBatches, rows.Err()
+}
+
+func (s *postgresStore) GetAllBatchStatuses() ([]openai.BatchResponse, error) {
+    rows, err := s.db.Query(`SELECT id, batch FROM batches ORDER BY created_at DESC`)
+    if err != nil {
+        return nil, fmt.Errorf("failed to query batch statuses: %w", err)
+    }
+    defer rows.Close()
+
+    results := make([]openai.BatchResponse, 0)
+    for rows.Next() {
+        var batchID string
+        var encoded []byte
+        if err := rows.Scan(&batchID, &encoded); err != nil {
+            return nil, fmt.Errorf("failed to read batch status: %w", err)
+        }
+        var result openai.BatchResponse
+        if err := json.Unmarshal(encoded, &result.Batch); err != nil {
+            return nil, fmt.Errorf("failed to decode status of batch %s: %w", batchID, err)
+        }
+        results = append(results, result)
+    }
+    return results, rows.Err()
+}
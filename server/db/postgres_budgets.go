@@ -0,0 +1,76 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "database/sql"
+    "errors"
+    "fmt"
+)
+
+func (s *postgresStore) GetBudgets() ([]models.Budget, error) {
+    rows, err := s.db.Query(`SELECT ` + budgetColumns + ` FROM budgets ORDER BY tenant`)
+    if err != nil {
+        return nil, fmt.Errorf("failed to find budgets: %w", err)
+    }
+    defer rows.Close()
+
+    budgets := make([]models.Budget, 0)
+    for rows.Next() {
+        budget, err := scanPostgresBudget(rows)
+        if err != nil {
+            return nil, err
+        }
+        budgets = append(budgets, budget)
+    }
+    return budgets, rows.Err()
+}
+
+func (s *postgresStore) GetBudget(tenant string) (models.Budget, error) {
+    budget, err := scanPostgresBudget(s.db.QueryRow(`SELECT `+budgetColumns+` FROM budgets WHERE tenant = $1`, tenant))
+    if errors.Is(err, sql.ErrNoRows) {
+        return models.Budget{}, ErrNotFound
+    }
+    return budget, err
+}
+
+// scanPostgresBudget reads a row of budgetColumns.
+func scanPostgresBudget(row interface{ Scan(...any) error }) (models.Budget, error) {
+    var budget models.Budget
+    err := row.Scan(
+        &budget.Tenant, &budget.DailyTokens, &budget.MonthlyTokens, &budget.DailyUSD, &budget.MonthlyUSD,
+        &budget.RequestsPerMinute, &budget.UpdatedAt,
+    )
+    return budget, err
+}
+
+func (s *postgresStore) SaveBudget(budget models.Budget) error {
+    _, err := s.db.Exec(
+        `INSERT INTO budgets (`+budgetColumns+`)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (tenant) DO UPDATE SET
+            daily_tokens = excluded.daily_tokens,
+            monthly_tokens = excluded.monthly_tokens,
+            daily_usd = excluded.daily_usd,
+            monthly_usd = excluded.monthly_usd,
+            requests_per_minute = excluded.requests_per_minute,
+            updated_at = excluded.updated_at`,
+        budget.Tenant, budget.DailyTokens, budget.MonthlyTokens, budget.DailyUSD, budget.MonthlyUSD,
+        budget.RequestsPerMinute, budget.UpdatedAt,
+    )
+    return err
+}
+
+func (s *postgresStore) DeleteBudget(tenant string) error {
+    result, err := s.db.Exec(`DELETE FROM budgets WHERE tenant = $1`, tenant)
+    if err != nil {
+        return err
+    }
+    deleted, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if deleted == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
@@ -0,0 +1,382 @@
+package db
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/jackc/pgx/v5"
+    openai "github.com/sashabaranov/go-openai"
+)
+
+func (s *postgresStore) GetCachedResponse(hash string) (models.CachedSamples, error) {
+    var id int64
+    var samples models.CachedSamples
+    err := s.db.QueryRow(
+        `SELECT id, sampled FROM cached_responses WHERE hash = $1 AND (expires_at IS NULL OR expires_at > now())`,
+        hash,
+    ).Scan(&id, &samples.Sampled)
+    if errors.Is(err, sql.ErrNoRows) {
+        return models.CachedSamples{}, ErrNotFound
+    }
+    if err != nil {
+        return models.CachedSamples{}, err
+    }
+    samples.EntryID = strconv.FormatInt(id, 10)
+
+    rows, err := s.db.Query(`SELECT response FROM cached_samples WHERE entry_id = $1 ORDER BY cached_at, key`, id)
+    if err != nil {
+        return models.CachedSamples{}, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var encoded []byte
+        if err := rows.Scan(&encoded); err != nil {
+            return models.CachedSamples{}, err
+        }
+        var response openai.ChatCompletionResponse
+        if err := json.Unmarshal(encoded, &response); err != nil {
+            return models.CachedSamples{}, fmt.Errorf("failed to decode cached response: %w", err)
+        }
+        samples.Responses = append(samples.Responses, response)
+    }
+    if err := rows.Err(); err != nil {
+        return models.CachedSamples{}, err
+    }
+    if len(samples.Responses) == 0 {
+        return models.CachedSamples{}, ErrNotFound
+    }
+    return samples, nil
+}
+
+func (s *postgresStore) CacheRequestResponse(entry models.CacheEntry, maxSamples int) error {
+    key, err := sampleKey(entry.Response)
+    if err != nil {
+        return err
+    }
+    response, err := json.Marshal(entry.Response)
+    if err != nil {
+        return fmt.Errorf("failed to encode response: %w", err)
+    }
+    var expiresAt *time.Time
+    if !entry.ExpiresAt.IsZero() {
+        expiresAt = &entry.ExpiresAt
+    }
+
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    now := time.Now()
+    // An entry that expired but was not evicted yet is replaced, so its samples and expiry are not kept
+    _, err = tx.Exec(`DELETE FROM cached_responses WHERE hash = $1 AND expires_at <= $2`, entry.Hash, now)
+    if err != nil {
+        return fmt.Errorf("failed to delete the expired cached response: %w", err)
+    }
+    var id int64
+    err = tx.QueryRow(
+        `INSERT INTO cached_responses (hash, hash_version, request_body, tenant, route, model, source, sampled, cached_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, 1, $8, $9)
+        ON CONFLICT (hash) DO UPDATE SET sampled = cached_responses.sampled + 1
+        RETURNING id`,
+        entry.Hash, entry.HashVersion, string(entry.Request.Body), entry.Request.Tenant, entry.Request.Route,
+        entry.Request.Params.Model, entry.Source, now, expiresAt,
+    ).Scan(&id)
+    if err != nil {
+        return err
+    }
+
+    // The upsert above locks the entry's row, so concurrent writers cannot exceed maxSamples
+    _, err = tx.Exec(
+        `INSERT INTO cached_samples (entry_id, key, response, cached_at)
+        SELECT $1::bigint, $2::text, $3::jsonb, $4::timestamptz
+        WHERE (SELECT COUNT(*) FROM cached_samples WHERE entry_id = $1) < $5
+        ON CONFLICT (entry_id, key) DO NOTHING`,
+        id, key, string(response), now, maxSamples,
+    )
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (s *postgresStore) EvictCachedResponses(maxEntries int64) (int64, error) {
+    result, err := s.db.Exec(
+        `DELETE FROM cached_responses WHERE id IN (
+            SELECT id FROM cached_responses ORDER BY cached_at
+            LIMIT GREATEST((SELECT COUNT(*) FROM cached_responses) - $1, 0)
+        )`,
+        maxEntries,
+    )
+    if err != nil {
+        return 0, fmt.Errorf("failed to evict cached responses: %w", err)
+    }
+    return result.RowsAffected()
+}
+
+func (s *postgresStore) InvalidateCachedResponses(filter models.CacheFilter) (int64, error) {
+    query := `DELETE FROM cached_responses`
+    conditions, args := postgresCacheConditions(filter)
+    if len(conditions) > 0 {
+        query += ` WHERE ` + strings.Join(conditions, " AND ")
+    }
+    result, err := s.db.Exec(query, args...)
+    if err != nil {
+        return 0, fmt.Errorf("failed to invalidate cached responses: %w", err)
+    }
+    return result.RowsAffected()
+}
+
+// postgresCacheConditions turns a cache filter into conditions on cached_responses, numbering
+// their parameters from $1.
+func postgresCacheConditions(filter models.CacheFilter) ([]string, []any) {
+    var conditions []string
+    var args []any
+    addCondition := func(clause string, value any) {
+        args = append(args, value)
+        conditions = append(conditions, fmt.Sprintf(clause, len(args)))
+    }
+    if filter.Hash != "" {
+        addCondition("hash = $%d", filter.Hash)
+    }
+    if filter.Model != "" {
+        addCondition("model = $%d", filter.Model)
+    }
+    if filter.Tenant != "" {
+        addCondition("tenant = $%d", filter.Tenant)
+    }
+    if !filter.From.IsZero() {
+        addCondition("cached_at >= $%d", filter.From)
+    }
+    if !filter.To.IsZero() {
+        addCondition("cached_at < $%d", filter.To)
+    }
+    return conditions, args
+}
+
+// ExportCachedResponses calls onEntry with every unexpired entry matching filter, in the order
+// the entries were cached.
+func (s *postgresStore) ExportCachedResponses(ctx context.Context, filter models.CacheFilter, onEntry func(models.CachedRequest) error) error {
+    conditions, args := postgresCacheConditions(filter)
+    conditions = append(conditions,
+        "(expires_at IS NULL OR expires_at > now())",
+        "EXISTS (SELECT 1 FROM cached_samples WHERE entry_id = cached_responses.id)",
+        fmt.Sprintf("id > $%d", len(args)+1))
+
+    var after int64
+    for {
+        entries, lastID, err := s.exportPage(ctx, conditions, append(args[:len(args):len(args)], after, exportPageSize))
+        if err != nil {
+            return err
+        }
+        for _, entry := range entries {
+            if err := onEntry(entry); err != nil {
+                return err
+            }
+        }
+        if len(entries) < exportPageSize {
+            return nil
+        }
+        after = lastID
+    }
+}
+
+// exportPage reads the next page of entries to export with their samples, and returns the id of the last one.
+func (s *postgresStore) exportPage(ctx context.Context, conditions []string, args []any) ([]models.CachedRequest, int64, error) {
+    rows, err := s.db.QueryContext(ctx,
+        `SELECT r.id, r.hash, r.tenant, r.route, r.request_body, r.cached_at, s.response
+        FROM (SELECT * FROM cached_responses WHERE `+strings.Join(conditions, " AND ")+
+            fmt.Sprintf(` ORDER BY id LIMIT $%d) r`, len(args))+`
+        JOIN cached_samples s ON s.entry_id = r.id
+        ORDER BY r.id, s.cached_at, s.key`,
+        args...,
+    )
+    if err != nil {
+        return nil, 0, fmt.Errorf("failed to export cached responses: %w", err)
+    }
+    defer rows.Close()
+
+    var entries []models.CachedRequest
+    var entryID int64 = -1
+    for rows.Next() {
+        var id int64
+        var hash, tenant, route, body, encoded string
+        var cachedAt time.Time
+        if err := rows.Scan(&id, &hash, &tenant, &route, &body, &cachedAt, &encoded); err != nil {
+            return nil, 0, fmt.Errorf("failed to read cached response: %w", err)
+        }
+        if id != entryID {
+            entryID = id
+            entries = append(entries, models.CachedRequest{
+                Hash:     hash,
+                Tenant:   tenant,
+                Route:    route,
+                Body:     json.RawMessage(body),
+                CachedAt: cachedAt,
+            })
+        }
+        var response openai.ChatCompletionResponse
+        if err := json.Unmarshal([]byte(encoded), &response); err != nil {
+            return nil, 0, fmt.Errorf("failed to decode cached response: %w", err)
+        }
+        entry := &entries[len(entries)-1]
+        entry.Responses = append(entry.Responses, response)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, 0, fmt.Errorf("failed to iterate cached responses: %w", err)
+    }
+    return entries, entryID, nil
+}
+
+// WatchCachedResponses listens for the notifications the cached_responses trigger sends.
+// Notifications sent while not listening are lost, so every (re)connect starts with a reset.
+func (s *postgresStore) WatchCachedResponses(ctx context.Context, onChange func(models.CacheChange)) error {
+    conn, err := pgx.Connect(ctx, s.url)
+    if err != nil {
+        return fmt.Errorf("failed to connect for cache notifications: %w", err)
+    }
+    defer conn.Close(context.Background())
+
+    if _, err := conn.Exec(ctx, `LISTEN cached_responses`); err != nil {
+        return fmt.Errorf("failed to listen for cache notifications: %w", err)
+    }
+    onChange(models.CacheChange{Reset: true})
+
+    for {
+        notification, err := conn.WaitForNotification(ctx)
+        if err != nil {
+            return fmt.Errorf("cache notifications stopped: %w", err)
+        }
+
+        var change struct {
+            ID   int64  `json:"id"`
+            Hash string `json:"hash"`
+        }
+        if err := json.Unmarshal([]byte(notification.Payload), &change); err != nil {
+            onChange(models.CacheChange{Reset: true})
+            continue
+        }
+        onChange(models.CacheChange{EntryID: strconv.FormatInt(change.ID, 10), Hash: change.Hash})
+    }
+}
+
+func (s *postgresStore) RehashCachedResponses(hashVersion int, rehash func(request models.ChatRequest) (string, error), all bool, dryRun bool) (RehashResult, error) {
+    var result RehashResult
+
+    query := `SELECT id, hash, hash_version, request_body, tenant, route FROM cached_responses`
+    var args []any
+    if !all {
+        query += ` WHERE hash_version != $1`
+        args = append(args, hashVersion)
+    }
+    rows, err := s.db.Query(query, args...)
+    if err != nil {
+        return result, fmt.Errorf("failed to find cached responses to rehash: %w", err)
+    }
+
+    // Read every entry first, so updates do not race the open cursor
+    type cachedRequest struct {
+        id          int64
+        hash        string
+        hashVersion int
+        body        []byte
+        tenant      string
+        route       string
+    }
+    var entries []cachedRequest
+    for rows.Next() {
+        var entry cachedRequest
+        if err := rows.Scan(&entry.id, &entry.hash, &entry.hashVersion, &entry.body, &entry.tenant, &entry.route); err != nil {
+            rows.Close()
+            return result, fmt.Errorf("failed to read cached response: %w", err)
+        }
+        entries = append(entries, entry)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return result, fmt.Errorf("failed to iterate cached responses: %w", err)
+    }
+
+    for _, entry := range entries {
+        result.Scanned++
+
+        tenant := entry.tenant
+        if tenant == "" {
+            tenant = models.DefaultTenant
+        }
+        hash, err := rehash(models.ChatRequest{Body: json.RawMessage(entry.body), Tenant: tenant, Route: entry.route})
+        if err != nil {
+            logger.WarnLogger.Printf("Failed to rehash cached response %d: %v", entry.id, err)
+            result.Failed++
+            continue
+        }
+
+        // Entries the rules did not change are left alone
+        if hash == entry.hash && entry.hashVersion == hashVersion {
+            continue
+        }
+        if dryRun {
+            result.Updated++
+            continue
+        }
+
+        if err := s.rehashEntry(entry.id, hash, hashVersion); err != nil {
+            logger.WarnLogger.Printf("Failed to update cached response %d: %v", entry.id, err)
+            result.Failed++
+            continue
+        }
+        result.Updated++
+
+        if result.Scanned%1000 == 0 {
+            logger.InfoLogger.Printf("Rehashed %d cached responses so far", result.Updated)
+        }
+    }
+    return result, nil
+}
+
+// rehashEntry moves a cached response to a new hash. If another entry already has that hash,
+// the samples of both are the same request's and are merged into the other entry.
+func (s *postgresStore) rehashEntry(id int64, hash string, hashVersion int) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var existing int64
+    err = tx.QueryRow(`SELECT id FROM cached_responses WHERE hash = $1 AND id != $2 FOR UPDATE`, hash, id).Scan(&existing)
+    switch {
+    case errors.Is(err, sql.ErrNoRows):
+        _, err = tx.Exec(`UPDATE cached_responses SET hash = $1, hash_version = $2 WHERE id = $3`, hash, hashVersion, id)
+    case err == nil:
+        _, err = tx.Exec(
+            `INSERT INTO cached_samples (entry_id, key, response, cached_at)
+            SELECT $1, key, response, cached_at FROM cached_samples WHERE entry_id = $2
+            ON CONFLICT (entry_id, key) DO NOTHING`,
+            existing, id,
+        )
+        if err == nil {
+            _, err = tx.Exec(
+                `UPDATE cached_responses SET sampled = sampled + (SELECT sampled FROM cached_responses WHERE id = $1) WHERE id = $2`,
+                id, existing,
+            )
+        }
+        if err == nil {
+            _, err = tx.Exec(`DELETE FROM cached_responses WHERE id = $1`, id)
+        }
+    }
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+)
+
+func (s *postgresStore) SaveDeadLetter(deadLetter models.DeadLetter) error {
+    batchIDs, err := json.Marshal(deadLetter.BatchIDs)
+    if err != nil {
+        return fmt.Errorf("failed to encode batch ids: %w", err)
+    }
+
+    _, err = s.db.Exec(
+        `INSERT INTO dead_letters (`+deadLetterColumns+`)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        ON CONFLICT (hash) DO UPDATE SET
+            request = excluded.request,
+            tenant = excluded.tenant,
+            route = excluded.route,
+            last_error = excluded.last_error,
+            error_class = excluded.error_class,
+            batch_ids = excluded.batch_ids,
+            attempts = excluded.attempts,
+            created_at = excluded.created_at`,
+        deadLetter.Hash, string(deadLetter.Request), deadLetter.Tenant, deadLetter.Route, deadLetter.LastError,
+        deadLetter.ErrorClass, string(batchIDs), deadLetter.Attempts, deadLetter.CreatedAt,
+    )
+    return err
+}
+
+// scanPostgresDeadLetter reads a row of deadLetterColumns.
+func scanPostgresDeadLetter(row interface{ Scan(...any) error }) (models.DeadLetter, error) {
+    var deadLetter models.DeadLetter
+    var request, batchIDs []byte
+    err := row.Scan(
+        &deadLetter.Hash, &request, &deadLetter.Tenant, &deadLetter.Route, &deadLetter.LastError,
+        &deadLetter.ErrorClass, &batchIDs, &deadLetter.Attempts, &deadLetter.CreatedAt,
+    )
+    if err != nil {
+        return models.DeadLetter{}, err
+    }
+
+    deadLetter.Request = json.RawMessage(request)
+    if err := json.Unmarshal(batchIDs, &deadLetter.BatchIDs); err != nil {
+        return models.DeadLetter{}, fmt.Errorf("failed to decode batch ids of dead letter %s: %w", deadLetter.Hash, err)
+    }
+    return deadLetter, nil
+}
+
+func (s *postgresStore) GetDeadLetters(limit int64) ([]models.DeadLetter, error) {
+    rows, err := s.db.Query(`SELECT `+deadLetterColumns+` FROM dead_letters ORDER BY created_at DESC LIMIT $1`, limit)
+    if err != nil {
+        return nil, fmt.Errorf("failed to find dead letters: %w", err)
+    }
+    defer rows.Close()
+
+    deadLetters := make([]models.DeadLetter, 0)
+    for rows.Next() {
+        deadLetter, err := scanPostgresDeadLetter(rows)
+        if err != nil {
+            return nil, err
+        }
+        deadLetters = append(deadLetters, deadLetter)
+    }
+    return deadLetters, rows.Err()
+}
+
+func (s *postgresStore) GetDeadLetter(hash string) (models.DeadLetter, error) {
+    deadLetter, err := scanPostgresDeadLetter(s.db.QueryRow(`SELECT `+deadLetterColumns+` FROM dead_letters WHERE hash = $1`, hash))
+    if errors.Is(err, sql.ErrNoRows) {
+        return models.DeadLetter{}, ErrNotFound
+    }
+    return deadLetter, err
+}
+
+func (s *postgresStore) DeleteDeadLetter(hash string) error {
+    result, err := s.db.Exec(`DELETE FROM dead_letters WHERE hash = $1`, hash)
+    if err != nil {
+        return err
+    }
+    deleted, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if deleted == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+func (s *postgresStore) PurgeDeadLetters(before time.Time) (int64, error) {
+    query := `DELETE FROM dead_letters`
+    var args []any
+    if !before.IsZero() {
+        query += ` WHERE created_at < $1`
+        args = append(args, before)
+    }
+
+    result, err := s.db.Exec(query, args...)
+    if err != nil {
+        return 0, fmt.Errorf("failed to purge dead letters: %w", err)
+    }
+    return result.RowsAffected()
+}
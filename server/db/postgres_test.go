@@ -0,0 +1,72 @@
+package db
+
+import (
+    "database/sql"
+    "fmt"
+    "net/url"
+    "os"
+    "testing"
+    "time"
+)
+
+// newTestPostgresStore opens a store on the database POSTGRES_URL points at, in a schema of its
+// own that is dropped once the test finished. Tests using it are skipped if POSTGRES_URL is not set.
+func newTestPostgresStore(t *testing.T) Store {
+    t.Helper()
+    databaseURL := os.Getenv("POSTGRES_URL")
+    if databaseURL == "" {
+        t.Skip("POSTGRES_URL is not set")
+    }
+
+    admin, err := sql.Open("pgx", databaseURL)
+    if err != nil {
+        t.Fatalf("sql.Open() error = %v", err)
+    }
+    t.Cleanup(func() { admin.Close() })
+    schema := fmt.Sprintf("batchgpt_test_%d", time.Now().UnixNano())
+    if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+        t.Fatalf("failed to create schema %s: %v", schema, err)
+    }
+    t.Cleanup(func() {
+        if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+            t.Errorf("failed to drop schema %s: %v", schema, err)
+        }
+    })
+
+    parsed, err := url.Parse(databaseURL)
+    if err != nil {
+        t.Fatalf("POSTGRES_URL is not a URL: %v", err)
+    }
+    query := parsed.Query()
+    query.Set("search_path", schema)
+    parsed.RawQuery = query.Encode()
+
+    store, err := newPostgresStore(parsed.String())
+    if err != nil {
+        t.Fatalf("newPostgresStore() error = %v", err)
+    }
+    t.Cleanup(func() { store.Close() })
+    if _, err := store.Migrate(); err != nil {
+        t.Fatalf("Migrate() error = %v", err)
+    }
+    return store
+}
+
+func TestPostgresBudgets(t *testing.T) { testStoreBudgets(t, newTestPostgresStore) }
+
+func TestPostgresUsage(t *testing.T) { testStoreUsage(t, newTestPostgresStore) }
+
+func TestPostgresCacheSamples(t *testing.T) { testStoreCacheSamples(t, newTestPostgresStore) }
+
+func TestPostgresCacheExpiry(t *testing.T) { testStoreCacheExpiry(t, newTestPostgresStore) }
+
+func TestPostgresInvalidateCachedResponses(t *testing.T) {
+    testStoreInvalidateCachedResponses(t, newTestPostgresStore)
+}
+
+func TestPostgresExportCachedResponses(t *testing.T) { testStoreExportCachedResponses(t, newTestPostgresStore) }
+
+func TestPostgresBatchStatuses(t *testing.T) { testStoreBatchStatuses(t, newTestPostgresStore) }
+func TestPostgresTrackBatch(t *testing.T) { testStoreTrackBatch(t, newTestPostgresStore) }
+
+func TestPostgresQueuedRequests(t *testing.T) { testStoreQueuedRequests(t, newTestPostgresStore) }
@@ -0,0 +1,91 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "context"
+    "encoding/json"
+    "fmt"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// queuedRequestDocument stores the request body as a JSON string, like deadLetterDocument, so
+// it is submitted unchanged after a restart.
+type queuedRequestDocument struct {
+    Hash           string        `bson:"_id"`
+    RequestBody    string        `bson:"request_body"`
+    Tenant         string        `bson:"tenant"`
+    Route          string        `bson:"route"`
+    CacheDirective string        `bson:"cache_directive"`
+    CacheTTL       time.Duration `bson:"cache_ttl"`
+    QueuedAt       time.Time     `bson:"queued_at"`
+}
+
+func (s *mongoStore) SaveQueuedRequest(request models.QueuedRequest) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    document := queuedRequestDocument{
+        Hash:           request.Hash,
+        RequestBody:    string(request.Body),
+        Tenant:         request.Tenant,
+        Route:          request.Route,
+        CacheDirective: string(request.CacheDirective),
+        CacheTTL:       request.CacheTTL,
+        QueuedAt:       request.QueuedAt,
+    }
+    _, err := s.queuedRequestsCollection.ReplaceOne(
+        ctx,
+        bson.M{"_id": request.Hash},
+        document,
+        options.Replace().SetUpsert(true),
+    )
+    return err
+}
+
+func (s *mongoStore) DeleteQueuedRequest(hash string, queuedAt time.Time) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    _, err := s.queuedRequestsCollection.DeleteOne(ctx, bson.M{"_id": hash, "queued_at": queuedAt})
+    return err
+}
+
+func (s *mongoStore) GetQueuedRequests() ([]models.QueuedRequest, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    cursor, err := s.queuedRequestsCollection.Find(
+        ctx,
+        bson.M{},
+        options.Find().SetSort(bson.D{{Key: "queued_at", Value: 1}}),
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to find queued requests: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    var documents []queuedRequestDocument
+    if err = cursor.All(ctx, &documents); err != nil {
+        return nil, fmt.Errorf("failed to decode queued requests: %w", err)
+    }
+
+    requests := make([]models.QueuedRequest, 0, len(documents))
+    for _, document := range documents {
+        if !json.Valid([]byte(document.RequestBody)) {
+            return nil, fmt.Errorf("queued request %s does not hold a valid JSON request", document.Hash)
+        }
+        requests = append(requests, models.QueuedRequest{
+            Hash:           document.Hash,
+            Body:           json.RawMessage(document.RequestBody),
+            Tenant:         document.Tenant,
+            Route:          document.Route,
+            CacheDirective: models.CacheDirective(document.CacheDirective),
+            CacheTTL:       document.CacheTTL,
+            QueuedAt:       document.QueuedAt,
+        })
+    }
+    return requests, nil
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "context"
+    "encoding/json"
+    "fmt"
+    "reflect"
+
+    openai "github.com/sashabaranov/go-openai"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/bsoncodec"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// legacyRequestRegistry decodes nested documents into maps rather than bson.D, so the
+// untyped fields of a stored go-openai request (tools, tool_choice, ...) encode back to JSON objects.
+var legacyRequestRegistry = func() *bsoncodec.Registry {
+    registry := bson.NewRegistry()
+    registry.RegisterTypeMapEntry(bson.TypeEmbeddedDocument, reflect.TypeOf(bson.M{}))
+    return registry
+}()
+
+// RehashResult counts what RehashCachedResponses did.
+type RehashResult struct {
+    Scanned int
+    Updated int
+    Failed  int
+}
+
+// RehashCachedResponses recomputes the hash of every cached response stored with a fingerprint
+// version other than hashVersion, using rehash on its request. Entries cached before
+// request bodies were stored only hold the go-openai request struct; their body is rebuilt
+// from it and stored as well. Entries cached without a tenant are rehashed as the default
+// tenant's, and entries cached without a model get the one of their request, so the cache
+// filters by tenant and model find them. With all set, entries already at hashVersion are rehashed too, e.g. after the
+// cache key rules changed. With dryRun set, nothing is written.
+func (s *mongoStore) RehashCachedResponses(hashVersion int, rehash func(request models.ChatRequest) (string, error), all bool, dryRun bool) (RehashResult, error) {
+    ctx := context.Background()
+    var result RehashResult
+
+    filter := bson.M{"hash_version": bson.M{"$ne": hashVersion}}
+    if all {
+        filter = bson.M{}
+    }
+    cursor, err := s.cachedResponsesCollection.Find(ctx, filter)
+    if err != nil {
+        return result, fmt.Errorf("failed to find cached responses to rehash: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    for cursor.Next(ctx) {
+        result.Scanned++
+
+        var document struct {
+            ID          primitive.ObjectID           `bson:"_id"`
+            Hash        string                       `bson:"hash"`
+            HashVersion int                          `bson:"hash_version"`
+            RequestBody string                       `bson:"request_body"`
+            Tenant      string                       `bson:"tenant"`
+            Model       string                       `bson:"model"`
+            Route       string                       `bson:"route"`
+            Request     openai.ChatCompletionRequest `bson:"request"`
+        }
+        if err := bson.UnmarshalWithRegistry(legacyRequestRegistry, cursor.Current, &document); err != nil {
+            logger.WarnLogger.Printf("Failed to decode cached response: %v", err)
+            result.Failed++
+            continue
+        }
+
+        body := json.RawMessage(document.RequestBody)
+        if document.RequestBody == "" {
+            body, err = json.Marshal(document.Request)
+            if err != nil {
+                logger.WarnLogger.Printf("Failed to rebuild request body of cached response %s: %v", document.ID.Hex(), err)
+                result.Failed++
+                continue
+            }
+        }
+
+        tenant := document.Tenant
+        if tenant == "" {
+            tenant = models.DefaultTenant
+        }
+        hash, err := rehash(models.ChatRequest{Body: body, Tenant: tenant, Route: document.Route})
+        if err != nil {
+            logger.WarnLogger.Printf("Failed to rehash cached response %s: %v", document.ID.Hex(), err)
+            result.Failed++
+            continue
+        }
+
+        model := document.Model
+        if model == "" {
+            model = requestModel(body)
+        }
+
+        // Entries the rules did not change are left alone
+        if hash == document.Hash && document.HashVersion == hashVersion && document.RequestBody != "" &&
+            document.Tenant == tenant && document.Model == model {
+            continue
+        }
+        if dryRun {
+            result.Updated++
+            continue
+        }
+
+        _, err = s.cachedResponsesCollection.UpdateByID(ctx, document.ID, bson.M{"$set": bson.M{
+            "hash":         hash,
+            "hash_version": hashVersion,
+            "request_body": string(body),
+            "tenant":       tenant,
+            "model":        model,
+        }})
+        if mongo.IsDuplicateKeyError(err) {
+            // Another entry already has the new hash; its samples and this entry's are the same request's
+            err = s.mergeIntoHash(ctx, hash, document.ID)
+        }
+        if err != nil {
+            logger.WarnLogger.Printf("Failed to update cached response %s: %v", document.ID.Hex(), err)
+            result.Failed++
+            continue
+        }
+        result.Updated++
+
+        if result.Scanned%1000 == 0 {
+            logger.InfoLogger.Printf("Rehashed %d cached responses so far", result.Updated)
+        }
+    }
+
+    if err := cursor.Err(); err != nil {
+        return result, fmt.Errorf("failed to iterate cached responses: %w", err)
+    }
+    return result, nil
+}
+
+// requestModel reads the model of a request body, or returns "" if it has none.
+func requestModel(body json.RawMessage) string {
+    var request struct {
+        Model string `json:"model"`
+    }
+    if err := json.Unmarshal(body, &request); err != nil {
+        return ""
+    }
+    return request.Model
+}
+
+// mergeIntoHash merges the cached response id into the entry already stored under hash.
+func (s *mongoStore) mergeIntoHash(ctx context.Context, hash string, id primitive.ObjectID) error {
+    var existing struct {
+        ID primitive.ObjectID `bson:"_id"`
+    }
+    if err := s.cachedResponsesCollection.FindOne(ctx, bson.M{"hash": hash}).Decode(&existing); err != nil {
+        return fmt.Errorf("failed to find the cached response to merge into: %w", err)
+    }
+    return s.mergeCachedResponses(ctx, existing.ID, []primitive.ObjectID{id})
+}
@@ -0,0 +1,24 @@
+package db
+
+import "testing"
+
+func TestRequestModel(t *testing.T) {
+    tests := []struct {
+        name string
+        body string
+        want string
+    }{
+        {name: "model", body: `{"model":"gpt-4o","messages":[]}`, want: "gpt-4o"},
+        {name: "no model", body: `{"messages":[]}`, want: ""},
+        {name: "model of another type", body: `{"model":4}`, want: ""},
+        {name: "invalid JSON", body: `{"model":`, want: ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := requestModel([]byte(tt.body)); got != tt.want {
+                t.Errorf("requestModel() = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,470 @@
+package db
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+    _ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order, each once, and recorded in schema_migrations. Times are
+// stored as Unix nanoseconds. Never change a released migration; append a new one instead.
+var sqliteMigrations = []sqlMigration{
+    // Databases created before migrations were recorded already have these tables
+    {"Create batch_logs, cached_responses, cached_samples and dead_letters", `
+CREATE TABLE IF NOT EXISTS batch_logs (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    batch_id   TEXT NOT NULL,
+    status     TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    batch      TEXT NOT NULL,
+    timestamp  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS batch_logs_batch_id ON batch_logs (batch_id, timestamp);
+
+CREATE TABLE IF NOT EXISTS cached_responses (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    hash         TEXT NOT NULL UNIQUE,
+    hash_version INTEGER NOT NULL,
+    request_body TEXT NOT NULL,
+    tenant       TEXT NOT NULL,
+    route        TEXT NOT NULL,
+    model        TEXT NOT NULL,
+    sampled      INTEGER NOT NULL,
+    timestamp    INTEGER NOT NULL,
+    expires_at   INTEGER
+);
+CREATE INDEX IF NOT EXISTS cached_responses_timestamp ON cached_responses (timestamp);
+CREATE INDEX IF NOT EXISTS cached_responses_expires_at ON cached_responses (expires_at);
+
+CREATE TABLE IF NOT EXISTS cached_samples (
+    entry_id  INTEGER NOT NULL REFERENCES cached_responses (id) ON DELETE CASCADE,
+    key       TEXT NOT NULL,
+    response  TEXT NOT NULL,
+    timestamp INTEGER NOT NULL,
+    PRIMARY KEY (entry_id, key)
+);
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+    hash        TEXT PRIMARY KEY,
+    request     TEXT NOT NULL,
+    tenant      TEXT NOT NULL,
+    route       TEXT NOT NULL,
+    last_error  TEXT NOT NULL,
+    error_class TEXT NOT NULL,
+    batch_ids   TEXT NOT NULL,
+    attempts    INTEGER NOT NULL,
+    created_at  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS dead_letters_created_at ON dead_letters (created_at);
+`},
+    // batch_logs held a row per poll; only the latest state and the transitions are kept
+    {"Move batch_logs into batches and batch_history", `
+CREATE TABLE batches (
+    id         TEXT PRIMARY KEY,
+    status     TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    batch      TEXT NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+CREATE INDEX batches_status ON batches (status, created_at);
+CREATE INDEX batches_created_at ON batches (created_at);
+
+CREATE TABLE batch_history (
+    id        INTEGER PRIMARY KEY AUTOINCREMENT,
+    batch_id  TEXT NOT NULL,
+    status    TEXT NOT NULL,
+    total     INTEGER NOT NULL,
+    completed INTEGER NOT NULL,
+    failed    INTEGER NOT NULL,
+    timestamp INTEGER NOT NULL
+);
+CREATE INDEX batch_history_batch_id ON batch_history (batch_id, timestamp);
+
+INSERT INTO batches (id, status, created_at, batch, updated_at)
+SELECT batch_id, status, created_at, batch, timestamp FROM (
+    SELECT *, ROW_NUMBER() OVER (PARTITION BY batch_id ORDER BY timestamp DESC, id DESC) AS position
+    FROM batch_logs
+) WHERE position = 1;
+
+INSERT INTO batch_history (batch_id, status, total, completed, failed, timestamp)
+SELECT batch_id, status, total, completed, failed, timestamp FROM (
+    SELECT *,
+        LAG(status) OVER logs AS previous_status,
+        LAG(total) OVER logs AS previous_total,
+        LAG(completed) OVER logs AS previous_completed,
+        LAG(failed) OVER logs AS previous_failed
+    FROM (
+        SELECT id, batch_id, status, timestamp,
+            COALESCE(json_extract(batch, '$.request_counts.total'), 0) AS total,
+            COALESCE(json_extract(batch, '$.request_counts.completed'), 0) AS completed,
+            COALESCE(json_extract(batch, '$.request_counts.failed'), 0) AS failed
+        FROM batch_logs
+    )
+    WINDOW logs AS (PARTITION BY batch_id ORDER BY timestamp, id)
+)
+WHERE previous_status IS NULL
+    OR status != previous_status
+    OR total != previous_total
+    OR completed != previous_completed
+    OR failed != previous_failed
+ORDER BY timestamp, id;
+
+DROP TABLE batch_logs;
+`},
+    {"Index the dangling batches, for paging through them", `
+CREATE INDEX batches_dangling ON batches (id) WHERE status NOT IN ('completed', 'failed', 'cancelled', 'expired');
+`},
+    {"Record where cached responses came from", `
+ALTER TABLE cached_responses ADD COLUMN source TEXT NOT NULL DEFAULT '';
+`},
+    {"Create daily_usage", `
+CREATE TABLE daily_usage (
+    day               TEXT NOT NULL,
+    tenant            TEXT NOT NULL,
+    model             TEXT NOT NULL,
+    source            TEXT NOT NULL,
+    requests          INTEGER NOT NULL,
+    prompt_tokens     INTEGER NOT NULL,
+    completion_tokens INTEGER NOT NULL,
+    PRIMARY KEY (day, tenant, model, source)
+);
+CREATE INDEX daily_usage_tenant ON daily_usage (tenant, day);
+`},
+    {"Create budgets", `
+CREATE TABLE budgets (
+    tenant              TEXT PRIMARY KEY,
+    daily_tokens        INTEGER NOT NULL,
+    monthly_tokens      INTEGER NOT NULL,
+    daily_usd           REAL NOT NULL,
+    monthly_usd         REAL NOT NULL,
+    requests_per_minute INTEGER NOT NULL,
+    updated_at          INTEGER NOT NULL
+);
+`},
+    {"Create queued_requests", `
+CREATE TABLE queued_requests (
+    hash            TEXT PRIMARY KEY,
+    request_body    TEXT NOT NULL,
+    tenant          TEXT NOT NULL,
+    route           TEXT NOT NULL,
+    cache_directive TEXT NOT NULL,
+    cache_ttl       INTEGER NOT NULL,
+    queued_at       INTEGER NOT NULL
+);
+CREATE INDEX queued_requests_queued_at ON queued_requests (queued_at);
+`},
+}
+
+// sqliteStore is the embedded SQLite storage backend, for running batch-gpt without a database server.
+type sqliteStore struct {
+    db   *sql.DB
+    done chan struct{}
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+    database, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+    if err != nil {
+        return nil, fmt.Errorf("failed to open SQLite database %s: %w", path, err)
+    }
+    // SQLite allows a single writer, so a single connection avoids busy errors between them
+    database.SetMaxOpenConns(1)
+
+    s := &sqliteStore{
+        db:   database,
+        done: make(chan struct{}),
+    }
+    go s.deleteExpiredResponses()
+
+    log.Printf("Opened SQLite database %s", path)
+    return s, nil
+}
+
+func (s *sqliteStore) Close() error {
+    close(s.done)
+    return s.db.Close()
+}
+
+func (s *sqliteStore) GetMigrations() ([]Migration, error) {
+    var tables int
+    if err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&tables); err != nil {
+        return nil, fmt.Errorf("failed to look up schema_migrations: %w", err)
+    }
+    appliedAt := make(map[int]time.Time)
+    if tables > 0 {
+        rows, err := s.db.Query(`SELECT version, applied_at FROM schema_migrations`)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+        }
+        defer rows.Close()
+        for rows.Next() {
+            var version int
+            var at int64
+            if err := rows.Scan(&version, &at); err != nil {
+                return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+            }
+            appliedAt[version] = time.Unix(0, at)
+        }
+        if err := rows.Err(); err != nil {
+            return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+        }
+    }
+    return listMigrations(describeSQLMigrations(sqliteMigrations), appliedAt), nil
+}
+
+// Migrate applies the migrations that have not been applied yet, in a single transaction.
+func (s *sqliteStore) Migrate() ([]Migration, error) {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return nil, fmt.Errorf("failed to start schema migration: %w", err)
+    }
+    defer tx.Rollback()
+
+    _, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+        version    INTEGER PRIMARY KEY,
+        applied_at INTEGER NOT NULL
+    )`)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+    }
+
+    var current int
+    if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+        return nil, fmt.Errorf("failed to read the schema version: %w", err)
+    }
+    if current > len(sqliteMigrations) {
+        return nil, fmt.Errorf("database schema version %d is newer than this release supports (%d)", current, len(sqliteMigrations))
+    }
+
+    var applied []Migration
+    for version := current + 1; version <= len(sqliteMigrations); version++ {
+        migration := sqliteMigrations[version-1]
+        if _, err := tx.Exec(migration.statements); err != nil {
+            return nil, fmt.Errorf("failed to apply schema migration %d (%s): %w", version, migration.description, err)
+        }
+        now := time.Now()
+        if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, now.UnixNano()); err != nil {
+            return nil, fmt.Errorf("failed to record schema migration %d: %w", version, err)
+        }
+        applied = append(applied, Migration{Version: version, Description: migration.description, AppliedAt: now})
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, fmt.Errorf("failed to commit schema migrations: %w", err)
+    }
+    for _, migration := range applied {
+        log.Printf("Applied SQLite schema migration %d: %s", migration.Version, migration.Description)
+    }
+    return applied, nil
+}
+
+// deleteExpiredResponses removes expired cached responses once a minute, like the MongoDB TTL index.
+func (s *sqliteStore) deleteExpiredResponses() {
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-s.done:
+            return
+        case <-ticker.C:
+            if _, err := s.db.Exec(`DELETE FROM cached_responses WHERE expires_at <= ?`, time.Now().UnixNano()); err != nil {
+                logger.WarnLogger.Printf("Failed to delete expired cached responses: %v", err)
+            }
+        }
+    }
+}
+
+func (s *sqliteStore) LogBatchStatus(batchStatus openai.BatchResponse) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var previous string
+    err = tx.QueryRow(`SELECT batch FROM batches WHERE id = ?`, batchStatus.ID).Scan(&previous)
+    isNew := errors.Is(err, sql.ErrNoRows)
+    if err != nil && !isNew {
+        return err
+    }
+
+    current := batchStatus.Batch
+    isTransition := true
+    if !isNew {
+        var previousBatch openai.Batch
+        if err := json.Unmarshal([]byte(previous), &previousBatch); err != nil {
+            return fmt.Errorf("failed to decode the previous status of batch %s: %w", batchStatus.ID, err)
+        }
+        current = keepMetadata(previousBatch, current)
+        isTransition = isBatchTransition(previousBatch, current)
+    }
+    batch, err := json.Marshal(current)
+    if err != nil {
+        return fmt.Errorf("failed to encode batch status: %w", err)
+    }
+
+    now := time.Now().UnixNano()
+    _, err = tx.Exec(
+        `INSERT INTO batches (id, status, created_at, batch, updated_at) VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT (id) DO UPDATE SET
+            status = excluded.status,
+            created_at = excluded.created_at,
+            batch = excluded.batch,
+            updated_at = excluded.updated_at`,
+        current.ID, current.Status, current.CreatedAt, string(batch), now,
+    )
+    if err != nil {
+        return err
+    }
+
+    if isTransition {
+        if err := insertSQLiteBatchTransition(tx, current, now); err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+func (s *sqliteStore) TrackBatch(batchStatus openai.BatchResponse) error {
+    batch, err := json.Marshal(batchStatus.Batch)
+    if err != nil {
+        return fmt.Errorf("failed to encode batch status: %w", err)
+    }
+
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    now := time.Now().UnixNano()
+    result, err := tx.Exec(
+        `INSERT INTO batches (id, status, created_at, batch, updated_at) VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT (id) DO NOTHING`,
+        batchStatus.ID, batchStatus.Status, batchStatus.CreatedAt, string(batch), now,
+    )
+    if err != nil {
+        return err
+    }
+    if inserted, err := result.RowsAffected(); err != nil {
+        return err
+    } else if inserted == 0 {
+        return ErrAlreadyExists
+    }
+
+    if err := insertSQLiteBatchTransition(tx, batchStatus.Batch, now); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// insertSQLiteBatchTransition adds the current status of a batch to its history.
+func insertSQLiteBatchTransition(tx *sql.Tx, batch openai.Batch, now int64) error {
+    counts := batch.RequestCounts
+    _, err := tx.Exec(
+        `INSERT INTO batch_history (batch_id, status, total, completed, failed, timestamp) VALUES (?, ?, ?, ?, ?, ?)`,
+        batch.ID, batch.Status, counts.Total, counts.Completed, counts.Failed, now,
+    )
+    return err
+}
+
+func (s *sqliteStore) GetLatestBatchStatus(batchID string) (openai.Batch, error) {
+    var encoded string
+    err := s.db.QueryRow(`SELECT batch FROM batches WHERE id = ?`, batchID).Scan(&encoded)
+    if errors.Is(err, sql.ErrNoRows) {
+        return openai.Batch{}, ErrNotFound
+    }
+    if err != nil {
+        return openai.Batch{}, err
+    }
+
+    var batch openai.Batch
+    if err := json.Unmarshal([]byte(encoded), &batch); err != nil {
+        return openai.Batch{}, fmt.Errorf("failed to decode batch status: %w", err)
+    }
+    return batch, nil
+}
+
+func (s *sqliteStore) GetBatchHistory(batchID string) ([]models.BatchTransition, error) {
+    rows, err := s.db.Query(
+        `SELECT status, total, completed, failed, timestamp FROM batch_history WHERE batch_id = ? ORDER BY timestamp, id`,
+        batchID,
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to query the history of batch %s: %w", batchID, err)
+    }
+    defer rows.Close()
+
+    var transitions []models.BatchTransition
+    for rows.Next() {
+        transition := models.BatchTransition{BatchID: batchID}
+        var timestamp int64
+        counts := &transition.RequestCounts
+        if err := rows.Scan(&transition.Status, &counts.Total, &counts.Completed, &counts.Failed, &timestamp); err != nil {
+            return nil, fmt.Errorf("failed to read the history of batch %s: %w", batchID, err)
+        }
+        transition.Timestamp = time.Unix(0, timestamp)
+        transitions = append(transitions, transition)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    if len(transitions) == 0 {
+        return nil, ErrNotFound
+    }
+    return transitions, nil
+}
+
+// sqliteDanglingBatchesQuery matches the batches_dangling index, which only holds the dangling batches.
+var sqliteDanglingBatchesQuery = `SELECT batch FROM batches WHERE status NOT IN (` + terminalBatchStatusesSQL + `) AND id > ? ORDER BY id LIMIT ?`
+
+func (s *sqliteStore) GetDanglingBatches(after string, limit int) ([]openai.Batch, error) {
+    rows, err := s.db.Query(sqliteDanglingBatchesQuery, after, limit)
+    if err != nil {
+        return nil, fmt.Errorf("failed to query dangling batches: %w", err)
+    }
+    defer rows.Close()
+
+    danglingBatches := make([]openai.Batch, 0)
+    for rows.Next() {
+        var encoded string
+        if err := rows.Scan(&encoded); err != nil {
+            return nil, fmt.Errorf("failed to read dangling batch: %w", err)
+        }
+        var batch openai.Batch
+        if err := json.Unmarshal([]byte(encoded), &batch); err != nil {
+            return nil, fmt.Errorf("failed to decode dangling batch: %w", err)
+        }
+        danglingBatches = append(danglingBatches, batch)
+    }
+    return danglingBatches, rows.Err()
+}
+
+func (s *sqliteStore) GetAllBatchStatuses() ([]openai.BatchResponse, error) {
+    rows, err := s.db.Query(`SELECT id, batch FROM batches ORDER BY created_at DESC`)
+    if err != nil {
+        return nil, fmt.Errorf("failed to query batch statuses: %w", err)
+    }
+    defer rows.Close()
+
+    results := make([]openai.BatchResponse, 0)
+    for rows.Next() {
+        var batchID, encoded string
+        if err := rows.Scan(&batchID, &encoded); err != nil {
+            return nil, fmt.Errorf("failed to read batch status: %w", err)
+        }
+        var result openai.BatchResponse
+        if err := json.Unmarshal([]byte(encoded), &result.Batch); err != nil {
+            return nil, fmt.Errorf("failed to decode status of batch %s: %w", batchID, err)
+        }
+        results = append(results, result)
+    }
+    return results, rows.Err()
+}
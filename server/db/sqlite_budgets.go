@@ -0,0 +1,81 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "database/sql"
+    "errors"
+    "fmt"
+    "time"
+)
+
+const budgetColumns = `tenant, daily_tokens, monthly_tokens, daily_usd, monthly_usd, requests_per_minute, updated_at`
+
+func (s *sqliteStore) GetBudgets() ([]models.Budget, error) {
+    rows, err := s.db.Query(`SELECT ` + budgetColumns + ` FROM budgets ORDER BY tenant`)
+    if err != nil {
+        return nil, fmt.Errorf("failed to find budgets: %w", err)
+    }
+    defer rows.Close()
+
+    budgets := make([]models.Budget, 0)
+    for rows.Next() {
+        budget, err := scanSQLiteBudget(rows)
+        if err != nil {
+            return nil, err
+        }
+        budgets = append(budgets, budget)
+    }
+    return budgets, rows.Err()
+}
+
+func (s *sqliteStore) GetBudget(tenant string) (models.Budget, error) {
+    budget, err := scanSQLiteBudget(s.db.QueryRow(`SELECT `+budgetColumns+` FROM budgets WHERE tenant = ?`, tenant))
+    if errors.Is(err, sql.ErrNoRows) {
+        return models.Budget{}, ErrNotFound
+    }
+    return budget, err
+}
+
+// scanSQLiteBudget reads a row of budgetColumns.
+func scanSQLiteBudget(row interface{ Scan(...any) error }) (models.Budget, error) {
+    var budget models.Budget
+    var updatedAt int64
+    err := row.Scan(
+        &budget.Tenant, &budget.DailyTokens, &budget.MonthlyTokens, &budget.DailyUSD, &budget.MonthlyUSD,
+        &budget.RequestsPerMinute, &updatedAt,
+    )
+    budget.UpdatedAt = time.Unix(0, updatedAt)
+    return budget, err
+}
+
+func (s *sqliteStore) SaveBudget(budget models.Budget) error {
+    _, err := s.db.Exec(
+        `INSERT INTO budgets (`+budgetColumns+`)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (tenant) DO UPDATE SET
+            daily_tokens = excluded.daily_tokens,
+            monthly_tokens = excluded.monthly_tokens,
+            daily_usd = excluded.daily_usd,
+            monthly_usd = excluded.monthly_usd,
+            requests_per_minute = excluded.requests_per_minute,
+            updated_at = excluded.updated_at`,
+        budget.Tenant, budget.DailyTokens, budget.MonthlyTokens, budget.DailyUSD, budget.MonthlyUSD,
+        budget.RequestsPerMinute, budget.UpdatedAt.UnixNano(),
+    )
+    return err
+}
+
+func (s *sqliteStore) DeleteBudget(tenant string) error {
+    result, err := s.db.Exec(`DELETE FROM budgets WHERE tenant = ?`, tenant)
+    if err != nil {
+        return err
+    }
+    deleted, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if deleted == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
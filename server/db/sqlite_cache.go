@@ -0,0 +1,344 @@
+package db
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+func (s *sqliteStore) GetCachedResponse(hash string) (models.CachedSamples, error) {
+    var id int64
+    var samples models.CachedSamples
+    err := s.db.QueryRow(
+        `SELECT id, sampled FROM cached_responses WHERE hash = ? AND (expires_at IS NULL OR expires_at > ?)`,
+        hash, time.Now().UnixNano(),
+    ).Scan(&id, &samples.Sampled)
+    if errors.Is(err, sql.ErrNoRows) {
+        return models.CachedSamples{}, ErrNotFound
+    }
+    if err != nil {
+        return models.CachedSamples{}, err
+    }
+    samples.EntryID = strconv.FormatInt(id, 10)
+
+    rows, err := s.db.Query(`SELECT response FROM cached_samples WHERE entry_id = ? ORDER BY timestamp, rowid`, id)
+    if err != nil {
+        return models.CachedSamples{}, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var encoded string
+        if err := rows.Scan(&encoded); err != nil {
+            return models.CachedSamples{}, err
+        }
+        var response openai.ChatCompletionResponse
+        if err := json.Unmarshal([]byte(encoded), &response); err != nil {
+            return models.CachedSamples{}, fmt.Errorf("failed to decode cached response: %w", err)
+        }
+        samples.Responses = append(samples.Responses, response)
+    }
+    if err := rows.Err(); err != nil {
+        return models.CachedSamples{}, err
+    }
+    if len(samples.Responses) == 0 {
+        return models.CachedSamples{}, ErrNotFound
+    }
+    return samples, nil
+}
+
+func (s *sqliteStore) CacheRequestResponse(entry models.CacheEntry, maxSamples int) error {
+    key, err := sampleKey(entry.Response)
+    if err != nil {
+        return err
+    }
+    response, err := json.Marshal(entry.Response)
+    if err != nil {
+        return fmt.Errorf("failed to encode response: %w", err)
+    }
+    var expiresAt *int64
+    if !entry.ExpiresAt.IsZero() {
+        unix := entry.ExpiresAt.UnixNano()
+        expiresAt = &unix
+    }
+
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    now := time.Now().UnixNano()
+    // An entry that expired but was not evicted yet is replaced, so its samples and expiry are not kept
+    _, err = tx.Exec(`DELETE FROM cached_responses WHERE hash = ? AND expires_at <= ?`, entry.Hash, now)
+    if err != nil {
+        return fmt.Errorf("failed to delete the expired cached response: %w", err)
+    }
+    var id int64
+    err = tx.QueryRow(
+        `INSERT INTO cached_responses (hash, hash_version, request_body, tenant, route, model, source, sampled, timestamp, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?, ?)
+        ON CONFLICT (hash) DO UPDATE SET sampled = sampled + 1
+        RETURNING id`,
+        entry.Hash, entry.HashVersion, string(entry.Request.Body), entry.Request.Tenant, entry.Request.Route,
+        entry.Request.Params.Model, entry.Source, now, expiresAt,
+    ).Scan(&id)
+    if err != nil {
+        return err
+    }
+
+    _, err = tx.Exec(
+        `INSERT OR IGNORE INTO cached_samples (entry_id, key, response, timestamp)
+        SELECT ?, ?, ?, ? WHERE (SELECT COUNT(*) FROM cached_samples WHERE entry_id = ?) < ?`,
+        id, key, string(response), now, id, maxSamples,
+    )
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (s *sqliteStore) EvictCachedResponses(maxEntries int64) (int64, error) {
+    result, err := s.db.Exec(
+        `DELETE FROM cached_responses WHERE id IN (
+            SELECT id FROM cached_responses ORDER BY timestamp
+            LIMIT MAX((SELECT COUNT(*) FROM cached_responses) - ?, 0)
+        )`,
+        maxEntries,
+    )
+    if err != nil {
+        return 0, fmt.Errorf("failed to evict cached responses: %w", err)
+    }
+    return result.RowsAffected()
+}
+
+func (s *sqliteStore) InvalidateCachedResponses(filter models.CacheFilter) (int64, error) {
+    query := `DELETE FROM cached_responses`
+    conditions, args := sqliteCacheConditions(filter)
+    if len(conditions) > 0 {
+        query += ` WHERE ` + strings.Join(conditions, " AND ")
+    }
+    result, err := s.db.Exec(query, args...)
+    if err != nil {
+        return 0, fmt.Errorf("failed to invalidate cached responses: %w", err)
+    }
+    return result.RowsAffected()
+}
+
+// sqliteCacheConditions turns a cache filter into conditions on cached_responses.
+func sqliteCacheConditions(filter models.CacheFilter) ([]string, []any) {
+    var conditions []string
+    var args []any
+    for _, condition := range []struct {
+        clause string
+        value  string
+    }{{"hash = ?", filter.Hash}, {"model = ?", filter.Model}, {"tenant = ?", filter.Tenant}} {
+        if condition.value != "" {
+            conditions = append(conditions, condition.clause)
+            args = append(args, condition.value)
+        }
+    }
+    if !filter.From.IsZero() {
+        conditions = append(conditions, "timestamp >= ?")
+        args = append(args, filter.From.UnixNano())
+    }
+    if !filter.To.IsZero() {
+        conditions = append(conditions, "timestamp < ?")
+        args = append(args, filter.To.UnixNano())
+    }
+    return conditions, args
+}
+
+// ExportCachedResponses calls onEntry with every unexpired entry matching filter, in the order
+// the entries were cached.
+func (s *sqliteStore) ExportCachedResponses(ctx context.Context, filter models.CacheFilter, onEntry func(models.CachedRequest) error) error {
+    conditions, args := sqliteCacheConditions(filter)
+    conditions = append(conditions,
+        "(expires_at IS NULL OR expires_at > ?)",
+        "EXISTS (SELECT 1 FROM cached_samples WHERE entry_id = cached_responses.id)",
+        "id > ?")
+    args = append(args, time.Now().UnixNano())
+
+    var after int64
+    for {
+        entries, lastID, err := s.exportPage(ctx, conditions, append(args[:len(args):len(args)], after, exportPageSize))
+        if err != nil {
+            return err
+        }
+        // The rows of the page are closed, so onEntry does not hold the only connection
+        for _, entry := range entries {
+            if err := onEntry(entry); err != nil {
+                return err
+            }
+        }
+        if len(entries) < exportPageSize {
+            return nil
+        }
+        after = lastID
+    }
+}
+
+// exportPage reads the next page of entries to export with their samples, and returns the id of the last one.
+func (s *sqliteStore) exportPage(ctx context.Context, conditions []string, args []any) ([]models.CachedRequest, int64, error) {
+    rows, err := s.db.QueryContext(ctx,
+        `SELECT r.id, r.hash, r.tenant, r.route, r.request_body, r.timestamp, s.response
+        FROM (SELECT * FROM cached_responses WHERE `+strings.Join(conditions, " AND ")+` ORDER BY id LIMIT ?) r
+        JOIN cached_samples s ON s.entry_id = r.id
+        ORDER BY r.id, s.timestamp, s.rowid`,
+        args...,
+    )
+    if err != nil {
+        return nil, 0, fmt.Errorf("failed to export cached responses: %w", err)
+    }
+    defer rows.Close()
+
+    var entries []models.CachedRequest
+    var entryID int64 = -1
+    for rows.Next() {
+        var id, cachedAt int64
+        var hash, tenant, route, body, encoded string
+        if err := rows.Scan(&id, &hash, &tenant, &route, &body, &cachedAt, &encoded); err != nil {
+            return nil, 0, fmt.Errorf("failed to read cached response: %w", err)
+        }
+        if id != entryID {
+            entryID = id
+            entries = append(entries, models.CachedRequest{
+                Hash:     hash,
+                Tenant:   tenant,
+                Route:    route,
+                Body:     json.RawMessage(body),
+                CachedAt: time.Unix(0, cachedAt),
+            })
+        }
+        var response openai.ChatCompletionResponse
+        if err := json.Unmarshal([]byte(encoded), &response); err != nil {
+            return nil, 0, fmt.Errorf("failed to decode cached response: %w", err)
+        }
+        entry := &entries[len(entries)-1]
+        entry.Responses = append(entry.Responses, response)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, 0, fmt.Errorf("failed to iterate cached responses: %w", err)
+    }
+    return entries, entryID, nil
+}
+
+// WatchCachedResponses is not supported; an embedded database has no other replicas to watch.
+func (s *sqliteStore) WatchCachedResponses(ctx context.Context, onChange func(models.CacheChange)) error {
+    return ErrUnsupported
+}
+
+func (s *sqliteStore) RehashCachedResponses(hashVersion int, rehash func(request models.ChatRequest) (string, error), all bool, dryRun bool) (RehashResult, error) {
+    var result RehashResult
+
+    query := `SELECT id, hash, hash_version, request_body, tenant, route FROM cached_responses`
+    var args []any
+    if !all {
+        query += ` WHERE hash_version != ?`
+        args = append(args, hashVersion)
+    }
+    rows, err := s.db.Query(query, args...)
+    if err != nil {
+        return result, fmt.Errorf("failed to find cached responses to rehash: %w", err)
+    }
+
+    // Read every entry first, since the single connection is needed for the updates
+    type cachedRequest struct {
+        id          int64
+        hash        string
+        hashVersion int
+        body        string
+        tenant      string
+        route       string
+    }
+    var entries []cachedRequest
+    for rows.Next() {
+        var entry cachedRequest
+        if err := rows.Scan(&entry.id, &entry.hash, &entry.hashVersion, &entry.body, &entry.tenant, &entry.route); err != nil {
+            rows.Close()
+            return result, fmt.Errorf("failed to read cached response: %w", err)
+        }
+        entries = append(entries, entry)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return result, fmt.Errorf("failed to iterate cached responses: %w", err)
+    }
+
+    for _, entry := range entries {
+        result.Scanned++
+
+        tenant := entry.tenant
+        if tenant == "" {
+            tenant = models.DefaultTenant
+        }
+        hash, err := rehash(models.ChatRequest{Body: json.RawMessage(entry.body), Tenant: tenant, Route: entry.route})
+        if err != nil {
+            logger.WarnLogger.Printf("Failed to rehash cached response %d: %v", entry.id, err)
+            result.Failed++
+            continue
+        }
+
+        // Entries the rules did not change are left alone
+        if hash == entry.hash && entry.hashVersion == hashVersion {
+            continue
+        }
+        if dryRun {
+            result.Updated++
+            continue
+        }
+
+        if err := s.rehashEntry(entry.id, hash, hashVersion); err != nil {
+            logger.WarnLogger.Printf("Failed to update cached response %d: %v", entry.id, err)
+            result.Failed++
+            continue
+        }
+        result.Updated++
+
+        if result.Scanned%1000 == 0 {
+            logger.InfoLogger.Printf("Rehashed %d cached responses so far", result.Updated)
+        }
+    }
+    return result, nil
+}
+
+// rehashEntry moves a cached response to a new hash. If another entry already has that hash,
+// the samples of both are the same request's and are merged into the other entry.
+func (s *sqliteStore) rehashEntry(id int64, hash string, hashVersion int) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var existing int64
+    err = tx.QueryRow(`SELECT id FROM cached_responses WHERE hash = ? AND id != ?`, hash, id).Scan(&existing)
+    switch {
+    case errors.Is(err, sql.ErrNoRows):
+        _, err = tx.Exec(`UPDATE cached_responses SET hash = ?, hash_version = ? WHERE id = ?`, hash, hashVersion, id)
+    case err == nil:
+        _, err = tx.Exec(`UPDATE OR IGNORE cached_samples SET entry_id = ? WHERE entry_id = ?`, existing, id)
+        if err == nil {
+            _, err = tx.Exec(
+                `UPDATE cached_responses SET sampled = sampled + (SELECT sampled FROM cached_responses WHERE id = ?) WHERE id = ?`,
+                id, existing,
+            )
+        }
+        if err == nil {
+            _, err = tx.Exec(`DELETE FROM cached_responses WHERE id = ?`, id)
+        }
+    }
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+)
+
+func (s *sqliteStore) SaveDeadLetter(deadLetter models.DeadLetter) error {
+    batchIDs, err := json.Marshal(deadLetter.BatchIDs)
+    if err != nil {
+        return fmt.Errorf("failed to encode batch ids: %w", err)
+    }
+
+    _, err = s.db.Exec(
+        `INSERT INTO dead_letters (hash, request, tenant, route, last_error, error_class, batch_ids, attempts, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (hash) DO UPDATE SET
+            request = excluded.request,
+            tenant = excluded.tenant,
+            route = excluded.route,
+            last_error = excluded.last_error,
+            error_class = excluded.error_class,
+            batch_ids = excluded.batch_ids,
+            attempts = excluded.attempts,
+            created_at = excluded.created_at`,
+        deadLetter.Hash, string(deadLetter.Request), deadLetter.Tenant, deadLetter.Route, deadLetter.LastError,
+        deadLetter.ErrorClass, string(batchIDs), deadLetter.Attempts, deadLetter.CreatedAt.UnixNano(),
+    )
+    return err
+}
+
+const deadLetterColumns = `hash, request, tenant, route, last_error, error_class, batch_ids, attempts, created_at`
+
+// scanDeadLetter reads a row of deadLetterColumns.
+func scanDeadLetter(row interface{ Scan(...any) error }) (models.DeadLetter, error) {
+    var deadLetter models.DeadLetter
+    var request, batchIDs string
+    var createdAt int64
+    err := row.Scan(
+        &deadLetter.Hash, &request, &deadLetter.Tenant, &deadLetter.Route, &deadLetter.LastError,
+        &deadLetter.ErrorClass, &batchIDs, &deadLetter.Attempts, &createdAt,
+    )
+    if err != nil {
+        return models.DeadLetter{}, err
+    }
+
+    if !json.Valid([]byte(request)) {
+        return models.DeadLetter{}, fmt.Errorf("dead letter %s does not hold a valid JSON request", deadLetter.Hash)
+    }
+    deadLetter.Request = json.RawMessage(request)
+    if err := json.Unmarshal([]byte(batchIDs), &deadLetter.BatchIDs); err != nil {
+        return models.DeadLetter{}, fmt.Errorf("failed to decode batch ids of dead letter %s: %w", deadLetter.Hash, err)
+    }
+    deadLetter.CreatedAt = time.Unix(0, createdAt)
+    return deadLetter, nil
+}
+
+func (s *sqliteStore) GetDeadLetters(limit int64) ([]models.DeadLetter, error) {
+    rows, err := s.db.Query(`SELECT `+deadLetterColumns+` FROM dead_letters ORDER BY created_at DESC LIMIT ?`, limit)
+    if err != nil {
+        return nil, fmt.Errorf("failed to find dead letters: %w", err)
+    }
+    defer rows.Close()
+
+    deadLetters := make([]models.DeadLetter, 0)
+    for rows.Next() {
+        deadLetter, err := scanDeadLetter(rows)
+        if err != nil {
+            return nil, err
+        }
+        deadLetters = append(deadLetters, deadLetter)
+    }
+    return deadLetters, rows.Err()
+}
+
+func (s *sqliteStore) GetDeadLetter(hash string) (models.DeadLetter, error) {
+    deadLetter, err := scanDeadLetter(s.db.QueryRow(`SELECT `+deadLetterColumns+` FROM dead_letters WHERE hash = ?`, hash))
+    if errors.Is(err, sql.ErrNoRows) {
+        return models.DeadLetter{}, ErrNotFound
+    }
+    return deadLetter, err
+}
+
+func (s *sqliteStore) DeleteDeadLetter(hash string) error {
+    result, err := s.db.Exec(`DELETE FROM dead_letters WHERE hash = ?`, hash)
+    if err != nil {
+        return err
+    }
+    deleted, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if deleted == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+func (s *sqliteStore) PurgeDeadLetters(before time.Time) (int64, error) {
+    query := `DELETE FROM dead_letters`
+    var args []any
+    if !before.IsZero() {
+        query += ` WHERE created_at < ?`
+        args = append(args, before.UnixNano())
+    }
+
+    result, err := s.db.Exec(query, args...)
+    if err != nil {
+        return 0, fmt.Errorf("failed to purge dead letters: %w", err)
+    }
+    return result.RowsAffected()
+}
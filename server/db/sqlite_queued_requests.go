@@ -0,0 +1,57 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "encoding/json"
+    "fmt"
+    "time"
+)
+
+func (s *sqliteStore) SaveQueuedRequest(request models.QueuedRequest) error {
+    _, err := s.db.Exec(
+        `INSERT INTO queued_requests (hash, request_body, tenant, route, cache_directive, cache_ttl, queued_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (hash) DO UPDATE SET
+            request_body = excluded.request_body,
+            tenant = excluded.tenant,
+            route = excluded.route,
+            cache_directive = excluded.cache_directive,
+            cache_ttl = excluded.cache_ttl,
+            queued_at = excluded.queued_at`,
+        request.Hash, string(request.Body), request.Tenant, request.Route, string(request.CacheDirective),
+        int64(request.CacheTTL), request.QueuedAt.UnixNano(),
+    )
+    return err
+}
+
+func (s *sqliteStore) DeleteQueuedRequest(hash string, queuedAt time.Time) error {
+    _, err := s.db.Exec(`DELETE FROM queued_requests WHERE hash = ? AND queued_at = ?`, hash, queuedAt.UnixNano())
+    return err
+}
+
+func (s *sqliteStore) GetQueuedRequests() ([]models.QueuedRequest, error) {
+    rows, err := s.db.Query(
+        `SELECT hash, request_body, tenant, route, cache_directive, cache_ttl, queued_at
+        FROM queued_requests ORDER BY queued_at, hash`,
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to find queued requests: %w", err)
+    }
+    defer rows.Close()
+
+    requests := make([]models.QueuedRequest, 0)
+    for rows.Next() {
+        var request models.QueuedRequest
+        var body, directive string
+        var cacheTTL, queuedAt int64
+        if err := rows.Scan(&request.Hash, &body, &request.Tenant, &request.Route, &directive, &cacheTTL, &queuedAt); err != nil {
+            return nil, err
+        }
+        request.Body = json.RawMessage(body)
+        request.CacheDirective = models.CacheDirective(directive)
+        request.CacheTTL = time.Duration(cacheTTL)
+        request.QueuedAt = time.Unix(0, queuedAt)
+        requests = append(requests, request)
+    }
+    return requests, rows.Err()
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+    "path/filepath"
+    "testing"
+)
+
+func newTestSQLiteStore(t *testing.T) Store {
+    t.Helper()
+    store, err := newSQLiteStore(filepath.Join(t.TempDir(), "batchgpt.db"))
+    if err != nil {
+        t.Fatalf("newSQLiteStore() error = %v", err)
+    }
+    t.Cleanup(func() { store.Close() })
+    if _, err := store.Migrate(); err != nil {
+        t.Fatalf("Migrate() error = %v", err)
+    }
+    return store
+}
+
+func TestSQLiteBudgets(t *testing.T) { testStoreBudgets(t, newTestSQLiteStore) }
+
+func TestSQLiteUsage(t *testing.T) { testStoreUsage(t, newTestSQLiteStore) }
+
+func TestSQLiteCacheSamples(t *testing.T) { testStoreCacheSamples(t, newTestSQLiteStore) }
+
+func TestSQLiteCacheExpiry(t *testing.T) { testStoreCacheExpiry(t, newTestSQLiteStore) }
+
+func TestSQLiteInvalidateCachedResponses(t *testing.T) {
+    testStoreInvalidateCachedResponses(t, newTestSQLiteStore)
+}
+
+func TestSQLiteExportCachedResponses(t *testing.T) { testStoreExportCachedResponses(t, newTestSQLiteStore) }
+
+func TestSQLiteBatchStatuses(t *testing.T) { testStoreBatchStatuses(t, newTestSQLiteStore) }
+func TestSQLiteTrackBatch(t *testing.T) { testStoreTrackBatch(t, newTestSQLiteStore) }
+
+func TestSQLiteQueuedRequests(t *testing.T) { testStoreQueuedRequests(t, newTestSQLiteStore) }
@@ -0,0 +1,72 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "fmt"
+    "strings"
+)
+
+func (s *sqliteStore) RecordUsage(records []models.UsageRecord) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    for _, record := range records {
+        _, err := tx.Exec(
+            `INSERT INTO daily_usage (day, tenant, model, source, requests, prompt_tokens, completion_tokens)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (day, tenant, model, source) DO UPDATE SET
+                requests = requests + excluded.requests,
+                prompt_tokens = prompt_tokens + excluded.prompt_tokens,
+                completion_tokens = completion_tokens + excluded.completion_tokens`,
+            record.Day, record.Tenant, record.Model, record.Source, record.Requests, record.PromptTokens, record.CompletionTokens,
+        )
+        if err != nil {
+            return fmt.Errorf("failed to record usage: %w", err)
+        }
+    }
+    return tx.Commit()
+}
+
+func (s *sqliteStore) GetUsage(filter models.UsageFilter) ([]models.UsageRecord, error) {
+    var conditions []string
+    var args []any
+    for _, condition := range []struct {
+        clause string
+        value  string
+    }{
+        {"tenant = ?", filter.Tenant},
+        {"model = ?", filter.Model},
+        {"day >= ?", filter.From},
+        {"day <= ?", filter.To},
+    } {
+        if condition.value != "" {
+            conditions = append(conditions, condition.clause)
+            args = append(args, condition.value)
+        }
+    }
+    query := `SELECT day, tenant, model, source, requests, prompt_tokens, completion_tokens FROM daily_usage`
+    if len(conditions) > 0 {
+        query += ` WHERE ` + strings.Join(conditions, ` AND `)
+    }
+    query += ` ORDER BY day, tenant, model, source`
+
+    rows, err := s.db.Query(query, args...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to find usage: %w", err)
+    }
+    defer rows.Close()
+
+    records := make([]models.UsageRecord, 0)
+    for rows.Next() {
+        var record models.UsageRecord
+        err := rows.Scan(&record.Day, &record.Tenant, &record.Model, &record.Source, &record.Requests, &record.PromptTokens, &record.CompletionTokens)
+        if err != nil {
+            return nil, err
+        }
+        records = append(records, record)
+    }
+    return records, rows.Err()
+}
@@ -0,0 +1,516 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "testing"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// The tests of this file run against every SQL backend; newStore opens an empty, migrated store.
+
+func testCacheEntry(hash, tenant, model, content string) models.CacheEntry {
+    return models.CacheEntry{
+        Hash:        hash,
+        HashVersion: 1,
+        Request: models.ChatRequest{
+            Body:   []byte(fmt.Sprintf(`{"model":%q,"messages":[]}`, model)),
+            Params: openai.ChatCompletionRequest{Model: model},
+            Tenant: tenant,
+            Route:  "/v1/chat/completions",
+        },
+        Response: openai.ChatCompletionResponse{
+            Model:   model,
+            Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Role: "assistant", Content: content}}},
+        },
+    }
+}
+
+func testStoreBudgets(t *testing.T, newStore func(t *testing.T) Store) {
+    store := newStore(t)
+
+    if _, err := store.GetBudget("acme"); !errors.Is(err, ErrNotFound) {
+        t.Fatalf("GetBudget() of a tenant without a budget: error = %v, want %v", err, ErrNotFound)
+    }
+
+    tests := []struct {
+        name string
+        save models.Budget
+        want models.Budget
+    }{
+        {
+            name: "new budget",
+            save: models.Budget{Tenant: "acme", DailyTokens: 1000, MonthlyUSD: 12.5, RequestsPerMinute: 60},
+            want: models.Budget{Tenant: "acme", DailyTokens: 1000, MonthlyUSD: 12.5, RequestsPerMinute: 60},
+        },
+        {
+            name: "replaced budget",
+            save: models.Budget{Tenant: "acme", MonthlyTokens: 5000, DailyUSD: 1.25},
+            want: models.Budget{Tenant: "acme", MonthlyTokens: 5000, DailyUSD: 1.25},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if err := store.SaveBudget(tt.save); err != nil {
+                t.Fatalf("SaveBudget() error = %v", err)
+            }
+            got, err := store.GetBudget(tt.save.Tenant)
+            if err != nil {
+                t.Fatalf("GetBudget() error = %v", err)
+            }
+            got.UpdatedAt = time.Time{}
+            if got != tt.want {
+                t.Errorf("GetBudget() = %+v, want %+v", got, tt.want)
+            }
+        })
+    }
+
+    if err := store.SaveBudget(models.Budget{Tenant: "globex", DailyTokens: 1}); err != nil {
+        t.Fatalf("SaveBudget() error = %v", err)
+    }
+    if budgets, err := store.GetBudgets(); err != nil || len(budgets) != 2 {
+        t.Errorf("GetBudgets() = %d budgets, %v, want 2", len(budgets), err)
+    }
+    if err := store.DeleteBudget("acme"); err != nil {
+        t.Fatalf("DeleteBudget() error = %v", err)
+    }
+    if _, err := store.GetBudget("acme"); !errors.Is(err, ErrNotFound) {
+        t.Errorf("GetBudget() after DeleteBudget: error = %v, want %v", err, ErrNotFound)
+    }
+}
+
+func testStoreUsage(t *testing.T, newStore func(t *testing.T) Store) {
+    store := newStore(t)
+    records := []models.UsageRecord{
+        {Day: "2024-05-01", Tenant: "acme", Model: "gpt-4o", Source: models.UsageSourceBatch, Requests: 1, PromptTokens: 10, CompletionTokens: 5},
+        {Day: "2024-05-01", Tenant: "acme", Model: "gpt-4o", Source: models.UsageSourceCache, Requests: 1, PromptTokens: 10, CompletionTokens: 5},
+        {Day: "2024-05-02", Tenant: "acme", Model: "gpt-4o-mini", Source: models.UsageSourceBatch, Requests: 2, PromptTokens: 20, CompletionTokens: 8},
+        {Day: "2024-05-03", Tenant: "globex", Model: "gpt-4o", Source: models.UsageSourceBatch, Requests: 1, PromptTokens: 7, CompletionTokens: 3},
+    }
+    if err := store.RecordUsage(records); err != nil {
+        t.Fatalf("RecordUsage() error = %v", err)
+    }
+    // Recording the same day, tenant, model and source again adds to the counts
+    if err := store.RecordUsage(records[:1]); err != nil {
+        t.Fatalf("RecordUsage() error = %v", err)
+    }
+
+    tests := []struct {
+        name       string
+        filter     models.UsageFilter
+        wantDays   []string
+        wantPrompt int64
+    }{
+        {name: "everything", filter: models.UsageFilter{}, wantDays: []string{"2024-05-01", "2024-05-01", "2024-05-02", "2024-05-03"}, wantPrompt: 57},
+        {name: "tenant", filter: models.UsageFilter{Tenant: "acme"}, wantDays: []string{"2024-05-01", "2024-05-01", "2024-05-02"}, wantPrompt: 50},
+        {name: "model", filter: models.UsageFilter{Model: "gpt-4o-mini"}, wantDays: []string{"2024-05-02"}, wantPrompt: 20},
+        {name: "days", filter: models.UsageFilter{From: "2024-05-02", To: "2024-05-03"}, wantDays: []string{"2024-05-02", "2024-05-03"}, wantPrompt: 27},
+        {name: "nothing", filter: models.UsageFilter{Tenant: "initech"}, wantDays: []string{}, wantPrompt: 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := store.GetUsage(tt.filter)
+            if err != nil {
+                t.Fatalf("GetUsage() error = %v", err)
+            }
+            if len(got) != len(tt.wantDays) {
+                t.Fatalf("GetUsage() = %d records, want %d", len(got), len(tt.wantDays))
+            }
+            var prompt int64
+            for i, record := range got {
+                if record.Day != tt.wantDays[i] {
+                    t.Errorf("record %d day = %s, want %s", i, record.Day, tt.wantDays[i])
+                }
+                prompt += record.PromptTokens
+            }
+            if prompt != tt.wantPrompt {
+                t.Errorf("prompt tokens = %d, want %d", prompt, tt.wantPrompt)
+            }
+        })
+    }
+}
+
+func testStoreCacheSamples(t *testing.T, newStore func(t *testing.T) Store) {
+    tests := []struct {
+        name        string
+        contents    []string
+        maxSamples  int
+        wantSamples []string
+        wantSampled int
+    }{
+        {name: "one response", contents: []string{"a"}, maxSamples: 3, wantSamples: []string{"a"}, wantSampled: 1},
+        {name: "repeated response", contents: []string{"a", "a"}, maxSamples: 3, wantSamples: []string{"a"}, wantSampled: 2},
+        {name: "distinct responses", contents: []string{"a", "b", "a"}, maxSamples: 3, wantSamples: []string{"a", "b"}, wantSampled: 3},
+        {name: "capped samples", contents: []string{"a", "b", "c"}, maxSamples: 2, wantSamples: []string{"a", "b"}, wantSampled: 3},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store := newStore(t)
+            for _, content := range tt.contents {
+                if err := store.CacheRequestResponse(testCacheEntry("hash", "acme", "gpt-4o", content), tt.maxSamples); err != nil {
+                    t.Fatalf("CacheRequestResponse() error = %v", err)
+                }
+            }
+
+            got, err := store.GetCachedResponse("hash")
+            if err != nil {
+                t.Fatalf("GetCachedResponse() error = %v", err)
+            }
+            if got.Sampled != tt.wantSampled {
+                t.Errorf("sampled = %d, want %d", got.Sampled, tt.wantSampled)
+            }
+            if len(got.Responses) != len(tt.wantSamples) {
+                t.Fatalf("GetCachedResponse() = %d samples, want %d", len(got.Responses), len(tt.wantSamples))
+            }
+            for i, response := range got.Responses {
+                if content := response.Choices[0].Message.Content; content != tt.wantSamples[i] {
+                    t.Errorf("sample %d = %q, want %q", i, content, tt.wantSamples[i])
+                }
+            }
+        })
+    }
+}
+
+func testStoreCacheExpiry(t *testing.T, newStore func(t *testing.T) Store) {
+    store := newStore(t)
+    entry := testCacheEntry("expired", "acme", "gpt-4o", "a")
+    entry.ExpiresAt = time.Now().Add(-time.Minute)
+    if err := store.CacheRequestResponse(entry, 1); err != nil {
+        t.Fatalf("CacheRequestResponse() error = %v", err)
+    }
+    if _, err := store.GetCachedResponse("expired"); !errors.Is(err, ErrNotFound) {
+        t.Errorf("GetCachedResponse() of an expired entry: error = %v, want %v", err, ErrNotFound)
+    }
+    if _, err := store.GetCachedResponse("missing"); !errors.Is(err, ErrNotFound) {
+        t.Errorf("GetCachedResponse() of a missing entry: error = %v, want %v", err, ErrNotFound)
+    }
+
+    // Caching a response again replaces the expired entry rather than adding to it
+    entry = testCacheEntry("expired", "acme", "gpt-4o", "b")
+    entry.ExpiresAt = time.Now().Add(time.Hour)
+    if err := store.CacheRequestResponse(entry, 1); err != nil {
+        t.Fatalf("CacheRequestResponse() error = %v", err)
+    }
+    got, err := store.GetCachedResponse("expired")
+    if err != nil {
+        t.Fatalf("GetCachedResponse() of a re-cached entry: error = %v", err)
+    }
+    if got.Sampled != 1 || len(got.Responses) != 1 || got.Responses[0].Choices[0].Message.Content != "b" {
+        t.Errorf("GetCachedResponse() of a re-cached entry = %d sampled, %v, want the new response only", got.Sampled, got.Responses)
+    }
+}
+
+func testStoreInvalidateCachedResponses(t *testing.T, newStore func(t *testing.T) Store) {
+    tests := []struct {
+        name       string
+        filter     models.CacheFilter
+        wantLeft   []string
+    }{
+        {name: "everything", filter: models.CacheFilter{}, wantLeft: nil},
+        {name: "hash", filter: models.CacheFilter{Hash: "acme-4o"}, wantLeft: []string{"acme-mini", "globex-4o"}},
+        {name: "tenant", filter: models.CacheFilter{Tenant: "acme"}, wantLeft: []string{"globex-4o"}},
+        {name: "model", filter: models.CacheFilter{Model: "gpt-4o"}, wantLeft: []string{"acme-mini"}},
+        {name: "tenant and model", filter: models.CacheFilter{Tenant: "acme", Model: "gpt-4o"}, wantLeft: []string{"acme-mini", "globex-4o"}},
+        {name: "cached later", filter: models.CacheFilter{From: time.Now().Add(time.Hour)}, wantLeft: []string{"acme-4o", "acme-mini", "globex-4o"}},
+        {name: "cached earlier", filter: models.CacheFilter{To: time.Now().Add(time.Hour)}, wantLeft: nil},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store := newStore(t)
+            entries := []models.CacheEntry{
+                testCacheEntry("acme-4o", "acme", "gpt-4o", "a"),
+                testCacheEntry("acme-mini", "acme", "gpt-4o-mini", "a"),
+                testCacheEntry("globex-4o", "globex", "gpt-4o", "a"),
+            }
+            for _, entry := range entries {
+                if err := store.CacheRequestResponse(entry, 1); err != nil {
+                    t.Fatalf("CacheRequestResponse() error = %v", err)
+                }
+            }
+
+            deleted, err := store.InvalidateCachedResponses(tt.filter)
+            if err != nil {
+                t.Fatalf("InvalidateCachedResponses() error = %v", err)
+            }
+            if want := int64(len(entries) - len(tt.wantLeft)); deleted != want {
+                t.Errorf("InvalidateCachedResponses() = %d, want %d", deleted, want)
+            }
+            for _, hash := range tt.wantLeft {
+                if _, err := store.GetCachedResponse(hash); err != nil {
+                    t.Errorf("GetCachedResponse(%s) error = %v, want it kept", hash, err)
+                }
+            }
+        })
+    }
+}
+
+func testStoreExportCachedResponses(t *testing.T, newStore func(t *testing.T) Store) {
+    store := newStore(t)
+    // More entries than fit a page, so the export reads several
+    entries := 2*exportPageSize + 3
+    for i := 0; i < entries; i++ {
+        tenant := "acme"
+        if i%2 == 1 {
+            tenant = "globex"
+        }
+        if err := store.CacheRequestResponse(testCacheEntry(fmt.Sprintf("hash-%04d", i), tenant, "gpt-4o", "a"), 2); err != nil {
+            t.Fatalf("CacheRequestResponse() error = %v", err)
+        }
+    }
+    if err := store.CacheRequestResponse(testCacheEntry("hash-0000", "acme", "gpt-4o", "b"), 2); err != nil {
+        t.Fatalf("CacheRequestResponse() error = %v", err)
+    }
+
+    tests := []struct {
+        name      string
+        filter    models.CacheFilter
+        wantCount int
+    }{
+        {name: "everything", filter: models.CacheFilter{}, wantCount: entries},
+        {name: "tenant", filter: models.CacheFilter{Tenant: "acme"}, wantCount: (entries + 1) / 2},
+        {name: "hash", filter: models.CacheFilter{Hash: "hash-0000"}, wantCount: 1},
+        {name: "nothing", filter: models.CacheFilter{Model: "gpt-4o-mini"}, wantCount: 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var exported []models.CachedRequest
+            err := store.ExportCachedResponses(context.Background(), tt.filter, func(entry models.CachedRequest) error {
+                // The store stays usable while an entry is handled
+                if _, err := store.GetCachedResponse(entry.Hash); err != nil {
+                    return err
+                }
+                exported = append(exported, entry)
+                return nil
+            })
+            if err != nil {
+                t.Fatalf("ExportCachedResponses() error = %v", err)
+            }
+            if len(exported) != tt.wantCount {
+                t.Fatalf("ExportCachedResponses() = %d entries, want %d", len(exported), tt.wantCount)
+            }
+            for i := 1; i < len(exported); i++ {
+                if exported[i].Hash <= exported[i-1].Hash {
+                    t.Fatalf("entry %d (%s) exported after %s", i, exported[i].Hash, exported[i-1].Hash)
+                }
+            }
+            if len(exported) > 0 && exported[0].Hash == "hash-0000" && len(exported[0].Responses) != 2 {
+                t.Errorf("hash-0000 exported with %d samples, want 2", len(exported[0].Responses))
+            }
+        })
+    }
+
+    stop := errors.New("stop")
+    calls := 0
+    err := store.ExportCachedResponses(context.Background(), models.CacheFilter{}, func(models.CachedRequest) error {
+        calls++
+        return stop
+    })
+    if !errors.Is(err, stop) || calls != 1 {
+        t.Errorf("ExportCachedResponses() = %v after %d calls, want %v after 1", err, calls, stop)
+    }
+}
+
+func testStoreBatchStatuses(t *testing.T, newStore func(t *testing.T) Store) {
+    store := newStore(t)
+    updates := []struct {
+        id        string
+        status    string
+        completed int
+    }{
+        {"batch_a", "validating", 0},
+        {"batch_a", "in_progress", 0},
+        {"batch_a", "in_progress", 0},
+        {"batch_a", "in_progress", 5},
+        {"batch_a", "completed", 10},
+        {"batch_b", "in_progress", 0},
+        {"batch_c", "finalizing", 0},
+        {"batch_d", "failed", 0},
+    }
+    for _, update := range updates {
+        batch := openai.BatchResponse{Batch: openai.Batch{
+            ID:            update.id,
+            Status:        update.status,
+            RequestCounts: openai.BatchRequestCounts{Total: 10, Completed: update.completed},
+        }}
+        if err := store.LogBatchStatus(batch); err != nil {
+            t.Fatalf("LogBatchStatus() error = %v", err)
+        }
+    }
+
+    tests := []struct {
+        id          string
+        wantStatus  string
+        wantHistory []string
+    }{
+        {id: "batch_a", wantStatus: "completed", wantHistory: []string{"validating", "in_progress", "in_progress", "completed"}},
+        {id: "batch_b", wantStatus: "in_progress", wantHistory: []string{"in_progress"}},
+        {id: "batch_d", wantStatus: "failed", wantHistory: []string{"failed"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.id, func(t *testing.T) {
+            latest, err := store.GetLatestBatchStatus(tt.id)
+            if err != nil {
+                t.Fatalf("GetLatestBatchStatus() error = %v", err)
+            }
+            if latest.Status != tt.wantStatus {
+                t.Errorf("status = %s, want %s", latest.Status, tt.wantStatus)
+            }
+            history, err := store.GetBatchHistory(tt.id)
+            if err != nil {
+                t.Fatalf("GetBatchHistory() error = %v", err)
+            }
+            if len(history) != len(tt.wantHistory) {
+                t.Fatalf("GetBatchHistory() = %d transitions, want %d", len(history), len(tt.wantHistory))
+            }
+            for i, transition := range history {
+                if transition.Status != tt.wantHistory[i] {
+                    t.Errorf("transition %d = %s, want %s", i, transition.Status, tt.wantHistory[i])
+                }
+            }
+        })
+    }
+
+    if _, err := store.GetLatestBatchStatus("batch_missing"); !errors.Is(err, ErrNotFound) {
+        t.Errorf("GetLatestBatchStatus() of a missing batch: error = %v, want %v", err, ErrNotFound)
+    }
+
+    pages := []struct {
+        after string
+        limit int
+        want  []string
+    }{
+        {after: "", limit: 10, want: []string{"batch_b", "batch_c"}},
+        {after: "", limit: 1, want: []string{"batch_b"}},
+        {after: "batch_b", limit: 1, want: []string{"batch_c"}},
+        {after: "batch_c", limit: 1, want: []string{}},
+    }
+    for _, page := range pages {
+        dangling, err := store.GetDanglingBatches(page.after, page.limit)
+        if err != nil {
+            t.Fatalf("GetDanglingBatches() error = %v", err)
+        }
+        var got []string
+        for _, batch := range dangling {
+            got = append(got, batch.ID)
+        }
+        if fmt.Sprint(got) != fmt.Sprint(page.want) {
+            t.Errorf("GetDanglingBatches(%q, %d) = %v, want %v", page.after, page.limit, got, page.want)
+        }
+    }
+}
+
+func testStoreTrackBatch(t *testing.T, newStore func(t *testing.T) Store) {
+    store := newStore(t)
+    imported := openai.BatchResponse{Batch: openai.Batch{
+        ID:       "batch_imported",
+        Status:   "in_progress",
+        Metadata: map[string]any{"batch_gpt_tenants": "acme", "owner": "data-science"},
+    }}
+    if err := store.TrackBatch(imported); err != nil {
+        t.Fatalf("TrackBatch() error = %v", err)
+    }
+    if err := store.TrackBatch(imported); !errors.Is(err, ErrAlreadyExists) {
+        t.Errorf("TrackBatch() of a tracked batch: error = %v, want %v", err, ErrAlreadyExists)
+    }
+    if err := store.LogBatchStatus(openai.BatchResponse{Batch: openai.Batch{ID: "batch_logged", Status: "validating"}}); err != nil {
+        t.Fatalf("LogBatchStatus() error = %v", err)
+    }
+    if err := store.TrackBatch(openai.BatchResponse{Batch: openai.Batch{ID: "batch_logged"}}); !errors.Is(err, ErrAlreadyExists) {
+        t.Errorf("TrackBatch() of a logged batch: error = %v, want %v", err, ErrAlreadyExists)
+    }
+
+    // Statuses polled later carry the metadata of the batch upstream only
+    polled := openai.BatchResponse{Batch: openai.Batch{
+        ID:       "batch_imported",
+        Status:   "completed",
+        Metadata: map[string]any{"owner": "research"},
+    }}
+    if err := store.LogBatchStatus(polled); err != nil {
+        t.Fatalf("LogBatchStatus() error = %v", err)
+    }
+    latest, err := store.GetLatestBatchStatus("batch_imported")
+    if err != nil {
+        t.Fatalf("GetLatestBatchStatus() error = %v", err)
+    }
+    want := map[string]any{"batch_gpt_tenants": "acme", "owner": "research"}
+    if latest.Status != "completed" || fmt.Sprint(latest.Metadata) != fmt.Sprint(want) {
+        t.Errorf("GetLatestBatchStatus() = %s with %v, want completed with %v", latest.Status, latest.Metadata, want)
+    }
+    if len(polled.Metadata) != 1 {
+        t.Errorf("LogBatchStatus() changed the metadata it was given to %v", polled.Metadata)
+    }
+
+    history, err := store.GetBatchHistory("batch_imported")
+    if err != nil {
+        t.Fatalf("GetBatchHistory() error = %v", err)
+    }
+    if len(history) != 2 || history[0].Status != "in_progress" || history[1].Status != "completed" {
+        t.Errorf("GetBatchHistory() = %+v, want in_progress then completed", history)
+    }
+}
+
+func testStoreQueuedRequests(t *testing.T, newStore func(t *testing.T) Store) {
+    store := newStore(t)
+    queuedAt := time.Now().UTC().Truncate(time.Millisecond)
+    requests := []models.QueuedRequest{
+        {Hash: "later", Body: []byte(`{"model":"gpt-4o","messages":[]}`), Tenant: "acme", Route: "/v1/chat/completions", QueuedAt: queuedAt},
+        {
+            Hash:           "earlier",
+            Body:           []byte(`{"model":"gpt-4o-mini","messages":[],"new_param":1}`),
+            Tenant:         "globex",
+            Route:          "/v1/chat/completions",
+            CacheDirective: models.CacheBypass,
+            CacheTTL:       90 * time.Second,
+            QueuedAt:       queuedAt.Add(-time.Minute),
+        },
+    }
+    for _, request := range requests {
+        if err := store.SaveQueuedRequest(request); err != nil {
+            t.Fatalf("SaveQueuedRequest() error = %v", err)
+        }
+    }
+
+    got, err := store.GetQueuedRequests()
+    if err != nil {
+        t.Fatalf("GetQueuedRequests() error = %v", err)
+    }
+    if len(got) != 2 || got[0].Hash != "earlier" || got[1].Hash != "later" {
+        t.Fatalf("GetQueuedRequests() = %+v, want earlier and later", got)
+    }
+    want := requests[1]
+    if got[0].Tenant != want.Tenant || got[0].Route != want.Route || got[0].CacheDirective != want.CacheDirective ||
+        got[0].CacheTTL != want.CacheTTL || !got[0].QueuedAt.Equal(want.QueuedAt) {
+        t.Errorf("GetQueuedRequests() = %+v, want %+v", got[0], want)
+    }
+    var body map[string]any
+    if err := json.Unmarshal(got[0].Body, &body); err != nil || body["new_param"] != float64(1) {
+        t.Errorf("body = %s, want the stored request with its unknown fields", got[0].Body)
+    }
+
+    // Queuing a request again replaces it, and removing the earlier one keeps the new one
+    requeued := requests[0]
+    requeued.QueuedAt = queuedAt.Add(time.Second)
+    if err := store.SaveQueuedRequest(requeued); err != nil {
+        t.Fatalf("SaveQueuedRequest() error = %v", err)
+    }
+    if err := store.DeleteQueuedRequest("later", queuedAt); err != nil {
+        t.Fatalf("DeleteQueuedRequest() error = %v", err)
+    }
+    if got, _ := store.GetQueuedRequests(); len(got) != 2 {
+        t.Errorf("GetQueuedRequests() after removing a replaced request = %d requests, want 2", len(got))
+    }
+
+    for _, request := range []models.QueuedRequest{requeued, requests[1], requests[1]} {
+        if err := store.DeleteQueuedRequest(request.Hash, request.QueuedAt); err != nil {
+            t.Fatalf("DeleteQueuedRequest() error = %v", err)
+        }
+    }
+    if got, _ := store.GetQueuedRequests(); len(got) != 0 {
+        t.Errorf("GetQueuedRequests() after removing every request = %+v, want none", got)
+    }
+}
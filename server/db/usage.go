@@ -0,0 +1,95 @@
+package db
+
+import (
+    "batch-gpt/server/models"
+    "context"
+    "fmt"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type usageDocument struct {
+    Day              string `bson:"day"`
+    Tenant           string `bson:"tenant"`
+    Model            string `bson:"model"`
+    Source           string `bson:"source"`
+    Requests         int64  `bson:"requests"`
+    PromptTokens     int64  `bson:"prompt_tokens"`
+    CompletionTokens int64  `bson:"completion_tokens"`
+}
+
+func (s *mongoStore) RecordUsage(records []models.UsageRecord) error {
+    if len(records) == 0 {
+        return nil
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    writes := make([]mongo.WriteModel, 0, len(records))
+    for _, record := range records {
+        writes = append(writes, mongo.NewUpdateOneModel().
+            SetFilter(bson.M{"day": record.Day, "tenant": record.Tenant, "model": record.Model, "source": record.Source}).
+            SetUpdate(bson.M{"$inc": bson.M{
+                "requests":          record.Requests,
+                "prompt_tokens":     record.PromptTokens,
+                "completion_tokens": record.CompletionTokens,
+            }}).
+            SetUpsert(true))
+    }
+    if _, err := s.dailyUsageCollection.BulkWrite(ctx, writes); err != nil {
+        return fmt.Errorf("failed to record usage: %w", err)
+    }
+    return nil
+}
+
+func (s *mongoStore) GetUsage(filter models.UsageFilter) ([]models.UsageRecord, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    query := bson.M{}
+    if filter.Tenant != "" {
+        query["tenant"] = filter.Tenant
+    }
+    if filter.Model != "" {
+        query["model"] = filter.Model
+    }
+    days := bson.M{}
+    if filter.From != "" {
+        days["$gte"] = filter.From
+    }
+    if filter.To != "" {
+        days["$lte"] = filter.To
+    }
+    if len(days) > 0 {
+        query["day"] = days
+    }
+
+    cursor, err := s.dailyUsageCollection.Find(
+        ctx,
+        query,
+        options.Find().SetSort(bson.D{
+            {Key: "day", Value: 1},
+            {Key: "tenant", Value: 1},
+            {Key: "model", Value: 1},
+            {Key: "source", Value: 1},
+        }),
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to find usage: %w", err)
+    }
+    defer cursor.Close(ctx)
+
+    var documents []usageDocument
+    if err = cursor.All(ctx, &documents); err != nil {
+        return nil, fmt.Errorf("failed to decode usage: %w", err)
+    }
+
+    records := make([]models.UsageRecord, 0, len(documents))
+    for _, document := range documents {
+        records = append(records, models.UsageRecord(document))
+    }
+    return records, nil
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+    "crypto/subtle"
+    "net/http"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// NewAdminAuthMiddleware requires admin requests to carry "Authorization: Bearer <adminAPIKey>".
+// If adminAPIKey is empty, every admin request is rejected.
+func NewAdminAuthMiddleware(adminAPIKey string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+        if adminAPIKey == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminAPIKey)) != 1 {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: "Invalid admin API key",
+                },
+            })
+            return
+        }
+        c.Next()
+    }
+}
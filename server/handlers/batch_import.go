@@ -0,0 +1,48 @@
+package handlers
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "batch-gpt/services/batch"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+    openai "github.com/sashabaranov/go-openai"
+)
+
+type importBatchesRequest struct {
+    BatchIDs []string `json:"batch_ids"`
+    Tenant   string   `json:"tenant"`
+}
+
+// NewImportBatchesHandler returns a handler that imports batches created outside batch-gpt,
+// caching their responses for the tenant named in the request. Each batch is reported on
+// separately; batches that have not finished are reported as pending and cached once they do.
+func NewImportBatchesHandler(batchOrch batch.Orchestrator) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var request importBatchesRequest
+        if err := c.ShouldBindJSON(&request); err != nil || len(request.BatchIDs) == 0 {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: "Request body must list the batches to import in batch_ids",
+                },
+            })
+            return
+        }
+
+        imports := make([]models.BatchImport, 0, len(request.BatchIDs))
+        for _, batchID := range request.BatchIDs {
+            imported, err := batchOrch.ImportBatch(batchID, request.Tenant, false)
+            if err != nil {
+                logger.WarnLogger.Printf("Failed to import batch %s: %v", batchID, err)
+                imported.Error = err.Error()
+            }
+            imports = append(imports, imported)
+        }
+
+        c.JSON(http.StatusOK, gin.H{
+            "data": imports,
+        })
+    }
+}
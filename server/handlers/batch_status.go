@@ -4,138 +4,176 @@ import (
 	"batch-gpt/server/db"
 	"batch-gpt/server/logger"
 	"batch-gpt/services/client"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	openai "github.com/sashabaranov/go-openai"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func HandleRetrieveBatch(c *gin.Context) {
-    batchID := strings.TrimPrefix(c.Param("batch_id"), "/")
-    if batchID == "" {
-    c.JSON(http.StatusBadRequest, openai.ErrorResponse{
-	        Error: &openai.APIError{
-	            Type: "invalid_request_error",
-	            Message: "Missing batch_id parameter",
-	        },
-	    })
-	    return
+func NewRetrieveBatchHandler(store db.BatchStore) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        batchID := strings.TrimPrefix(c.Param("batch_id"), "/")
+        if batchID == "" {
+        c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+    	        Error: &openai.APIError{
+    	            Type: "invalid_request_error",
+    	            Message: "Missing batch_id parameter",
+    	        },
+    	    })
+    	    return
+        }
+
+        batchStatus, err := store.GetLatestBatchStatus(batchID)
+        if err != nil {
+            if errors.Is(err, db.ErrNotFound) {
+                c.JSON(http.StatusNotFound, openai.ErrorResponse{
+                    Error: &openai.APIError{
+                        Type: "invalid_request_error",
+                        Message: "No such batch",
+                    },
+                })
+            } else {
+                c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
+                    Error: &openai.APIError{
+                        Type: "internal_server_error",
+                        Message: "Failed to retrieve batch status",
+                    },
+                })
+            }
+            return
+        }
+        // Convert the Batch to BatchResponse
+        response := openai.BatchResponse{
+            Batch: batchStatus,
+        }
+
+        c.JSON(http.StatusOK, response)
     }
+}
 
-    batchStatus, err := db.GetLatestBatchStatus(batchID)
-    if err != nil {
-        if err == mongo.ErrNoDocuments {
-            c.JSON(http.StatusNotFound, openai.ErrorResponse{
-                Error: &openai.APIError{
-                    Type: "invalid_request_error",
-                    Message: "No such batch",
-                },
-            })
-        } else {
+func NewListBatchesHandler(store db.BatchStore) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        batchStatuses, err := store.GetAllBatchStatuses()
+        if err != nil {
             c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
                 Error: &openai.APIError{
-                    Type: "internal_server_error",
-                    Message: "Failed to retrieve batch status",
+                    Type:    "internal_server_error",
+                    Message: "Failed to retrieve batch statuses",
                 },
             })
+            return
         }
-        return
-    }
-    // Convert the Batch to BatchResponse
-    response := openai.BatchResponse{
-        Batch: batchStatus,
-    }
-
-    c.JSON(http.StatusOK, response)
-}
 
-func HandleListBatches(c *gin.Context) {
-    batchStatuses, err := db.GetAllBatchStatuses()
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
-            Error: &openai.APIError{
-                Type:    "internal_server_error",
-                Message: "Failed to retrieve batch statuses",
-            },
+        c.JSON(http.StatusOK, gin.H{
+            "data": batchStatuses,
         })
-        return
     }
-
-    c.JSON(http.StatusOK, gin.H{
-        "data": batchStatuses,
-    })
 }
 
-func HandleCancelBatch(c *gin.Context) {
-    batchID := strings.TrimPrefix(c.Param("batch_id"), "/")
-    if batchID == "" {
-        c.JSON(http.StatusBadRequest, openai.ErrorResponse{
-            Error: &openai.APIError{
-                Type: "invalid_request_error",
-                Message: "Missing batch_id parameter",
-            },
-        })
-        return
-    }
+// NewCancelBatchHandler returns a handler that cancels a batch through the OpenAI client
+// set on the context as "openAIClient".
+func NewCancelBatchHandler(store db.BatchStore) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        batchID := strings.TrimPrefix(c.Param("batch_id"), "/")
+        if batchID == "" {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type: "invalid_request_error",
+                    Message: "Missing batch_id parameter",
+                },
+            })
+            return
+        }
+
+        // Get current batch status first
+        batchStatus, err := store.GetLatestBatchStatus(batchID)
+        if err != nil {
+            if errors.Is(err, db.ErrNotFound) {
+                c.JSON(http.StatusNotFound, openai.ErrorResponse{
+                    Error: &openai.APIError{
+                        Type: "invalid_request_error",
+                        Message: "No such batch",
+                    },
+                })
+            } else {
+                c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
+                    Error: &openai.APIError{
+                        Type: "internal_server_error",
+                        Message: "Failed to retrieve batch status",
+                    },
+                })
+            }
+            return
+        }
 
-    // Get current batch status first
-    batchStatus, err := db.GetLatestBatchStatus(batchID)
-    if err != nil {
-        if err == mongo.ErrNoDocuments {
-            c.JSON(http.StatusNotFound, openai.ErrorResponse{
+        // Check if batch can be cancelled
+        if batchStatus.Status == "completed" ||
+           batchStatus.Status == "cancelled" ||
+           batchStatus.Status == "failed" ||
+           batchStatus.Status == "expired" {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
                 Error: &openai.APIError{
                     Type: "invalid_request_error",
-                    Message: "No such batch",
+                    Message: fmt.Sprintf("Cannot cancel batch in %s state", batchStatus.Status),
                 },
             })
-        } else {
+            return
+        }
+
+        // Get openAI client from context
+        openAIClient := c.MustGet("openAIClient").(client.OpenAIClient)
+
+        // Forward cancel request to OpenAI
+        response, err := openAIClient.CancelBatch(c.Request.Context(), batchID)
+        if err != nil {
             c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
                 Error: &openai.APIError{
                     Type: "internal_server_error",
-                    Message: "Failed to retrieve batch status",
+                    Message: "Failed to cancel batch",
                 },
             })
+            return
         }
-        return
-    }
 
-    // Check if batch can be cancelled
-    if batchStatus.Status == "completed" ||
-       batchStatus.Status == "cancelled" ||
-       batchStatus.Status == "failed" ||
-       batchStatus.Status == "expired" {
-        c.JSON(http.StatusBadRequest, openai.ErrorResponse{
-            Error: &openai.APIError{
-                Type: "invalid_request_error",
-                Message: fmt.Sprintf("Cannot cancel batch in %s state", batchStatus.Status),
-            },
-        })
-        return
-    }
+        // Log the cancelled status
+        err = store.LogBatchStatus(response)
+        if err != nil {
+            logger.WarnLogger.Printf("Failed to log cancelled batch status: %v", err)
+        }
 
-    // Get openAI client from context
-    openAIClient := c.MustGet("openAIClient").(client.OpenAIClient)
-
-    // Forward cancel request to OpenAI
-    response, err := openAIClient.CancelBatch(c.Request.Context(), batchID)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
-            Error: &openai.APIError{
-                Type: "internal_server_error",
-                Message: "Failed to cancel batch",
-            },
-        })
-        return
+        c.JSON(http.StatusOK, response)
     }
+}
 
-    // Log the cancelled status
-    err = db.LogBatchStatus(response)
-    if err != nil {
-        logger.WarnLogger.Printf("Failed to log cancelled batch status: %v", err)
-    }
+// NewBatchHistoryHandler returns a handler listing the status and request count transitions of a batch.
+func NewBatchHistoryHandler(store db.BatchStore) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        batchID := c.Param("batch_id")
+        transitions, err := store.GetBatchHistory(batchID)
+        if err != nil {
+            if errors.Is(err, db.ErrNotFound) {
+                c.JSON(http.StatusNotFound, openai.ErrorResponse{
+                    Error: &openai.APIError{
+                        Type:    "invalid_request_error",
+                        Message: "No such batch",
+                    },
+                })
+            } else {
+                c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
+                    Error: &openai.APIError{
+                        Type:    "internal_server_error",
+                        Message: "Failed to retrieve batch history",
+                    },
+                })
+            }
+            return
+        }
 
-    c.JSON(http.StatusOK, response)
+        c.JSON(http.StatusOK, gin.H{
+            "data": transitions,
+        })
+    }
 }
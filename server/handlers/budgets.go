@@ -0,0 +1,107 @@
+package handlers
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "batch-gpt/services/budget"
+    "errors"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// NewListBudgetsHandler returns a handler that lists the budget of every tenant that has one,
+// with what the tenant spent of it today and this month.
+func NewListBudgetsHandler(budgets budget.Enforcer) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        statuses, err := budgets.GetStatuses()
+        if err != nil {
+            respondBudgetError(c, err)
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{
+            "data": statuses,
+        })
+    }
+}
+
+func NewRetrieveBudgetHandler(budgets budget.Enforcer) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        status, err := budgets.GetStatus(c.Param("tenant"))
+        if err != nil {
+            respondBudgetError(c, err)
+            return
+        }
+
+        c.JSON(http.StatusOK, status)
+    }
+}
+
+// NewSetBudgetHandler returns a handler that sets the budget of the tenant in the path to the
+// limits in the request body, replacing its earlier budget. Limits left out are not enforced.
+func NewSetBudgetHandler(budgets budget.Enforcer) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var request models.Budget
+        if err := c.ShouldBindJSON(&request); err != nil {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: "Request body must be a JSON budget: " + err.Error(),
+                },
+            })
+            return
+        }
+        request.Tenant = c.Param("tenant")
+
+        saved, err := budgets.SetBudget(request)
+        if err != nil {
+            respondBudgetError(c, err)
+            return
+        }
+
+        c.JSON(http.StatusOK, saved)
+    }
+}
+
+func NewDeleteBudgetHandler(budgets budget.Enforcer) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if err := budgets.DeleteBudget(c.Param("tenant")); err != nil {
+            respondBudgetError(c, err)
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"deleted": 1})
+    }
+}
+
+func respondBudgetError(c *gin.Context, err error) {
+    if errors.Is(err, db.ErrNotFound) {
+        c.JSON(http.StatusNotFound, openai.ErrorResponse{
+            Error: &openai.APIError{
+                Type:    "invalid_request_error",
+                Message: "No budget is set for this tenant",
+            },
+        })
+        return
+    }
+    if errors.Is(err, budget.ErrInvalidBudget) {
+        c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+            Error: &openai.APIError{
+                Type:    "invalid_request_error",
+                Message: "Budget limits must not be negative",
+            },
+        })
+        return
+    }
+
+    logger.ErrorLogger.Printf("Failed to access budget: %v", err)
+    c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
+        Error: &openai.APIError{
+            Type:    "internal_server_error",
+            Message: "Failed to access budget",
+        },
+    })
+}
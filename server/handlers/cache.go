@@ -0,0 +1,165 @@
+package handlers
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "batch-gpt/services/cache"
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// NewInvalidateCacheHandler returns a handler that deletes the cached responses matching the
+// "hash", "model" and "tenant" query parameters and cached between the RFC 3339 timestamps
+// "from" (inclusive) and "to" (exclusive). Clearing the whole cache requires "all=true" instead of filters.
+func NewInvalidateCacheHandler(cacheOrch cache.Orchestrator) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        filter, ok := parseCacheFilter(c)
+        if !ok {
+            return
+        }
+
+        if filter == (models.CacheFilter{}) && c.Query("all") != "true" {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: "Specify hash, model, tenant, from or to, or all=true to clear the whole cache",
+                },
+            })
+            return
+        }
+
+        invalidateCache(c, cacheOrch, filter)
+    }
+}
+
+// parseCacheFilter reads a cache filter from the "hash", "model", "tenant", "from" and "to"
+// query parameters. It responds with an error and returns false if a timestamp is invalid.
+func parseCacheFilter(c *gin.Context) (models.CacheFilter, bool) {
+    filter := models.CacheFilter{
+        Hash:   c.Query("hash"),
+        Model:  c.Query("model"),
+        Tenant: c.Query("tenant"),
+    }
+
+    for _, bound := range []struct {
+        name  string
+        value *time.Time
+    }{{"from", &filter.From}, {"to", &filter.To}} {
+        value := c.Query(bound.name)
+        if value == "" {
+            continue
+        }
+        parsed, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: bound.name + " must be an RFC 3339 timestamp",
+                },
+            })
+            return filter, false
+        }
+        *bound.value = parsed
+    }
+    return filter, true
+}
+
+func NewInvalidateCachedResponseHandler(cacheOrch cache.Orchestrator) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        invalidateCache(c, cacheOrch, models.CacheFilter{Hash: c.Param("hash")})
+    }
+}
+
+// NewCacheStatsHandler returns a handler that reports the hits and misses of each cache tier.
+func NewCacheStatsHandler(cacheOrch cache.Orchestrator) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.JSON(http.StatusOK, cacheOrch.Stats())
+    }
+}
+
+func invalidateCache(c *gin.Context, cacheOrch cache.Orchestrator, filter models.CacheFilter) {
+    deleted, err := cacheOrch.Invalidate(filter)
+    if err != nil {
+        logger.ErrorLogger.Printf("Failed to invalidate cached responses: %v", err)
+        c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
+            Error: &openai.APIError{
+                Type:    "internal_server_error",
+                Message: "Failed to invalidate cached responses",
+            },
+        })
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
+// NewImportCacheFilesHandler returns a handler that caches the responses of a pair of Batch API
+// files uploaded as the "input" and "output" parts of a multipart form, for the tenant in the
+// "tenant" field. Progress is streamed as JSON lines, the last of which has "done" set, or
+// "error" if the import stopped.
+func NewImportCacheFilesHandler(cacheOrch cache.Orchestrator) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        inputHeader, inputErr := c.FormFile("input")
+        outputHeader, outputErr := c.FormFile("output")
+        if inputErr != nil || outputErr != nil {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: "Upload the batch input and output files as the input and output parts of a multipart form",
+                },
+            })
+            return
+        }
+
+        input, err := inputHeader.Open()
+        if err != nil {
+            respondImportError(c, err)
+            return
+        }
+        defer input.Close()
+        output, err := outputHeader.Open()
+        if err != nil {
+            respondImportError(c, err)
+            return
+        }
+        defer output.Close()
+
+        source := c.PostForm("source")
+        if source == "" {
+            source = inputHeader.Filename + "+" + outputHeader.Filename
+        }
+
+        c.Header("Content-Type", "application/x-ndjson")
+        c.Status(http.StatusOK)
+        encoder := json.NewEncoder(c.Writer)
+        _, err = cacheOrch.Import(c.Request.Context(), cache.ImportFiles{
+            Input:      input,
+            InputSize:  inputHeader.Size,
+            Output:     output,
+            OutputSize: outputHeader.Size,
+            Source:     source,
+            Tenant:     c.PostForm("tenant"),
+        }, func(progress models.CacheImport) {
+            encoder.Encode(progress)
+            c.Writer.Flush()
+        })
+        if err != nil {
+            logger.ErrorLogger.Printf("Failed to import %s into the cache: %v", source, err)
+            encoder.Encode(gin.H{"error": err.Error()})
+        }
+    }
+}
+
+func respondImportError(c *gin.Context, err error) {
+    logger.ErrorLogger.Printf("Failed to open uploaded batch file: %v", err)
+    c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
+        Error: &openai.APIError{
+            Type:    "internal_server_error",
+            Message: "Failed to read the uploaded files",
+        },
+    })
+}
@@ -1,43 +1,201 @@
 package handlers
 
 import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
     "batch-gpt/services/batch"
+    "batch-gpt/services/budget"
     "batch-gpt/services/cache"
     "batch-gpt/services/config"
+    "batch-gpt/services/usage"
+    "batch-gpt/services/validation"
+    "errors"
+    "io"
     "net/http"
+    "strconv"
+    "strings"
+    "time"
     "github.com/gin-gonic/gin"
     openai "github.com/sashabaranov/go-openai"
 )
 
+// TenantHeader names the tenant a request is made for. Cache key rules can differ per tenant.
+// It is only read when clients are not authenticated; otherwise the tenant is that of the client's key.
+const TenantHeader = "X-BatchGPT-Tenant"
+
+// CacheTTLHeader sets how many seconds the response to a request is cached for,
+// overriding the configured TTL.
+const CacheTTLHeader = "X-BatchGPT-Cache-TTL"
+
+// CacheHeader sets the cache directive of a request: bypass, refresh or only.
+// It takes precedence over Cache-Control.
+const CacheHeader = "X-BatchGPT-Cache"
+
+// BudgetWarningHeader is set on responses to tenants that spent most of their budget.
+const BudgetWarningHeader = "X-BatchGPT-Budget-Warning"
+
+// SampleHeader picks which cached sample of a request is returned: a 0-based index or "random".
+const SampleHeader = "X-BatchGPT-Sample"
+
 type ChatCompletionsHandler struct {
     batchOrch batch.Orchestrator
     cacheOrch cache.Orchestrator
+    usage usage.Tracker
+    budgets budget.Enforcer
     servingMode config.ServingMode
+    validator validation.Validator
+    clientKeys config.ClientKeysConfig
 }
 
-func NewChatCompletionsHandler(batchOrch batch.Orchestrator, cacheOrch cache.Orchestrator, servingMode config.ServingMode) gin.HandlerFunc {
+func NewChatCompletionsHandler(batchOrch batch.Orchestrator, cacheOrch cache.Orchestrator, usageTracker usage.Tracker, budgets budget.Enforcer, servingMode config.ServingMode, validator validation.Validator, clientKeys config.ClientKeysConfig) gin.HandlerFunc {
     handler := &ChatCompletionsHandler{
         batchOrch: batchOrch,
         cacheOrch: cacheOrch,
+        usage: usageTracker,
+        budgets: budgets,
         servingMode: servingMode,
+        validator: validator,
+        clientKeys: clientKeys,
     }
     return handler.Handle
 }
 
 func (h *ChatCompletionsHandler) Handle(c *gin.Context) {
-    var request openai.ChatCompletionRequest
-    if err := c.ShouldBindJSON(&request); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    // Budgets are enforced per tenant, so the tenant must come from the client's key
+    // rather than from a header the client could set to anything
+    tenant, ok := h.tenant(c)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, openai.ErrorResponse{
+            Error: &openai.APIError{
+                Type: "invalid_request_error",
+                Code: "invalid_api_key",
+                Message: "Incorrect API key provided",
+            },
+        })
+        return
+    }
+    if err := models.ValidateTenant(tenant); err != nil {
+        c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+            Error: &openai.APIError{
+                Type:    "invalid_request_error",
+                Message: "Invalid " + TenantHeader + " header: " + err.Error(),
+            },
+        })
+        return
+    }
+
+    // Read one byte past the limit so oversized bodies are detected without reading them whole
+    rawBody, err := io.ReadAll(io.LimitReader(c.Request.Body, h.validator.GetMaxBodyBytes()+1))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+            Error: &openai.APIError{
+                Type: "invalid_request_error",
+                Message: "Failed to read request body",
+            },
+        })
+        return
+    }
+    if apiErr := h.validator.ValidateBodySize(len(rawBody)); apiErr != nil {
+        c.JSON(http.StatusBadRequest, openai.ErrorResponse{Error: apiErr})
         return
     }
 
-    // Check cache first
-    if cachedResponse, found := h.cacheOrch.GetFromCache(request); found {
-        c.JSON(http.StatusOK, cachedResponse)
+    request, err := models.NewChatRequest(rawBody)
+    var typeErr *models.FieldTypeError
+    if errors.As(err, &typeErr) {
+        c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+            Error: &openai.APIError{
+                Type:    "invalid_request_error",
+                Code:    "invalid_type",
+                Param:   &typeErr.Field,
+                Message: typeErr.Error(),
+            },
+        })
         return
     }
+    if err != nil {
+        c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+            Error: &openai.APIError{
+                Type: "invalid_request_error",
+                Message: "We could not parse the JSON body of your request: " + err.Error(),
+            },
+        })
+        return
+    }
+    request.Tenant = tenant
+    if rejection := h.budgets.Admit(request.Tenant); rejection != nil {
+        respondRejection(c, rejection)
+        return
+    }
+    // Responses from the cache cost nothing, so tenants over their budget still get them
+    warning, quotaRejection := h.budgets.Check(request.Tenant)
+    if warning != "" {
+        c.Header(BudgetWarningHeader, warning)
+    }
+    request.Route = c.FullPath()
+    if value := c.GetHeader(CacheTTLHeader); value != "" {
+        seconds, err := strconv.Atoi(value)
+        if err != nil || seconds <= 0 {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: CacheTTLHeader + " must be a positive number of seconds",
+                },
+            })
+            return
+        }
+        request.CacheTTL = time.Duration(seconds) * time.Second
+    }
+    directive, ok := parseCacheDirective(c)
+    if !ok {
+        c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+            Error: &openai.APIError{
+                Type:    "invalid_request_error",
+                Message: CacheHeader + " must be one of bypass, refresh or only",
+            },
+        })
+        return
+    }
+    request.CacheDirective = directive
+    if value := c.GetHeader(SampleHeader); value != "" {
+        if value == "random" {
+            request.CacheSample = &models.SampleSelection{Random: true}
+        } else if index, err := strconv.Atoi(value); err == nil && index >= 0 {
+            request.CacheSample = &models.SampleSelection{Index: index}
+        } else {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: SampleHeader + " must be a sample index or \"random\"",
+                },
+            })
+            return
+        }
+    }
+
+    // Check cache first, unless the request asks for a fresh answer
+    if directive != models.CacheBypass && directive != models.CacheRefresh {
+        if hit, found := h.cacheOrch.GetFromCache(request); found {
+            // Fewer samples are cached than wanted, so have the next batch produce another one,
+            // unless the tenant is over budget or the request accepts only cached responses
+            if hit.NeedsMoreSamples && !h.servingMode.IsCache() && quotaRejection == nil && directive != models.CacheOnly {
+                if err := h.batchOrch.RequeueRequest(request); err != nil {
+                    logger.WarnLogger.Printf("Failed to queue another sample: %v", err)
+                }
+            }
+            h.usage.RecordCacheHit(request, hit.Response)
+            c.JSON(http.StatusOK, hit.Response)
+            return
+        }
+    }
 
     // If cache-only mode and no cache hit, return error
+    if directive == models.CacheOnly {
+        c.JSON(http.StatusNotFound, gin.H{
+            "error": "Response not found in cache and the request only accepts cached responses",
+        })
+        return
+    }
     if h.servingMode.IsCache() {
         c.JSON(http.StatusNotFound, gin.H{
             "error": "Response not found in cache and server is in cache-only mode",
@@ -45,9 +203,20 @@ func (h *ChatCompletionsHandler) Handle(c *gin.Context) {
         return
     }
 
+    // Reject requests the Batch API would fail on before they are queued
+    if apiErr := h.validator.Validate(request); apiErr != nil {
+        c.JSON(http.StatusBadRequest, openai.ErrorResponse{Error: apiErr})
+        return
+    }
+
+    if quotaRejection != nil {
+        respondRejection(c, quotaRejection)
+        return
+    }
+
     // Normal processing for async/sync modes
     resultChan := h.batchOrch.AddRequest(request)
-    
+
     select {
     case result := <-resultChan:
         if result.IsAsync {
@@ -62,4 +231,69 @@ func (h *ChatCompletionsHandler) Handle(c *gin.Context) {
     case <-c.Request.Context().Done():
         c.JSON(http.StatusRequestTimeout, gin.H{"error": "Request timeout"})
     }
-}
\ No newline at end of file
+}
+
+// respondRejection turns a request away with 429, like the OpenAI API does for rate limits and exhausted quotas.
+func respondRejection(c *gin.Context, rejection *budget.Rejection) {
+    errorType := "requests"
+    if rejection.Code == budget.CodeInsufficientQuota {
+        errorType = "insufficient_quota"
+    }
+    if rejection.RetryAfter > 0 {
+        c.Header("Retry-After", strconv.Itoa(int(rejection.RetryAfter.Seconds())))
+    }
+    c.JSON(http.StatusTooManyRequests, openai.ErrorResponse{
+        Error: &openai.APIError{
+            Code:    rejection.Code,
+            Type:    errorType,
+            Message: rejection.Message,
+        },
+    })
+}
+
+// parseCacheDirective reads the cache directive of a request from the X-BatchGPT-Cache header,
+// or else from Cache-Control: no-store bypasses the cache, no-cache refreshes it and
+// only-if-cached answers from the cache only.
+func parseCacheDirective(c *gin.Context) (models.CacheDirective, bool) {
+    if value := c.GetHeader(CacheHeader); value != "" {
+        switch directive := models.CacheDirective(strings.ToLower(strings.TrimSpace(value))); directive {
+        case models.CacheBypass, models.CacheRefresh, models.CacheOnly:
+            return directive, true
+        default:
+            return models.CacheDefault, false
+        }
+    }
+
+    directive := models.CacheDefault
+    for _, value := range strings.Split(c.GetHeader("Cache-Control"), ",") {
+        switch strings.ToLower(strings.TrimSpace(value)) {
+        case "no-store":
+            // no-store wins over anything else in the header
+            return models.CacheBypass, true
+        case "no-cache":
+            directive = models.CacheRefresh
+        case "only-if-cached":
+            if directive == models.CacheDefault {
+                directive = models.CacheOnly
+            }
+        }
+    }
+    return directive, true
+}
+
+// tenant returns the tenant of the client's key, or the one named by TenantHeader when
+// clients are not authenticated. It returns false if the client's key is missing or unknown.
+func (h *ChatCompletionsHandler) tenant(c *gin.Context) (string, bool) {
+    tenant := c.GetHeader(TenantHeader)
+    if h.clientKeys.IsEnabled() {
+        var ok bool
+        tenant, ok = h.clientKeys.GetTenant(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+        if !ok {
+            return "", false
+        }
+    }
+    if tenant == "" {
+        tenant = models.DefaultTenant
+    }
+    return tenant, true
+}
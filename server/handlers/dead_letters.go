@@ -0,0 +1,168 @@
+package handlers
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "batch-gpt/services/batch"
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    openai "github.com/sashabaranov/go-openai"
+)
+
+func NewListDeadLettersHandler(store db.DeadLetterStore) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        limit, err := strconv.ParseInt(c.DefaultQuery("limit", "100"), 10, 64)
+        if err != nil || limit <= 0 {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: "limit must be a positive integer",
+                },
+            })
+            return
+        }
+
+        deadLetters, err := store.GetDeadLetters(limit)
+        if err != nil {
+            logger.ErrorLogger.Printf("Failed to list dead letters: %v", err)
+            c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "internal_server_error",
+                    Message: "Failed to retrieve dead letters",
+                },
+            })
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{
+            "data": deadLetters,
+        })
+    }
+}
+
+func NewRetrieveDeadLetterHandler(store db.DeadLetterStore) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        deadLetter, err := store.GetDeadLetter(c.Param("hash"))
+        if err != nil {
+            respondDeadLetterError(c, err)
+            return
+        }
+
+        c.JSON(http.StatusOK, deadLetter)
+    }
+}
+
+func NewDeleteDeadLetterHandler(store db.DeadLetterStore) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if err := store.DeleteDeadLetter(c.Param("hash")); err != nil {
+            respondDeadLetterError(c, err)
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"deleted": 1})
+    }
+}
+
+// NewPurgeDeadLettersHandler returns a handler that deletes all dead letters, or only those
+// created before the RFC 3339 timestamp given in the "before" query parameter.
+func NewPurgeDeadLettersHandler(store db.DeadLetterStore) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var before time.Time
+        if value := c.Query("before"); value != "" {
+            var err error
+            before, err = time.Parse(time.RFC3339, value)
+            if err != nil {
+                c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                    Error: &openai.APIError{
+                        Type:    "invalid_request_error",
+                        Message: "before must be an RFC 3339 timestamp",
+                    },
+                })
+                return
+            }
+        }
+
+        deleted, err := store.PurgeDeadLetters(before)
+        if err != nil {
+            logger.ErrorLogger.Printf("Failed to purge dead letters: %v", err)
+            c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "internal_server_error",
+                    Message: "Failed to purge dead letters",
+                },
+            })
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+    }
+}
+
+// NewRequeueDeadLetterHandler returns a handler that submits a dead-lettered request
+// to the next batch and removes it from the dead letters.
+func NewRequeueDeadLetterHandler(store db.DeadLetterStore, batchOrch batch.Orchestrator) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        deadLetter, err := store.GetDeadLetter(c.Param("hash"))
+        if err != nil {
+            respondDeadLetterError(c, err)
+            return
+        }
+
+        request, err := models.NewChatRequest(deadLetter.Request)
+        if err != nil {
+            c.JSON(http.StatusUnprocessableEntity, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: "Dead letter does not hold a valid chat completion request",
+                },
+            })
+            return
+        }
+        request.Tenant = deadLetter.Tenant
+        if request.Tenant == "" {
+            request.Tenant = models.DefaultTenant
+        }
+        request.Route = deadLetter.Route
+
+        if err := batchOrch.RequeueRequest(request); err != nil {
+            c.JSON(http.StatusConflict, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: err.Error(),
+                },
+            })
+            return
+        }
+
+        if err := store.DeleteDeadLetter(deadLetter.Hash); err != nil {
+            logger.WarnLogger.Printf("Failed to delete requeued dead letter %s: %v", deadLetter.Hash, err)
+        }
+
+        c.JSON(http.StatusAccepted, gin.H{"message": "Request requeued for processing"})
+    }
+}
+
+func respondDeadLetterError(c *gin.Context, err error) {
+    if errors.Is(err, db.ErrNotFound) {
+        c.JSON(http.StatusNotFound, openai.ErrorResponse{
+            Error: &openai.APIError{
+                Type:    "invalid_request_error",
+                Message: "No such dead letter",
+            },
+        })
+        return
+    }
+
+    logger.ErrorLogger.Printf("Failed to access dead letter: %v", err)
+    c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
+        Error: &openai.APIError{
+            Type:    "internal_server_error",
+            Message: "Failed to retrieve dead letter",
+        },
+    })
+}
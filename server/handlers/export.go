@@ -0,0 +1,66 @@
+package handlers
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/services/export"
+    "encoding/json"
+    "net/http"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// NewExportDatasetHandler returns a handler that streams cached conversations as JSON lines in
+// the "format" query parameter's format (fine-tune or eval). The cache filter parameters select
+// entries, "finish_reason" (comma-separated) and "tag" select replies, "dedupe=false" keeps
+// duplicates and "scrub_pii=true" replaces personal data. Errors after the first line has been
+// sent are reported as a last line with "error" set.
+func NewExportDatasetHandler(exporter export.Exporter) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        filter, ok := parseCacheFilter(c)
+        if !ok {
+            return
+        }
+        options := export.Options{
+            Format:   c.DefaultQuery("format", export.FormatFineTune),
+            Filter:   filter,
+            Tag:      c.Query("tag"),
+            Dedupe:   c.Query("dedupe") != "false",
+            ScrubPII: c.Query("scrub_pii") == "true",
+        }
+        if reasons := c.Query("finish_reason"); reasons != "" {
+            options.FinishReasons = strings.Split(reasons, ",")
+        }
+        if options.Format != export.FormatFineTune && options.Format != export.FormatEval {
+            c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "invalid_request_error",
+                    Message: "format must be " + export.FormatFineTune + " or " + export.FormatEval,
+                },
+            })
+            return
+        }
+
+        c.Header("Content-Type", "application/x-ndjson")
+        c.Status(http.StatusOK)
+        result, err := exporter.Export(c.Request.Context(), flushWriter{c.Writer}, options)
+        if err != nil {
+            logger.ErrorLogger.Printf("Failed to export dataset: %v", err)
+            json.NewEncoder(c.Writer).Encode(gin.H{"error": err.Error()})
+            return
+        }
+        logger.InfoLogger.Printf("Exported %d examples, %d duplicates and %d replies left out", result.Exported, result.Duplicates, result.Skipped)
+    }
+}
+
+// flushWriter sends each example to the client as soon as it is written.
+type flushWriter struct {
+    gin.ResponseWriter
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+    n, err := w.ResponseWriter.Write(p)
+    w.Flush()
+    return n, err
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+    "batch-gpt/services/client"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+// NewHealthHandler returns a handler that reports whether the server is up and the state of
+// the circuit breaker in front of the OpenAI API. The server keeps answering from its cache
+// and collating requests while the API is unhealthy, so it reports itself degraded rather than down.
+func NewHealthHandler(upstream client.HealthReporter) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        health := upstream.Health()
+        status := "ok"
+        if health.State != client.CircuitClosed {
+            status = "degraded"
+        }
+        c.JSON(http.StatusOK, gin.H{
+            "status":   status,
+            "upstream": health,
+        })
+    }
+}
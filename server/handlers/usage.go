@@ -0,0 +1,50 @@
+package handlers
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "batch-gpt/services/usage"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// NewUsageHandler returns a handler that reports spend and savings per day, tenant and model.
+// The "tenant" and "model" query parameters narrow the report down, and "from" and "to" bound
+// it to a range of days (YYYY-MM-DD, both inclusive).
+func NewUsageHandler(usageTracker usage.Tracker) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        filter := models.UsageFilter{
+            Tenant: c.Query("tenant"),
+            Model:  c.Query("model"),
+            From:   c.Query("from"),
+            To:     c.Query("to"),
+        }
+        for _, day := range []string{filter.From, filter.To} {
+            if _, err := time.Parse(usage.DayFormat, day); day != "" && err != nil {
+                c.JSON(http.StatusBadRequest, openai.ErrorResponse{
+                    Error: &openai.APIError{
+                        Type:    "invalid_request_error",
+                        Message: "from and to must be days formatted as YYYY-MM-DD",
+                    },
+                })
+                return
+            }
+        }
+
+        report, err := usageTracker.Report(filter)
+        if err != nil {
+            logger.ErrorLogger.Printf("Failed to report usage: %v", err)
+            c.JSON(http.StatusInternalServerError, openai.ErrorResponse{
+                Error: &openai.APIError{
+                    Type:    "internal_server_error",
+                    Message: "Failed to report usage",
+                },
+            })
+            return
+        }
+        c.JSON(http.StatusOK, report)
+    }
+}
@@ -4,9 +4,14 @@ import (
 	"batch-gpt/server/db"
 	"batch-gpt/server/handlers"
 	"batch-gpt/services/batch"
+	"batch-gpt/services/budget"
 	"batch-gpt/services/cache"
 	"batch-gpt/services/client"
 	"batch-gpt/services/config"
+	"batch-gpt/services/export"
+	"batch-gpt/services/fingerprint"
+	"batch-gpt/services/usage"
+	"batch-gpt/services/validation"
 	"log"
 	"os"
 	"strconv"
@@ -19,13 +24,38 @@ func main() {
     // Initialize configurations
     servingMode := config.NewServingMode(os.Getenv("CLIENT_SERVING_MODE"))
     pollingConfig := config.NewPollingConfig()
+    upstreamConfig := config.NewUpstreamConfig()
+    reconcileConfig := config.NewReconcileConfig()
+    resubmissionConfig := config.NewResubmissionConfig()
+    retryConfig := config.NewRetryConfig()
+    bisectConfig := config.NewBisectConfig()
+    validationConfig := config.NewValidationConfig()
+    cacheKeyConfig := config.NewCacheKeyConfig()
+    cacheTTLConfig := config.NewCacheTTLConfig()
+    cacheSamplingConfig := config.NewCacheSamplingConfig()
+    memoryCacheConfig := config.NewMemoryCacheConfig()
+    pricingConfig := config.NewPricingConfig()
+    budgetConfig := config.NewBudgetConfig()
+    clientKeysConfig := config.NewClientKeysConfig()
+    if !clientKeysConfig.IsEnabled() {
+        log.Println("CLIENT_KEYS_FILE is not set - clients are not authenticated and name their own tenant, so budgets can be bypassed")
+    }
 
     // Initialize database
-    db.InitMongoDB()
+    store, err := db.NewStore()
+    if err != nil {
+        log.Fatalf("Failed to open storage: %v", err)
+    }
+    defer store.Close()
 
     // Initialize services
-    openAIClient := client.NewOpenAIClient(os.Getenv("OPENAI_API_KEY"))
-    cacheOrch := cache.NewOrchestrator()
+    openAIClient := client.NewResilientClient(client.NewOpenAIClient(os.Getenv("OPENAI_API_KEY")), upstreamConfig)
+    fingerprinter := fingerprint.NewFingerprinter(cacheKeyConfig)
+    cacheOrch := cache.NewOrchestrator(store, fingerprinter, cacheTTLConfig, cacheSamplingConfig, memoryCacheConfig)
+    go cacheOrch.WatchChanges()
+    validator := validation.NewValidator(validationConfig)
+    usageTracker := usage.NewTracker(store, pricingConfig)
+    budgets := budget.NewEnforcer(store, usageTracker, pricingConfig, budgetConfig)
 
     // Get batch duration from env
     collateDuration, err := strconv.Atoi(os.Getenv("COLLATE_BATCHES_FOR_DURATION_IN_MS"))
@@ -34,37 +64,80 @@ func main() {
     }
     batchDuration := time.Duration(collateDuration) * time.Millisecond
 
-    // Initialize batch processor and orchestrator
-    batchProcessor := batch.NewProcessor(openAIClient, pollingConfig)
+    // Initialize batch poller, processor and orchestrator
+    batchPoller := batch.NewPoller(openAIClient, store, pollingConfig)
+    go batchPoller.Start()
+    batchProcessor := batch.NewProcessor(openAIClient, store, batchPoller, bisectConfig, reconcileConfig)
     batchOrch := batch.NewOrchestrator(
         batchProcessor,
+        openAIClient,
+        store,
         cacheOrch,
+        usageTracker,
+        budgets,
         servingMode,
+        resubmissionConfig,
+        retryConfig,
+        reconcileConfig,
+        fingerprinter,
         batchDuration,
     )
 
     if servingMode.IsCache() {
-        // In cache mode, only process dangling batches
-        go batchOrch.ContinueDanglingBatches()
+        // In cache mode, only process dangling and orphaned batches
+        go func() {
+            batchOrch.ContinueDanglingBatches()
+            batchOrch.StartReconciling()
+        }()
         log.Println("Server starting in cache-only mode - processing only dangling batches")
     } else {
         // In sync/async mode, start regular processing and handle dangling batches
         go batchOrch.StartProcessing()
-        go batchOrch.ContinueDanglingBatches()
+        // Orphaned batches are looked for once the dangling ones are tracked, so none is picked up twice
+        go func() {
+            batchOrch.ContinueDanglingBatches()
+            batchOrch.StartReconciling()
+        }()
         log.Println("Server starting in", servingMode.GetMode(), "mode - processing new and dangling batches")
     }
 
     // Initialize router
     r := gin.Default()
 
-    r.POST("/v1/chat/completions", handlers.NewChatCompletionsHandler(batchOrch, cacheOrch, servingMode))
-    r.GET("/v1/batches/:batch_id", handlers.HandleRetrieveBatch)
-    r.GET("/v1/batches", handlers.HandleListBatches)
+    r.GET("/health", handlers.NewHealthHandler(openAIClient))
+    r.POST("/v1/chat/completions", handlers.NewChatCompletionsHandler(batchOrch, cacheOrch, usageTracker, budgets, servingMode, validator, clientKeysConfig))
+    r.GET("/v1/batches/:batch_id", handlers.NewRetrieveBatchHandler(store))
+    r.GET("/v1/batches", handlers.NewListBatchesHandler(store))
+    cancelBatch := handlers.NewCancelBatchHandler(store)
     r.POST("/v1/batches/:batch_id/cancel", func(c *gin.Context) {
             c.Set("openAIClient", openAIClient)
-            handlers.HandleCancelBatch(c)
+            cancelBatch(c)
         })
 
+    adminAPIKey := os.Getenv("ADMIN_API_KEY")
+    if adminAPIKey == "" {
+        log.Println("ADMIN_API_KEY is not set - admin endpoints are disabled")
+    } else {
+        admin := r.Group("/admin", handlers.NewAdminAuthMiddleware(adminAPIKey))
+        admin.POST("/batches/import", handlers.NewImportBatchesHandler(batchOrch))
+        admin.GET("/batches/:batch_id/history", handlers.NewBatchHistoryHandler(store))
+        admin.GET("/dead_letters", handlers.NewListDeadLettersHandler(store))
+        admin.DELETE("/dead_letters", handlers.NewPurgeDeadLettersHandler(store))
+        admin.GET("/dead_letters/:hash", handlers.NewRetrieveDeadLetterHandler(store))
+        admin.DELETE("/dead_letters/:hash", handlers.NewDeleteDeadLetterHandler(store))
+        admin.POST("/dead_letters/:hash/requeue", handlers.NewRequeueDeadLetterHandler(store, batchOrch))
+        admin.DELETE("/cache", handlers.NewInvalidateCacheHandler(cacheOrch))
+        admin.DELETE("/cache/:hash", handlers.NewInvalidateCachedResponseHandler(cacheOrch))
+        admin.POST("/cache/import", handlers.NewImportCacheFilesHandler(cacheOrch))
+        admin.GET("/cache/export", handlers.NewExportDatasetHandler(export.NewExporter(store)))
+        admin.GET("/cache/stats", handlers.NewCacheStatsHandler(cacheOrch))
+        admin.GET("/usage", handlers.NewUsageHandler(usageTracker))
+        admin.GET("/budgets", handlers.NewListBudgetsHandler(budgets))
+        admin.GET("/budgets/:tenant", handlers.NewRetrieveBudgetHandler(budgets))
+        admin.PUT("/budgets/:tenant", handlers.NewSetBudgetHandler(budgets))
+        admin.DELETE("/budgets/:tenant", handlers.NewDeleteBudgetHandler(budgets))
+    }
+
     log.Println("Server starting on :8080")
     if err := r.Run(":8080"); err != nil {
         log.Fatalf("Failed to start server: %v", err)
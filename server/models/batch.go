@@ -1,14 +1,25 @@
 package models
 
-import (
-	openai "github.com/sashabaranov/go-openai"
-)
-
 type BatchRequestItem struct {
     CustomID string
-    Request  openai.ChatCompletionRequest
+    Request  ChatRequest
 }
 
 type BatchRequest struct {
     Requests []BatchRequestItem
-}
\ No newline at end of file
+    // JobID ties together the batches submitted for the same requests, such as the parts of a split up failed batch
+    JobID    string
+}
+
+// TerminalBatchStatuses are the statuses of batches that will not change anymore.
+var TerminalBatchStatuses = []string{"completed", "failed", "cancelled", "expired"}
+
+// IsTerminalBatchStatus reports whether a batch with the given status will not change anymore.
+func IsTerminalBatchStatus(status string) bool {
+    for _, terminal := range TerminalBatchStatuses {
+        if status == terminal {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// BatchTransition is a change in a batch's status or request counts, as seen when polling it.
+type BatchTransition struct {
+    BatchID       string                    `json:"batch_id"`
+    Status        string                    `json:"status"`
+    RequestCounts openai.BatchRequestCounts `json:"request_counts"`
+    Timestamp     time.Time                 `json:"timestamp"`
+}
@@ -0,0 +1,12 @@
+package models
+
+// BatchImport reports on a batch created outside batch-gpt being brought into tracking and
+// the cache. Pending batches had not finished yet; their responses are cached once they do.
+type BatchImport struct {
+    BatchID  string `json:"batch_id"`
+    Status   string `json:"status,omitempty"`
+    Requests int    `json:"requests"`
+    Cached   int    `json:"cached"`
+    Pending  bool   `json:"pending"`
+    Error    string `json:"error,omitempty"`
+}
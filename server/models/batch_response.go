@@ -14,4 +14,26 @@ type BatchResponseItem struct {
         Body       openai.ChatCompletionResponse `json:"body"`
         Error      *openai.APIError              `json:"error"`
     } `json:"response"`
+    // Error is set for items from the batch error file, which carry no response.
+    Error *openai.APIError `json:"error"`
+}
+
+// BatchOutput holds everything collected from a batch once it reached a terminal status.
+// For expired and cancelled batches, Responses only covers the items that finished in time.
+// Items that came back with an error are kept apart in Failed.
+type BatchOutput struct {
+    BatchID   string
+    Status    string
+    Responses []BatchResponseItem
+    Failed    []BatchResponseItem
+    // Errors holds the batch-level errors of a failed batch, e.g. input file validation errors.
+    Errors    []BatchError
+}
+
+// BatchError is a batch-level error reported by the Batch API.
+// Line is the 1-based line of the input file the error refers to, if any.
+type BatchError struct {
+    Code    string
+    Message string
+    Line    *int
 }
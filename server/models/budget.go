@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Budget limits what a tenant may spend upstream and how fast it may send requests.
+// Days and months are UTC. Limits of 0 are not enforced.
+type Budget struct {
+    Tenant            string    `json:"tenant"`
+    DailyTokens       int64     `json:"daily_tokens"`
+    MonthlyTokens     int64     `json:"monthly_tokens"`
+    DailyUSD          float64   `json:"daily_usd"`
+    MonthlyUSD        float64   `json:"monthly_usd"`
+    RequestsPerMinute int       `json:"requests_per_minute"`
+    UpdatedAt         time.Time `json:"updated_at"`
+}
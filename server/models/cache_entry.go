@@ -0,0 +1,73 @@
+package models
+
+import (
+    "encoding/json"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// CacheEntry is a response cached under the hash of its request.
+// HashVersion is the fingerprint version the hash was computed with.
+// A zero ExpiresAt keeps the entry until it is evicted or invalidated.
+// Source records where an imported response came from; it is kept from the first response cached for the hash.
+type CacheEntry struct {
+    Hash        string
+    HashVersion int
+    Request     ChatRequest
+    Response    openai.ChatCompletionResponse
+    ExpiresAt   time.Time
+    Source      string
+}
+
+// CachedSamples are the distinct responses cached for a request hash, oldest first.
+// Sampled counts every response cached for the hash, including those that repeated a sample.
+// EntryID identifies the stored entry.
+type CachedSamples struct {
+    EntryID   string
+    Responses []openai.ChatCompletionResponse
+    Sampled   int
+}
+
+// CachedRequest is a cached request with every response sampled for it, as exported from the cache.
+type CachedRequest struct {
+    Hash      string
+    Tenant    string
+    Route     string
+    Body      json.RawMessage
+    Responses []openai.ChatCompletionResponse
+    CachedAt  time.Time
+}
+
+// CacheChange is a change to the stored cache entries, made by this or another replica.
+// Hash is only known for new entries. Reset is set when any entry may have changed.
+type CacheChange struct {
+    EntryID string
+    Hash    string
+    Reset   bool
+}
+
+// CacheFilter selects cached responses to invalidate. Empty fields match any entry;
+// From and To bound the time the response was cached at.
+type CacheFilter struct {
+    Hash   string
+    Model  string
+    Tenant string
+    From   time.Time
+    To     time.Time
+}
+
+// CacheImport reports on importing a pair of batch input and output files into the cache.
+// Skipped responses were already cached, Unmatched ones have no chat completion request in the input file,
+// and Failed ones are error responses or lines that could not be read.
+type CacheImport struct {
+    Source     string `json:"source"`
+    BytesRead  int64  `json:"bytes_read"`
+    TotalBytes int64  `json:"total_bytes"`
+    Lines      int64  `json:"lines"`
+    Imported   int64  `json:"imported"`
+    Skipped    int64  `json:"skipped"`
+    Unmatched  int64  `json:"unmatched"`
+    Failed     int64  `json:"failed"`
+    Done       bool   `json:"done"`
+}
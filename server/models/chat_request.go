@@ -0,0 +1,210 @@
+package models
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// ChatRequest is a chat completion request as sent by the client. Body is kept verbatim and is
+// what gets submitted upstream and hashed, so parameters go-openai does not know about survive.
+// Params is the typed view of Body, for the parts of batch-gpt that need to inspect the request.
+// Tenant and Route say who sent the request and where, for rules that differ between them.
+// CacheTTL, if set, overrides the configured TTL of the cached response.
+type ChatRequest struct {
+    Body           json.RawMessage
+    Params         openai.ChatCompletionRequest
+    Tenant         string
+    Route          string
+    CacheTTL       time.Duration
+    CacheDirective CacheDirective
+    // CacheSample, if set, picks which cached sample is returned instead of the configured policy.
+    CacheSample    *SampleSelection
+}
+
+// SampleSelection picks one of the cached samples of a request: the one at Index, or a random one.
+type SampleSelection struct {
+    Random bool
+    Index  int
+}
+
+// CacheDirective says how a single request uses the response cache.
+type CacheDirective string
+
+const (
+    // CacheDefault looks the request up in the cache and caches its response.
+    CacheDefault CacheDirective = ""
+    // CacheBypass neither looks the request up nor caches its response.
+    CacheBypass CacheDirective = "bypass"
+    // CacheRefresh skips the lookup and replaces the cached response with the new one.
+    CacheRefresh CacheDirective = "refresh"
+    // CacheOnly answers from the cache only, like the cache serving mode.
+    CacheOnly CacheDirective = "only"
+)
+
+// Merge returns the directive an upstream request shared by callers with directives d and
+// other follows: refresh if either refreshes, otherwise the response is cached unless both bypass.
+func (d CacheDirective) Merge(other CacheDirective) CacheDirective {
+    switch {
+    case d == CacheRefresh || other == CacheRefresh:
+        return CacheRefresh
+    case d == CacheBypass && other == CacheBypass:
+        return CacheBypass
+    case d == CacheBypass:
+        return other
+    }
+    return d
+}
+
+// DefaultTenant is the tenant of requests that do not name one.
+const DefaultTenant = "default"
+
+// MaxTenantLength is the longest tenant name, so the tenants of a batch fit in its metadata.
+const MaxTenantLength = 64
+
+// ValidateTenant rejects tenant names that cannot be tagged on a batch: names longer than
+// MaxTenantLength, and names with a comma, which separates the tenants of a batch.
+func ValidateTenant(tenant string) error {
+    if len(tenant) > MaxTenantLength {
+        return fmt.Errorf("tenant %.16q... is longer than %d characters", tenant, MaxTenantLength)
+    }
+    if strings.Contains(tenant, ",") {
+        return fmt.Errorf("tenant %q contains a comma", tenant)
+    }
+    return nil
+}
+
+// looselyTypedFields are the fields the OpenAI API accepts in more forms than go-openai's typed
+// request does, with a check of the forms the API accepts. They are left out of Params when
+// go-openai cannot read them, and go upstream as sent.
+var looselyTypedFields = map[string]func(value json.RawMessage) bool{
+    // stop is a string or a list of strings, go-openai only reads the list
+    "stop": func(value json.RawMessage) bool {
+        var stop string
+        var stops []string
+        return json.Unmarshal(value, &stop) == nil || json.Unmarshal(value, &stops) == nil
+    },
+}
+
+// FieldTypeError is returned for a request field that go-openai knows but that has another JSON
+// type than the OpenAI API accepts, such as a string max_tokens.
+type FieldTypeError struct {
+    Field    string
+    Expected string
+    Got      string
+}
+
+func (e *FieldTypeError) Error() string {
+    return fmt.Sprintf("Invalid type for '%s': expected %s, but got %s instead.", e.Field, e.Expected, e.Got)
+}
+
+// NewChatRequest wraps a JSON request body. Fields go-openai does not know are kept in Body
+// only, so the request still goes upstream as sent. Fields it knows must have the JSON type the
+// OpenAI API accepts, or a FieldTypeError is returned, so they cannot fail a batch later.
+func NewChatRequest(body []byte) (ChatRequest, error) {
+    var params openai.ChatCompletionRequest
+    err := json.Unmarshal(body, &params)
+    var typeErr *json.UnmarshalTypeError
+    if errors.As(err, &typeErr) && typeErr.Field != "" {
+        params, err = decodeLooselyTyped(body)
+    }
+    if err != nil {
+        return ChatRequest{}, err
+    }
+    return ChatRequest{
+        Body:   append(json.RawMessage(nil), body...),
+        Params: params,
+    }, nil
+}
+
+// decodeLooselyTyped decodes a request that go-openai could not read as a whole, leaving out
+// the loosely typed fields once they are checked.
+func decodeLooselyTyped(body []byte) (openai.ChatCompletionRequest, error) {
+    var params openai.ChatCompletionRequest
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(body, &fields); err != nil {
+        return params, err
+    }
+    for name, isValid := range looselyTypedFields {
+        value, present := fields[name]
+        if !present {
+            continue
+        }
+        if !isValid(value) {
+            return params, &FieldTypeError{Field: name, Expected: "a string or an array of strings", Got: jsonTypeOf(value)}
+        }
+        delete(fields, name)
+    }
+
+    typed, err := json.Marshal(fields)
+    if err != nil {
+        return params, err
+    }
+    err = json.Unmarshal(typed, &params)
+    var typeErr *json.UnmarshalTypeError
+    if errors.As(err, &typeErr) {
+        return params, &FieldTypeError{Field: typeErr.Field, Expected: describeGoType(typeErr.Type), Got: articled(typeErr.Value)}
+    }
+    return params, err
+}
+
+// describeGoType names the JSON type a Go type is decoded from.
+func describeGoType(goType reflect.Type) string {
+    switch goType.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return "an integer"
+    case reflect.Float32, reflect.Float64:
+        return "a number"
+    case reflect.Bool:
+        return "a boolean"
+    case reflect.String:
+        return "a string"
+    case reflect.Slice, reflect.Array:
+        return "an array"
+    case reflect.Pointer:
+        return describeGoType(goType.Elem())
+    }
+    return "an object"
+}
+
+// jsonTypeOf names the JSON type of a value.
+func jsonTypeOf(value json.RawMessage) string {
+    var decoded any
+    if err := json.Unmarshal(value, &decoded); err != nil {
+        return "invalid JSON"
+    }
+    switch decoded.(type) {
+    case nil:
+        return "null"
+    case bool:
+        return "a boolean"
+    case float64:
+        return "a number"
+    case string:
+        return "a string"
+    case []any:
+        return "an array"
+    }
+    return "an object"
+}
+
+// articled turns the JSON value kinds encoding/json reports, such as "string" or "number 1.5",
+// into the wording of jsonTypeOf.
+func articled(value string) string {
+    kind, _, _ := strings.Cut(value, " ")
+    switch kind {
+    case "array", "object":
+        return "an " + kind
+    case "bool":
+        return "a boolean"
+    case "string", "number":
+        return "a " + kind
+    }
+    return kind
+}
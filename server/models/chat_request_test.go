@@ -0,0 +1,138 @@
+package models
+
+import (
+    "errors"
+    "strings"
+    "testing"
+)
+
+func TestNewChatRequest(t *testing.T) {
+    tests := []struct {
+        name        string
+        body        string
+        wantField   string
+        wantMessage string
+        wantStop    []string
+    }{
+        {
+            name: "typed fields",
+            body: `{"model":"gpt-4o","max_tokens":10,"stop":["\n"]}`,
+            wantStop: []string{"\n"},
+        },
+        {
+            name: "unknown fields",
+            body: `{"model":"gpt-4o","new_param":{"anything":true}}`,
+        },
+        {
+            name: "stop as a string",
+            body: `{"model":"gpt-4o","stop":"\n"}`,
+        },
+        {
+            name:        "stop as a number",
+            body:        `{"model":"gpt-4o","stop":5}`,
+            wantField:   "stop",
+            wantMessage: "Invalid type for 'stop': expected a string or an array of strings, but got a number instead.",
+        },
+        {
+            name:        "max_tokens as a string",
+            body:        `{"model":"gpt-4o","max_tokens":"abc"}`,
+            wantField:   "max_tokens",
+            wantMessage: "Invalid type for 'max_tokens': expected an integer, but got a string instead.",
+        },
+        {
+            name:        "temperature as a string next to a string stop",
+            body:        `{"model":"gpt-4o","stop":"\n","temperature":"hot"}`,
+            wantField:   "temperature",
+            wantMessage: "Invalid type for 'temperature': expected a number, but got a string instead.",
+        },
+        {
+            name:        "stream as a number",
+            body:        `{"model":"gpt-4o","stream":1}`,
+            wantField:   "stream",
+            wantMessage: "Invalid type for 'stream': expected a boolean, but got a number instead.",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            request, err := NewChatRequest([]byte(tt.body))
+            if tt.wantField == "" {
+                if err != nil {
+                    t.Fatalf("NewChatRequest() error = %v", err)
+                }
+                if string(request.Body) != tt.body {
+                    t.Errorf("Body = %s, want %s", request.Body, tt.body)
+                }
+                if request.Params.Model != "gpt-4o" {
+                    t.Errorf("Params.Model = %q, want gpt-4o", request.Params.Model)
+                }
+                if len(request.Params.Stop) != len(tt.wantStop) {
+                    t.Errorf("Params.Stop = %q, want %q", request.Params.Stop, tt.wantStop)
+                }
+                return
+            }
+
+            var typeErr *FieldTypeError
+            if !errors.As(err, &typeErr) {
+                t.Fatalf("NewChatRequest() error = %v, want a FieldTypeError", err)
+            }
+            if typeErr.Field != tt.wantField {
+                t.Errorf("Field = %q, want %q", typeErr.Field, tt.wantField)
+            }
+            if typeErr.Error() != tt.wantMessage {
+                t.Errorf("Error() = %q, want %q", typeErr.Error(), tt.wantMessage)
+            }
+        })
+    }
+}
+
+func TestNewChatRequestInvalidJSON(t *testing.T) {
+    _, err := NewChatRequest([]byte(`{"model":`))
+    if err == nil {
+        t.Fatal("NewChatRequest() error = nil, want a syntax error")
+    }
+    var typeErr *FieldTypeError
+    if errors.As(err, &typeErr) {
+        t.Errorf("NewChatRequest() error = %v, want a syntax error", err)
+    }
+}
+
+func TestCacheDirectiveMerge(t *testing.T) {
+    tests := []struct {
+        directive CacheDirective
+        other     CacheDirective
+        want      CacheDirective
+    }{
+        {CacheDefault, CacheDefault, CacheDefault},
+        {CacheBypass, CacheBypass, CacheBypass},
+        {CacheBypass, CacheDefault, CacheDefault},
+        {CacheDefault, CacheBypass, CacheDefault},
+        {CacheBypass, CacheRefresh, CacheRefresh},
+        {CacheRefresh, CacheDefault, CacheRefresh},
+        {CacheDefault, CacheRefresh, CacheRefresh},
+    }
+
+    for _, tt := range tests {
+        if got := tt.directive.Merge(tt.other); got != tt.want {
+            t.Errorf("%q.Merge(%q) = %q, want %q", tt.directive, tt.other, got, tt.want)
+        }
+    }
+}
+
+func TestValidateTenant(t *testing.T) {
+    tests := []struct {
+        tenant  string
+        wantErr bool
+    }{
+        {tenant: DefaultTenant},
+        {tenant: strings.Repeat("t", MaxTenantLength)},
+        {tenant: strings.Repeat("t", MaxTenantLength+1), wantErr: true},
+        {tenant: "acme,globex", wantErr: true},
+    }
+
+    for _, tt := range tests {
+        if err := ValidateTenant(tt.tenant); (err != nil) != tt.wantErr {
+            t.Errorf("ValidateTenant(%.16q) error = %v, want error %v", tt.tenant, err, tt.wantErr)
+        }
+    }
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+    "encoding/json"
+    "time"
+)
+
+// DeadLetter is a request that batch-gpt gave up on after it failed upstream.
+type DeadLetter struct {
+    Hash       string          `json:"hash"`
+    // Request is the request body as sent by the client.
+    Request    json.RawMessage `json:"request"`
+    // Tenant and Route are those of the original request, so a requeued request keeps its cache key.
+    Tenant     string          `json:"tenant"`
+    Route      string          `json:"route"`
+    LastError  string          `json:"last_error"`
+    ErrorClass string          `json:"error_class"`
+    BatchIDs   []string        `json:"batch_ids"`
+    // Attempts is how many times the request was submitted upstream. Parts a failed batch was split
+    // into and identical requests that shared its batch item do not add to it.
+    Attempts   int             `json:"attempts"`
+    CreatedAt  time.Time       `json:"created_at"`
+}
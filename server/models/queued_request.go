@@ -0,0 +1,20 @@
+package models
+
+import (
+    "encoding/json"
+    "time"
+)
+
+// QueuedRequest is a request batch-gpt accepted but did not settle yet, kept in the store so a
+// restart does not lose it.
+type QueuedRequest struct {
+    Hash           string          `json:"hash"`
+    // Body is the request body as sent by the client.
+    Body           json.RawMessage `json:"body"`
+    Tenant         string          `json:"tenant"`
+    Route          string          `json:"route"`
+    CacheDirective CacheDirective  `json:"cache_directive,omitempty"`
+    CacheTTL       time.Duration   `json:"cache_ttl,omitempty"`
+    // QueuedAt is kept to the millisecond, which every storage backend stores exactly.
+    QueuedAt       time.Time       `json:"queued_at"`
+}
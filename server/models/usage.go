@@ -0,0 +1,27 @@
+package models
+
+// Sources of the responses usage is recorded for.
+const (
+    UsageSourceBatch = "batch"
+    UsageSourceCache = "cache"
+)
+
+// UsageRecord counts the responses a tenant got for a model on a day (UTC, formatted as
+// 2006-01-02) from one source, and the tokens they took.
+type UsageRecord struct {
+    Day              string `json:"day"`
+    Tenant           string `json:"tenant"`
+    Model            string `json:"model"`
+    Source           string `json:"source"`
+    Requests         int64  `json:"requests"`
+    PromptTokens     int64  `json:"prompt_tokens"`
+    CompletionTokens int64  `json:"completion_tokens"`
+}
+
+// UsageFilter selects usage records. From and To are days, both inclusive; empty fields match any value.
+type UsageFilter struct {
+    Tenant string
+    Model  string
+    From   string
+    To     string
+}
@@ -0,0 +1,213 @@
+package batch
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "fmt"
+    "strings"
+    "sync"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// inputErrorCodes are the batch error codes caused by the content of the input file. Only
+// these are worth splitting a batch for; other errors, such as the organization running out
+// of enqueued tokens or credit, fail every part the same way.
+var inputErrorCodes = map[string]bool{
+    "invalid_request":            true,
+    "invalid_json_line":          true,
+    "invalid_value":              true,
+    "invalid_type":               true,
+    "invalid_url":                true,
+    "invalid_method":             true,
+    "invalid_model":              true,
+    "missing_required_parameter": true,
+    "mismatched_model":           true,
+    "mismatched_endpoint":        true,
+    "duplicate_custom_id":        true,
+    "model_not_found":            true,
+    "unsupported_value":          true,
+}
+
+// ResolveFailedBatch isolates the requests that made a batch fail and gets responses for the rest.
+// batchRequest must list the requests in the order of the batch input file.
+// onDone is called with the merged output once every resubmitted part finished.
+func (p *processor) ResolveFailedBatch(batchRequest models.BatchRequest, output models.BatchOutput, onDone func(models.BatchOutput, error)) {
+    if batchRequest.JobID == "" {
+        batchRequest.JobID = newJobID()
+    }
+    p.resolveFailedBatch(batchRequest, output, 0, onDone)
+}
+
+// resolveFailedBatch rejects the requests on lines named by the batch errors and resubmits
+// the remaining ones. If the errors do not point at lines but were caused by the input file,
+// the batch is split into halves and each half is resubmitted until the offending requests
+// are isolated. Batches that failed for any other reason are rejected as a whole.
+func (p *processor) resolveFailedBatch(batchRequest models.BatchRequest, output models.BatchOutput, depth int, onDone func(models.BatchOutput, error)) {
+    resolved := models.BatchOutput{
+        BatchID: output.BatchID,
+        Status:  output.Status,
+    }
+
+    rejectedLines := make(map[int]models.BatchError)
+    for _, batchError := range output.Errors {
+        if batchError.Line == nil || *batchError.Line < 1 || *batchError.Line > len(batchRequest.Requests) {
+            continue
+        }
+        rejectedLines[*batchError.Line-1] = batchError
+    }
+
+    if len(rejectedLines) > 0 {
+        var remaining []models.BatchRequestItem
+        for i, item := range batchRequest.Requests {
+            if batchError, rejected := rejectedLines[i]; rejected {
+                resolved.Failed = append(resolved.Failed, rejectItem(item, batchError.Code, batchError.Message))
+            } else {
+                remaining = append(remaining, item)
+            }
+        }
+        logger.InfoLogger.Printf("Batch %s failed on %d lines, resubmitting the remaining %d requests",
+            output.BatchID, len(resolved.Failed), len(remaining))
+
+        p.resubmitParts(resolved, batchRequest.JobID, depth, onDone, remaining)
+        return
+    }
+
+    code, message := summarizeBatchErrors(output.Errors)
+    if len(batchRequest.Requests) == 1 || depth >= p.bisectConfig.GetMaxDepth() || !isInputFailure(output.Errors) {
+        for _, item := range batchRequest.Requests {
+            resolved.Failed = append(resolved.Failed, rejectItem(item, code, message))
+        }
+        logger.WarnLogger.Printf("Rejecting %d requests of failed batch %s: %s", len(batchRequest.Requests), output.BatchID, message)
+        onDone(resolved, nil)
+        return
+    }
+
+    half := len(batchRequest.Requests) / 2
+    logger.InfoLogger.Printf("Batch %s failed without line information, splitting %d requests into halves",
+        output.BatchID, len(batchRequest.Requests))
+
+    p.resubmitParts(resolved, batchRequest.JobID, depth+1, onDone, batchRequest.Requests[:half], batchRequest.Requests[half:])
+}
+
+// isInputFailure tells whether every error of a failed batch was caused by its input file.
+func isInputFailure(batchErrors []models.BatchError) bool {
+    for _, batchError := range batchErrors {
+        if !inputErrorCodes[batchError.Code] {
+            return false
+        }
+    }
+    return len(batchErrors) > 0
+}
+
+// queuedPart is a part of a failed batch waiting for one of the resubmission slots.
+type queuedPart struct {
+    request models.BatchRequest
+    onDone  func(models.BatchOutput, error)
+}
+
+// resubmitParts submits each part as its own batch of job jobID and merges what comes back into
+// resolved, which is handed to onDone once every part finished.
+// Requests of a part whose batch could not be processed are left out, so they are treated as unfinished.
+func (p *processor) resubmitParts(resolved models.BatchOutput, jobID string, depth int, onDone func(models.BatchOutput, error), parts ...[]models.BatchRequestItem) {
+    var mu sync.Mutex
+    pending := 0
+    for _, part := range parts {
+        if len(part) > 0 {
+            pending++
+        }
+    }
+    if pending == 0 {
+        onDone(resolved, nil)
+        return
+    }
+
+    merge := func(output models.BatchOutput, err error) {
+        if err != nil {
+            logger.ErrorLogger.Printf("Failed to process resubmitted part of batch %s: %v", resolved.BatchID, err)
+        }
+
+        mu.Lock()
+        resolved.Responses = append(resolved.Responses, output.Responses...)
+        resolved.Failed = append(resolved.Failed, output.Failed...)
+        pending--
+        done := pending == 0
+        mu.Unlock()
+        if done {
+            onDone(resolved, nil)
+        }
+    }
+    for _, part := range parts {
+        if len(part) == 0 {
+            continue
+        }
+        partRequest := models.BatchRequest{Requests: part, JobID: jobID}
+        p.resubmit(partRequest, func(output models.BatchOutput, err error) {
+            if output.Status == "failed" {
+                logger.WarnLogger.Printf("Resubmitted part of batch %s failed in batch %s: %v", resolved.BatchID, output.BatchID, err)
+                p.resolveFailedBatch(partRequest, output, depth, merge)
+                return
+            }
+            merge(output, err)
+        })
+    }
+}
+
+// resubmit submits a part of a failed batch once fewer than the configured number of them are
+// running, across all failed batches. A part only takes up a slot while its own batch runs, not
+// while the parts it is split into are resolved.
+func (p *processor) resubmit(request models.BatchRequest, onDone func(models.BatchOutput, error)) {
+    p.mu.Lock()
+    if p.resubmitting >= p.bisectConfig.GetMaxConcurrentBatches() {
+        p.queuedParts = append(p.queuedParts, queuedPart{request, onDone})
+        p.mu.Unlock()
+        return
+    }
+    p.resubmitting++
+    p.mu.Unlock()
+
+    p.runResubmission(queuedPart{request, onDone})
+}
+
+// runResubmission submits a part that was given a slot, and hands the slot on to the next
+// queued part once the part's batch finished.
+func (p *processor) runResubmission(part queuedPart) {
+    p.submitBatch(part.request, func(output models.BatchOutput, err error) {
+        p.mu.Lock()
+        var next *queuedPart
+        if len(p.queuedParts) > 0 {
+            next = &p.queuedParts[0]
+            p.queuedParts = p.queuedParts[1:]
+        } else {
+            p.resubmitting--
+        }
+        p.mu.Unlock()
+
+        if next != nil {
+            p.runResubmission(*next)
+        }
+        part.onDone(output, err)
+    })
+}
+
+func rejectItem(item models.BatchRequestItem, code string, message string) models.BatchResponseItem {
+    return models.BatchResponseItem{
+        CustomID: item.CustomID,
+        Error: &openai.APIError{
+            Code:    code,
+            Type:    "invalid_request_error",
+            Message: message,
+        },
+    }
+}
+
+func summarizeBatchErrors(batchErrors []models.BatchError) (string, string) {
+    if len(batchErrors) == 0 {
+        return "", "batch processing failed"
+    }
+    messages := make([]string, 0, len(batchErrors))
+    for _, batchError := range batchErrors {
+        messages = append(messages, batchError.Message)
+    }
+    return batchErrors[0].Code, fmt.Sprintf("batch processing failed: %s", strings.Join(messages, "; "))
+}
@@ -0,0 +1,139 @@
+package batch
+
+import (
+    "batch-gpt/server/models"
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestIsInputFailure(t *testing.T) {
+    tests := []struct {
+        name   string
+        errors []models.BatchError
+        want   bool
+    }{
+        {name: "no errors", errors: nil, want: false},
+        {name: "input error", errors: []models.BatchError{{Code: "invalid_json_line"}}, want: true},
+        {name: "input errors", errors: []models.BatchError{{Code: "invalid_value"}, {Code: "model_not_found"}}, want: true},
+        {name: "quota error", errors: []models.BatchError{{Code: "token_limit_exceeded"}}, want: false},
+        {name: "input and quota errors", errors: []models.BatchError{{Code: "invalid_value"}, {Code: "insufficient_quota"}}, want: false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := isInputFailure(tt.errors); got != tt.want {
+                t.Errorf("isInputFailure() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestResolveFailedBatch(t *testing.T) {
+    line := func(n int) *int { return &n }
+
+    tests := []struct {
+        name          string
+        requests      int
+        poisoned      []int
+        errors        []models.BatchError
+        maxDepth      int
+        wantFailed    []int
+        wantResponses int
+        wantBatches   int
+    }{
+        {
+            name:          "errors on lines reject those lines",
+            requests:      4,
+            errors:        []models.BatchError{{Code: "invalid_value", Line: line(2)}},
+            maxDepth:      10,
+            wantFailed:    []int{1},
+            wantResponses: 3,
+            wantBatches:   1,
+        },
+        {
+            name:          "input errors without lines are bisected",
+            requests:      8,
+            poisoned:      []int{2, 5},
+            errors:        []models.BatchError{{Code: "invalid_value"}},
+            maxDepth:      10,
+            wantFailed:    []int{2, 5},
+            wantResponses: 6,
+            wantBatches:   10,
+        },
+        {
+            name:          "bisection stops at the maximum depth",
+            requests:      8,
+            poisoned:      []int{0},
+            errors:        []models.BatchError{{Code: "invalid_value"}},
+            maxDepth:      1,
+            wantFailed:    []int{0, 1, 2, 3},
+            wantResponses: 4,
+            wantBatches:   2,
+        },
+        {
+            name:          "other errors reject the whole batch",
+            requests:      4,
+            poisoned:      []int{0},
+            errors:        []models.BatchError{{Code: "token_limit_exceeded"}},
+            maxDepth:      10,
+            wantFailed:    []int{0, 1, 2, 3},
+            wantResponses: 0,
+            wantBatches:   0,
+        },
+        {
+            name:          "a batch without errors is rejected as a whole",
+            requests:      2,
+            maxDepth:      10,
+            wantFailed:    []int{0, 1},
+            wantResponses: 0,
+            wantBatches:   0,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            openAIClient := newTestClient()
+            p := newTestProcessor(openAIClient, tt.maxDepth)
+            batchRequest := testBatchRequest(tt.requests, tt.poisoned...)
+
+            done := make(chan models.BatchOutput, 1)
+            p.ResolveFailedBatch(batchRequest, models.BatchOutput{BatchID: "batch_0", Status: "failed", Errors: tt.errors}, func(output models.BatchOutput, err error) {
+                if err != nil {
+                    t.Errorf("ResolveFailedBatch() error = %v", err)
+                }
+                done <- output
+            })
+            var output models.BatchOutput
+            select {
+            case output = <-done:
+            case <-time.After(5 * time.Second):
+                t.Fatal("ResolveFailedBatch() did not finish")
+            }
+
+            if len(output.Responses) != tt.wantResponses {
+                t.Errorf("got %d responses, want %d", len(output.Responses), tt.wantResponses)
+            }
+            failed := customIDs(output.Failed)
+            if len(failed) != len(tt.wantFailed) {
+                t.Errorf("got failed items %v, want %v", failed, tt.wantFailed)
+            }
+            for _, index := range tt.wantFailed {
+                if !failed[fmt.Sprintf("req-%d", index)] {
+                    t.Errorf("req-%d was not rejected", index)
+                }
+            }
+            if len(openAIClient.batches) != tt.wantBatches {
+                t.Errorf("submitted %d batches, want %d", len(openAIClient.batches), tt.wantBatches)
+            }
+            if openAIClient.maxInFlight > 2 {
+                t.Errorf("%d batches ran at once, want at most 2", openAIClient.maxInFlight)
+            }
+            for _, batch := range openAIClient.batches {
+                if batch.Metadata[metadataJob] == "" {
+                    t.Errorf("batch %s has no job", batch.ID)
+                }
+            }
+        })
+    }
+}
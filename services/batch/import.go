@@ -0,0 +1,107 @@
+package batch
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "context"
+    "errors"
+    "fmt"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// chatCompletionsRoute is the route proxy clients send chat completions to. Requests read
+// back from batch input files are keyed under it so that they hit the cache.
+const chatCompletionsRoute = "/v1/chat/completions"
+
+// ErrBatchAlreadyTracked is returned when importing a batch that batch-gpt already tracks.
+var ErrBatchAlreadyTracked = errors.New("batch is already tracked")
+
+// ImportBatch brings a batch created outside batch-gpt, for example with the OpenAI SDK, into
+// tracking and caches its responses under the hashes of its requests, keyed for tenant.
+// Batches that have not finished are polled and cached once they do; with wait, ImportBatch
+// returns only then, otherwise it reports them as pending straight away.
+func (bo *orchestrator) ImportBatch(batchID string, tenant string, wait bool) (models.BatchImport, error) {
+    result := models.BatchImport{BatchID: batchID}
+    if err := models.ValidateTenant(tenant); err != nil {
+        return result, err
+    }
+
+    // Saves reading the input file of a batch that is tracked already
+    if _, err := bo.store.GetLatestBatchStatus(batchID); err == nil {
+        return result, ErrBatchAlreadyTracked
+    } else if !errors.Is(err, db.ErrNotFound) {
+        return result, fmt.Errorf("failed to look up batch: %w", err)
+    }
+
+    ctx := context.Background()
+    batchStatus, err := bo.processor.(*processor).client.RetrieveBatch(ctx, batchID)
+    if err != nil {
+        return result, fmt.Errorf("failed to retrieve batch: %w", err)
+    }
+    result.Status = batchStatus.Status
+    if batchStatus.Endpoint != openai.BatchEndpointChatCompletions {
+        return result, fmt.Errorf("batch endpoint is %s, only %s batches can be cached", batchStatus.Endpoint, openai.BatchEndpointChatCompletions)
+    }
+
+    rawResponse, err := bo.processor.(*processor).client.GetFileContent(ctx, batchStatus.InputFileID)
+    if err != nil {
+        return result, fmt.Errorf("failed to get input file: %w", err)
+    }
+    requests, err := GetBatchInputRequests(rawResponse)
+    if err != nil {
+        return result, fmt.Errorf("failed to parse input file: %w", err)
+    }
+    if tenant == "" {
+        tenant = models.DefaultTenant
+    }
+    for i := range requests {
+        requests[i].Request.Tenant = tenant
+        requests[i].Request.Route = chatCompletionsRoute
+    }
+    result.Requests = len(requests)
+
+    // The batch is tagged with its tenant like the batches batch-gpt creates, so that its requests
+    // get the tenant back through restoreRequestKeys if it is continued after a restart
+    metadata := make(map[string]any, len(batchStatus.Metadata)+1)
+    for key, value := range batchStatus.Metadata {
+        metadata[key] = value
+    }
+    metadata[metadataTenants] = tenant
+    batchStatus.Metadata = metadata
+    // Tracking fails if another import took the batch on since it was looked up
+    if err := bo.store.TrackBatch(batchStatus); errors.Is(err, db.ErrAlreadyExists) {
+        return result, ErrBatchAlreadyTracked
+    } else if err != nil {
+        return result, fmt.Errorf("failed to track batch: %w", err)
+    }
+    logger.InfoLogger.Printf("ImportBatch: Tracking batch %s with %d requests, status %s", batchID, len(requests), batchStatus.Status)
+
+    done := make(chan models.BatchImport, 1)
+    bo.processor.WatchBatch(batchID, func(output models.BatchOutput, err error) {
+        imported := result
+        imported.Status = output.Status
+        if err != nil {
+            logger.ErrorLogger.Printf("ImportBatch: Failed to collect batch %s: %v", batchID, err)
+            imported.Error = err.Error()
+            done <- imported
+            return
+        }
+        // Custom ids are the importer's own, the cache keys the requests by their hashes
+        bo.cache.CacheResponses(requests, output.Responses)
+        imported.Cached = len(output.Responses)
+        logger.InfoLogger.Printf("ImportBatch: Cached %d responses of batch %s", imported.Cached, batchID)
+        done <- imported
+    })
+
+    if !wait && !models.IsTerminalBatchStatus(batchStatus.Status) {
+        result.Pending = true
+        return result, nil
+    }
+    imported := <-done
+    if imported.Error != "" {
+        return imported, errors.New(imported.Error)
+    }
+    return imported, nil
+}
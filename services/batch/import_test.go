@@ -0,0 +1,212 @@
+package batch
+
+import (
+    "batch-gpt/server/models"
+    "batch-gpt/services/client"
+    "batch-gpt/services/config"
+    "batch-gpt/services/fingerprint"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// testImportClient serves the batches and files of an OpenAI account.
+type testImportClient struct {
+    client.OpenAIClient
+    batches map[string]openai.BatchResponse
+    files   map[string]string
+}
+
+func (c *testImportClient) RetrieveBatch(ctx context.Context, batchID string) (openai.BatchResponse, error) {
+    batchStatus, found := c.batches[batchID]
+    if !found {
+        return openai.BatchResponse{}, &openai.APIError{HTTPStatusCode: 404, Message: "No batch found"}
+    }
+    return batchStatus, nil
+}
+
+func (c *testImportClient) GetFileContent(ctx context.Context, fileID string) (openai.RawResponse, error) {
+    content, found := c.files[fileID]
+    if !found {
+        return openai.RawResponse{}, &openai.APIError{HTTPStatusCode: 404, Message: "No file found"}
+    }
+    return openai.RawResponse{ReadCloser: io.NopCloser(strings.NewReader(content))}, nil
+}
+
+// newImportTestClient serves a chat completions batch of the given status whose requests ask for
+// each of contents, with the responses of a completed batch.
+func newImportTestClient(batchID string, status string, contents ...string) *testImportClient {
+    var input, output strings.Builder
+    for i, content := range contents {
+        fmt.Fprintf(&input, `{"custom_id":"request-%d","method":"POST","url":"/v1/chat/completions","body":{"model":"gpt-4o-mini","messages":[{"role":"user","content":%q}]}}`+"\n", i, content)
+        fmt.Fprintf(&output, `{"id":"response-%d","custom_id":"request-%d","response":{"status_code":200,"body":{"id":"chatcmpl-%d","choices":[{"message":{"role":"assistant","content":"reply"}}]}}}`+"\n", i, i, i)
+    }
+
+    var batchStatus openai.BatchResponse
+    batchStatus.ID = batchID
+    batchStatus.Status = status
+    batchStatus.Endpoint = openai.BatchEndpointChatCompletions
+    batchStatus.InputFileID = "file-input"
+    if status == "completed" {
+        outputFileID := "file-output"
+        batchStatus.OutputFileID = &outputFileID
+    }
+    return &testImportClient{
+        batches: map[string]openai.BatchResponse{batchID: batchStatus},
+        files:   map[string]string{"file-input": input.String(), "file-output": output.String()},
+    }
+}
+
+// newImportTestFixture returns an orchestrator that imports batches from importClient and
+// polls them right away.
+func newImportTestFixture(importClient *testImportClient) *testFixture {
+    fixture := &testFixture{store: &testStore{}, cache: &testCache{}}
+    poller := NewPoller(importClient, fixture.store, testPollingConfig{initialInterval: time.Millisecond, maxInterval: time.Millisecond})
+    go poller.Start()
+    fixture.orchestrator = NewOrchestrator(
+        NewProcessor(importClient, fixture.store, poller, config.NewBisectConfig(), config.NewReconcileConfig()),
+        testUpstream{},
+        fixture.store,
+        fixture.cache,
+        testUsage{},
+        testBudgets{},
+        config.NewServingMode("async"),
+        testResubmissionConfig{},
+        testRetryConfig{maxAttempts: 1},
+        nil,
+        fingerprint.NewFingerprinter(config.NewCacheKeyConfig()),
+        time.Second,
+    )
+    return fixture
+}
+
+func TestImportBatch(t *testing.T) {
+    fixture := newImportTestFixture(newImportTestClient("batch_1", "completed", "first", "second"))
+
+    imported, err := fixture.orchestrator.ImportBatch("batch_1", "acme", false)
+    if err != nil {
+        t.Fatalf("ImportBatch() error = %v", err)
+    }
+    want := models.BatchImport{BatchID: "batch_1", Status: "completed", Requests: 2, Cached: 2}
+    if imported != want {
+        t.Errorf("ImportBatch() = %+v, want %+v", imported, want)
+    }
+
+    if len(fixture.cache.cached) != 2 {
+        t.Fatalf("cached %d requests, want 2", len(fixture.cache.cached))
+    }
+    for _, item := range fixture.cache.cached {
+        if item.Request.Tenant != "acme" || item.Request.Route != chatCompletionsRoute {
+            t.Errorf("cached request keyed for tenant %q and route %q, want acme and %s", item.Request.Tenant, item.Request.Route, chatCompletionsRoute)
+        }
+    }
+
+    tracked, err := fixture.store.GetLatestBatchStatus("batch_1")
+    if err != nil {
+        t.Fatalf("GetLatestBatchStatus() error = %v", err)
+    }
+    if tracked.Metadata[metadataTenants] != "acme" {
+        t.Errorf("tracked batch metadata = %v, want the tenant tagged", tracked.Metadata)
+    }
+
+    if _, err := fixture.orchestrator.ImportBatch("batch_1", "acme", false); !errors.Is(err, ErrBatchAlreadyTracked) {
+        t.Errorf("ImportBatch() of a tracked batch: error = %v, want %v", err, ErrBatchAlreadyTracked)
+    }
+}
+
+func TestImportBatchRejects(t *testing.T) {
+    importClient := newImportTestClient("batch_1", "completed", "first")
+    embeddings := importClient.batches["batch_1"]
+    embeddings.ID = "batch_embeddings"
+    embeddings.Endpoint = openai.BatchEndpointEmbeddings
+    importClient.batches["batch_embeddings"] = embeddings
+    fixture := newImportTestFixture(importClient)
+
+    tests := []struct {
+        name    string
+        batchID string
+        tenant  string
+    }{
+        {name: "missing batch", batchID: "batch_missing"},
+        {name: "embeddings batch", batchID: "batch_embeddings"},
+        {name: "overlong tenant", batchID: "batch_1", tenant: strings.Repeat("t", models.MaxTenantLength+1)},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, err := fixture.orchestrator.ImportBatch(tt.batchID, tt.tenant, false); err == nil {
+                t.Error("ImportBatch() error = nil, want an error")
+            }
+            if _, err := fixture.store.GetLatestBatchStatus(tt.batchID); err == nil {
+                t.Error("rejected batch is tracked")
+            }
+        })
+    }
+}
+
+func TestConcurrentImportsTrackOnce(t *testing.T) {
+    fixture := newImportTestFixture(newImportTestClient("batch_1", "in_progress", "first"))
+
+    var wg sync.WaitGroup
+    errs := make(chan error, 8)
+    for i := 0; i < cap(errs); i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            _, err := fixture.orchestrator.ImportBatch("batch_1", "acme", false)
+            errs <- err
+        }()
+    }
+    wg.Wait()
+    close(errs)
+
+    imported := 0
+    for err := range errs {
+        switch {
+        case err == nil:
+            imported++
+        case !errors.Is(err, ErrBatchAlreadyTracked):
+            t.Errorf("ImportBatch() error = %v", err)
+        }
+    }
+    if imported != 1 {
+        t.Errorf("%d imports succeeded, want 1", imported)
+    }
+}
+
+func TestImportedTenantSurvivesRestart(t *testing.T) {
+    importClient := newImportTestClient("batch_1", "in_progress", "first")
+    fixture := newImportTestFixture(importClient)
+
+    imported, err := fixture.orchestrator.ImportBatch("batch_1", "acme", false)
+    if err != nil {
+        t.Fatalf("ImportBatch() error = %v", err)
+    }
+    if !imported.Pending {
+        t.Errorf("ImportBatch() of a running batch = %+v, want it pending", imported)
+    }
+
+    // Statuses polled since carry only the metadata of the batch upstream
+    time.Sleep(10 * time.Millisecond)
+    tracked, err := fixture.store.GetLatestBatchStatus("batch_1")
+    if err != nil {
+        t.Fatalf("GetLatestBatchStatus() error = %v", err)
+    }
+
+    // After a restart, the requests of the dangling batch are read back from its input file
+    restarted := newImportTestFixture(importClient)
+    requests, err := GetBatchInputRequests(io.NopCloser(strings.NewReader(importClient.files["file-input"])))
+    if err != nil {
+        t.Fatalf("GetBatchInputRequests() error = %v", err)
+    }
+    restarted.orchestrator.restoreRequestKeys(tracked, requests)
+    if tenant := requests[0].Request.Tenant; tenant != "acme" {
+        t.Errorf("restored tenant = %q, want acme", tenant)
+    }
+}
@@ -6,26 +6,34 @@ import (
     "encoding/json"
     "fmt"
     "io"
-    openai "github.com/sashabaranov/go-openai"
 )
 
+// maxInputLineSize bounds a line of a batch input file, which the Batch API limits to 200MB as a whole.
+const maxInputLineSize = 16 * 1024 * 1024
+
 func GetBatchInputRequests(rawResponse io.ReadCloser) ([]models.BatchRequestItem, error) {
     defer rawResponse.Close()
 
     var items []models.BatchRequestItem
     scanner := bufio.NewScanner(rawResponse)
+    // A line holds a whole request, which may be far longer than the default limit of 64KB
+    scanner.Buffer(make([]byte, 0, 64*1024), maxInputLineSize)
 
     for scanner.Scan() {
         var batchItem struct {
-            CustomID string                        `json:"custom_id"`
-            Body     openai.ChatCompletionRequest `json:"body"`
+            CustomID string          `json:"custom_id"`
+            Body     json.RawMessage `json:"body"`
         }
         if err := json.Unmarshal(scanner.Bytes(), &batchItem); err != nil {
             return nil, fmt.Errorf("failed to unmarshal batch item: %w", err)
         }
+        request, err := models.NewChatRequest(batchItem.Body)
+        if err != nil {
+            return nil, fmt.Errorf("failed to unmarshal body of batch item %s: %w", batchItem.CustomID, err)
+        }
         items = append(items, models.BatchRequestItem{
             CustomID: batchItem.CustomID,
-            Request:  batchItem.Body,
+            Request:  request,
         })
     }
 
@@ -4,10 +4,15 @@ import (
 	"batch-gpt/server/db"
 	"batch-gpt/server/logger"
 	"batch-gpt/server/models"
+	"batch-gpt/services/budget"
 	"batch-gpt/services/cache"
+	"batch-gpt/services/client"
 	"batch-gpt/services/config"
-	"batch-gpt/services/utils"
+	"batch-gpt/services/fingerprint"
+	"batch-gpt/services/usage"
 	"context"
+	"errors"
+	"fmt"
 	// "os"
 	"sync"
 	"time"
@@ -16,33 +21,72 @@ import (
 )
 
 type orchestrator struct {
-    submitNextRequests         map[string]openai.ChatCompletionRequest
+    submitNextRequests         map[string]models.ChatRequest
     submitNextResultChannels   map[string][]chan BatchResult
-    allSubmittedRequests      map[string]openai.ChatCompletionRequest
+    allSubmittedRequests      map[string]models.ChatRequest
     allSubmittedResultChannels map[string][]chan BatchResult
     mu                        sync.Mutex
     batchDuration            time.Duration
     processingTicker         *time.Ticker
     processor               Processor
+    upstream                client.HealthReporter
+    store                   db.Store
     cache                   cache.Orchestrator
+    usage                   usage.Tracker
+    budgets                 budget.Enforcer
+    // reservations holds the estimated cost of every pending request against its tenant's budget
+    reservations            map[string]budget.Reservation
     servingMode             config.ServingMode
+    resubmissionConfig      config.ResubmissionConfig
+    resubmissions           map[string]int
+    retryConfig             config.RetryConfig
+    reconcileConfig         config.ReconcileConfig
+    attempts                map[string]int
+    // submissions counts the batches processBatch submitted each request in, the attempts a dead letter records
+    submissions             map[string]int
+    batchIDs                map[string][]string
+    // queuedAt holds when each request stored in the queue was queued, to remove it once settled
+    queuedAt                map[string]time.Time
+    fingerprinter           fingerprint.Fingerprinter
 }
 
 func NewOrchestrator(
     processor Processor,
+    upstream client.HealthReporter,
+    store db.Store,
     cache cache.Orchestrator,
+    usage usage.Tracker,
+    budgets budget.Enforcer,
     servingMode config.ServingMode,
+    resubmissionConfig config.ResubmissionConfig,
+    retryConfig config.RetryConfig,
+    reconcileConfig config.ReconcileConfig,
+    fingerprinter fingerprint.Fingerprinter,
     batchDuration time.Duration,
 ) *orchestrator {
     return &orchestrator{
         processor:                processor,
+        upstream:                 upstream,
+        store:                    store,
         cache:                    cache,
+        usage:                    usage,
+        budgets:                  budgets,
         servingMode:             servingMode,
+        resubmissionConfig:      resubmissionConfig,
+        retryConfig:             retryConfig,
+        reconcileConfig:         reconcileConfig,
+        fingerprinter:           fingerprinter,
         batchDuration:           batchDuration,
-        submitNextRequests:      make(map[string]openai.ChatCompletionRequest),
+        submitNextRequests:      make(map[string]models.ChatRequest),
         submitNextResultChannels: make(map[string][]chan BatchResult),
-        allSubmittedRequests:    make(map[string]openai.ChatCompletionRequest),
+        allSubmittedRequests:    make(map[string]models.ChatRequest),
         allSubmittedResultChannels: make(map[string][]chan BatchResult),
+        resubmissions:           make(map[string]int),
+        attempts:                make(map[string]int),
+        submissions:             make(map[string]int),
+        batchIDs:                make(map[string][]string),
+        queuedAt:                make(map[string]time.Time),
+        reservations:            make(map[string]budget.Reservation),
     }
 }
 
@@ -59,12 +103,12 @@ func (bo *orchestrator) startProcessing() {
     }
 }
 
-func (bo *orchestrator) AddRequest(request openai.ChatCompletionRequest) <-chan BatchResult {
+func (bo *orchestrator) AddRequest(request models.ChatRequest) <-chan BatchResult {
     bo.mu.Lock()
-    defer bo.mu.Unlock()
 
-    hash, err := utils.GenerateRequestHash(request)
+    hash, err := bo.fingerprinter.Fingerprint(request)
     if err != nil {
+        bo.mu.Unlock()
         logger.ErrorLogger.Printf("Failed to generate request hash: %v", err)
         resultChan := make(chan BatchResult, 1)
         resultChan <- BatchResult{Error: err}
@@ -74,13 +118,15 @@ func (bo *orchestrator) AddRequest(request openai.ChatCompletionRequest) <-chan
 
     resultChan := make(chan BatchResult, 1)
 
+    var queued *models.QueuedRequest
     if _, found := bo.allSubmittedRequests[hash]; found {
         logger.InfoLogger.Printf("BatchOrchestrator: cache hit: %s", hash)
+        queued = bo.mergeDirective(hash, request.CacheDirective)
     } else {
         logger.InfoLogger.Printf("BatchOrchestrator: cache miss: %s", hash)
         bo.submitNextRequests[hash] = request
-        bo.allSubmittedRequests[hash] = request
-        bo.allSubmittedResultChannels[hash] = []chan BatchResult{}
+        bo.track(hash, request)
+        queued = bo.queue(hash, request)
     }
 
     if bo.servingMode.IsAsync() {
@@ -92,10 +138,121 @@ func (bo *orchestrator) AddRequest(request openai.ChatCompletionRequest) <-chan
 	    // In sync mode, save channel to send result to once the response is available
 	    bo.allSubmittedResultChannels[hash] = append(bo.allSubmittedResultChannels[hash], resultChan)
     }
+    bo.mu.Unlock()
 
+    // Stored before the request is acknowledged, so it is not lost if batch-gpt restarts before it is settled
+    bo.saveQueuedRequest(queued)
     return resultChan
 }
 
+// RequeueRequest queues a request for the next batch without waiting for its result.
+func (bo *orchestrator) RequeueRequest(request models.ChatRequest) error {
+    if bo.servingMode.IsCache() {
+        return errors.New("requests cannot be queued in cache-only mode")
+    }
+
+    hash, err := bo.fingerprinter.Fingerprint(request)
+    if err != nil {
+        return fmt.Errorf("failed to generate request hash: %w", err)
+    }
+
+    bo.mu.Lock()
+    var queued *models.QueuedRequest
+    if _, found := bo.allSubmittedRequests[hash]; found {
+        logger.InfoLogger.Printf("BatchOrchestrator: request %s is already queued", hash)
+        queued = bo.mergeDirective(hash, request.CacheDirective)
+    } else {
+        bo.submitNextRequests[hash] = request
+        bo.track(hash, request)
+        queued = bo.queue(hash, request)
+        logger.InfoLogger.Printf("BatchOrchestrator: requeued request %s", hash)
+    }
+    bo.mu.Unlock()
+
+    bo.saveQueuedRequest(queued)
+    return nil
+}
+
+// track registers a request that is going upstream and reserves its estimated cost until
+// sendResult settles it. Identical requests share the reservation, as they share the batch item.
+// Callers must hold bo.mu.
+func (bo *orchestrator) track(hash string, request models.ChatRequest) {
+    bo.allSubmittedRequests[hash] = request
+    bo.allSubmittedResultChannels[hash] = []chan BatchResult{}
+    bo.reservations[hash] = bo.budgets.Reserve(request)
+}
+
+// mergeDirective lets an identical request joining a tracked one strengthen its cache
+// directive, so the shared response is cached if any of their callers wants it cached.
+// If that changed the directive of a request stored in the queue, it returns the request to store again.
+// Callers must hold bo.mu.
+func (bo *orchestrator) mergeDirective(hash string, directive models.CacheDirective) *models.QueuedRequest {
+    request := bo.allSubmittedRequests[hash]
+    merged := request.CacheDirective.Merge(directive)
+    if merged == request.CacheDirective {
+        return nil
+    }
+    request.CacheDirective = merged
+    bo.allSubmittedRequests[hash] = request
+    if queued, found := bo.submitNextRequests[hash]; found {
+        queued.CacheDirective = merged
+        bo.submitNextRequests[hash] = queued
+    }
+
+    queuedAt, stored := bo.queuedAt[hash]
+    if !stored {
+        return nil
+    }
+    return newQueuedRequest(hash, request, queuedAt)
+}
+
+// queue records that a newly tracked request is stored in the queue and returns it to store.
+// Callers must hold bo.mu.
+func (bo *orchestrator) queue(hash string, request models.ChatRequest) *models.QueuedRequest {
+    queuedAt := time.Now().UTC().Truncate(time.Millisecond)
+    bo.queuedAt[hash] = queuedAt
+    return newQueuedRequest(hash, request, queuedAt)
+}
+
+func newQueuedRequest(hash string, request models.ChatRequest, queuedAt time.Time) *models.QueuedRequest {
+    return &models.QueuedRequest{
+        Hash:           hash,
+        Body:           request.Body,
+        Tenant:         request.Tenant,
+        Route:          request.Route,
+        CacheDirective: request.CacheDirective,
+        CacheTTL:       request.CacheTTL,
+        QueuedAt:       queuedAt,
+    }
+}
+
+// saveQueuedRequest stores a request returned by queue or mergeDirective, if any.
+// A request that cannot be stored is still submitted, it is only lost if batch-gpt restarts first.
+func (bo *orchestrator) saveQueuedRequest(queued *models.QueuedRequest) {
+    if queued == nil {
+        return
+    }
+    if err := bo.store.SaveQueuedRequest(*queued); err != nil {
+        logger.ErrorLogger.Printf("BatchOrchestrator: Failed to store queued request %s: %v", queued.Hash, err)
+    }
+}
+
+// trackedDirectives returns items with the cache directives of the requests tracked under their
+// custom ids, which identical requests may have changed since the items were submitted.
+func (bo *orchestrator) trackedDirectives(items []models.BatchRequestItem) []models.BatchRequestItem {
+    bo.mu.Lock()
+    defer bo.mu.Unlock()
+
+    updated := make([]models.BatchRequestItem, len(items))
+    for i, item := range items {
+        if tracked, found := bo.allSubmittedRequests[item.CustomID]; found {
+            item.Request.CacheDirective = tracked.CacheDirective
+        }
+        updated[i] = item
+    }
+    return updated
+}
+
 func (bo *orchestrator) ProcessBatch() {
     bo.processBatch()
 }
@@ -105,9 +262,19 @@ func (bo *orchestrator) StartProcessing() {
 }
 
 func (bo *orchestrator) processBatch() {
+    // Requests keep collating while the OpenAI API is unhealthy. Once the open period is over,
+    // creating the batch is the trial call that tells whether the API recovered.
+    if health := bo.upstream.Health(); health.State == client.CircuitOpen && time.Now().Before(*health.RetryAt) {
+        logger.WarnLogger.Printf("processBatch: OpenAI API is unhealthy, holding back submission until %s", health.RetryAt.Format(time.RFC3339))
+        return
+    }
+
     bo.mu.Lock()
     requests := bo.submitNextRequests
-    bo.submitNextRequests = make(map[string]openai.ChatCompletionRequest)
+    bo.submitNextRequests = make(map[string]models.ChatRequest)
+    for hash := range requests {
+        bo.submissions[hash]++
+    }
     bo.mu.Unlock()
 
     if len(requests) == 0 {
@@ -126,146 +293,437 @@ func (bo *orchestrator) processBatch() {
         })
     }
 
-    responses, err := bo.processor.ProcessBatch(batchRequest)
+    for _, items := range splitByTenants(batchRequest.Requests) {
+        part := models.BatchRequest{Requests: items}
+        partRequests := requests
+        if len(items) < len(requests) {
+            partRequests = make(map[string]models.ChatRequest, len(items))
+            for _, item := range items {
+                partRequests[item.CustomID] = requests[item.CustomID]
+            }
+        }
+        // The batch is settled once it finished, without a goroutine waiting for it
+        bo.processor.ProcessBatch(part, func(output models.BatchOutput, err error) {
+            bo.completeBatch(partRequests, part, output, err)
+        })
+    }
+}
 
+// completeBatch settles the requests of a batch submitted by processBatch once the batch finished
+// or could not be created.
+func (bo *orchestrator) completeBatch(requests map[string]models.ChatRequest, batchRequest models.BatchRequest, output models.BatchOutput, err error) {
+    if output.BatchID == "" && client.IsTransient(err) {
+        // The batch was never created, so the requests are not lost but wait for the next one
+        logger.WarnLogger.Printf("processBatch: Failed to submit batch, requeueing %d requests: %v", len(requests), err)
+        bo.mu.Lock()
+        for hash, request := range requests {
+            if _, pending := bo.allSubmittedRequests[hash]; pending {
+                bo.submitNextRequests[hash] = request
+                bo.submissions[hash]--
+            }
+        }
+        bo.mu.Unlock()
+        return
+    }
+
+    bo.usage.RecordBatch(batchRequest.Requests, output.Responses)
     if err == nil {
-        bo.cache.CacheResponses(batchRequest.Requests, responses)
+        bo.cache.CacheResponses(bo.trackedDirectives(batchRequest.Requests), output.Responses)
+    } else {
+        logger.ErrorLogger.Printf("processBatch: Failed to process batch %s: %v", output.BatchID, err)
     }
 
     bo.mu.Lock()
-    defer bo.mu.Unlock()
+    deadLetters := bo.settleBatch(requests, output, err)
+    bo.mu.Unlock()
+
+    bo.saveDeadLetters(deadLetters)
+}
+
+// settleBatch hands the outcome of a batch to the requests waiting on it and decides
+// what happens to the ones that did not get a response. It returns the dead letters
+// to persist once bo.mu is released.
+// Callers must hold bo.mu.
+func (bo *orchestrator) settleBatch(requests map[string]models.ChatRequest, output models.BatchOutput, batchErr error) []models.DeadLetter {
+    if output.BatchID != "" {
+        for hash := range requests {
+            if _, pending := bo.allSubmittedRequests[hash]; pending {
+                bo.batchIDs[hash] = append(bo.batchIDs[hash], output.BatchID)
+            }
+        }
+    }
 
+    bo.deliverResponses(output.Responses)
+    deadLetters := bo.handleFailed(output)
+    return append(deadLetters, bo.handleUnfinished(requests, output, batchErr)...)
+}
+
+// deliverResponses sends each response to every channel waiting on its hash.
+// Callers must hold bo.mu.
+func (bo *orchestrator) deliverResponses(responses []models.BatchResponseItem) {
     for _, response := range responses {
-        result := BatchResult{
+        // The hash was submitted as the custom id during batch request creation to openAI
+        bo.sendResult(response.CustomID, BatchResult{
             Response: response.Response.Body,
-            Error:    err,
+            // if a new request arrives for a dangling batch in sync mode,
+            // it needs to receive IsAsync as false.
             IsAsync:  false,
+        })
+    }
+}
+
+// sendResult delivers result to all channels waiting on hash and forgets the request.
+// Callers must hold bo.mu.
+func (bo *orchestrator) sendResult(hash string, result BatchResult) {
+    channels, ok := bo.allSubmittedResultChannels[hash]
+    if !ok {
+        return
+    }
+    for _, ch := range channels {
+        select {
+        case ch <- result:
+        default:
+            // Channel is full, log this situation
+            logger.WarnLogger.Printf("Unable to send result for batch item %s", hash)
         }
-        hash := response.CustomID
-        if channels, ok := bo.allSubmittedResultChannels[hash]; ok {
-            for _, ch := range channels {
-                select {
-                case <-ch: // Try to receive, in case an async result was already sent
-                    // Channel was already used for async response, don't send again
-                default:
-                    ch <- result
-                }
-                close(ch)
+        close(ch)
+    }
+    delete(bo.allSubmittedRequests, hash)
+    delete(bo.allSubmittedResultChannels, hash)
+    delete(bo.resubmissions, hash)
+    delete(bo.attempts, hash)
+    delete(bo.submissions, hash)
+    delete(bo.batchIDs, hash)
+    if queuedAt, stored := bo.queuedAt[hash]; stored {
+        delete(bo.queuedAt, hash)
+        go func() {
+            if err := bo.store.DeleteQueuedRequest(hash, queuedAt); err != nil {
+                logger.ErrorLogger.Printf("BatchOrchestrator: Failed to remove settled request %s from the queue: %v", hash, err)
             }
-            delete(bo.allSubmittedRequests, hash)
-            delete(bo.allSubmittedResultChannels, hash)
+        }()
+    }
+    if reservation, reserved := bo.reservations[hash]; reserved {
+        bo.budgets.Release(reservation)
+        delete(bo.reservations, hash)
+    }
+}
+
+// handleFailed retries failed items whose error class is retryable until they run out
+// of attempts. Items that are not retried are dead-lettered and their waiters receive the error.
+// Items that never ran because the batch expired or was cancelled are left to handleUnfinished.
+// Callers must hold bo.mu.
+func (bo *orchestrator) handleFailed(output models.BatchOutput) []models.DeadLetter {
+    var deadLetters []models.DeadLetter
+    retried := 0
+    for _, item := range output.Failed {
+        hash := item.CustomID
+        request, pending := bo.allSubmittedRequests[hash]
+        if !pending {
+            continue
+        }
+
+        errorClass := classifyItemError(item)
+        if errorClass == errorClassUnfinished {
+            continue
+        }
+        message := itemErrorMessage(item)
+        bo.attempts[hash]++
+
+        if !bo.servingMode.IsCache() && bo.retryConfig.IsRetryable(errorClass) && bo.attempts[hash] < bo.retryConfig.GetMaxAttempts() {
+            bo.submitNextRequests[hash] = request
+            retried++
+            continue
+        }
+
+        deadLetters = append(deadLetters, bo.deadLetter(hash, errorClass, message))
+        bo.sendResult(hash, BatchResult{
+            Error: fmt.Errorf("request failed in batch %s after %d attempts: %s", output.BatchID, bo.attempts[hash], message),
+        })
+    }
+
+    if retried > 0 {
+        logger.InfoLogger.Printf("Retrying %d failed requests from batch %s", retried, output.BatchID)
+    }
+    return deadLetters
+}
+
+// deadLetter records what is known about a request that is being given up on.
+// Callers must hold bo.mu.
+func (bo *orchestrator) deadLetter(hash string, errorClass string, message string) models.DeadLetter {
+    request := bo.allSubmittedRequests[hash]
+    return models.DeadLetter{
+        Hash:       hash,
+        Request:    request.Body,
+        Tenant:     request.Tenant,
+        Route:      request.Route,
+        LastError:  message,
+        ErrorClass: errorClass,
+        BatchIDs:   append([]string(nil), bo.batchIDs[hash]...),
+        Attempts:   bo.submissions[hash],
+        CreatedAt:  time.Now(),
+    }
+}
+
+func (bo *orchestrator) saveDeadLetters(deadLetters []models.DeadLetter) {
+    for _, deadLetter := range deadLetters {
+        if err := bo.store.SaveDeadLetter(deadLetter); err != nil {
+            logger.ErrorLogger.Printf("Failed to save dead letter for request %s: %v", deadLetter.Hash, err)
         }
     }
+    if len(deadLetters) > 0 {
+        logger.WarnLogger.Printf("Moved %d requests to dead letters", len(deadLetters))
+    }
 }
 
+// handleUnfinished deals with the requests of a batch that did not get a response.
+// If the batch itself errored, their waiters receive that error. If the batch expired
+// or was cancelled, the requests are queued for the next batch until the resubmission
+// limit is reached, after which they are dead-lettered and their waiters receive an error.
+// Callers must hold bo.mu.
+func (bo *orchestrator) handleUnfinished(requests map[string]models.ChatRequest, output models.BatchOutput, batchErr error) []models.DeadLetter {
+    var deadLetters []models.DeadLetter
+    requeued := 0
+    for hash, request := range requests {
+        if _, pending := bo.allSubmittedRequests[hash]; !pending {
+            continue
+        }
+        // handleFailed already queued the items it retries
+        if _, queued := bo.submitNextRequests[hash]; queued {
+            continue
+        }
+
+        if batchErr != nil {
+            bo.sendResult(hash, BatchResult{Error: batchErr})
+            continue
+        }
+
+        if bo.servingMode.IsCache() || !bo.resubmissionConfig.ShouldResubmit() {
+            message := fmt.Sprintf("request did not finish before batch %s was %s", output.BatchID, output.Status)
+            deadLetters = append(deadLetters, bo.deadLetter(hash, errorClassUnfinished, message))
+            bo.sendResult(hash, BatchResult{Error: errors.New(message)})
+            continue
+        }
+
+        if bo.resubmissions[hash] >= bo.resubmissionConfig.GetMaxResubmissions() {
+            message := fmt.Sprintf("request did not finish before batch %s was %s, giving up after %d resubmissions",
+                output.BatchID, output.Status, bo.resubmissions[hash])
+            deadLetters = append(deadLetters, bo.deadLetter(hash, errorClassUnfinished, message))
+            bo.sendResult(hash, BatchResult{Error: errors.New(message)})
+            continue
+        }
+
+        bo.resubmissions[hash]++
+        bo.submitNextRequests[hash] = request
+        requeued++
+    }
+
+    if requeued > 0 {
+        logger.InfoLogger.Printf("Requeued %d unfinished requests from %s batch %s", requeued, output.Status, output.BatchID)
+    }
+    return deadLetters
+}
+
+// danglingBatchPageSize is how many dangling batches are read from the store at a time.
+const danglingBatchPageSize = 100
+
+// ContinueDanglingBatches registers the requests of the batches submitted before a restart and the
+// requests stored in the queue, then watches the batches. The queue is restored once the requests
+// of the batches are tracked, so the ones a batch already holds are not submitted again, and before
+// any batch can settle, so the queued copies of its requests are removed with them.
 func (bo *orchestrator) ContinueDanglingBatches() {
     logger.InfoLogger.Println("ContinueDanglingBatches: Starting to process dangling batches")
-    danglingBatches, err := db.GetDanglingBatches()
+
+    var watches []func()
+    after := ""
+    for {
+        danglingBatches, err := bo.store.GetDanglingBatches(after, danglingBatchPageSize)
+        if err != nil {
+            logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to get dangling batches: %v", err)
+            break
+        }
+
+        for _, batch := range danglingBatches {
+            logger.InfoLogger.Printf("ContinueDanglingBatches: Found dangling batch %s, last seen %s", batch.ID, batch.Status)
+            if watch := bo.trackDanglingBatch(batch); watch != nil {
+                watches = append(watches, watch)
+            }
+        }
+
+        if len(danglingBatches) < danglingBatchPageSize {
+            break
+        }
+        after = danglingBatches[len(danglingBatches)-1].ID
+    }
+
+    if !bo.servingMode.IsCache() {
+        bo.restoreQueuedRequests()
+    }
+    for _, watch := range watches {
+        watch()
+    }
+    logger.InfoLogger.Printf("ContinueDanglingBatches: Continued %d dangling batches", len(watches))
+}
+
+// restoreQueuedRequests queues the requests stored in the queue that are not tracked yet. Those
+// that are, because a dangling batch holds them, are removed from the queue once settled.
+func (bo *orchestrator) restoreQueuedRequests() {
+    stored, err := bo.store.GetQueuedRequests()
     if err != nil {
-        logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to get dangling batches: %v", err)
+        logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to read the queued requests: %v", err)
         return
     }
 
-    logger.InfoLogger.Printf("ContinueDanglingBatches: Found %d dangling batches", len(danglingBatches))
-
-    for _, batchID := range danglingBatches {
-        go func(id string) {
-            logger.InfoLogger.Printf("ContinueDanglingBatches: Processing dangling batch: %s", id)
+    restored := 0
+    var rehashed []*models.QueuedRequest
+    var stale []models.QueuedRequest
+    bo.mu.Lock()
+    for _, queued := range stored {
+        request, err := models.NewChatRequest(queued.Body)
+        if err != nil {
+            logger.ErrorLogger.Printf("ContinueDanglingBatches: Queued request %s is not a valid chat completion request: %v", queued.Hash, err)
+            continue
+        }
+        request.Tenant = queued.Tenant
+        request.Route = queued.Route
+        request.CacheDirective = queued.CacheDirective
+        request.CacheTTL = queued.CacheTTL
+
+        hash, err := bo.fingerprinter.Fingerprint(request)
+        if err != nil {
+            logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to generate hash for queued request %s: %v", queued.Hash, err)
+            continue
+        }
+        if hash != queued.Hash {
+            // The cache key rules changed; the request is stored again under its new hash
+            stale = append(stale, queued)
+        }
 
-            ctx := context.Background()
-            batchStatus, err := bo.processor.(*processor).client.RetrieveBatch(ctx, id)
-            if err != nil {
-                logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to retrieve batch %s: %v", id, err)
-                return
+        if _, tracked := bo.allSubmittedRequests[hash]; !tracked {
+            bo.submitNextRequests[hash] = request
+            bo.track(hash, request)
+            restored++
+        }
+        if _, stored := bo.queuedAt[hash]; !stored {
+            bo.queuedAt[hash] = queued.QueuedAt
+            if hash != queued.Hash {
+                rehashed = append(rehashed, newQueuedRequest(hash, request, queued.QueuedAt))
             }
+        }
+    }
+    bo.mu.Unlock()
 
-            rawResponse, err := bo.processor.(*processor).client.GetFileContent(ctx, batchStatus.InputFileID)
-            if err != nil {
-                logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to get file content: %v", err)
-                return
-            }
+    for _, queued := range rehashed {
+        bo.saveQueuedRequest(queued)
+    }
+    for _, queued := range stale {
+        if err := bo.store.DeleteQueuedRequest(queued.Hash, queued.QueuedAt); err != nil {
+            logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to remove rehashed request %s from the queue: %v", queued.Hash, err)
+        }
+    }
+    logger.InfoLogger.Printf("ContinueDanglingBatches: Restored %d of %d queued requests", restored, len(stored))
+}
 
-            requests, err := GetBatchInputRequests(rawResponse)
-            if err != nil {
-                logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to parse input requests: %v", err)
-                return
-            }
+// continueDanglingBatch registers the requests of a batch submitted before a restart and
+// hands the batch to the poller, settling its requests once it finishes.
+func (bo *orchestrator) continueDanglingBatch(batch openai.Batch) {
+    if watch := bo.trackDanglingBatch(batch); watch != nil {
+        watch()
+    }
+}
 
-            // Add dangling requests to the BatchOrchestrator
-            bo.mu.Lock()
-            for _, req := range requests {
-                hash, err := utils.GenerateRequestHash(req.Request)
-                if err != nil {
-                    logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to generate hash for request in batch %s: %v", id, err)
-                    continue
-                }
-
-                if _, exists := bo.allSubmittedRequests[hash]; !exists {
-                    bo.allSubmittedRequests[hash] = req.Request
-                    bo.allSubmittedResultChannels[hash] = []chan BatchResult{}
-                    logger.InfoLogger.Printf("ContinueDanglingBatches: Added dangling request with hash %s to BatchOrchestrator", hash)
-                }
-            }
-            bo.mu.Unlock()
+// trackDanglingBatch registers the requests of a batch submitted before a restart and returns
+// the function that hands the batch to the poller, or nil if its requests cannot be read.
+func (bo *orchestrator) trackDanglingBatch(batch openai.Batch) func() {
+    id := batch.ID
+    logger.InfoLogger.Printf("ContinueDanglingBatches: Processing dangling batch: %s", id)
 
-            responses, err := bo.processor.PollAndCollectResponses(id)
-            if err != nil {
-                logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to process dangling batch %s: %v", id, err)
-                return
-            }
-            logger.InfoLogger.Printf("ContinueDanglingBatches: Successfully processed dangling batch: %s", id)
+    rawResponse, err := bo.processor.(*processor).client.GetFileContent(context.Background(), batch.InputFileID)
+    if err != nil {
+        logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to get file content: %v", err)
+        return nil
+    }
 
-            // Update BatchOrchestrator with results
+    requests, err := GetBatchInputRequests(rawResponse)
+    if err != nil {
+        logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to parse input requests: %v", err)
+        return nil
+    }
+    bo.restoreRequestKeys(batch, requests)
+
+    // Add dangling requests to the BatchOrchestrator.
+    // The batch may have been submitted with hashes of an older fingerprint version, so
+    // responses are matched to requests through the custom ids stored in the batch and
+    // then tracked under the current hash like any other request.
+    pendingRequests := make(map[string]models.ChatRequest, len(requests))
+    hashByCustomID := make(map[string]string, len(requests))
+    cacheRequests := make([]models.BatchRequestItem, 0, len(requests))
+    bo.mu.Lock()
+    for _, req := range requests {
+        hash, err := bo.fingerprinter.Fingerprint(req.Request)
+        if err != nil {
+            logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to generate hash for request in batch %s: %v", id, err)
+            continue
+        }
+        pendingRequests[hash] = req.Request
+        hashByCustomID[req.CustomID] = hash
+        cacheRequests = append(cacheRequests, models.BatchRequestItem{
+            CustomID: hash,
+            Request:  req.Request,
+        })
+
+        if _, exists := bo.allSubmittedRequests[hash]; !exists {
+            bo.track(hash, req.Request)
+            logger.InfoLogger.Printf("ContinueDanglingBatches: Added dangling request with hash %s to BatchOrchestrator", hash)
+        }
+        bo.submissions[hash]++
+    }
+    bo.mu.Unlock()
+
+    complete := func(output models.BatchOutput, err error) {
+        translateCustomIDs(output.Responses, hashByCustomID)
+        translateCustomIDs(output.Failed, hashByCustomID)
+        bo.usage.RecordBatch(cacheRequests, output.Responses)
+        if err != nil {
+            logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to process dangling batch %s: %v", id, err)
             bo.mu.Lock()
-            for _, resp := range responses {
-                hash := resp.CustomID // Assuming hash was submitted as the custom id during batch request creation to openAI
-                result := BatchResult{
-                    Response: resp.Response.Body,
-                    Error:    nil,
-                    // if a new request arrives for a dangling batch in sync mode,
-                    // it needs to receive IsAsync as false.
-                    IsAsync:  false,
-                }
-
-                // In case of a dangling batch, orchestrator.allSubmittedResultChannels[hash] will
-                // contain channels for requests that were accumulated while the dangline batch was being processed.
-                if channels, exists := bo.allSubmittedResultChannels[hash]; exists {
-                    logger.InfoLogger.Printf("ContinueDanglingBatches: Dangling batch with hash=%s has %d result channels", hash, len(channels))
-                    for _, ch := range channels {
-                        select {
-                        case ch <- result:
-                            // Successfully sent the result
-                            logger.InfoLogger.Printf("ContinueDanglingBatches: Result successfully sent to channel")
-                        default:
-                            // Channel is full or closed, log this situation
-                            logger.WarnLogger.Printf("Unable to send result for dangling batch item %s", hash)
-                        }
-                        close(ch)
-                    }
-                    delete(bo.allSubmittedRequests, hash)
-                    delete(bo.allSubmittedResultChannels, hash)
-                }
-            }
+            deadLetters := bo.settleBatch(pendingRequests, output, err)
             bo.mu.Unlock()
+            bo.saveDeadLetters(deadLetters)
+            return
+        }
+        logger.InfoLogger.Printf("ContinueDanglingBatches: Successfully processed dangling batch: %s", id)
+
+        // Cache the responses while the requests are tracked, with the directives of their callers
+        bo.cache.CacheResponses(bo.trackedDirectives(cacheRequests), output.Responses)
+        logger.InfoLogger.Printf("ContinueDanglingBatches: Cached responses for dangling batch: %s", id)
+
+        // Update BatchOrchestrator with results.
+        // In case of a dangling batch, orchestrator.allSubmittedResultChannels[hash] will
+        // contain channels for requests that were accumulated while the dangline batch was being processed.
+        bo.mu.Lock()
+        deadLetters := bo.settleBatch(pendingRequests, output, nil)
+        bo.mu.Unlock()
+        bo.saveDeadLetters(deadLetters)
+    }
 
-            // Cache the responses
-            cacheRequests := make([]models.BatchRequestItem, len(requests))
-            for i, req := range requests {
-                hash, _ := utils.GenerateRequestHash(req.Request)
-                cacheRequests[i] = models.BatchRequestItem{
-                    CustomID: hash,
-                    Request:  req.Request,
-                }
+    return func() {
+        bo.processor.WatchBatch(id, func(output models.BatchOutput, err error) {
+            if output.Status == "failed" && !bo.servingMode.IsCache() {
+                logger.WarnLogger.Printf("ContinueDanglingBatches: Dangling batch %s failed, isolating the offending requests: %v", id, err)
+                jobID, _ := batch.Metadata[metadataJob].(string)
+                bo.processor.ResolveFailedBatch(models.BatchRequest{Requests: requests, JobID: jobID}, output, complete)
+                return
             }
+            complete(output, err)
+        })
+    }
+}
 
-            bo.cache.CacheResponses(cacheRequests, responses)
-            logger.InfoLogger.Printf("ContinueDanglingBatches: Cached responses for dangling batch: %s", id)
-
-            // Update batch status in the database
-            err = db.LogBatchStatus(batchStatus)
-            if err != nil {
-                logger.ErrorLogger.Printf("ContinueDanglingBatches: Failed to update batch status for %s: %v", id, err)
-            }
-        }(batchID)
+// translateCustomIDs replaces the custom ids of items with the hashes they map to.
+func translateCustomIDs(items []models.BatchResponseItem, hashByCustomID map[string]string) {
+    for i := range items {
+        if hash, ok := hashByCustomID[items[i].CustomID]; ok {
+            items[i].CustomID = hash
+        }
     }
 }
@@ -0,0 +1,417 @@
+package batch
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/models"
+    "batch-gpt/services/budget"
+    "batch-gpt/services/cache"
+    "batch-gpt/services/client"
+    "batch-gpt/services/config"
+    "batch-gpt/services/fingerprint"
+    "batch-gpt/services/usage"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// testProcessor finishes every batch right away with the output run returns for it.
+type testProcessor struct {
+    Processor
+    run     func(batchRequest models.BatchRequest) (models.BatchOutput, error)
+    batches []models.BatchRequest
+}
+
+func (p *testProcessor) ProcessBatch(batchRequest models.BatchRequest, onDone func(models.BatchOutput, error)) {
+    p.batches = append(p.batches, batchRequest)
+    onDone(p.run(batchRequest))
+}
+
+type testUpstream struct{}
+
+func (testUpstream) Health() client.UpstreamHealth {
+    return client.UpstreamHealth{State: client.CircuitClosed}
+}
+
+type testStore struct {
+    db.Store
+    mu          sync.Mutex
+    deadLetters []models.DeadLetter
+    queued      map[string]models.QueuedRequest
+    batches     map[string]openai.Batch
+}
+
+func (s *testStore) SaveQueuedRequest(request models.QueuedRequest) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.queued == nil {
+        s.queued = make(map[string]models.QueuedRequest)
+    }
+    s.queued[request.Hash] = request
+    return nil
+}
+
+func (s *testStore) DeleteQueuedRequest(hash string, queuedAt time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if queued, found := s.queued[hash]; found && queued.QueuedAt.Equal(queuedAt) {
+        delete(s.queued, hash)
+    }
+    return nil
+}
+
+func (s *testStore) GetQueuedRequests() ([]models.QueuedRequest, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    requests := make([]models.QueuedRequest, 0, len(s.queued))
+    for _, request := range s.queued {
+        requests = append(requests, request)
+    }
+    return requests, nil
+}
+
+func (s *testStore) queuedCount() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.queued)
+}
+
+func (s *testStore) GetDanglingBatches(after string, limit int) ([]openai.Batch, error) {
+    return nil, nil
+}
+
+func (s *testStore) SaveDeadLetter(deadLetter models.DeadLetter) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.deadLetters = append(s.deadLetters, deadLetter)
+    return nil
+}
+
+func (s *testStore) LogBatchStatus(batchStatus openai.BatchResponse) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.batches == nil {
+        s.batches = make(map[string]openai.Batch)
+    }
+    batch := batchStatus.Batch
+    if batch.Metadata == nil {
+        batch.Metadata = s.batches[batch.ID].Metadata
+    }
+    s.batches[batch.ID] = batch
+    return nil
+}
+
+func (s *testStore) TrackBatch(batchStatus openai.BatchResponse) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.batches == nil {
+        s.batches = make(map[string]openai.Batch)
+    }
+    if _, found := s.batches[batchStatus.ID]; found {
+        return db.ErrAlreadyExists
+    }
+    s.batches[batchStatus.ID] = batchStatus.Batch
+    return nil
+}
+
+func (s *testStore) GetLatestBatchStatus(batchID string) (openai.Batch, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if batch, found := s.batches[batchID]; found {
+        return batch, nil
+    }
+    return openai.Batch{}, db.ErrNotFound
+}
+
+type testCache struct {
+    cache.Orchestrator
+    cached []models.BatchRequestItem
+}
+
+func (c *testCache) CacheResponses(requests []models.BatchRequestItem, responses []models.BatchResponseItem) {
+    for _, response := range responses {
+        for _, request := range requests {
+            if request.CustomID == response.CustomID {
+                c.cached = append(c.cached, request)
+            }
+        }
+    }
+}
+
+type testUsage struct{}
+
+func (testUsage) RecordBatch(requests []models.BatchRequestItem, responses []models.BatchResponseItem) {}
+
+func (testUsage) RecordCacheHit(request models.ChatRequest, response openai.ChatCompletionResponse) {}
+
+func (testUsage) Report(filter models.UsageFilter) (usage.Report, error) {
+    return usage.Report{}, nil
+}
+
+type testBudgets struct {
+    budget.Enforcer
+}
+
+func (testBudgets) Reserve(request models.ChatRequest) budget.Reservation {
+    return budget.Reservation{Tenant: request.Tenant}
+}
+
+func (testBudgets) Release(reservation budget.Reservation) {}
+
+type testRetryConfig struct {
+    maxAttempts int
+}
+
+func (c testRetryConfig) GetMaxAttempts() int { return c.maxAttempts }
+
+func (c testRetryConfig) IsRetryable(errorClass string) bool {
+    return errorClass == errorClassServer || errorClass == errorClassRateLimit
+}
+
+type testResubmissionConfig struct {
+    maxResubmissions int
+}
+
+func (c testResubmissionConfig) ShouldResubmit() bool     { return c.maxResubmissions > 0 }
+func (c testResubmissionConfig) GetMaxResubmissions() int { return c.maxResubmissions }
+
+type testFixture struct {
+    orchestrator *orchestrator
+    processor    *testProcessor
+    store        *testStore
+    cache        *testCache
+}
+
+func newTestFixture(maxAttempts int, maxResubmissions int, run func(models.BatchRequest) (models.BatchOutput, error)) *testFixture {
+    fixture := &testFixture{
+        processor: &testProcessor{run: run},
+        store:     &testStore{},
+        cache:     &testCache{},
+    }
+    fixture.orchestrator = NewOrchestrator(
+        fixture.processor,
+        testUpstream{},
+        fixture.store,
+        fixture.cache,
+        testUsage{},
+        testBudgets{},
+        config.NewServingMode("async"),
+        testResubmissionConfig{maxResubmissions: maxResubmissions},
+        testRetryConfig{maxAttempts: maxAttempts},
+        nil,
+        fingerprint.NewFingerprinter(config.NewCacheKeyConfig()),
+        time.Second,
+    )
+    return fixture
+}
+
+func newTestRequest(t *testing.T, content string) models.ChatRequest {
+    t.Helper()
+    request, err := models.NewChatRequest([]byte(fmt.Sprintf(`{"model":"gpt-4o-mini","messages":[{"role":"user","content":%q}]}`, content)))
+    if err != nil {
+        t.Fatalf("NewChatRequest() error = %v", err)
+    }
+    request.Tenant = models.DefaultTenant
+    request.Route = chatCompletionsRoute
+    return request
+}
+
+func failedItem(customID string, code string) models.BatchResponseItem {
+    return models.BatchResponseItem{CustomID: customID, Error: &openai.APIError{Code: code, Message: code}}
+}
+
+func TestDeadLetterAttempts(t *testing.T) {
+    tests := []struct {
+        name         string
+        maxAttempts  int
+        code         string
+        duplicates   int
+        wantBatches  int
+        wantAttempts int
+        wantClass    string
+    }{
+        {name: "not retryable", maxAttempts: 3, code: "invalid_prompt", duplicates: 1, wantBatches: 1, wantAttempts: 1, wantClass: errorClassInvalidRequest},
+        {name: "retried until out of attempts", maxAttempts: 3, code: "server_error", duplicates: 1, wantBatches: 3, wantAttempts: 3, wantClass: errorClassServer},
+        {name: "identical requests count once", maxAttempts: 2, code: "rate_limit_exceeded", duplicates: 3, wantBatches: 2, wantAttempts: 2, wantClass: errorClassRateLimit},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            batchNumber := 0
+            fixture := newTestFixture(tt.maxAttempts, 0, func(batchRequest models.BatchRequest) (models.BatchOutput, error) {
+                batchNumber++
+                output := models.BatchOutput{BatchID: fmt.Sprintf("batch_%d", batchNumber), Status: "completed"}
+                for _, item := range batchRequest.Requests {
+                    output.Failed = append(output.Failed, failedItem(item.CustomID, tt.code))
+                }
+                return output, nil
+            })
+            for i := 0; i < tt.duplicates; i++ {
+                fixture.orchestrator.AddRequest(newTestRequest(t, "hello"))
+            }
+            for i := 0; i < tt.maxAttempts+1; i++ {
+                fixture.orchestrator.processBatch()
+            }
+
+            if len(fixture.processor.batches) != tt.wantBatches {
+                t.Errorf("submitted %d batches, want %d", len(fixture.processor.batches), tt.wantBatches)
+            }
+            if len(fixture.store.deadLetters) != 1 {
+                t.Fatalf("saved %d dead letters, want 1", len(fixture.store.deadLetters))
+            }
+            deadLetter := fixture.store.deadLetters[0]
+            if deadLetter.Attempts != tt.wantAttempts {
+                t.Errorf("attempts = %d, want %d", deadLetter.Attempts, tt.wantAttempts)
+            }
+            if len(deadLetter.BatchIDs) != tt.wantBatches {
+                t.Errorf("batch ids = %v, want %d", deadLetter.BatchIDs, tt.wantBatches)
+            }
+            if deadLetter.ErrorClass != tt.wantClass {
+                t.Errorf("error class = %s, want %s", deadLetter.ErrorClass, tt.wantClass)
+            }
+        })
+    }
+}
+
+func TestUnfinishedRequestsAreResubmitted(t *testing.T) {
+    tests := []struct {
+        name             string
+        maxResubmissions int
+        wantBatches      int
+    }{
+        {name: "resubmission disabled", maxResubmissions: 0, wantBatches: 1},
+        {name: "resubmitted until the limit", maxResubmissions: 2, wantBatches: 3},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fixture := newTestFixture(3, tt.maxResubmissions, func(batchRequest models.BatchRequest) (models.BatchOutput, error) {
+                return models.BatchOutput{BatchID: fmt.Sprintf("batch_%d", len(batchRequest.Requests)), Status: "expired"}, nil
+            })
+            fixture.orchestrator.AddRequest(newTestRequest(t, "hello"))
+            for i := 0; i < tt.maxResubmissions+2; i++ {
+                fixture.orchestrator.processBatch()
+            }
+
+            if len(fixture.processor.batches) != tt.wantBatches {
+                t.Errorf("submitted %d batches, want %d", len(fixture.processor.batches), tt.wantBatches)
+            }
+            if len(fixture.store.deadLetters) != 1 {
+                t.Fatalf("saved %d dead letters, want 1", len(fixture.store.deadLetters))
+            }
+            if deadLetter := fixture.store.deadLetters[0]; deadLetter.Attempts != tt.wantBatches || deadLetter.ErrorClass != errorClassUnfinished {
+                t.Errorf("dead letter attempts = %d, class = %s, want %d, %s", deadLetter.Attempts, deadLetter.ErrorClass, tt.wantBatches, errorClassUnfinished)
+            }
+        })
+    }
+}
+
+func TestIdenticalRequestsMergeCacheDirectives(t *testing.T) {
+    tests := []struct {
+        name       string
+        directives []models.CacheDirective
+        want       models.CacheDirective
+    }{
+        {name: "bypass alone", directives: []models.CacheDirective{models.CacheBypass}, want: models.CacheBypass},
+        {name: "bypass then default", directives: []models.CacheDirective{models.CacheBypass, models.CacheDefault}, want: models.CacheDefault},
+        {name: "default then bypass", directives: []models.CacheDirective{models.CacheDefault, models.CacheBypass}, want: models.CacheDefault},
+        {name: "refresh wins", directives: []models.CacheDirective{models.CacheBypass, models.CacheRefresh, models.CacheDefault}, want: models.CacheRefresh},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fixture := newTestFixture(1, 0, func(batchRequest models.BatchRequest) (models.BatchOutput, error) {
+                output := models.BatchOutput{BatchID: "batch_1", Status: "completed"}
+                for _, item := range batchRequest.Requests {
+                    output.Responses = append(output.Responses, models.BatchResponseItem{CustomID: item.CustomID})
+                }
+                return output, nil
+            })
+            for _, directive := range tt.directives {
+                request := newTestRequest(t, "hello")
+                request.CacheDirective = directive
+                fixture.orchestrator.AddRequest(request)
+            }
+            fixture.orchestrator.processBatch()
+
+            if len(fixture.cache.cached) != 1 {
+                t.Fatalf("cached %d responses, want 1", len(fixture.cache.cached))
+            }
+            if got := fixture.cache.cached[0].Request.CacheDirective; got != tt.want {
+                t.Errorf("cached with directive %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestDirectiveMergedWhileBatchRuns(t *testing.T) {
+    var fixture *testFixture
+    fixture = newTestFixture(1, 0, func(batchRequest models.BatchRequest) (models.BatchOutput, error) {
+        // An identical request without a directive arrives while the batch is running
+        fixture.orchestrator.AddRequest(newTestRequest(t, "hello"))
+
+        output := models.BatchOutput{BatchID: "batch_1", Status: "completed"}
+        for _, item := range batchRequest.Requests {
+            output.Responses = append(output.Responses, models.BatchResponseItem{CustomID: item.CustomID})
+        }
+        return output, nil
+    })
+    request := newTestRequest(t, "hello")
+    request.CacheDirective = models.CacheBypass
+    fixture.orchestrator.AddRequest(request)
+    fixture.orchestrator.processBatch()
+
+    if len(fixture.cache.cached) != 1 {
+        t.Fatalf("cached %d responses, want 1", len(fixture.cache.cached))
+    }
+    if got := fixture.cache.cached[0].Request.CacheDirective; got != models.CacheDefault {
+        t.Errorf("cached with directive %q, want the default", got)
+    }
+}
+
+func TestQueuedRequestsSurviveRestart(t *testing.T) {
+    respond := func(batchRequest models.BatchRequest) (models.BatchOutput, error) {
+        output := models.BatchOutput{BatchID: "batch_1", Status: "completed"}
+        for _, item := range batchRequest.Requests {
+            output.Responses = append(output.Responses, models.BatchResponseItem{CustomID: item.CustomID})
+        }
+        return output, nil
+    }
+
+    before := newTestFixture(1, 0, respond)
+    before.orchestrator.AddRequest(newTestRequest(t, "hello"))
+    before.orchestrator.AddRequest(newTestRequest(t, "hello"))
+    bypass := newTestRequest(t, "world")
+    bypass.CacheDirective = models.CacheBypass
+    before.orchestrator.AddRequest(bypass)
+    if got := before.store.queuedCount(); got != 2 {
+        t.Fatalf("stored %d queued requests, want 2", got)
+    }
+
+    // A new process on the same store picks the requests up where the old one left them
+    after := newTestFixture(1, 0, respond)
+    after.store = before.store
+    after.orchestrator.store = before.store
+    after.orchestrator.ContinueDanglingBatches()
+    after.orchestrator.processBatch()
+
+    if len(after.processor.batches) != 1 || len(after.processor.batches[0].Requests) != 2 {
+        t.Fatalf("submitted %v after the restart, want one batch of 2 requests", after.processor.batches)
+    }
+    for _, cached := range after.cache.cached {
+        if cached.Request.Params.Messages[0].Content == "world" && cached.Request.CacheDirective != models.CacheBypass {
+            t.Errorf("restored request lost its cache directive, got %q", cached.Request.CacheDirective)
+        }
+    }
+
+    // Settled requests are removed from the queue in the background
+    deadline := time.Now().Add(time.Second)
+    for after.store.queuedCount() > 0 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    if got := after.store.queuedCount(); got != 0 {
+        t.Errorf("%d settled requests are still queued", got)
+    }
+}
@@ -0,0 +1,226 @@
+package batch
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "batch-gpt/services/client"
+    "batch-gpt/services/config"
+    "container/heap"
+    "context"
+    "errors"
+    "math/rand/v2"
+    "sync"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// pollJitter spreads polls of batches submitted together by up to ±20% of their interval
+const pollJitter = 0.2
+
+type poller struct {
+    client      client.OpenAIClient
+    store       db.BatchStore
+    config      config.PollingConfig
+    mu          sync.Mutex
+    schedule    pollSchedule
+    watched     map[string]*polledBatch
+    pausedUntil time.Time // holds back every poll after the API asked to slow down
+    wake        chan struct{}
+    slots       chan struct{}
+}
+
+// polledBatch is a batch in the poll schedule.
+type polledBatch struct {
+    id         string
+    nextPoll   time.Time
+    interval   time.Duration
+    failures   int
+    onTerminal []func(openai.BatchResponse, error)
+    index      int
+}
+
+// pollSchedule is a min-heap of batches ordered by their next poll time.
+type pollSchedule []*polledBatch
+
+func (s pollSchedule) Len() int           { return len(s) }
+func (s pollSchedule) Less(i, j int) bool { return s[i].nextPoll.Before(s[j].nextPoll) }
+func (s pollSchedule) Swap(i, j int) {
+    s[i], s[j] = s[j], s[i]
+    s[i].index = i
+    s[j].index = j
+}
+
+func (s *pollSchedule) Push(x any) {
+    batch := x.(*polledBatch)
+    batch.index = len(*s)
+    *s = append(*s, batch)
+}
+
+func (s *pollSchedule) Pop() any {
+    old := *s
+    batch := old[len(old)-1]
+    old[len(old)-1] = nil
+    batch.index = -1
+    *s = old[:len(old)-1]
+    return batch
+}
+
+// NewPoller creates the poller that all batches are polled through. Start must be running
+// for watched batches to be polled.
+func NewPoller(client client.OpenAIClient, store db.BatchStore, pollingConfig config.PollingConfig) Poller {
+    return &poller{
+        client:  client,
+        store:   store,
+        config:  pollingConfig,
+        watched: make(map[string]*polledBatch),
+        wake:    make(chan struct{}, 1),
+        slots:   make(chan struct{}, pollingConfig.GetMaxConcurrency()),
+    }
+}
+
+func (p *poller) Watch(batchID string, onTerminal func(openai.BatchResponse, error)) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if batch, found := p.watched[batchID]; found {
+        batch.onTerminal = append(batch.onTerminal, onTerminal)
+        return
+    }
+    batch := &polledBatch{
+        id:         batchID,
+        nextPoll:   time.Now(),
+        interval:   p.config.GetInitialRetryInterval(),
+        onTerminal: []func(openai.BatchResponse, error){onTerminal},
+    }
+    p.watched[batchID] = batch
+    heap.Push(&p.schedule, batch)
+    p.signal()
+}
+
+// Start runs the schedule, handing batches that are due to at most GetMaxConcurrency polls at a time.
+func (p *poller) Start() {
+    for {
+        p.mu.Lock()
+        if len(p.schedule) == 0 {
+            p.mu.Unlock()
+            <-p.wake
+            continue
+        }
+        next := p.schedule[0].nextPoll
+        if p.pausedUntil.After(next) {
+            next = p.pausedUntil
+        }
+        if wait := time.Until(next); wait > 0 {
+            p.mu.Unlock()
+            timer := time.NewTimer(wait)
+            select {
+            case <-timer.C:
+            case <-p.wake:
+                timer.Stop()
+            }
+            continue
+        }
+        batch := heap.Pop(&p.schedule).(*polledBatch)
+        p.mu.Unlock()
+
+        p.slots <- struct{}{}
+        go func() {
+            defer func() { <-p.slots }()
+            p.poll(batch)
+        }()
+    }
+}
+
+// signal wakes up the schedule after it changed.
+// Callers must hold p.mu.
+func (p *poller) signal() {
+    select {
+    case p.wake <- struct{}{}:
+    default:
+    }
+}
+
+func (p *poller) poll(batch *polledBatch) {
+    batchStatus, err := p.client.RetrieveBatch(context.Background(), batch.id)
+    if err != nil {
+        p.retry(batch, err)
+        return
+    }
+
+    logger.InfoLogger.Printf("Batch Status: ID=%s, Status=%s, InputFileID=%s, OutputFileID=%v, RequestCounts=%+v",
+        batchStatus.ID, batchStatus.Status, batchStatus.InputFileID, batchStatus.OutputFileID, batchStatus.RequestCounts)
+
+    if err := p.store.LogBatchStatus(batchStatus); err != nil {
+        logger.WarnLogger.Printf("Failed to log batch status: %v", err)
+    }
+
+    if models.IsTerminalBatchStatus(batchStatus.Status) {
+        p.finish(batch, batchStatus, nil)
+        return
+    }
+
+    p.mu.Lock()
+    batch.failures = 0
+    p.reschedule(batch, jitter(batch.interval))
+    batch.interval = min(batch.interval*2, p.config.GetMaxRetryInterval())
+    p.mu.Unlock()
+}
+
+// retry schedules another poll after a failed one, waiting at least as long as the API asked to.
+// Transient errors are retried for as long as they last, backing off up to the maximum interval,
+// since the batch keeps running upstream. Batches whose status cannot be retrieved for good are
+// finished with the error.
+func (p *poller) retry(batch *polledBatch, err error) {
+    p.mu.Lock()
+    // Polls held back by the circuit breaker did not reach the API and do not count
+    if !errors.Is(err, client.ErrCircuitOpen) {
+        batch.failures++
+    }
+    if !client.IsTransient(err) {
+        p.mu.Unlock()
+        logger.ErrorLogger.Printf("Giving up polling batch %s after %d failed attempts: %v", batch.id, batch.failures, err)
+        p.finish(batch, openai.BatchResponse{}, err)
+        return
+    }
+
+    delay := jitter(batch.interval)
+    if retryAfter, ok := client.RetryAfter(err); ok {
+        // The limit applies to the whole account, so every batch waits
+        if until := time.Now().Add(retryAfter); until.After(p.pausedUntil) {
+            p.pausedUntil = until
+        }
+        delay = max(delay, retryAfter)
+    }
+    logger.WarnLogger.Printf("Failed to retrieve batch %s (%d failed attempts), polling again in %s: %v",
+        batch.id, batch.failures, delay.Round(time.Second), err)
+    p.reschedule(batch, delay)
+    batch.interval = min(batch.interval*2, p.config.GetMaxRetryInterval())
+    p.mu.Unlock()
+}
+
+// reschedule puts a polled batch back into the schedule.
+// Callers must hold p.mu.
+func (p *poller) reschedule(batch *polledBatch, delay time.Duration) {
+    batch.nextPoll = time.Now().Add(delay)
+    heap.Push(&p.schedule, batch)
+    p.signal()
+}
+
+// finish stops polling a batch and calls everyone waiting on it.
+func (p *poller) finish(batch *polledBatch, batchStatus openai.BatchResponse, err error) {
+    p.mu.Lock()
+    delete(p.watched, batch.id)
+    onTerminal := batch.onTerminal
+    p.mu.Unlock()
+
+    for _, callback := range onTerminal {
+        callback(batchStatus, err)
+    }
+}
+
+// jitter varies interval randomly by up to pollJitter in either direction.
+func jitter(interval time.Duration) time.Duration {
+    return time.Duration(float64(interval) * (1 - pollJitter + 2*pollJitter*rand.Float64()))
+}
@@ -0,0 +1,258 @@
+package batch
+
+import (
+    "batch-gpt/services/client"
+    "container/heap"
+    "context"
+    "errors"
+    "net/http"
+    "sync"
+    "testing"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+type testPollingConfig struct {
+    initialInterval time.Duration
+    maxInterval     time.Duration
+}
+
+func (c testPollingConfig) GetInitialRetryInterval() time.Duration { return c.initialInterval }
+func (c testPollingConfig) GetMaxRetryInterval() time.Duration     { return c.maxInterval }
+func (c testPollingConfig) GetMaxConcurrency() int                 { return 2 }
+
+// testPollClient answers RetrieveBatch with the results of retrieve, in order, repeating the last one.
+type testPollClient struct {
+    client.OpenAIClient
+    mu       sync.Mutex
+    retrieve []func(batchID string) (openai.BatchResponse, error)
+    calls    int
+}
+
+func (c *testPollClient) RetrieveBatch(ctx context.Context, batchID string) (openai.BatchResponse, error) {
+    c.mu.Lock()
+    next := c.retrieve[min(c.calls, len(c.retrieve)-1)]
+    c.calls++
+    c.mu.Unlock()
+    return next(batchID)
+}
+
+func batchWithStatus(status string) func(string) (openai.BatchResponse, error) {
+    return func(batchID string) (openai.BatchResponse, error) {
+        var batchStatus openai.BatchResponse
+        batchStatus.ID = batchID
+        batchStatus.Status = status
+        return batchStatus, nil
+    }
+}
+
+func failWith(err error) func(string) (openai.BatchResponse, error) {
+    return func(string) (openai.BatchResponse, error) {
+        return openai.BatchResponse{}, err
+    }
+}
+
+func newTestPoller(config testPollingConfig, retrieve ...func(string) (openai.BatchResponse, error)) *poller {
+    return NewPoller(&testPollClient{retrieve: retrieve}, &testStore{}, config).(*poller)
+}
+
+// watchNow adds a batch to the schedule and takes it out again, as Start does when it is due.
+func watchNow(p *poller, batchID string, onTerminal func(openai.BatchResponse, error)) *polledBatch {
+    p.Watch(batchID, onTerminal)
+    return heap.Pop(&p.schedule).(*polledBatch)
+}
+
+func TestPollSchedule(t *testing.T) {
+    now := time.Now()
+    var schedule pollSchedule
+    for i, offset := range []time.Duration{3, 1, 4, 1, 5, 9, 2, 6} {
+        heap.Push(&schedule, &polledBatch{id: string(rune('a' + i)), nextPoll: now.Add(offset * time.Second)})
+    }
+
+    // Rescheduling a batch moves it to its new place
+    late := schedule[0]
+    late.nextPoll = now.Add(10 * time.Second)
+    heap.Fix(&schedule, late.index)
+
+    var previous time.Time
+    for schedule.Len() > 0 {
+        batch := heap.Pop(&schedule).(*polledBatch)
+        if batch.index != -1 {
+            t.Errorf("popped batch %s has index %d, want -1", batch.id, batch.index)
+        }
+        if batch.nextPoll.Before(previous) {
+            t.Fatalf("batch %s polled at %s came after one at %s", batch.id, batch.nextPoll, previous)
+        }
+        previous = batch.nextPoll
+    }
+    if !previous.Equal(now.Add(10 * time.Second)) {
+        t.Errorf("last batch polled at %s, want the rescheduled one", previous)
+    }
+}
+
+func TestJitter(t *testing.T) {
+    for i := 0; i < 1000; i++ {
+        got := jitter(time.Minute)
+        if got < 48*time.Second || got > 72*time.Second {
+            t.Fatalf("jitter(1m) = %s, want within 20%% of 1m", got)
+        }
+    }
+}
+
+func TestPollBacksOff(t *testing.T) {
+    config := testPollingConfig{initialInterval: time.Second, maxInterval: 5 * time.Second}
+    p := newTestPoller(config, batchWithStatus("in_progress"))
+    batch := watchNow(p, "batch_1", func(openai.BatchResponse, error) {})
+
+    // Each poll waits for the current interval, give or take the jitter, then doubles it up to the maximum
+    for _, step := range []struct{ wait, next time.Duration }{{1, 2}, {2, 4}, {4, 5}, {5, 5}} {
+        before := time.Now()
+        p.poll(batch)
+        delay := batch.nextPoll.Sub(before)
+        wait := step.wait * time.Second
+        if delay < time.Duration(float64(wait)*(1-pollJitter)) || delay > time.Duration(float64(wait)*(1+pollJitter))+time.Second {
+            t.Errorf("next poll in %s, want about %s", delay, wait)
+        }
+        if batch.interval != step.next*time.Second {
+            t.Errorf("interval = %s, want %s", batch.interval, step.next*time.Second)
+        }
+        if p.schedule.Len() != 1 {
+            t.Fatalf("schedule holds %d batches, want 1", p.schedule.Len())
+        }
+        heap.Pop(&p.schedule)
+    }
+}
+
+func TestPollFinishesTerminalBatches(t *testing.T) {
+    p := newTestPoller(testPollingConfig{initialInterval: time.Second, maxInterval: time.Minute}, batchWithStatus("completed"))
+
+    var got []string
+    batch := watchNow(p, "batch_1", func(batchStatus openai.BatchResponse, err error) {
+        if err != nil {
+            t.Errorf("onTerminal error = %v", err)
+        }
+        got = append(got, "first:"+batchStatus.Status)
+    })
+    // Watching a batch again adds a callback instead of a second poll
+    p.Watch("batch_1", func(batchStatus openai.BatchResponse, err error) {
+        got = append(got, "second:"+batchStatus.Status)
+    })
+    if p.schedule.Len() != 0 {
+        t.Fatal("watching a batch again scheduled a second poll")
+    }
+
+    p.poll(batch)
+    if len(got) != 2 || got[0] != "first:completed" || got[1] != "second:completed" {
+        t.Errorf("callbacks = %v, want both called with completed", got)
+    }
+    if _, found := p.watched["batch_1"]; found {
+        t.Error("finished batch is still watched")
+    }
+    if p.schedule.Len() != 0 {
+        t.Errorf("finished batch is still scheduled")
+    }
+}
+
+func TestPollRetries(t *testing.T) {
+    serverErr := &openai.APIError{HTTPStatusCode: http.StatusInternalServerError}
+    rateLimitErr := &client.RetryAfterError{Err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, RetryAfter: time.Hour}
+    invalidErr := &openai.APIError{HTTPStatusCode: http.StatusNotFound}
+
+    tests := []struct {
+        name         string
+        err          error
+        wantFailures int
+        wantFinished bool
+        wantPaused   bool
+    }{
+        {name: "transient error", err: serverErr, wantFailures: 1},
+        {name: "open circuit", err: client.ErrCircuitOpen, wantFailures: 0},
+        {name: "rate limit", err: rateLimitErr, wantFailures: 1, wantPaused: true},
+        {name: "permanent error", err: invalidErr, wantFailures: 1, wantFinished: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p := newTestPoller(testPollingConfig{initialInterval: time.Second, maxInterval: time.Minute}, failWith(tt.err))
+            var finishedWith error
+            batch := watchNow(p, "batch_1", func(batchStatus openai.BatchResponse, err error) {
+                finishedWith = err
+            })
+
+            before := time.Now()
+            p.poll(batch)
+            if batch.failures != tt.wantFailures {
+                t.Errorf("failures = %d, want %d", batch.failures, tt.wantFailures)
+            }
+            if tt.wantFinished {
+                if !errors.Is(finishedWith, tt.err) {
+                    t.Errorf("onTerminal error = %v, want %v", finishedWith, tt.err)
+                }
+                if p.schedule.Len() != 0 {
+                    t.Error("batch is still scheduled after a permanent error")
+                }
+                return
+            }
+
+            if finishedWith != nil {
+                t.Errorf("onTerminal called with %v after a transient error", finishedWith)
+            }
+            if p.schedule.Len() != 1 {
+                t.Fatalf("schedule holds %d batches, want 1", p.schedule.Len())
+            }
+            if batch.interval != 2*time.Second {
+                t.Errorf("interval = %s, want 2s", batch.interval)
+            }
+            if paused := p.pausedUntil.After(before); paused != tt.wantPaused {
+                t.Errorf("paused = %v, want %v", paused, tt.wantPaused)
+            }
+            if tt.wantPaused && batch.nextPoll.Before(before.Add(time.Hour)) {
+                t.Errorf("next poll at %s, want at least the hour the API asked for", batch.nextPoll.Sub(before))
+            }
+        })
+    }
+}
+
+func TestPollSuccessResetsFailures(t *testing.T) {
+    serverErr := &openai.APIError{HTTPStatusCode: http.StatusBadGateway}
+    p := newTestPoller(testPollingConfig{initialInterval: time.Second, maxInterval: time.Minute},
+        failWith(serverErr), failWith(serverErr), batchWithStatus("in_progress"))
+    batch := watchNow(p, "batch_1", func(openai.BatchResponse, error) {})
+
+    for want := 1; want <= 2; want++ {
+        p.poll(batch)
+        if batch.failures != want {
+            t.Fatalf("failures = %d, want %d", batch.failures, want)
+        }
+        heap.Pop(&p.schedule)
+    }
+    p.poll(batch)
+    if batch.failures != 0 {
+        t.Errorf("failures after a successful poll = %d, want 0", batch.failures)
+    }
+}
+
+func TestPollerStart(t *testing.T) {
+    p := newTestPoller(testPollingConfig{initialInterval: time.Millisecond, maxInterval: 5 * time.Millisecond},
+        batchWithStatus("validating"), failWith(&openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}),
+        batchWithStatus("in_progress"), batchWithStatus("completed"))
+    go p.Start()
+
+    done := make(chan openai.BatchResponse, 1)
+    p.Watch("batch_1", func(batchStatus openai.BatchResponse, err error) {
+        if err != nil {
+            t.Errorf("onTerminal error = %v", err)
+        }
+        done <- batchStatus
+    })
+
+    select {
+    case batchStatus := <-done:
+        if batchStatus.Status != "completed" {
+            t.Errorf("status = %s, want completed", batchStatus.Status)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("batch was not polled to completion")
+    }
+}
@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	openai "github.com/sashabaranov/go-openai"
@@ -19,20 +20,64 @@ import (
 
 type processor struct {
 	client        client.OpenAIClient
-	pollingConfig config.PollingConfig
+	store         db.BatchStore
+	poller        Poller
+	bisectConfig  config.BisectConfig
+	instanceID    string
+	mu            sync.Mutex
+	// resubmitting counts the batches split off failed batches that are running; parts
+	// beyond the configured limit wait in queuedParts
+	resubmitting  int
+	queuedParts   []queuedPart
 }
 
-func NewProcessor(client client.OpenAIClient, pollingConfig config.PollingConfig) Processor {
+// rawChatCompletionLine is a batch input line that passes the request body through as the
+// client sent it, unlike openai.BatchChatCompletionRequest which re-encodes the typed request.
+type rawChatCompletionLine struct {
+	CustomID string               `json:"custom_id"`
+	Method   string               `json:"method"`
+	URL      openai.BatchEndpoint `json:"url"`
+	Body     json.RawMessage      `json:"body"`
+}
+
+func (l rawChatCompletionLine) MarshalBatchLineItem() []byte {
+	// json.Marshal compacts the raw body, keeping the line free of newlines
+	marshal, _ := json.Marshal(l)
+	return marshal
+}
+
+func NewProcessor(client client.OpenAIClient, store db.BatchStore, poller Poller, bisectConfig config.BisectConfig, reconcileConfig config.ReconcileConfig) Processor {
 	return &processor{
 		client:        client,
-		pollingConfig: pollingConfig,
+		store:         store,
+		poller:        poller,
+		bisectConfig:  bisectConfig,
+		instanceID:    reconcileConfig.GetInstanceID(),
+	}
+}
+
+func (p *processor) ProcessBatch(batchRequest models.BatchRequest, onDone func(models.BatchOutput, error)) {
+	// Parts split off the batch if it fails belong to the same job
+	if batchRequest.JobID == "" {
+		batchRequest.JobID = newJobID()
 	}
+	p.submitBatch(batchRequest, func(output models.BatchOutput, err error) {
+		if output.Status == "failed" {
+			logger.WarnLogger.Printf("Batch %s failed: %v", output.BatchID, err)
+			p.resolveFailedBatch(batchRequest, output, 0, onDone)
+			return
+		}
+		onDone(output, err)
+	})
 }
 
-func (p *processor) ProcessBatch(batchRequest models.BatchRequest) ([]models.BatchResponseItem, error) {
+// submitBatch creates a batch for the requests and hands it to the poller. onDone is called
+// with its output once it reaches a terminal status, or right away if it could not be created.
+func (p *processor) submitBatch(batchRequest models.BatchRequest, onDone func(models.BatchOutput, error)) {
 	batchChatRequest := openai.CreateBatchWithUploadFileRequest{
 		Endpoint:         openai.BatchEndpointChatCompletions,
 		CompletionWindow: "24h",
+		Metadata:         p.batchMetadata(batchRequest),
 		UploadBatchFileRequest: openai.UploadBatchFileRequest{
 			FileName: "batch_request.jsonl",
 			Lines:    make([]openai.BatchLineItem, len(batchRequest.Requests)),
@@ -40,99 +85,161 @@ func (p *processor) ProcessBatch(batchRequest models.BatchRequest) ([]models.Bat
 	}
 
 	for i, requestItem := range batchRequest.Requests {
-		batchChatRequest.UploadBatchFileRequest.Lines[i] = openai.BatchChatCompletionRequest{
+		batchChatRequest.UploadBatchFileRequest.Lines[i] = rawChatCompletionLine{
 			CustomID: requestItem.CustomID,
-			Body:     requestItem.Request,
+			Body:     requestItem.Request.Body,
 			Method:   "POST",
 			URL:      openai.BatchEndpointChatCompletions,
 		}
 	}
 
+	submittedAt := time.Now()
 	batchStatus, err := p.client.CreateBatchWithUploadFile(context.Background(), batchChatRequest)
+	if err != nil && client.ClassifyError(err) == client.ErrorClassNetwork {
+		// The batch may have been created before the connection failed
+		if created, found := p.findJobBatch(batchRequest.JobID, submittedAt); found {
+			logger.WarnLogger.Printf("Creating batch of job %s failed, but batch %s was created: %v", batchRequest.JobID, created.ID, err)
+			batchStatus, err = openai.BatchResponse{Batch: created}, nil
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to create batch: %w", err)
+		onDone(models.BatchOutput{}, fmt.Errorf("failed to create batch: %w", err))
+		return
 	}
 
-	err = db.LogBatchStatus(batchStatus)
+	err = p.store.LogBatchStatus(batchStatus)
 	if err != nil {
 		logger.WarnLogger.Printf("Failed to log initial batch status: %v", err)
 	}
 
-	return p.PollAndCollectResponses(batchStatus.ID)
+	p.WatchBatch(batchStatus.ID, onDone)
 }
 
-func (p *processor) PollAndCollectResponses(batchID string) ([]models.BatchResponseItem, error) {
-	ctx := context.Background()
-	retryIntervalSeconds := 5 * time.Second
+// WatchBatch hands a batch to the poller and calls onDone with its output once the batch
+// reaches a terminal status. onDone runs on its own goroutine.
+func (p *processor) WatchBatch(batchID string, onDone func(models.BatchOutput, error)) {
+	p.poller.Watch(batchID, func(batchStatus openai.BatchResponse, err error) {
+		go func() {
+			if err != nil {
+				onDone(models.BatchOutput{BatchID: batchID}, fmt.Errorf("failed to retrieve batch status: %w", err))
+				return
+			}
+			onDone(p.collectOutput(batchStatus))
+		}()
+	})
+}
 
-	for {
-		batchStatus, err := p.client.RetrieveBatch(ctx, batchID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to retrieve batch status: %w", err)
+// collectOutput turns a batch in a terminal status into its output.
+func (p *processor) collectOutput(batchStatus openai.BatchResponse) (models.BatchOutput, error) {
+	output := models.BatchOutput{
+		BatchID: batchStatus.ID,
+		Status:  batchStatus.Status,
+	}
+
+	if batchStatus.Status == "failed" {
+		if batchStatus.Errors != nil {
+			for _, batchError := range batchStatus.Errors.Data {
+				output.Errors = append(output.Errors, models.BatchError{
+					Code:    batchError.Code,
+					Message: batchError.Message,
+					Line:    batchError.Line,
+				})
+			}
 		}
+		return output, fmt.Errorf("batch processing %s", batchStatus.Status)
+	}
 
-		logger.InfoLogger.Printf("Batch Status: ID=%s, Status=%s, InputFileID=%s, OutputFileID=%v, RequestCounts=%+v",
-			batchStatus.ID, batchStatus.Status, batchStatus.InputFileID, batchStatus.OutputFileID, batchStatus.RequestCounts)
+	responses, failed, err := p.collectResponses(context.Background(), batchStatus)
+	if err != nil {
+		return output, err
+	}
+	output.Responses = responses
+	output.Failed = failed
+	return output, nil
+}
 
-		err = db.LogBatchStatus(batchStatus)
-		if err != nil {
-			logger.WarnLogger.Printf("Failed to log batch status: %v", err)
+// collectResponses reads the output and error files of a batch in a terminal status and
+// separates successful responses from failed items.
+// Expired and cancelled batches may stop before any item finished, in which case
+// there is no output file and no responses are returned.
+func (p *processor) collectResponses(ctx context.Context, batchStatus openai.BatchResponse) ([]models.BatchResponseItem, []models.BatchResponseItem, error) {
+	if batchStatus.OutputFileID == nil && batchStatus.ErrorFileID == nil {
+		if batchStatus.Status == "completed" {
+			return nil, nil, errors.New("output file ID is missing")
 		}
+		logger.InfoLogger.Printf("Batch %s is %s without an output file, no items finished", batchStatus.ID, batchStatus.Status)
+		return nil, nil, nil
+	}
 
-		switch batchStatus.Status {
-		case "completed", "expired", "cancelled":
-			if batchStatus.OutputFileID == nil {
-				return nil, errors.New("output file ID is missing")
-			}
+	var items []models.BatchResponseItem
+	for _, fileID := range []*string{batchStatus.OutputFileID, batchStatus.ErrorFileID} {
+		if fileID == nil {
+			continue
+		}
+		fileItems, err := p.readResponseFile(ctx, *fileID)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, fileItems...)
+	}
 
-			rawResponse, err := p.client.GetFileContent(ctx, *batchStatus.OutputFileID)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get file content: %w", err)
-			}
-			defer rawResponse.Close()
+	var responses, failed []models.BatchResponseItem
+	for _, item := range items {
+		if item.Error != nil || item.Response.Error != nil || item.Response.StatusCode != 200 {
+			logger.WarnLogger.Printf("API error for item %s in batch %s: %s", item.CustomID, batchStatus.ID, itemErrorMessage(item))
+			failed = append(failed, item)
+			continue
+		}
+		responses = append(responses, item)
+	}
 
-			// Read the raw response into a byte slice
-			content, err := io.ReadAll(rawResponse)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read response content: %w", err)
-			}
+	if batchStatus.Status != "completed" {
+		logger.InfoLogger.Printf("Collected %d partial responses from %s batch %s", len(responses), batchStatus.Status, batchStatus.ID)
+	}
 
-			lines := bytes.Split(content, []byte("\n"))
-			var responses []models.BatchResponseItem
-			for _, line := range lines {
-				if len(line) == 0 {
-					continue
-				}
+	return responses, failed, nil
+}
 
-				var batchResponseItem models.BatchResponseItem
-				if err := json.Unmarshal(line, &batchResponseItem); err != nil {
-					return nil, fmt.Errorf("failed to unmarshal response item: %w", err)
-				}
+// readResponseFile parses a batch output or error file. Lines that are not valid JSON
+// are turned into failed items when their custom_id can still be recovered, and skipped otherwise.
+func (p *processor) readResponseFile(ctx context.Context, fileID string) ([]models.BatchResponseItem, error) {
+	rawResponse, err := p.client.GetFileContent(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file content: %w", err)
+	}
+	defer rawResponse.Close()
 
-				if batchResponseItem.Response.StatusCode != 200 {
-					return nil, fmt.Errorf("API error for item %s: status code %d", batchResponseItem.CustomID, batchResponseItem.Response.StatusCode)
-				}
+	// Read the raw response into a byte slice
+	content, err := io.ReadAll(rawResponse)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response content: %w", err)
+	}
 
-				if batchResponseItem.Response.Error != nil {
-					return nil, fmt.Errorf("API error for item %s: %v", batchResponseItem.CustomID, batchResponseItem.Response.Error)
-				}
+	lines := bytes.Split(content, []byte("\n"))
+	var items []models.BatchResponseItem
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
 
-				responses = append(responses, batchResponseItem)
+		var batchResponseItem models.BatchResponseItem
+		if err := json.Unmarshal(line, &batchResponseItem); err != nil {
+			customID := recoverCustomID(line)
+			if customID == "" {
+				logger.WarnLogger.Printf("Skipping unreadable line in file %s: %v", fileID, err)
+				continue
 			}
-
-			return responses, nil
-
-		case "failed":
-			return nil, fmt.Errorf("batch processing %s", batchStatus.Status)
-
-		default:
-			time.Sleep(retryIntervalSeconds)
-			if retryIntervalSeconds < p.pollingConfig.GetMaxRetryInterval() {
-				retryIntervalSeconds = retryIntervalSeconds * 2
-				if retryIntervalSeconds > p.pollingConfig.GetMaxRetryInterval() {
-					retryIntervalSeconds = p.pollingConfig.GetMaxRetryInterval()
-				}
+			batchResponseItem = models.BatchResponseItem{
+				CustomID: customID,
+				Error: &openai.APIError{
+					Type:    errorClassMalformed,
+					Message: fmt.Sprintf("failed to unmarshal response item: %v", err),
+				},
 			}
 		}
+
+		items = append(items, batchResponseItem)
 	}
+
+	return items, nil
 }
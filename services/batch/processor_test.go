@@ -0,0 +1,148 @@
+package batch
+
+import (
+    "batch-gpt/server/models"
+    "batch-gpt/services/client"
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// testClient runs batches in memory. A batch holding a request whose body contains "poison"
+// fails with an input error that does not name the line; any other batch completes with a
+// response per request.
+type testClient struct {
+    client.OpenAIClient
+    mu          sync.Mutex
+    batches     []openai.Batch
+    files       map[string]string
+    inFlight    int
+    maxInFlight int
+}
+
+func newTestClient() *testClient {
+    return &testClient{files: make(map[string]string)}
+}
+
+func (c *testClient) CreateBatchWithUploadFile(ctx context.Context, request openai.CreateBatchWithUploadFileRequest) (openai.BatchResponse, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    id := fmt.Sprintf("batch_%d", len(c.batches)+1)
+    var output bytes.Buffer
+    poisoned := false
+    for _, line := range request.Lines {
+        item := line.(rawChatCompletionLine)
+        if strings.Contains(string(item.Body), "poison") {
+            poisoned = true
+        }
+        fmt.Fprintf(&output, `{"custom_id":%q,"response":{"status_code":200,"body":{"id":"chatcmpl-%s","object":"chat.completion"}}}`+"\n", item.CustomID, item.CustomID)
+    }
+
+    var batch openai.Batch
+    if poisoned {
+        encoded := fmt.Sprintf(`{"id":%q,"status":"failed","errors":{"object":"list","data":[{"code":"invalid_value","message":"poisoned request"}]}}`, id)
+        if err := json.Unmarshal([]byte(encoded), &batch); err != nil {
+            return openai.BatchResponse{}, err
+        }
+    } else {
+        outputFileID := "file_" + id
+        c.files[outputFileID] = output.String()
+        batch = openai.Batch{ID: id, Status: "completed", OutputFileID: &outputFileID}
+    }
+    batch.CreatedAt = int(time.Now().Unix())
+    batch.Metadata = request.Metadata
+    c.batches = append(c.batches, batch)
+    c.inFlight++
+    c.maxInFlight = max(c.maxInFlight, c.inFlight)
+    return openai.BatchResponse{Batch: batch}, nil
+}
+
+func (c *testClient) GetFileContent(ctx context.Context, fileID string) (openai.RawResponse, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    content, found := c.files[fileID]
+    if !found {
+        return openai.RawResponse{}, &openai.APIError{HTTPStatusCode: 404, Message: "no such file"}
+    }
+    return openai.RawResponse{ReadCloser: io.NopCloser(strings.NewReader(content))}, nil
+}
+
+// finish ends a batch started by CreateBatchWithUploadFile and returns it.
+func (c *testClient) finish(batchID string) openai.BatchResponse {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.inFlight--
+    for _, batch := range c.batches {
+        if batch.ID == batchID {
+            return openai.BatchResponse{Batch: batch}
+        }
+    }
+    return openai.BatchResponse{}
+}
+
+// testPoller finishes every watched batch after a millisecond.
+type testPoller struct {
+    client *testClient
+}
+
+func (p testPoller) Watch(batchID string, onTerminal func(openai.BatchResponse, error)) {
+    go func() {
+        time.Sleep(time.Millisecond)
+        onTerminal(p.client.finish(batchID), nil)
+    }()
+}
+
+func (p testPoller) Start() {}
+
+type testBisectConfig struct {
+    maxDepth int
+}
+
+func (c testBisectConfig) GetMaxDepth() int              { return c.maxDepth }
+func (c testBisectConfig) GetMaxConcurrentBatches() int { return 2 }
+
+type testReconcileConfig struct{}
+
+func (testReconcileConfig) GetInstanceID() string         { return "test-instance" }
+func (testReconcileConfig) GetInterval() time.Duration    { return 0 }
+func (testReconcileConfig) GetLookback() time.Duration    { return time.Hour }
+
+func newTestProcessor(openAIClient *testClient, maxDepth int) *processor {
+    return NewProcessor(openAIClient, &testStore{}, testPoller{openAIClient}, testBisectConfig{maxDepth}, testReconcileConfig{}).(*processor)
+}
+
+// testBatchRequest holds count requests; those at the poisoned indexes make a batch fail.
+func testBatchRequest(count int, poisoned ...int) models.BatchRequest {
+    var batchRequest models.BatchRequest
+    for i := 0; i < count; i++ {
+        content := fmt.Sprintf("request %d", i)
+        for _, index := range poisoned {
+            if index == i {
+                content = "poison"
+            }
+        }
+        batchRequest.Requests = append(batchRequest.Requests, models.BatchRequestItem{
+            CustomID: fmt.Sprintf("req-%d", i),
+            Request: models.ChatRequest{
+                Body: json.RawMessage(fmt.Sprintf(`{"model":"gpt-4o-mini","messages":[{"role":"user","content":%q}]}`, content)),
+            },
+        })
+    }
+    return batchRequest
+}
+
+func customIDs(items []models.BatchResponseItem) map[string]bool {
+    ids := make(map[string]bool, len(items))
+    for _, item := range items {
+        ids[item.CustomID] = true
+    }
+    return ids
+}
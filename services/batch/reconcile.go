@@ -0,0 +1,237 @@
+package batch
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// Metadata keys every batch is created with. A batch carrying metadataInstance was created
+// by batch-gpt, which lets batches that were never tracked be found upstream.
+const (
+    metadataInstance = "batch_gpt_instance"
+    metadataJob      = "batch_gpt_job"
+    metadataTenants  = "batch_gpt_tenants"
+)
+
+const (
+    // maxMetadataValueLength is the longest metadata value the Batch API accepts
+    maxMetadataValueLength = 512
+    // orphanGracePeriod leaves batches that were just created to the instance that is still tracking them
+    orphanGracePeriod = 10 * time.Minute
+    listBatchPageSize = 100
+    // jobBatchClockSkew is how far before its submission the batch of a job is looked for
+    jobBatchClockSkew = time.Minute
+)
+
+func newJobID() string {
+    id := make([]byte, 12)
+    if _, err := rand.Read(id); err != nil {
+        return fmt.Sprintf("job-%d", time.Now().UnixNano())
+    }
+    return hex.EncodeToString(id)
+}
+
+// batchMetadata tags a batch with the instance that creates it, its job and the tenants of its requests.
+func (p *processor) batchMetadata(batchRequest models.BatchRequest) map[string]any {
+    metadata := map[string]any{
+        metadataInstance: truncateMetadata(p.instanceID),
+        metadataJob:      batchRequest.JobID,
+    }
+    if tenants := batchTenants(batchRequest.Requests); len(tenants) > 0 {
+        metadata[metadataTenants] = strings.Join(tenants, ",")
+    }
+    return metadata
+}
+
+// batchTenants lists the tenants of the requests of a batch, sorted.
+func batchTenants(items []models.BatchRequestItem) []string {
+    seen := make(map[string]bool)
+    var tenants []string
+    for _, item := range items {
+        if tenant := item.Request.Tenant; tenant != "" && !seen[tenant] {
+            seen[tenant] = true
+            tenants = append(tenants, tenant)
+        }
+    }
+    sort.Strings(tenants)
+    return tenants
+}
+
+// splitByTenants splits collated requests into batches whose tenants fit in one metadata value,
+// keeping the requests of a tenant together. Most collations have few tenants and stay whole.
+func splitByTenants(items []models.BatchRequestItem) [][]models.BatchRequestItem {
+    tenants := batchTenants(items)
+    if len(strings.Join(tenants, ",")) <= maxMetadataValueLength {
+        return [][]models.BatchRequestItem{items}
+    }
+
+    byTenant := make(map[string][]models.BatchRequestItem)
+    for _, item := range items {
+        byTenant[item.Request.Tenant] = append(byTenant[item.Request.Tenant], item)
+    }
+    var parts [][]models.BatchRequestItem
+    var part []models.BatchRequestItem
+    length := 0
+    for _, tenant := range tenants {
+        // Tenant names are at most models.MaxTenantLength long, so each fits on its own
+        if length > 0 && length+1+len(tenant) > maxMetadataValueLength {
+            parts = append(parts, part)
+            part, length = nil, 0
+        }
+        if length > 0 {
+            length++
+        }
+        length += len(tenant)
+        part = append(part, byTenant[tenant]...)
+    }
+    // Requests without a tenant are not tagged and go with the last batch
+    part = append(part, byTenant[""]...)
+    return append(parts, part)
+}
+
+// restoreRequestKeys sets the tenant and route of requests read back from the input file of a
+// batch, which only holds their bodies. Each request gets the tenant among those the batch was
+// tagged with whose cache key is the custom id the request was submitted under.
+func (bo *orchestrator) restoreRequestKeys(batch openai.Batch, requests []models.BatchRequestItem) {
+    tenants := []string{models.DefaultTenant}
+    if tagged, ok := batch.Metadata[metadataTenants].(string); ok && tagged != "" {
+        tenants = strings.Split(tagged, ",")
+    }
+
+    for i := range requests {
+        request := &requests[i].Request
+        request.Route = chatCompletionsRoute
+        request.Tenant = ""
+        for _, tenant := range tenants {
+            request.Tenant = tenant
+            if hash, err := bo.fingerprinter.Fingerprint(*request); err == nil && hash == requests[i].CustomID {
+                break
+            }
+            request.Tenant = ""
+        }
+        if request.Tenant == "" {
+            // Submitted with an older fingerprint version or other cache key rules
+            request.Tenant = models.DefaultTenant
+            if len(tenants) == 1 {
+                request.Tenant = tenants[0]
+            }
+        }
+    }
+}
+
+func truncateMetadata(value string) string {
+    if len(value) <= maxMetadataValueLength {
+        return value
+    }
+    return value[:maxMetadataValueLength]
+}
+
+// FindOrphanedBatches lists the batches batch-gpt created upstream since createdAfter that are
+// missing from storage, which happens when it stops between creating a batch and logging it.
+func (p *processor) FindOrphanedBatches(createdAfter time.Time) ([]openai.Batch, error) {
+    ctx := context.Background()
+    limit := listBatchPageSize
+    var after *string
+    var orphaned []openai.Batch
+    for {
+        page, err := p.client.ListBatch(ctx, after, &limit)
+        if err != nil {
+            return orphaned, fmt.Errorf("failed to list batches: %w", err)
+        }
+
+        for _, batch := range page.Data {
+            // Batches are listed newest first
+            createdAt := time.Unix(int64(batch.CreatedAt), 0)
+            if createdAt.Before(createdAfter) {
+                return orphaned, nil
+            }
+            if _, tagged := batch.Metadata[metadataInstance]; !tagged || time.Since(createdAt) < orphanGracePeriod {
+                continue
+            }
+
+            _, err := p.store.GetLatestBatchStatus(batch.ID)
+            if errors.Is(err, db.ErrNotFound) {
+                orphaned = append(orphaned, batch)
+            } else if err != nil {
+                return orphaned, fmt.Errorf("failed to look up batch %s: %w", batch.ID, err)
+            }
+        }
+
+        if !page.HasMore || len(page.Data) == 0 {
+            return orphaned, nil
+        }
+        after = &page.LastID
+    }
+}
+
+// findJobBatch looks for the batch of a job submitted at submittedAt, paging through the batches
+// created since.
+func (p *processor) findJobBatch(jobID string, submittedAt time.Time) (openai.Batch, bool) {
+    ctx := context.Background()
+    limit := listBatchPageSize
+    // Allows for the clocks of batch-gpt and the API being apart
+    createdAfter := submittedAt.Add(-jobBatchClockSkew)
+    var after *string
+    for {
+        page, err := p.client.ListBatch(ctx, after, &limit)
+        if err != nil {
+            logger.WarnLogger.Printf("Failed to look for the batch of job %s: %v", jobID, err)
+            return openai.Batch{}, false
+        }
+        for _, batch := range page.Data {
+            if batch.Metadata[metadataJob] == jobID {
+                return batch, true
+            }
+            // Batches are listed newest first
+            if time.Unix(int64(batch.CreatedAt), 0).Before(createdAfter) {
+                return openai.Batch{}, false
+            }
+        }
+        if !page.HasMore || len(page.Data) == 0 {
+            return openai.Batch{}, false
+        }
+        after = &page.LastID
+    }
+}
+
+// ReconcileOrphanedBatches adopts batches batch-gpt created but never tracked: they are logged,
+// and their requests are settled and their responses cached like those of a dangling batch.
+func (bo *orchestrator) ReconcileOrphanedBatches() {
+    orphaned, err := bo.processor.FindOrphanedBatches(time.Now().Add(-bo.reconcileConfig.GetLookback()))
+    if err != nil {
+        logger.ErrorLogger.Printf("ReconcileOrphanedBatches: %v", err)
+    }
+
+    for _, batch := range orphaned {
+        logger.WarnLogger.Printf("ReconcileOrphanedBatches: Adopting untracked batch %s of job %v created by %v, status %s",
+            batch.ID, batch.Metadata[metadataJob], batch.Metadata[metadataInstance], batch.Status)
+        if err := bo.store.LogBatchStatus(openai.BatchResponse{Batch: batch}); err != nil {
+            logger.ErrorLogger.Printf("ReconcileOrphanedBatches: Failed to log batch %s: %v", batch.ID, err)
+            continue
+        }
+        bo.continueDanglingBatch(batch)
+    }
+    logger.InfoLogger.Printf("ReconcileOrphanedBatches: Adopted %d untracked batches", len(orphaned))
+}
+
+// StartReconciling reconciles orphaned batches now and then on the configured interval.
+func (bo *orchestrator) StartReconciling() {
+    bo.ReconcileOrphanedBatches()
+    if bo.reconcileConfig.GetInterval() == 0 {
+        return
+    }
+    for range time.Tick(bo.reconcileConfig.GetInterval()) {
+        bo.ReconcileOrphanedBatches()
+    }
+}
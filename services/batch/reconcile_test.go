@@ -0,0 +1,253 @@
+package batch
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/models"
+    "batch-gpt/services/client"
+    "batch-gpt/services/config"
+    "batch-gpt/services/fingerprint"
+    "context"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// testListClient lists batches, newest first, a page of at most limit at a time.
+type testListClient struct {
+    client.OpenAIClient
+    batches []openai.Batch
+    pages   int
+}
+
+func (c *testListClient) ListBatch(ctx context.Context, after *string, limit *int) (openai.ListBatchResponse, error) {
+    c.pages++
+    start := 0
+    if after != nil {
+        for i, batch := range c.batches {
+            if batch.ID == *after {
+                start = i + 1
+            }
+        }
+    }
+    end := min(start+*limit, len(c.batches))
+    page := openai.ListBatchResponse{Data: c.batches[start:end], HasMore: end < len(c.batches)}
+    if end > start {
+        page.LastID = c.batches[end-1].ID
+    }
+    return page, nil
+}
+
+// testBatchStore holds the batches in known.
+type testBatchStore struct {
+    db.BatchStore
+    known map[string]bool
+}
+
+func (s testBatchStore) GetLatestBatchStatus(batchID string) (openai.Batch, error) {
+    if s.known[batchID] {
+        return openai.Batch{ID: batchID}, nil
+    }
+    return openai.Batch{}, db.ErrNotFound
+}
+
+// testCacheKeyConfig trims message contents in the keys of the tenants in trimmed.
+type testCacheKeyConfig struct {
+    trimmed map[string]bool
+}
+
+func (c testCacheKeyConfig) GetRules(route string, tenant string) config.CacheKeyRules {
+    return config.CacheKeyRules{TrimContent: c.trimmed[tenant]}
+}
+
+// listedBatches returns count batches created a minute apart, newest first, ending at newest.
+func listedBatches(count int, newest time.Time, metadata func(i int) map[string]any) []openai.Batch {
+    batches := make([]openai.Batch, count)
+    for i := range batches {
+        batches[i].ID = fmt.Sprintf("batch_%d", i)
+        batches[i].CreatedAt = int(newest.Add(-time.Duration(i) * time.Minute).Unix())
+        batches[i].Metadata = metadata(i)
+    }
+    return batches
+}
+
+func tenantItems(tenants ...string) []models.BatchRequestItem {
+    items := make([]models.BatchRequestItem, len(tenants))
+    for i, tenant := range tenants {
+        items[i] = models.BatchRequestItem{CustomID: fmt.Sprintf("request_%d", i), Request: models.ChatRequest{Tenant: tenant}}
+    }
+    return items
+}
+
+func TestBatchMetadata(t *testing.T) {
+    p := &processor{instanceID: "instance-1"}
+
+    metadata := p.batchMetadata(models.BatchRequest{JobID: "job-1", Requests: tenantItems("b", "a", "b", "")})
+    want := map[string]any{metadataInstance: "instance-1", metadataJob: "job-1", metadataTenants: "a,b"}
+    if fmt.Sprint(metadata) != fmt.Sprint(want) {
+        t.Errorf("batchMetadata() = %v, want %v", metadata, want)
+    }
+
+    metadata = p.batchMetadata(models.BatchRequest{JobID: "job-2", Requests: tenantItems("")})
+    if _, tagged := metadata[metadataTenants]; tagged {
+        t.Errorf("batchMetadata() = %v, want no tenants for requests without one", metadata)
+    }
+}
+
+func TestSplitByTenants(t *testing.T) {
+    if parts := splitByTenants(tenantItems("a", "b", "a")); len(parts) != 1 || len(parts[0]) != 3 {
+        t.Errorf("splitByTenants() of two tenants = %d parts, want the batch whole", len(parts))
+    }
+
+    // 20 tenants of the longest name, with two requests each and one request without a tenant
+    var tenants []string
+    for i := 0; i < 20; i++ {
+        tenant := fmt.Sprintf("%02d", i) + strings.Repeat("t", models.MaxTenantLength-2)
+        tenants = append(tenants, tenant, tenant)
+    }
+    items := tenantItems(append(tenants, "")...)
+
+    parts := splitByTenants(items)
+    if len(parts) < 3 {
+        t.Fatalf("splitByTenants() = %d parts, want at least 3", len(parts))
+    }
+    partOf := make(map[string]int)
+    total := 0
+    for i, part := range parts {
+        total += len(part)
+        if tagged := strings.Join(batchTenants(part), ","); len(tagged) > maxMetadataValueLength {
+            t.Errorf("part %d tags %d characters of tenants, want at most %d", i, len(tagged), maxMetadataValueLength)
+        }
+        for _, item := range part {
+            if previous, found := partOf[item.Request.Tenant]; found && previous != i {
+                t.Errorf("tenant %.8s... is split across parts %d and %d", item.Request.Tenant, previous, i)
+            }
+            partOf[item.Request.Tenant] = i
+        }
+    }
+    if total != len(items) {
+        t.Errorf("parts hold %d requests, want %d", total, len(items))
+    }
+}
+
+func TestRestoreRequestKeys(t *testing.T) {
+    fixture := newTestFixture(1, 0, nil)
+    fingerprinter := fingerprint.NewFingerprinter(testCacheKeyConfig{trimmed: map[string]bool{"trimmed": true}})
+    fixture.orchestrator.fingerprinter = fingerprinter
+
+    request := newTestRequest(t, "  hello  ")
+    hashFor := func(tenant string) string {
+        keyed := request
+        keyed.Tenant = tenant
+        hash, err := fingerprinter.Fingerprint(keyed)
+        if err != nil {
+            t.Fatalf("Fingerprint() error = %v", err)
+        }
+        return hash
+    }
+    if hashFor("trimmed") == hashFor("acme") {
+        t.Fatal("the tenants' cache keys must differ for the test to tell them apart")
+    }
+
+    tests := []struct {
+        name     string
+        tenants  any
+        customID string
+        want     string
+    }{
+        {name: "tenant whose key matches", tenants: "acme,trimmed", customID: hashFor("trimmed"), want: "trimmed"},
+        {name: "first tenant whose key matches", tenants: "acme,other,trimmed", customID: hashFor("acme"), want: "acme"},
+        {name: "no key matches among tenants", tenants: "acme,trimmed", customID: "outdated", want: models.DefaultTenant},
+        {name: "no key matches the only tenant", tenants: "acme", customID: "outdated", want: "acme"},
+        {name: "untagged batch", customID: hashFor(models.DefaultTenant), want: models.DefaultTenant},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            batch := openai.Batch{Metadata: map[string]any{}}
+            if tt.tenants != nil {
+                batch.Metadata[metadataTenants] = tt.tenants
+            }
+            requests := []models.BatchRequestItem{{CustomID: tt.customID, Request: models.ChatRequest{Body: request.Body}}}
+
+            fixture.orchestrator.restoreRequestKeys(batch, requests)
+            if got := requests[0].Request.Tenant; got != tt.want {
+                t.Errorf("Tenant = %q, want %q", got, tt.want)
+            }
+            if got := requests[0].Request.Route; got != chatCompletionsRoute {
+                t.Errorf("Route = %q, want %q", got, chatCompletionsRoute)
+            }
+        })
+    }
+}
+
+func TestFindJobBatch(t *testing.T) {
+    submittedAt := time.Now()
+    jobOf := func(i int) map[string]any { return map[string]any{metadataJob: fmt.Sprintf("job-%d", i)} }
+
+    tests := []struct {
+        name      string
+        jobID     string
+        // newest is how many minutes after the submission the newest batch was created
+        newest    int
+        want      string
+        wantPages int
+    }{
+        {name: "on the first page", jobID: "job-3", newest: 10, want: "batch_3", wantPages: 1},
+        {name: "on a later page", jobID: "job-250", newest: 300, want: "batch_250", wantPages: 3},
+        // Batches are a minute apart, so paging stops past the one created a minute before the submission
+        {name: "older than the submission", jobID: "job-400", newest: 10, wantPages: 1},
+        {name: "older than the submission on a later page", jobID: "job-400", newest: 150, wantPages: 2},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            newest := submittedAt.Add(time.Duration(tt.newest) * time.Minute)
+            listClient := &testListClient{batches: listedBatches(500, newest, jobOf)}
+            p := &processor{client: listClient}
+
+            batch, found := p.findJobBatch(tt.jobID, submittedAt)
+            if found != (tt.want != "") || batch.ID != tt.want {
+                t.Errorf("findJobBatch() = %q, %v, want %q", batch.ID, found, tt.want)
+            }
+            if listClient.pages != tt.wantPages {
+                t.Errorf("listed %d pages, want %d", listClient.pages, tt.wantPages)
+            }
+        })
+    }
+}
+
+func TestFindOrphanedBatches(t *testing.T) {
+    now := time.Now()
+    tagged := func(i int) map[string]any {
+        if i%4 == 3 {
+            // Created outside batch-gpt
+            return map[string]any{}
+        }
+        return map[string]any{metadataInstance: "instance-1", metadataJob: fmt.Sprintf("job-%d", i)}
+    }
+    listClient := &testListClient{batches: listedBatches(300, now, tagged)}
+    p := &processor{client: listClient, store: testBatchStore{known: map[string]bool{"batch_20": true, "batch_150": true}}}
+
+    orphaned, err := p.FindOrphanedBatches(now.Add(-200 * time.Minute))
+    if err != nil {
+        t.Fatalf("FindOrphanedBatches() error = %v", err)
+    }
+
+    var ids []string
+    for _, batch := range orphaned {
+        ids = append(ids, batch.ID)
+    }
+    // Batches in the grace period, untagged, tracked or created before the lookback are left out
+    var want []string
+    for i := 10; i < 200; i++ {
+        if i%4 != 3 && i != 20 && i != 150 {
+            want = append(want, fmt.Sprintf("batch_%d", i))
+        }
+    }
+    if strings.Join(ids, " ") != strings.Join(want, " ") {
+        t.Errorf("FindOrphanedBatches() = %v, want %v", ids, want)
+    }
+}
@@ -0,0 +1,63 @@
+package batch
+
+import (
+    "batch-gpt/server/models"
+    "fmt"
+    "regexp"
+)
+
+// Error classes used to decide whether a failed batch item is retried.
+const (
+    errorClassRateLimit      = "rate_limit"
+    errorClassServer         = "server_error"
+    errorClassMalformed      = "malformed_response"
+    errorClassInvalidRequest = "invalid_request"
+    errorClassUnfinished     = "unfinished"
+)
+
+var customIDPattern = regexp.MustCompile(`"custom_id"\s*:\s*"([^"]+)"`)
+
+// recoverCustomID extracts the custom_id from a response line that could not be parsed.
+func recoverCustomID(line []byte) string {
+    match := customIDPattern.FindSubmatch(line)
+    if match == nil {
+        return ""
+    }
+    return string(match[1])
+}
+
+// classifyItemError maps a failed batch item to one of the error classes above.
+func classifyItemError(item models.BatchResponseItem) string {
+    if item.Error != nil {
+        switch {
+        case item.Error.Type == errorClassMalformed:
+            return errorClassMalformed
+        case item.Error.Code == "rate_limit_exceeded":
+            return errorClassRateLimit
+        case item.Error.Code == "server_error" || item.Error.Type == "server_error":
+            return errorClassServer
+        case item.Error.Code == "batch_expired" || item.Error.Code == "batch_cancelled":
+            // The request never ran, the batch stopped before reaching it
+            return errorClassUnfinished
+        }
+        return errorClassInvalidRequest
+    }
+
+    switch code := item.Response.StatusCode; {
+    case code == 429:
+        return errorClassRateLimit
+    case code >= 500:
+        return errorClassServer
+    }
+    return errorClassInvalidRequest
+}
+
+func itemErrorMessage(item models.BatchResponseItem) string {
+    if item.Error != nil {
+        return item.Error.Message
+    }
+    if item.Response.Error != nil {
+        return fmt.Sprintf("status code %d: %s", item.Response.StatusCode, item.Response.Error.Message)
+    }
+    return fmt.Sprintf("status code %d", item.Response.StatusCode)
+}
@@ -0,0 +1,88 @@
+package batch
+
+import (
+    "batch-gpt/server/models"
+    "testing"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+func TestClassifyItemError(t *testing.T) {
+    tests := []struct {
+        name string
+        item models.BatchResponseItem
+        want string
+    }{
+        {name: "malformed line", item: models.BatchResponseItem{Error: &openai.APIError{Type: errorClassMalformed}}, want: errorClassMalformed},
+        {name: "rate limit error", item: failedItem("a", "rate_limit_exceeded"), want: errorClassRateLimit},
+        {name: "server error code", item: failedItem("a", "server_error"), want: errorClassServer},
+        {name: "server error type", item: models.BatchResponseItem{Error: &openai.APIError{Type: "server_error"}}, want: errorClassServer},
+        {name: "expired batch", item: failedItem("a", "batch_expired"), want: errorClassUnfinished},
+        {name: "cancelled batch", item: failedItem("a", "batch_cancelled"), want: errorClassUnfinished},
+        {name: "other error", item: failedItem("a", "invalid_prompt"), want: errorClassInvalidRequest},
+        {name: "status 429", item: responseItem(429), want: errorClassRateLimit},
+        {name: "status 500", item: responseItem(500), want: errorClassServer},
+        {name: "status 503", item: responseItem(503), want: errorClassServer},
+        {name: "status 400", item: responseItem(400), want: errorClassInvalidRequest},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := classifyItemError(tt.item); got != tt.want {
+                t.Errorf("classifyItemError() = %s, want %s", got, tt.want)
+            }
+        })
+    }
+}
+
+func responseItem(statusCode int) models.BatchResponseItem {
+    var item models.BatchResponseItem
+    item.CustomID = "a"
+    item.Response.StatusCode = statusCode
+    return item
+}
+
+func TestRecoverCustomID(t *testing.T) {
+    tests := []struct {
+        name string
+        line string
+        want string
+    }{
+        {name: "truncated line", line: `{"id":"batch_req_1","custom_id":"abc123","response":{"status_code":200,"body":{"id":`, want: "abc123"},
+        {name: "spaces around the colon", line: `{"custom_id" :  "abc123", "response": nul`, want: "abc123"},
+        {name: "no custom id", line: `{"id":"batch_req_1","response":`, want: ""},
+        {name: "empty custom id", line: `{"custom_id":"","response":`, want: ""},
+        {name: "not JSON", line: `garbage`, want: ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := recoverCustomID([]byte(tt.line)); got != tt.want {
+                t.Errorf("recoverCustomID() = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestItemErrorMessage(t *testing.T) {
+    withError := responseItem(400)
+    withError.Response.Error = &openai.APIError{Message: "bad request"}
+
+    tests := []struct {
+        name string
+        item models.BatchResponseItem
+        want string
+    }{
+        {name: "item error", item: failedItem("a", "server_error"), want: "server_error"},
+        {name: "response error", item: withError, want: "status code 400: bad request"},
+        {name: "status only", item: responseItem(500), want: "status code 500"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := itemErrorMessage(tt.item); got != tt.want {
+                t.Errorf("itemErrorMessage() = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
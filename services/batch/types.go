@@ -2,6 +2,7 @@ package batch
 
 import (
 	"batch-gpt/server/models"
+	"time"
 
 	openai "github.com/sashabaranov/go-openai"
 )
@@ -13,13 +14,31 @@ type BatchResult struct {
 }
 
 type Orchestrator interface {
-    AddRequest(request openai.ChatCompletionRequest) <-chan BatchResult
+    AddRequest(request models.ChatRequest) <-chan BatchResult
+    RequeueRequest(request models.ChatRequest) error
     ProcessBatch()
     StartProcessing()
     ContinueDanglingBatches()
+    ReconcileOrphanedBatches()
+    StartReconciling()
+    ImportBatch(batchID string, tenant string, wait bool) (models.BatchImport, error)
 }
 
 type Processor interface {
-    ProcessBatch(batchRequest models.BatchRequest) ([]models.BatchResponseItem, error)
-    PollAndCollectResponses(batchID string) ([]models.BatchResponseItem, error)
+    // ProcessBatch submits a batch and returns without waiting for it. onDone is called with
+    // its output once it finished, after the requests that made it fail were isolated.
+    ProcessBatch(batchRequest models.BatchRequest, onDone func(models.BatchOutput, error))
+    WatchBatch(batchID string, onDone func(models.BatchOutput, error))
+    ResolveFailedBatch(batchRequest models.BatchRequest, output models.BatchOutput, onDone func(models.BatchOutput, error))
+    FindOrphanedBatches(createdAfter time.Time) ([]openai.Batch, error)
+}
+
+// Poller polls the status of every submitted batch from one schedule, so that the number
+// of status requests in flight stays bounded however many batches are active.
+type Poller interface {
+    // Watch schedules a batch for polling. onTerminal is called once the batch reaches a
+    // terminal status, or with an error if its status cannot be retrieved for good. It runs
+    // on a poll worker and must not block.
+    Watch(batchID string, onTerminal func(openai.BatchResponse, error))
+    Start()
 }
@@ -0,0 +1,329 @@
+package budget
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "batch-gpt/services/config"
+    "batch-gpt/services/usage"
+    "errors"
+    "fmt"
+    "math"
+    "sync"
+    "time"
+)
+
+// ErrInvalidBudget is returned for budgets with negative limits.
+var ErrInvalidBudget = errors.New("budget limits must not be negative")
+
+// promptBytesPerToken is how many bytes of a request body make up a prompt token, roughly.
+// The whole body is counted, so the estimate errs on the high side.
+const promptBytesPerToken = 4
+
+type enforcer struct {
+    store         db.BudgetStore
+    usageTracker  usage.Tracker
+    pricingConfig config.PricingConfig
+    config        config.BudgetConfig
+    mu            sync.Mutex
+    tenants       map[string]*tenantState
+    // reserved sums up the reservations of each tenant; they are not dropped when the tenant's state is
+    reserved      map[string]Spent
+}
+
+// tenantState is what the enforcer holds in memory for a tenant.
+type tenantState struct {
+    budget   *models.Budget // nil if the tenant has no budget
+    spent    Spent
+    loadedAt time.Time
+    // The rate limit is a token bucket holding up to a minute's worth of requests
+    requests   float64
+    refilledAt time.Time
+}
+
+func NewEnforcer(store db.BudgetStore, usageTracker usage.Tracker, pricingConfig config.PricingConfig, budgetConfig config.BudgetConfig) Enforcer {
+    return &enforcer{
+        store:         store,
+        usageTracker:  usageTracker,
+        pricingConfig: pricingConfig,
+        config:        budgetConfig,
+        tenants:       make(map[string]*tenantState),
+        reserved:      make(map[string]Spent),
+    }
+}
+
+func (e *enforcer) Admit(tenant string) *Rejection {
+    budget, _ := e.state(tenant)
+    if budget == nil || budget.RequestsPerMinute <= 0 {
+        return nil
+    }
+
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    state, found := e.tenants[tenant]
+    if !found {
+        // The budget was changed since it was read
+        return nil
+    }
+    perSecond := float64(budget.RequestsPerMinute) / 60
+    now := time.Now()
+    if state.refilledAt.IsZero() {
+        state.requests = float64(budget.RequestsPerMinute)
+    } else {
+        state.requests = min(state.requests+now.Sub(state.refilledAt).Seconds()*perSecond, float64(budget.RequestsPerMinute))
+    }
+    state.refilledAt = now
+
+    if state.requests >= 1 {
+        state.requests--
+        return nil
+    }
+    retryAfter := time.Duration(math.Ceil((1-state.requests)/perSecond)) * time.Second
+    return &Rejection{
+        Code: CodeRateLimitExceeded,
+        Message: fmt.Sprintf("Rate limit reached for tenant %s on requests per minute: Limit %d. Please try again in %s.",
+            tenant, budget.RequestsPerMinute, retryAfter),
+        RetryAfter: retryAfter,
+    }
+}
+
+func (e *enforcer) Check(tenant string) (string, *Rejection) {
+    budget, spent := e.state(tenant)
+    if budget == nil {
+        return "", nil
+    }
+    spent = spent.plus(e.reservedFor(tenant))
+
+    var warning string
+    var highest float64
+    for _, limit := range []struct {
+        name  string
+        spent float64
+        limit float64
+        unit  func(float64) string
+    }{
+        {"daily token budget", float64(spent.DailyTokens), float64(budget.DailyTokens), formatTokens},
+        {"monthly token budget", float64(spent.MonthlyTokens), float64(budget.MonthlyTokens), formatTokens},
+        {"daily budget", spent.DailyUSD, budget.DailyUSD, formatDollars},
+        {"monthly budget", spent.MonthlyUSD, budget.MonthlyUSD, formatDollars},
+    } {
+        if limit.limit <= 0 {
+            continue
+        }
+        share := limit.spent / limit.limit * 100
+        if share >= 100 {
+            return "", &Rejection{
+                Code: CodeInsufficientQuota,
+                Message: fmt.Sprintf("Tenant %s exceeded its %s of %s. Requests are accepted again once the budget resets or is raised.",
+                    tenant, limit.name, limit.unit(limit.limit)),
+            }
+        }
+        if share >= e.config.GetSoftLimitPercent() && share > highest {
+            highest = share
+            warning = fmt.Sprintf("%s: %.0f%% of %s spent", limit.name, share, limit.unit(limit.limit))
+        }
+    }
+    return warning, nil
+}
+
+func (e *enforcer) Reserve(request models.ChatRequest) Reservation {
+    tenant := request.Tenant
+    if tenant == "" {
+        tenant = models.DefaultTenant
+    }
+    promptTokens := int64((len(request.Body) + promptBytesPerToken - 1) / promptBytesPerToken)
+    completionTokens := int64(e.config.GetDefaultCompletionTokens())
+    if request.Params.MaxCompletionsTokens > 0 {
+        completionTokens = int64(request.Params.MaxCompletionsTokens)
+    } else if request.Params.MaxTokens > 0 {
+        completionTokens = int64(request.Params.MaxTokens)
+    }
+
+    reservation := Reservation{Tenant: tenant, Tokens: promptTokens + completionTokens}
+    if price, ok := e.pricingConfig.GetPrice(request.Params.Model); ok {
+        reservation.USD = (float64(promptTokens)*price.BatchInput + float64(completionTokens)*price.BatchOutput) / 1_000_000
+    }
+
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.reserved[tenant] = e.reserved[tenant].plus(reservation.spent())
+    return reservation
+}
+
+func (e *enforcer) Release(reservation Reservation) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    reserved := e.reserved[reservation.Tenant].plus(reservation.spent().negated())
+    if reserved.MonthlyTokens <= 0 {
+        delete(e.reserved, reservation.Tenant)
+    } else {
+        e.reserved[reservation.Tenant] = reserved
+    }
+    // The usage of the request was recorded by now, so read the spend again
+    if state, found := e.tenants[reservation.Tenant]; found {
+        state.loadedAt = time.Time{}
+    }
+}
+
+// spent is what the reservation holds back, today and this month alike.
+func (r Reservation) spent() Spent {
+    return Spent{DailyTokens: r.Tokens, MonthlyTokens: r.Tokens, DailyUSD: r.USD, MonthlyUSD: r.USD}
+}
+
+func (s Spent) plus(other Spent) Spent {
+    return Spent{
+        DailyTokens:   s.DailyTokens + other.DailyTokens,
+        MonthlyTokens: s.MonthlyTokens + other.MonthlyTokens,
+        DailyUSD:      s.DailyUSD + other.DailyUSD,
+        MonthlyUSD:    s.MonthlyUSD + other.MonthlyUSD,
+    }
+}
+
+func (s Spent) negated() Spent {
+    return Spent{DailyTokens: -s.DailyTokens, MonthlyTokens: -s.MonthlyTokens, DailyUSD: -s.DailyUSD, MonthlyUSD: -s.MonthlyUSD}
+}
+
+func formatTokens(tokens float64) string {
+    return fmt.Sprintf("%.0f tokens", tokens)
+}
+
+func formatDollars(amount float64) string {
+    return fmt.Sprintf("$%.2f", amount)
+}
+
+// state returns the budget of a tenant and what it spent, read from the store once the ones
+// held in memory are older than the refresh interval or from an earlier day. Failures to read
+// them keep the ones held, so an unavailable store does not turn every request away.
+func (e *enforcer) state(tenant string) (*models.Budget, Spent) {
+    now := time.Now().UTC()
+    e.mu.Lock()
+    state, found := e.tenants[tenant]
+    if found && now.Sub(state.loadedAt) < e.config.GetRefreshInterval() && sameDay(now, state.loadedAt) {
+        defer e.mu.Unlock()
+        return state.budget, state.spent
+    }
+    e.mu.Unlock()
+
+    budget, spent, err := e.load(tenant, now)
+
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    state, found = e.tenants[tenant]
+    if !found {
+        state = &tenantState{}
+        e.tenants[tenant] = state
+    }
+    state.loadedAt = now
+    if err != nil {
+        logger.ErrorLogger.Printf("Failed to read the budget of tenant %s, keeping the last one read: %v", tenant, err)
+        return state.budget, state.spent
+    }
+    state.budget = budget
+    state.spent = spent
+    return budget, spent
+}
+
+func (e *enforcer) load(tenant string, now time.Time) (*models.Budget, Spent, error) {
+    budget, err := e.store.GetBudget(tenant)
+    if errors.Is(err, db.ErrNotFound) {
+        return nil, Spent{}, nil
+    }
+    if err != nil {
+        return nil, Spent{}, err
+    }
+    spent, err := e.spent(tenant, now)
+    if err != nil {
+        return nil, Spent{}, err
+    }
+    return &budget, spent, nil
+}
+
+// spent sums up what the batches of a tenant took today and this month.
+func (e *enforcer) spent(tenant string, now time.Time) (Spent, error) {
+    report, err := e.usageTracker.Report(models.UsageFilter{
+        Tenant: tenant,
+        From:   time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Format(usage.DayFormat),
+    })
+    if err != nil {
+        return Spent{}, err
+    }
+
+    var spent Spent
+    today := now.Format(usage.DayFormat)
+    for _, summary := range report.Data {
+        tokens := summary.BatchPromptTokens + summary.BatchCompletionTokens
+        spent.MonthlyTokens += tokens
+        spent.MonthlyUSD += summary.Spend
+        if summary.Day == today {
+            spent.DailyTokens += tokens
+            spent.DailyUSD += summary.Spend
+        }
+    }
+    return spent, nil
+}
+
+func sameDay(a, b time.Time) bool {
+    return a.Format(usage.DayFormat) == b.Format(usage.DayFormat)
+}
+
+func (e *enforcer) GetStatuses() ([]Status, error) {
+    budgets, err := e.store.GetBudgets()
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now().UTC()
+    statuses := make([]Status, 0, len(budgets))
+    for _, budget := range budgets {
+        spent, err := e.spent(budget.Tenant, now)
+        if err != nil {
+            return nil, err
+        }
+        statuses = append(statuses, Status{Budget: budget, Spent: spent, Reserved: e.reservedFor(budget.Tenant)})
+    }
+    return statuses, nil
+}
+
+func (e *enforcer) GetStatus(tenant string) (Status, error) {
+    budget, err := e.store.GetBudget(tenant)
+    if err != nil {
+        return Status{}, err
+    }
+    spent, err := e.spent(tenant, time.Now().UTC())
+    if err != nil {
+        return Status{}, err
+    }
+    return Status{Budget: budget, Spent: spent, Reserved: e.reservedFor(tenant)}, nil
+}
+
+func (e *enforcer) reservedFor(tenant string) Spent {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return e.reserved[tenant]
+}
+
+// SetBudget stores the budget of a tenant and enforces it from the next request on. Other
+// replicas enforce it once their refresh interval passed.
+func (e *enforcer) SetBudget(budget models.Budget) (models.Budget, error) {
+    if budget.DailyTokens < 0 || budget.MonthlyTokens < 0 || budget.DailyUSD < 0 || budget.MonthlyUSD < 0 || budget.RequestsPerMinute < 0 {
+        return models.Budget{}, ErrInvalidBudget
+    }
+    budget.UpdatedAt = time.Now().UTC()
+    if err := e.store.SaveBudget(budget); err != nil {
+        return models.Budget{}, err
+    }
+    e.forget(budget.Tenant)
+    return budget, nil
+}
+
+func (e *enforcer) DeleteBudget(tenant string) error {
+    err := e.store.DeleteBudget(tenant)
+    e.forget(tenant)
+    return err
+}
+
+func (e *enforcer) forget(tenant string) {
+    e.mu.Lock()
+    delete(e.tenants, tenant)
+    e.mu.Unlock()
+}
@@ -0,0 +1,240 @@
+package budget
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/models"
+    "batch-gpt/services/config"
+    "batch-gpt/services/usage"
+    "testing"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+type testBudgetStore struct {
+    budgets map[string]models.Budget
+}
+
+func (s *testBudgetStore) GetBudgets() ([]models.Budget, error) {
+    var budgets []models.Budget
+    for _, budget := range s.budgets {
+        budgets = append(budgets, budget)
+    }
+    return budgets, nil
+}
+
+func (s *testBudgetStore) GetBudget(tenant string) (models.Budget, error) {
+    budget, found := s.budgets[tenant]
+    if !found {
+        return models.Budget{}, db.ErrNotFound
+    }
+    return budget, nil
+}
+
+func (s *testBudgetStore) SaveBudget(budget models.Budget) error {
+    s.budgets[budget.Tenant] = budget
+    return nil
+}
+
+func (s *testBudgetStore) DeleteBudget(tenant string) error {
+    delete(s.budgets, tenant)
+    return nil
+}
+
+// testTracker reports the same summaries for any filter.
+type testTracker struct {
+    summaries []usage.Summary
+}
+
+func (t *testTracker) RecordBatch(requests []models.BatchRequestItem, responses []models.BatchResponseItem) {}
+
+func (t *testTracker) RecordCacheHit(request models.ChatRequest, response openai.ChatCompletionResponse) {}
+
+func (t *testTracker) Report(filter models.UsageFilter) (usage.Report, error) {
+    return usage.Report{Data: t.summaries}, nil
+}
+
+type testBudgetConfig struct{}
+
+func (testBudgetConfig) GetRefreshInterval() time.Duration { return time.Minute }
+func (testBudgetConfig) GetSoftLimitPercent() float64      { return 80 }
+func (testBudgetConfig) GetDefaultCompletionTokens() int   { return 1024 }
+
+type testPricingConfig struct{}
+
+func (testPricingConfig) GetPrice(model string) (config.ModelPrice, bool) {
+    if model != "gpt-4o-mini" {
+        return config.ModelPrice{}, false
+    }
+    return config.ModelPrice{BatchInput: 1_000_000, BatchOutput: 1_000_000}, true
+}
+
+func newTestEnforcer(budgets []models.Budget, summaries []usage.Summary) Enforcer {
+    store := &testBudgetStore{budgets: make(map[string]models.Budget)}
+    for _, budget := range budgets {
+        store.budgets[budget.Tenant] = budget
+    }
+    return NewEnforcer(store, &testTracker{summaries: summaries}, testPricingConfig{}, testBudgetConfig{})
+}
+
+func TestCheck(t *testing.T) {
+    today := time.Now().UTC().Format(usage.DayFormat)
+    earlier := "2000-01-01"
+
+    tests := []struct {
+        name        string
+        budget      *models.Budget
+        summaries   []usage.Summary
+        reserve     []string
+        wantWarning string
+        wantCode    string
+    }{
+        {
+            name:      "tenant without a budget",
+            summaries: []usage.Summary{{Day: today, BatchPromptTokens: 1_000_000}},
+        },
+        {
+            name:      "under the soft limit",
+            budget:    &models.Budget{Tenant: "acme", DailyTokens: 1000},
+            summaries: []usage.Summary{{Day: today, BatchPromptTokens: 400, BatchCompletionTokens: 100}},
+        },
+        {
+            name:        "over the soft limit",
+            budget:      &models.Budget{Tenant: "acme", DailyTokens: 1000},
+            summaries:   []usage.Summary{{Day: today, BatchPromptTokens: 600, BatchCompletionTokens: 250}},
+            wantWarning: "daily token budget: 85% of 1000 tokens spent",
+        },
+        {
+            name:      "daily tokens spent",
+            budget:    &models.Budget{Tenant: "acme", DailyTokens: 1000},
+            summaries: []usage.Summary{{Day: today, BatchPromptTokens: 600, BatchCompletionTokens: 400}},
+            wantCode:  CodeInsufficientQuota,
+        },
+        {
+            name:      "earlier days only count towards the month",
+            budget:    &models.Budget{Tenant: "acme", DailyTokens: 1000, MonthlyTokens: 10000},
+            summaries: []usage.Summary{{Day: earlier, BatchPromptTokens: 5000}, {Day: today, BatchPromptTokens: 100}},
+        },
+        {
+            name:        "the highest share is warned about",
+            budget:      &models.Budget{Tenant: "acme", DailyTokens: 1000, MonthlyUSD: 10},
+            summaries:   []usage.Summary{{Day: today, BatchPromptTokens: 820, Spend: 9.5}},
+            wantWarning: "monthly budget: 95% of $10.00 spent",
+        },
+        {
+            name:     "monthly spend spent",
+            budget:   &models.Budget{Tenant: "acme", MonthlyUSD: 10},
+            summaries: []usage.Summary{{Day: earlier, Spend: 6}, {Day: today, Spend: 4}},
+            wantCode: CodeInsufficientQuota,
+        },
+        {
+            name:        "reservations count as spent",
+            budget:      &models.Budget{Tenant: "acme", DailyTokens: 1000},
+            summaries:   []usage.Summary{{Day: today, BatchPromptTokens: 500}},
+            reserve:     []string{`{"model":"gpt-4o","messages":[],"max_tokens":296}`},
+            wantWarning: "daily token budget: 81% of 1000 tokens spent",
+        },
+        {
+            name:      "reservations take the default completion tokens",
+            budget:    &models.Budget{Tenant: "acme", DailyTokens: 1000},
+            summaries: nil,
+            reserve:   []string{`{"model":"gpt-4o","messages":[]}`},
+            wantCode:  CodeInsufficientQuota,
+        },
+        {
+            name:     "reservations are priced",
+            budget:   &models.Budget{Tenant: "acme", DailyUSD: 100},
+            reserve:  []string{`{"model":"gpt-4o-mini","messages":[],"max_tokens":100}`},
+            wantCode: CodeInsufficientQuota,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var budgets []models.Budget
+            if tt.budget != nil {
+                budgets = append(budgets, *tt.budget)
+            }
+            enforcer := newTestEnforcer(budgets, tt.summaries)
+            for _, body := range tt.reserve {
+                request, err := models.NewChatRequest([]byte(body))
+                if err != nil {
+                    t.Fatalf("NewChatRequest() error = %v", err)
+                }
+                request.Tenant = "acme"
+                enforcer.Reserve(request)
+            }
+
+            warning, rejection := enforcer.Check("acme")
+            if warning != tt.wantWarning {
+                t.Errorf("warning = %q, want %q", warning, tt.wantWarning)
+            }
+            code := ""
+            if rejection != nil {
+                code = rejection.Code
+            }
+            if code != tt.wantCode {
+                t.Errorf("rejection code = %q, want %q", code, tt.wantCode)
+            }
+        })
+    }
+}
+
+func TestReleaseDropsReservation(t *testing.T) {
+    enforcer := newTestEnforcer([]models.Budget{{Tenant: "acme", DailyTokens: 1000}}, nil)
+    request, err := models.NewChatRequest([]byte(`{"model":"gpt-4o","messages":[]}`))
+    if err != nil {
+        t.Fatalf("NewChatRequest() error = %v", err)
+    }
+    request.Tenant = "acme"
+
+    reservation := enforcer.Reserve(request)
+    if _, rejection := enforcer.Check("acme"); rejection == nil {
+        t.Fatalf("Check() with %d tokens reserved did not reject", reservation.Tokens)
+    }
+    enforcer.Release(reservation)
+    if warning, rejection := enforcer.Check("acme"); warning != "" || rejection != nil {
+        t.Errorf("Check() after Release = %q, %v, want no warning and no rejection", warning, rejection)
+    }
+}
+
+func TestAdmit(t *testing.T) {
+    tests := []struct {
+        name     string
+        budget   *models.Budget
+        requests int
+        admitted int
+    }{
+        {name: "tenant without a budget", requests: 100, admitted: 100},
+        {name: "budget without a rate limit", budget: &models.Budget{Tenant: "acme", DailyTokens: 1000}, requests: 100, admitted: 100},
+        {name: "a minute's worth of requests", budget: &models.Budget{Tenant: "acme", RequestsPerMinute: 3}, requests: 5, admitted: 3},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var budgets []models.Budget
+            if tt.budget != nil {
+                budgets = append(budgets, *tt.budget)
+            }
+            enforcer := newTestEnforcer(budgets, nil)
+
+            admitted := 0
+            for i := 0; i < tt.requests; i++ {
+                rejection := enforcer.Admit("acme")
+                if rejection == nil {
+                    admitted++
+                    continue
+                }
+                if rejection.Code != CodeRateLimitExceeded {
+                    t.Errorf("rejection code = %q, want %q", rejection.Code, CodeRateLimitExceeded)
+                }
+                if rejection.RetryAfter <= 0 {
+                    t.Errorf("rejection retry after = %v, want it positive", rejection.RetryAfter)
+                }
+            }
+            if admitted != tt.admitted {
+                t.Errorf("admitted %d of %d requests, want %d", admitted, tt.requests, tt.admitted)
+            }
+        })
+    }
+}
@@ -0,0 +1,64 @@
+package budget
+
+import (
+    "batch-gpt/server/models"
+    "time"
+)
+
+// OpenAI error codes of rejected requests.
+const (
+    CodeRateLimitExceeded = "rate_limit_exceeded"
+    CodeInsufficientQuota = "insufficient_quota"
+)
+
+// Rejection is why a request of a tenant was turned away. RetryAfter is set when waiting helps.
+type Rejection struct {
+    Code       string
+    Message    string
+    RetryAfter time.Duration
+}
+
+// Spent is what a tenant's batches took today and this month, in UTC. Responses served from
+// the cache cost nothing and are not counted.
+type Spent struct {
+    DailyTokens   int64   `json:"daily_tokens"`
+    MonthlyTokens int64   `json:"monthly_tokens"`
+    DailyUSD      float64 `json:"daily_usd"`
+    MonthlyUSD    float64 `json:"monthly_usd"`
+}
+
+// Reservation is the estimated cost of a request that is queued or in a batch, held back from
+// its tenant's budget until the request is settled.
+type Reservation struct {
+    Tenant string
+    Tokens int64
+    USD    float64
+}
+
+// Status is a tenant's budget, what it spent of it, and what the requests of the tenant that
+// this replica queued or submitted may still spend.
+type Status struct {
+    Budget   models.Budget `json:"budget"`
+    Spent    Spent         `json:"spent"`
+    Reserved Spent         `json:"reserved"`
+}
+
+// Enforcer holds tenants to their budgets. Tenants without a budget are not limited.
+type Enforcer interface {
+    // Admit counts a request against the rate limit of its tenant, and rejects it if the
+    // tenant is over the limit.
+    Admit(tenant string) *Rejection
+    // Check rejects requests of a tenant that spent its budget, and warns once the tenant
+    // spent a configured share of it. Reserved costs count as spent.
+    Check(tenant string) (warning string, rejection *Rejection)
+    // Reserve holds the estimated cost of a request that goes upstream back from its tenant's
+    // budget: its prompt and, at most, max_tokens completion tokens at the Batch API price.
+    Reserve(request models.ChatRequest) Reservation
+    // Release drops a reservation once its request is settled. The tenant's spend is read again
+    // on the next check, which then counts what the request actually took.
+    Release(reservation Reservation)
+    GetStatuses() ([]Status, error)
+    GetStatus(tenant string) (Status, error)
+    SetBudget(budget models.Budget) (models.Budget, error)
+    DeleteBudget(tenant string) error
+}
@@ -0,0 +1,188 @@
+package cache
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "batch-gpt/services/fingerprint"
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+)
+
+const (
+    // importRoute is the route proxy clients send chat completions to, which imported requests
+    // are keyed under so that they hit the cache.
+    importRoute = "/v1/chat/completions"
+    // importProgressInterval is how many output lines are imported between progress reports
+    importProgressInterval = 10000
+)
+
+// ImportFiles is a pair of Batch API input and output files to import into the cache.
+// The input file is read at the offsets of the requests the output file answers, so it
+// must allow random access; the output file is streamed once.
+type ImportFiles struct {
+    Input      io.ReaderAt
+    InputSize  int64
+    Output     io.Reader
+    OutputSize int64
+    // Source names the files in the provenance of the imported responses
+    Source     string
+    // Tenant is the tenant the responses are cached for, the default tenant if empty
+    Tenant     string
+}
+
+// inputLine locates a request in the input file.
+type inputLine struct {
+    offset int64
+    length int
+}
+
+// Import caches the successful responses of an output file under the hashes of the requests
+// they answer in the input file. Responses to requests that are already cached are skipped,
+// so importing the same files again changes nothing. onProgress, if set, is called every
+// importProgressInterval output lines and once at the end.
+func (co *orchestrator) Import(ctx context.Context, files ImportFiles, onProgress func(models.CacheImport)) (models.CacheImport, error) {
+    progress := models.CacheImport{Source: files.Source, TotalBytes: files.OutputSize}
+    report := func() {
+        if onProgress != nil {
+            onProgress(progress)
+        }
+    }
+
+    index, err := indexInputFile(io.NewSectionReader(files.Input, 0, files.InputSize))
+    if err != nil {
+        return progress, err
+    }
+    logger.InfoLogger.Printf("Importing %s: indexed %d requests of the input file", files.Source, len(index))
+
+    tenant := files.Tenant
+    if tenant == "" {
+        tenant = models.DefaultTenant
+    }
+
+    reader := bufio.NewReaderSize(files.Output, 1024*1024)
+    for {
+        if err := ctx.Err(); err != nil {
+            return progress, err
+        }
+        line, readErr := reader.ReadBytes('\n')
+        if readErr != nil && readErr != io.EOF {
+            return progress, fmt.Errorf("failed to read output file: %w", readErr)
+        }
+        progress.BytesRead += int64(len(line))
+        if len(line) > 0 {
+            progress.Lines++
+            if err := co.importLine(line, index, files, tenant, &progress); err != nil {
+                return progress, err
+            }
+            if progress.Lines%importProgressInterval == 0 {
+                report()
+            }
+        }
+        if readErr == io.EOF {
+            break
+        }
+    }
+
+    progress.Done = true
+    report()
+    logger.InfoLogger.Printf("Imported %s: %d responses cached, %d already cached, %d unmatched, %d failed",
+        files.Source, progress.Imported, progress.Skipped, progress.Unmatched, progress.Failed)
+    return progress, nil
+}
+
+// indexInputFile maps the custom ids of the chat completion requests in an input file to their lines.
+func indexInputFile(input io.Reader) (map[string]inputLine, error) {
+    index := make(map[string]inputLine)
+    reader := bufio.NewReaderSize(input, 1024*1024)
+    var offset int64
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err != nil && err != io.EOF {
+            return nil, fmt.Errorf("failed to read input file: %w", err)
+        }
+        if len(line) > 0 {
+            var request struct {
+                CustomID string `json:"custom_id"`
+                URL      string `json:"url"`
+            }
+            if json.Unmarshal(line, &request) == nil && request.CustomID != "" && request.URL == importRoute {
+                index[request.CustomID] = inputLine{offset: offset, length: len(line)}
+            }
+            offset += int64(len(line))
+        }
+        if err == io.EOF {
+            return index, nil
+        }
+    }
+}
+
+// importLine caches the response on one line of the output file. Only store errors are
+// returned; lines that cannot be imported are counted in progress.
+func (co *orchestrator) importLine(line []byte, index map[string]inputLine, files ImportFiles, tenant string, progress *models.CacheImport) error {
+    var item models.BatchResponseItem
+    if err := json.Unmarshal(line, &item); err != nil {
+        progress.Failed++
+        return nil
+    }
+    if item.Error != nil || item.Response.Error != nil || item.Response.StatusCode != http.StatusOK {
+        progress.Failed++
+        return nil
+    }
+    location, found := index[item.CustomID]
+    if !found {
+        progress.Unmatched++
+        return nil
+    }
+
+    inputBytes := make([]byte, location.length)
+    if _, err := files.Input.ReadAt(inputBytes, location.offset); err != nil && err != io.EOF {
+        return fmt.Errorf("failed to read request %s from the input file: %w", item.CustomID, err)
+    }
+    var input struct {
+        Body json.RawMessage `json:"body"`
+    }
+    if err := json.Unmarshal(inputBytes, &input); err != nil {
+        progress.Failed++
+        return nil
+    }
+    request, err := models.NewChatRequest(input.Body)
+    if err != nil {
+        progress.Failed++
+        return nil
+    }
+    request.Tenant = tenant
+    request.Route = importRoute
+
+    hash, err := co.fingerprinter.Fingerprint(request)
+    if err != nil {
+        progress.Failed++
+        return nil
+    }
+    if _, err := co.store.GetCachedResponse(hash); err == nil {
+        progress.Skipped++
+        return nil
+    } else if !errors.Is(err, db.ErrNotFound) {
+        return fmt.Errorf("failed to look up cached response: %w", err)
+    }
+
+    err = co.store.CacheRequestResponse(models.CacheEntry{
+        Hash:        hash,
+        HashVersion: fingerprint.CurrentVersion,
+        Request:     request,
+        Response:    item.Response.Body,
+        ExpiresAt:   co.expiresAt(request),
+        Source:      files.Source + "#" + item.CustomID,
+    }, co.maxSamples(request))
+    co.memory.remove(hash)
+    if err != nil {
+        return fmt.Errorf("failed to cache response %s: %w", item.CustomID, err)
+    }
+    progress.Imported++
+    return nil
+}
@@ -0,0 +1,191 @@
+package cache
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/models"
+    "batch-gpt/services/config"
+    "batch-gpt/services/fingerprint"
+    "context"
+    "errors"
+    "strings"
+    "testing"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// testCacheStore holds cached entries by hash.
+type testCacheStore struct {
+    db.CacheStore
+    entries map[string]models.CacheEntry
+}
+
+func (s *testCacheStore) GetCachedResponse(hash string) (models.CachedSamples, error) {
+    entry, found := s.entries[hash]
+    if !found {
+        return models.CachedSamples{}, db.ErrNotFound
+    }
+    return models.CachedSamples{EntryID: hash, Responses: []openai.ChatCompletionResponse{entry.Response}, Sampled: 1}, nil
+}
+
+func (s *testCacheStore) CacheRequestResponse(entry models.CacheEntry, maxSamples int) error {
+    if s.entries == nil {
+        s.entries = make(map[string]models.CacheEntry)
+    }
+    s.entries[entry.Hash] = entry
+    return nil
+}
+
+func newImportTestOrchestrator() (*orchestrator, *testCacheStore) {
+    store := &testCacheStore{}
+    co := NewOrchestrator(store, fingerprint.NewFingerprinter(config.NewCacheKeyConfig()),
+        config.NewCacheTTLConfig(), config.NewCacheSamplingConfig(), testMemoryCacheConfig{}).(*orchestrator)
+    return co, store
+}
+
+const importTestInput = `{"custom_id":"req-1","method":"POST","url":"/v1/chat/completions","body":{"model":"gpt-4o-mini","messages":[{"role":"user","content":"first"}]}}
+{"custom_id":"req-2","method":"POST","url":"/v1/chat/completions","body":{"model":"gpt-4o-mini","messages":[{"role":"user","content":"second"}]}}
+{"custom_id":"req-3","method":"POST","url":"/v1/embeddings","body":{"model":"text-embedding-3-small","input":"third"}}
+{"custom_id":"req-4","method":"POST","url":"/v1/chat/completions","body":{"model":"gpt-4o-mini","messages":[{"role":"user","content":"first"}]}}`
+
+const importTestOutput = `{"id":"r1","custom_id":"req-1","response":{"status_code":200,"body":{"id":"chatcmpl-1","model":"gpt-4o-mini","choices":[{"message":{"role":"assistant","content":"one"}}]}}}
+{"id":"r2","custom_id":"req-2","response":{"status_code":400,"body":{}}}
+{"id":"r3","custom_id":"req-3","response":{"status_code":200,"body":{}}}
+{"id":"r5","custom_id":"req-5","response":{"status_code":200,"body":{}}}
+not json
+{"id":"r4","custom_id":"req-4","response":{"status_code":200,"body":{"id":"chatcmpl-4","model":"gpt-4o-mini","choices":[{"message":{"role":"assistant","content":"four"}}]}}}
+`
+
+func importTestFiles() ImportFiles {
+    return ImportFiles{
+        Input:      strings.NewReader(importTestInput),
+        InputSize:  int64(len(importTestInput)),
+        Output:     strings.NewReader(importTestOutput),
+        OutputSize: int64(len(importTestOutput)),
+        Source:     "input.jsonl+output.jsonl",
+        Tenant:     "evals",
+    }
+}
+
+func TestImport(t *testing.T) {
+    co, store := newImportTestOrchestrator()
+
+    var reports []models.CacheImport
+    result, err := co.Import(context.Background(), importTestFiles(), func(progress models.CacheImport) {
+        reports = append(reports, progress)
+    })
+    if err != nil {
+        t.Fatalf("Import() error = %v", err)
+    }
+    // req-4 asks what req-1 asked, so its response is skipped; req-3 is no chat completion and
+    // req-5 is not in the input file
+    want := models.CacheImport{
+        Source:     "input.jsonl+output.jsonl",
+        BytesRead:  int64(len(importTestOutput)),
+        TotalBytes: int64(len(importTestOutput)),
+        Lines:      6,
+        Imported:   1,
+        Skipped:    1,
+        Unmatched:  2,
+        Failed:     2,
+        Done:       true,
+    }
+    if result != want {
+        t.Errorf("Import() = %+v, want %+v", result, want)
+    }
+    if len(reports) != 1 || reports[0] != want {
+        t.Errorf("progress reports = %+v, want only the final one", reports)
+    }
+
+    if len(store.entries) != 1 {
+        t.Fatalf("cached %d entries, want 1", len(store.entries))
+    }
+    for _, entry := range store.entries {
+        if entry.Source != "input.jsonl+output.jsonl#req-1" {
+            t.Errorf("Source = %q, want the files and custom id of the response", entry.Source)
+        }
+        if entry.Request.Tenant != "evals" || entry.Request.Route != importRoute {
+            t.Errorf("request keyed for tenant %q and route %q, want evals and %s", entry.Request.Tenant, entry.Request.Route, importRoute)
+        }
+        if entry.Response.ID != "chatcmpl-1" {
+            t.Errorf("Response.ID = %q, want chatcmpl-1", entry.Response.ID)
+        }
+        hash, err := co.fingerprinter.Fingerprint(entry.Request)
+        if err != nil || hash != entry.Hash {
+            t.Errorf("entry cached under %s, want the hash of its request %s (%v)", entry.Hash, hash, err)
+        }
+    }
+}
+
+func TestImportTwice(t *testing.T) {
+    co, store := newImportTestOrchestrator()
+    if _, err := co.Import(context.Background(), importTestFiles(), nil); err != nil {
+        t.Fatalf("Import() error = %v", err)
+    }
+
+    result, err := co.Import(context.Background(), importTestFiles(), nil)
+    if err != nil {
+        t.Fatalf("Import() again error = %v", err)
+    }
+    if result.Imported != 0 || result.Skipped != 2 {
+        t.Errorf("Import() again imported %d and skipped %d, want 0 and 2", result.Imported, result.Skipped)
+    }
+    if len(store.entries) != 1 {
+        t.Errorf("cached %d entries, want 1", len(store.entries))
+    }
+}
+
+func TestImportDefaultTenant(t *testing.T) {
+    co, store := newImportTestOrchestrator()
+    files := importTestFiles()
+    files.Tenant = ""
+    if _, err := co.Import(context.Background(), files, nil); err != nil {
+        t.Fatalf("Import() error = %v", err)
+    }
+    for _, entry := range store.entries {
+        if entry.Request.Tenant != models.DefaultTenant {
+            t.Errorf("Tenant = %q, want %q", entry.Request.Tenant, models.DefaultTenant)
+        }
+    }
+}
+
+func TestImportCanceled(t *testing.T) {
+    co, store := newImportTestOrchestrator()
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    result, err := co.Import(ctx, importTestFiles(), nil)
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("Import() error = %v, want %v", err, context.Canceled)
+    }
+    if result.Done || len(store.entries) != 0 {
+        t.Errorf("canceled Import() = %+v with %d entries cached, want nothing done", result, len(store.entries))
+    }
+}
+
+func TestImportProgress(t *testing.T) {
+    co, _ := newImportTestOrchestrator()
+    output := strings.Repeat(`{"custom_id":"missing","response":{"status_code":200,"body":{}}}`+"\n", importProgressInterval*2+1)
+    files := ImportFiles{
+        Input:      strings.NewReader(""),
+        Output:     strings.NewReader(output),
+        OutputSize: int64(len(output)),
+    }
+
+    var reports []models.CacheImport
+    if _, err := co.Import(context.Background(), files, func(progress models.CacheImport) {
+        reports = append(reports, progress)
+    }); err != nil {
+        t.Fatalf("Import() error = %v", err)
+    }
+    if len(reports) != 3 {
+        t.Fatalf("got %d progress reports, want 3", len(reports))
+    }
+    for i, wantLines := range []int64{importProgressInterval, importProgressInterval * 2, importProgressInterval*2 + 1} {
+        if reports[i].Lines != wantLines || reports[i].Done != (i == 2) {
+            t.Errorf("report %d = %d lines, done %v, want %d lines, done %v", i, reports[i].Lines, reports[i].Done, wantLines, i == 2)
+        }
+    }
+    if last := reports[2]; last.BytesRead != last.TotalBytes || last.Unmatched != last.Lines {
+        t.Errorf("final report = %+v, want every line read and unmatched", last)
+    }
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+    "batch-gpt/server/models"
+    "batch-gpt/services/config"
+    "container/list"
+    "encoding/json"
+    "sync"
+    "time"
+)
+
+// memoryEntry is a request hash held by the memory tier. Entries without samples are
+// negative entries, remembering that the hash was not cached.
+type memoryEntry struct {
+    hash      string
+    samples   *models.CachedSamples
+    size      int64
+    expiresAt time.Time
+}
+
+// memoryCache is a least recently used cache of store lookups, bounded by entries and bytes.
+type memoryCache struct {
+    config  config.MemoryCacheConfig
+    mu      sync.Mutex
+    entries map[string]*list.Element
+    // hashByEntryID maps store entry ids to hashes, for changes that only name the entry id
+    hashByEntryID map[string]string
+    recency       *list.List
+    bytes         int64
+    stats         MemoryTierStats
+}
+
+func newMemoryCache(memoryCacheConfig config.MemoryCacheConfig) *memoryCache {
+    return &memoryCache{
+        config:        memoryCacheConfig,
+        entries:       make(map[string]*list.Element),
+        hashByEntryID: make(map[string]string),
+        recency:       list.New(),
+    }
+}
+
+// get returns the samples held for a hash. found is false if the hash is not held at all;
+// samples is nil if the hash is held as a recent miss.
+func (mc *memoryCache) get(hash string) (samples *models.CachedSamples, found bool) {
+    if !mc.config.IsEnabled() {
+        return nil, false
+    }
+
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+
+    element, ok := mc.entries[hash]
+    if !ok {
+        mc.stats.Misses++
+        return nil, false
+    }
+    entry := element.Value.(*memoryEntry)
+    if time.Now().After(entry.expiresAt) {
+        mc.removeElement(element)
+        mc.stats.Misses++
+        return nil, false
+    }
+
+    mc.recency.MoveToFront(element)
+    if entry.samples == nil {
+        mc.stats.NegativeHits++
+    } else {
+        mc.stats.Hits++
+    }
+    return entry.samples, true
+}
+
+// put holds the samples cached for a hash, or a recent miss if samples is nil.
+func (mc *memoryCache) put(hash string, samples *models.CachedSamples) {
+    if !mc.config.IsEnabled() {
+        return
+    }
+
+    ttl := mc.config.GetTTL()
+    size := int64(len(hash))
+    if samples == nil {
+        ttl = mc.config.GetNegativeTTL()
+    } else {
+        encoded, err := json.Marshal(samples.Responses)
+        if err != nil {
+            return
+        }
+        size += int64(len(encoded))
+    }
+    if ttl <= 0 || size > mc.config.GetMaxBytes() {
+        return
+    }
+
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+
+    if element, ok := mc.entries[hash]; ok {
+        mc.removeElement(element)
+    }
+    entry := &memoryEntry{
+        hash:      hash,
+        samples:   samples,
+        size:      size,
+        expiresAt: time.Now().Add(ttl),
+    }
+    mc.entries[hash] = mc.recency.PushFront(entry)
+    if samples != nil && samples.EntryID != "" {
+        mc.hashByEntryID[samples.EntryID] = hash
+    }
+    mc.bytes += size
+
+    for len(mc.entries) > mc.config.GetMaxEntries() || mc.bytes > mc.config.GetMaxBytes() {
+        mc.removeElement(mc.recency.Back())
+        mc.stats.Evictions++
+    }
+}
+
+// remove drops a hash, e.g. after its cached responses changed.
+func (mc *memoryCache) remove(hash string) {
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+
+    if element, ok := mc.entries[hash]; ok {
+        mc.removeElement(element)
+    }
+}
+
+// removeEntryID drops the hash held for a store entry id, if any.
+func (mc *memoryCache) removeEntryID(entryID string) {
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+
+    if hash, ok := mc.hashByEntryID[entryID]; ok {
+        if element, ok := mc.entries[hash]; ok {
+            mc.removeElement(element)
+        }
+    }
+}
+
+// purge drops everything.
+func (mc *memoryCache) purge() {
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+
+    mc.entries = make(map[string]*list.Element)
+    mc.hashByEntryID = make(map[string]string)
+    mc.recency.Init()
+    mc.bytes = 0
+}
+
+func (mc *memoryCache) removeElement(element *list.Element) {
+    entry := element.Value.(*memoryEntry)
+    mc.recency.Remove(element)
+    delete(mc.entries, entry.hash)
+    if entry.samples != nil {
+        delete(mc.hashByEntryID, entry.samples.EntryID)
+    }
+    mc.bytes -= entry.size
+}
+
+func (mc *memoryCache) getStats() MemoryTierStats {
+    mc.mu.Lock()
+    defer mc.mu.Unlock()
+
+    stats := mc.stats
+    stats.Entries = len(mc.entries)
+    stats.Bytes = mc.bytes
+    return stats
+}
@@ -0,0 +1,187 @@
+package cache
+
+import (
+    "batch-gpt/server/models"
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+type testMemoryCacheConfig struct {
+    maxEntries  int
+    maxBytes    int64
+    ttl         time.Duration
+    negativeTTL time.Duration
+}
+
+func (c testMemoryCacheConfig) IsEnabled() bool                { return c.maxEntries > 0 }
+func (c testMemoryCacheConfig) GetMaxEntries() int             { return c.maxEntries }
+func (c testMemoryCacheConfig) GetMaxBytes() int64             { return c.maxBytes }
+func (c testMemoryCacheConfig) GetTTL() time.Duration          { return c.ttl }
+func (c testMemoryCacheConfig) GetNegativeTTL() time.Duration  { return c.negativeTTL }
+func (c testMemoryCacheConfig) UsesChangeStreams() bool        { return false }
+
+func testSamples(entryID string, content string) *models.CachedSamples {
+    return &models.CachedSamples{
+        EntryID:   entryID,
+        Responses: []openai.ChatCompletionResponse{{Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: content}}}}},
+        Sampled:   1,
+    }
+}
+
+// testEntrySize is the number of bytes the memory tier counts for testSamples(entryID, content).
+func testEntrySize(t *testing.T, hash string, content string) int64 {
+    t.Helper()
+    encoded, err := json.Marshal(testSamples("", content).Responses)
+    if err != nil {
+        t.Fatalf("json.Marshal() error = %v", err)
+    }
+    return int64(len(hash) + len(encoded))
+}
+
+func TestMemoryCache(t *testing.T) {
+    defaultConfig := testMemoryCacheConfig{maxEntries: 2, maxBytes: 1 << 20, ttl: time.Hour, negativeTTL: time.Hour}
+    entrySize := testEntrySize(t, "a", strings.Repeat("a", 80))
+
+    tests := []struct {
+        name   string
+        config testMemoryCacheConfig
+        // run acts on the cache; held and missing list the hashes it must and must not hold afterwards
+        run     func(mc *memoryCache)
+        held    []string
+        missing []string
+    }{
+        {
+            name:   "least recently put is evicted",
+            config: defaultConfig,
+            run: func(mc *memoryCache) {
+                mc.put("a", testSamples("1", "a"))
+                mc.put("b", testSamples("2", "b"))
+                mc.put("c", testSamples("3", "c"))
+            },
+            held:    []string{"b", "c"},
+            missing: []string{"a"},
+        },
+        {
+            name:   "get makes an entry recent",
+            config: defaultConfig,
+            run: func(mc *memoryCache) {
+                mc.put("a", testSamples("1", "a"))
+                mc.put("b", testSamples("2", "b"))
+                mc.get("a")
+                mc.put("c", testSamples("3", "c"))
+            },
+            held:    []string{"a", "c"},
+            missing: []string{"b"},
+        },
+        {
+            name:   "bytes bound evicts",
+            config: testMemoryCacheConfig{maxEntries: 10, maxBytes: entrySize * 3 / 2, ttl: time.Hour, negativeTTL: time.Hour},
+            run: func(mc *memoryCache) {
+                mc.put("a", testSamples("1", strings.Repeat("a", 80)))
+                mc.put("b", testSamples("2", strings.Repeat("b", 80)))
+            },
+            held:    []string{"b"},
+            missing: []string{"a"},
+        },
+        {
+            name:   "entry larger than the bound is not held",
+            config: testMemoryCacheConfig{maxEntries: 10, maxBytes: entrySize - 1, ttl: time.Hour, negativeTTL: time.Hour},
+            run: func(mc *memoryCache) {
+                mc.put("a", testSamples("1", strings.Repeat("a", 80)))
+            },
+            missing: []string{"a"},
+        },
+        {
+            name:   "expired entry is dropped",
+            config: testMemoryCacheConfig{maxEntries: 2, maxBytes: 1 << 20, ttl: time.Nanosecond, negativeTTL: time.Hour},
+            run: func(mc *memoryCache) {
+                mc.put("a", testSamples("1", "a"))
+                time.Sleep(time.Millisecond)
+            },
+            missing: []string{"a"},
+        },
+        {
+            name:   "negative entries are held for the negative TTL",
+            config: testMemoryCacheConfig{maxEntries: 2, maxBytes: 1 << 20, ttl: time.Hour, negativeTTL: time.Nanosecond},
+            run: func(mc *memoryCache) {
+                mc.put("a", nil)
+                time.Sleep(time.Millisecond)
+                mc.put("b", nil)
+            },
+            missing: []string{"a"},
+        },
+        {
+            name:   "negative entries are off without a negative TTL",
+            config: testMemoryCacheConfig{maxEntries: 2, maxBytes: 1 << 20, ttl: time.Hour},
+            run: func(mc *memoryCache) {
+                mc.put("a", nil)
+            },
+            missing: []string{"a"},
+        },
+        {
+            name:   "remove by entry id",
+            config: defaultConfig,
+            run: func(mc *memoryCache) {
+                mc.put("a", testSamples("1", "a"))
+                mc.put("b", testSamples("2", "b"))
+                mc.removeEntryID("1")
+            },
+            held:    []string{"b"},
+            missing: []string{"a"},
+        },
+        {
+            name:   "disabled",
+            config: testMemoryCacheConfig{maxBytes: 1 << 20, ttl: time.Hour, negativeTTL: time.Hour},
+            run: func(mc *memoryCache) {
+                mc.put("a", testSamples("1", "a"))
+            },
+            missing: []string{"a"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            mc := newMemoryCache(tt.config)
+            tt.run(mc)
+            for _, hash := range tt.held {
+                if _, found := mc.get(hash); !found {
+                    t.Errorf("get(%q) found nothing, want it held", hash)
+                }
+            }
+            for _, hash := range tt.missing {
+                if _, found := mc.get(hash); found {
+                    t.Errorf("get(%q) found an entry, want none", hash)
+                }
+            }
+        })
+    }
+}
+
+func TestMemoryCacheStats(t *testing.T) {
+    mc := newMemoryCache(testMemoryCacheConfig{maxEntries: 1, maxBytes: 1 << 20, ttl: time.Hour, negativeTTL: time.Hour})
+    mc.put("a", testSamples("1", "a"))
+    mc.get("a")
+    mc.put("b", nil)
+    mc.get("b")
+    mc.get("a")
+
+    samples, found := mc.get("b")
+    if !found || samples != nil {
+        t.Errorf("get() of a negative entry = %v, %v, want nil, true", samples, found)
+    }
+
+    stats := mc.getStats()
+    want := MemoryTierStats{Hits: 1, NegativeHits: 2, Misses: 1, Evictions: 1, Entries: 1, Bytes: int64(len("b"))}
+    if stats != want {
+        t.Errorf("getStats() = %+v, want %+v", stats, want)
+    }
+
+    mc.purge()
+    if stats := mc.getStats(); stats.Entries != 0 || stats.Bytes != 0 {
+        t.Errorf("getStats() after purge = %+v, want no entries", stats)
+    }
+}
@@ -4,36 +4,127 @@ import (
 	"batch-gpt/server/db"
 	"batch-gpt/server/logger"
 	"batch-gpt/server/models"
-	"batch-gpt/services/utils"
-
-	openai "github.com/sashabaranov/go-openai"
+	"batch-gpt/services/config"
+	"batch-gpt/services/fingerprint"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
 )
 
-type orchestrator struct{}
+// maxSampleRequestsFactor bounds how many responses are requested for a hash, relative to the
+// number of samples wanted, so requests whose responses keep repeating stop being resubmitted.
+const maxSampleRequestsFactor = 2
+
+type orchestrator struct {
+    store             db.CacheStore
+    fingerprinter     fingerprint.Fingerprinter
+    ttlConfig         config.CacheTTLConfig
+    samplingConfig    config.CacheSamplingConfig
+    memoryCacheConfig config.MemoryCacheConfig
+    memory            *memoryCache
+    storeHits         atomic.Int64
+    storeMisses       atomic.Int64
+}
 
-func NewOrchestrator() Orchestrator {
-    return &orchestrator{}
+func NewOrchestrator(
+    store db.CacheStore,
+    fingerprinter fingerprint.Fingerprinter,
+    ttlConfig config.CacheTTLConfig,
+    samplingConfig config.CacheSamplingConfig,
+    memoryCacheConfig config.MemoryCacheConfig,
+) Orchestrator {
+    return &orchestrator{
+        store:             store,
+        fingerprinter:     fingerprinter,
+        ttlConfig:         ttlConfig,
+        samplingConfig:    samplingConfig,
+        memoryCacheConfig: memoryCacheConfig,
+        memory:            newMemoryCache(memoryCacheConfig),
+    }
 }
 
-func (co *orchestrator) GetFromCache(request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, bool) {
-    hash, err := utils.GenerateRequestHash(request)
+func (co *orchestrator) GetFromCache(request models.ChatRequest) (CacheHit, bool) {
+    hash, err := co.fingerprinter.Fingerprint(request)
     if err != nil {
         logger.ErrorLogger.Printf("Failed to generate request hash: %v", err)
-        return openai.ChatCompletionResponse{}, false
+        return CacheHit{}, false
     }
 
-    cachedResponse, err := db.GetCachedResponse(hash)
-    if err == nil {
-        logger.InfoLogger.Printf("Cache hit for request hash: %s", hash)
-        return cachedResponse, true
+    samples, err := co.lookup(hash)
+    if err != nil {
+        logger.InfoLogger.Printf("Cache miss for request hash: %s", hash)
+        return CacheHit{}, false
     }
 
-    logger.InfoLogger.Printf("Cache miss for request hash: %s", hash)
-    return openai.ChatCompletionResponse{}, false
+    selection := request.CacheSample
+    if selection == nil {
+        selection = &models.SampleSelection{Random: co.samplingConfig.GetSelection() == config.SampleRandom}
+    }
+    index := selection.Index
+    if selection.Random {
+        index = rand.Intn(len(samples.Responses))
+    }
+    if index >= len(samples.Responses) {
+        // The requested sample does not exist yet, so the request goes upstream to produce one
+        logger.InfoLogger.Printf("Cache miss for sample %d of request hash: %s", index, hash)
+        return CacheHit{}, false
+    }
+
+    logger.InfoLogger.Printf("Cache hit for sample %d of request hash: %s", index, hash)
+    maxSamples := co.maxSamples(request)
+    return CacheHit{
+        Response:         samples.Responses[index],
+        NeedsMoreSamples: len(samples.Responses) < maxSamples && samples.Sampled < maxSamples*maxSampleRequestsFactor,
+    }, true
+}
+
+// lookup returns the samples cached for a hash from the memory tier, or else from the store.
+// Misses are remembered in the memory tier as well.
+func (co *orchestrator) lookup(hash string) (*models.CachedSamples, error) {
+    if samples, found := co.memory.get(hash); found {
+        if samples == nil {
+            return nil, db.ErrNotFound
+        }
+        return samples, nil
+    }
+
+    samples, err := co.store.GetCachedResponse(hash)
+    if err != nil {
+        co.storeMisses.Add(1)
+        if errors.Is(err, db.ErrNotFound) {
+            co.memory.put(hash, nil)
+        } else {
+            logger.ErrorLogger.Printf("Failed to look up cached response: %v", err)
+        }
+        return nil, err
+    }
+    co.storeHits.Add(1)
+    co.memory.put(hash, &samples)
+    return &samples, nil
+}
+
+// maxSamples returns how many distinct responses are cached for a request. Requests with
+// temperature 0 are close to deterministic, so only one response is cached for them.
+func (co *orchestrator) maxSamples(request models.ChatRequest) int {
+    maxSamples := co.samplingConfig.GetMaxSamples()
+    if maxSamples <= 1 {
+        return 1
+    }
+
+    var params struct {
+        Temperature *float64 `json:"temperature"`
+    }
+    if err := json.Unmarshal(request.Body, &params); err == nil && params.Temperature != nil && *params.Temperature == 0 {
+        return 1
+    }
+    return maxSamples
 }
 
 func (co *orchestrator) CacheResponses(requests []models.BatchRequestItem, responses []models.BatchResponseItem) {
-    requestMap := make(map[string]openai.ChatCompletionRequest)
+    requestMap := make(map[string]models.ChatRequest)
     for _, req := range requests {
         requestMap[req.CustomID] = req.Request
     }
@@ -48,14 +139,34 @@ func (co *orchestrator) CacheResponses(requests []models.BatchRequestItem, respo
             continue
         }
 
-        hash, err := utils.GenerateRequestHash(request)
+        if request.CacheDirective == models.CacheBypass {
+            continue
+        }
+
+        hash, err := co.fingerprinter.Fingerprint(request)
         if err != nil {
             logger.ErrorLogger.Printf("Failed to generate request hash: %v", err)
             failed_caches += 1
             continue
         }
 
-        err = db.CacheRequestResponse(hash, request, resp.Response.Body)
+        if request.CacheDirective == models.CacheRefresh {
+            if _, err := co.store.InvalidateCachedResponses(models.CacheFilter{Hash: hash}); err != nil {
+                logger.ErrorLogger.Printf("Failed to replace cached response for request hash %s: %v", hash, err)
+                failed_caches += 1
+                continue
+            }
+        }
+
+        err = co.store.CacheRequestResponse(models.CacheEntry{
+            Hash:        hash,
+            HashVersion: fingerprint.CurrentVersion,
+            Request:     request,
+            Response:    resp.Response.Body,
+            ExpiresAt:   co.expiresAt(request),
+        }, co.maxSamples(request))
+        // Drop the hash from the memory tier, whether it was held as a miss or with fewer samples
+        co.memory.remove(hash)
         if err != nil {
         	failed_caches += 1
         } else {
@@ -63,4 +174,77 @@ func (co *orchestrator) CacheResponses(requests []models.BatchRequestItem, respo
         }
     }
     logger.InfoLogger.Printf("Caching results: %d/%d successful, %d failed", success_caches, len(responses), failed_caches)
+
+    if maxEntries := co.ttlConfig.GetMaxEntries(); maxEntries > 0 && success_caches > 0 {
+        evicted, err := co.store.EvictCachedResponses(maxEntries)
+        if err != nil {
+            logger.ErrorLogger.Printf("Failed to evict cached responses: %v", err)
+        } else if evicted > 0 {
+            logger.InfoLogger.Printf("Evicted %d cached responses to stay within %d entries", evicted, maxEntries)
+        }
+    }
+}
+
+// Invalidate deletes the cached responses matching filter from the store and the memory tier.
+// Other replicas drop them from their memory tier through the change stream or their TTL.
+func (co *orchestrator) Invalidate(filter models.CacheFilter) (int64, error) {
+    deleted, err := co.store.InvalidateCachedResponses(filter)
+    if filter == (models.CacheFilter{Hash: filter.Hash}) && filter.Hash != "" {
+        co.memory.remove(filter.Hash)
+    } else {
+        co.memory.purge()
+    }
+    return deleted, err
+}
+
+func (co *orchestrator) Stats() Stats {
+    return Stats{
+        Memory: co.memory.getStats(),
+        Store: TierStats{
+            Hits:   co.storeHits.Load(),
+            Misses: co.storeMisses.Load(),
+        },
+    }
+}
+
+// WatchChanges keeps the memory tier coherent with changes made by other replicas, if change
+// streams are enabled. It runs until the server stops and reconnects when the stream ends.
+func (co *orchestrator) WatchChanges() {
+    if !co.memoryCacheConfig.IsEnabled() || !co.memoryCacheConfig.UsesChangeStreams() {
+        return
+    }
+
+    for {
+        err := co.store.WatchCachedResponses(context.Background(), func(change models.CacheChange) {
+            if change.Reset {
+                co.memory.purge()
+                return
+            }
+            co.memory.removeEntryID(change.EntryID)
+            if change.Hash != "" {
+                co.memory.remove(change.Hash)
+            }
+        })
+        if errors.Is(err, db.ErrUnsupported) {
+            logger.WarnLogger.Printf("Cache change streams are not available, memory cache entries only expire by TTL: %v", err)
+            return
+        }
+        logger.WarnLogger.Printf("Cache change stream ended, reconnecting in 5 seconds: %v", err)
+        // Changes may have been missed while the stream was down
+        co.memory.purge()
+        time.Sleep(5 * time.Second)
+    }
+}
+
+// expiresAt returns when the cached response to a request expires, or the zero time if it does not.
+// A TTL set on the request itself wins over the configured ones.
+func (co *orchestrator) expiresAt(request models.ChatRequest) time.Time {
+    ttl := request.CacheTTL
+    if ttl == 0 {
+        ttl = co.ttlConfig.GetTTL(request.Params.Model, request.Tenant)
+    }
+    if ttl == 0 {
+        return time.Time{}
+    }
+    return time.Now().Add(ttl)
 }
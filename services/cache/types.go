@@ -2,10 +2,46 @@ package cache
 
 import (
     "batch-gpt/server/models"
+    "context"
+
     openai "github.com/sashabaranov/go-openai"
 )
 
+// CacheHit is a cached response to a request. NeedsMoreSamples is set while fewer distinct
+// responses are cached for the request than configured, so another one should be requested.
+type CacheHit struct {
+    Response         openai.ChatCompletionResponse
+    NeedsMoreSamples bool
+}
+
+// Stats counts cache lookups per tier since the server started.
+type Stats struct {
+    Memory MemoryTierStats `json:"memory"`
+    Store  TierStats       `json:"store"`
+}
+
+// TierStats counts the lookups a cache tier answered and those it could not.
+type TierStats struct {
+    Hits   int64 `json:"hits"`
+    Misses int64 `json:"misses"`
+}
+
+// MemoryTierStats describes the in-process tier. NegativeHits are lookups answered by a
+// remembered miss, without asking the store.
+type MemoryTierStats struct {
+    Hits         int64 `json:"hits"`
+    NegativeHits int64 `json:"negative_hits"`
+    Misses       int64 `json:"misses"`
+    Evictions    int64 `json:"evictions"`
+    Entries      int   `json:"entries"`
+    Bytes        int64 `json:"bytes"`
+}
+
 type Orchestrator interface {
-    GetFromCache(request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, bool)
+    GetFromCache(request models.ChatRequest) (CacheHit, bool)
+    Invalidate(filter models.CacheFilter) (int64, error)
+    Stats() Stats
+    WatchChanges()
     CacheResponses(requests []models.BatchRequestItem, responses []models.BatchResponseItem)
+    Import(ctx context.Context, files ImportFiles, onProgress func(models.CacheImport)) (models.CacheImport, error)
 }
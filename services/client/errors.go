@@ -0,0 +1,65 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "net/http"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// Classes of errors returned by OpenAI API calls. Rate limits, server errors and network
+// errors are transient and worth retrying; invalid requests fail the same way every time.
+const (
+    ErrorClassRateLimit      = "rate_limit"
+    ErrorClassServer         = "server_error"
+    ErrorClassNetwork        = "network_error"
+    ErrorClassInvalidRequest = "invalid_request"
+    ErrorClassCanceled       = "canceled"
+    ErrorClassCircuitOpen    = "circuit_open"
+)
+
+// ErrCircuitOpen is returned without calling the API while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("OpenAI API is unhealthy, calls are paused by the circuit breaker")
+
+// ClassifyError returns the class of an error returned by an OpenAI API call.
+func ClassifyError(err error) string {
+    if errors.Is(err, ErrCircuitOpen) {
+        return ErrorClassCircuitOpen
+    }
+    if errors.Is(err, context.Canceled) {
+        return ErrorClassCanceled
+    }
+    if _, ok := RetryAfter(err); ok {
+        return ErrorClassRateLimit
+    }
+
+    statusCode := 0
+    var apiErr *openai.APIError
+    var requestErr *openai.RequestError
+    if errors.As(err, &apiErr) {
+        statusCode = apiErr.HTTPStatusCode
+    } else if errors.As(err, &requestErr) {
+        statusCode = requestErr.HTTPStatusCode
+    }
+
+    switch {
+    case statusCode == 0:
+        // No response came back: the connection failed or timed out
+        return ErrorClassNetwork
+    case statusCode == http.StatusTooManyRequests:
+        return ErrorClassRateLimit
+    case statusCode >= http.StatusInternalServerError:
+        return ErrorClassServer
+    }
+    return ErrorClassInvalidRequest
+}
+
+// IsTransient tells whether a call that failed with err may succeed if it is made again later.
+func IsTransient(err error) bool {
+    switch ClassifyError(err) {
+    case ErrorClassRateLimit, ErrorClassServer, ErrorClassNetwork, ErrorClassCircuitOpen:
+        return true
+    }
+    return false
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"context"
+	"net/http"
 
 	openai "github.com/sashabaranov/go-openai"
 )
@@ -11,23 +12,39 @@ type openAIClient struct {
 }
 
 func NewOpenAIClient(apiKey string) OpenAIClient {
+    clientConfig := openai.DefaultConfig(apiKey)
+    clientConfig.HTTPClient = &retryAfterDoer{client: &http.Client{}}
     return &openAIClient{
-        client: openai.NewClient(apiKey),
+        client: openai.NewClientWithConfig(clientConfig),
     }
 }
 
 func (c *openAIClient) CreateBatchWithUploadFile(ctx context.Context, req openai.CreateBatchWithUploadFileRequest) (openai.BatchResponse, error) {
-    return c.client.CreateBatchWithUploadFile(ctx, req)
+    ctx, retryAfter := withRetryAfter(ctx)
+    batch, err := c.client.CreateBatchWithUploadFile(ctx, req)
+    return batch, wrapRetryAfter(err, *retryAfter)
 }
 
 func (c *openAIClient) RetrieveBatch(ctx context.Context, batchID string) (openai.BatchResponse, error) {
-    return c.client.RetrieveBatch(ctx, batchID)
+    ctx, retryAfter := withRetryAfter(ctx)
+    batch, err := c.client.RetrieveBatch(ctx, batchID)
+    return batch, wrapRetryAfter(err, *retryAfter)
 }
 
 func (c *openAIClient) GetFileContent(ctx context.Context, fileID string) (openai.RawResponse, error) {
-    return c.client.GetFileContent(ctx, fileID)
+    ctx, retryAfter := withRetryAfter(ctx)
+    content, err := c.client.GetFileContent(ctx, fileID)
+    return content, wrapRetryAfter(err, *retryAfter)
 }
 
 func (c *openAIClient) CancelBatch(ctx context.Context, batchID string) (openai.BatchResponse, error) {
-    return c.client.CancelBatch(ctx, batchID)
+    ctx, retryAfter := withRetryAfter(ctx)
+    batch, err := c.client.CancelBatch(ctx, batchID)
+    return batch, wrapRetryAfter(err, *retryAfter)
+}
+
+func (c *openAIClient) ListBatch(ctx context.Context, after *string, limit *int) (openai.ListBatchResponse, error) {
+    ctx, retryAfter := withRetryAfter(ctx)
+    batches, err := c.client.ListBatch(ctx, after, limit)
+    return batches, wrapRetryAfter(err, *retryAfter)
 }
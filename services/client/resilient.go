@@ -0,0 +1,216 @@
+package client
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/services/config"
+    "context"
+    "math/rand/v2"
+    "sync"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// States of the circuit breaker. While it is open, calls fail with ErrCircuitOpen without
+// reaching the API; once the open period is over, a single trial call decides whether it closes again.
+const (
+    CircuitClosed   = "closed"
+    CircuitOpen     = "open"
+    CircuitHalfOpen = "half_open"
+)
+
+// UpstreamHealth describes the circuit breaker in front of the OpenAI API.
+type UpstreamHealth struct {
+    State               string     `json:"state"`
+    ConsecutiveFailures int        `json:"consecutive_failures"`
+    LastError           string     `json:"last_error,omitempty"`
+    OpenedAt            *time.Time `json:"opened_at,omitempty"`
+    RetryAt             *time.Time `json:"retry_at,omitempty"`
+}
+
+// HealthReporter reports whether the OpenAI API is currently considered healthy.
+type HealthReporter interface {
+    Health() UpstreamHealth
+}
+
+// ResilientClient is an OpenAIClient that retries transient errors and stops calling
+// the API while it keeps failing.
+type ResilientClient interface {
+    OpenAIClient
+    HealthReporter
+}
+
+type resilientClient struct {
+    client      OpenAIClient
+    config      config.UpstreamConfig
+    mu          sync.Mutex
+    state       string
+    failures    int
+    lastError   string
+    openedAt    time.Time
+    retryAt     time.Time
+    trialActive bool
+}
+
+// NewResilientClient wraps client with retries, capped exponential backoff and a circuit breaker.
+func NewResilientClient(client OpenAIClient, upstreamConfig config.UpstreamConfig) ResilientClient {
+    return &resilientClient{
+        client: client,
+        config: upstreamConfig,
+        state:  CircuitClosed,
+    }
+}
+
+// CreateBatchWithUploadFile is not retried after network errors: the batch may have been
+// created before the connection failed, and creating it again would run and bill it twice.
+func (c *resilientClient) CreateBatchWithUploadFile(ctx context.Context, req openai.CreateBatchWithUploadFileRequest) (openai.BatchResponse, error) {
+    return withRetries(c, ctx, "CreateBatchWithUploadFile", isRetryableCreate, func(ctx context.Context) (openai.BatchResponse, error) {
+        return c.client.CreateBatchWithUploadFile(ctx, req)
+    })
+}
+
+// isRetryableCreate tells whether creating a batch may be tried again after err. Rate limits
+// and server errors are answers from the API, so no batch was created.
+func isRetryableCreate(err error) bool {
+    return IsTransient(err) && ClassifyError(err) != ErrorClassNetwork
+}
+
+func (c *resilientClient) RetrieveBatch(ctx context.Context, batchID string) (openai.BatchResponse, error) {
+    return withRetries(c, ctx, "RetrieveBatch", IsTransient, func(ctx context.Context) (openai.BatchResponse, error) {
+        return c.client.RetrieveBatch(ctx, batchID)
+    })
+}
+
+func (c *resilientClient) GetFileContent(ctx context.Context, fileID string) (openai.RawResponse, error) {
+    return withRetries(c, ctx, "GetFileContent", IsTransient, func(ctx context.Context) (openai.RawResponse, error) {
+        return c.client.GetFileContent(ctx, fileID)
+    })
+}
+
+func (c *resilientClient) CancelBatch(ctx context.Context, batchID string) (openai.BatchResponse, error) {
+    return withRetries(c, ctx, "CancelBatch", IsTransient, func(ctx context.Context) (openai.BatchResponse, error) {
+        return c.client.CancelBatch(ctx, batchID)
+    })
+}
+
+func (c *resilientClient) ListBatch(ctx context.Context, after *string, limit *int) (openai.ListBatchResponse, error) {
+    return withRetries(c, ctx, "ListBatch", IsTransient, func(ctx context.Context) (openai.ListBatchResponse, error) {
+        return c.client.ListBatch(ctx, after, limit)
+    })
+}
+
+func (c *resilientClient) Health() UpstreamHealth {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    health := UpstreamHealth{
+        State:               c.state,
+        ConsecutiveFailures: c.failures,
+        LastError:           c.lastError,
+    }
+    if c.state != CircuitClosed {
+        openedAt, retryAt := c.openedAt, c.retryAt
+        health.OpenedAt = &openedAt
+        health.RetryAt = &retryAt
+    }
+    return health
+}
+
+// withRetries makes a call until it succeeds, fails with an error retryable rejects, or runs
+// out of attempts. A Retry-After hint longer than the maximum backoff is left to the caller.
+func withRetries[T any](c *resilientClient, ctx context.Context, operation string, retryable func(error) bool, call func(context.Context) (T, error)) (T, error) {
+    backoff := c.config.GetInitialBackoff()
+    var result T
+    var err error
+    for attempt := 1; ; attempt++ {
+        if openErr := c.allow(); openErr != nil {
+            if err != nil {
+                // The breaker opened while retrying; the last error says more about why
+                return result, err
+            }
+            return result, openErr
+        }
+        result, err = call(ctx)
+        c.record(err)
+        if err == nil || !retryable(err) || attempt >= c.config.GetMaxAttempts() {
+            return result, err
+        }
+
+        // Equal jitter waits between half and all of the backoff, so callers that failed together do not retry together
+        delay := backoff/2 + rand.N(backoff/2+1)
+        if retryAfter, ok := RetryAfter(err); ok {
+            if retryAfter > c.config.GetMaxBackoff() {
+                return result, err
+            }
+            delay = max(delay, retryAfter)
+        }
+        logger.WarnLogger.Printf("%s failed with %s (attempt %d of %d), retrying in %s: %v",
+            operation, ClassifyError(err), attempt, c.config.GetMaxAttempts(), delay.Round(time.Millisecond), err)
+
+        timer := time.NewTimer(delay)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return result, err
+        case <-timer.C:
+        }
+        backoff = min(backoff*2, c.config.GetMaxBackoff())
+    }
+}
+
+// allow tells whether a call may go out, moving an open circuit to half open once its
+// open period is over. Only one trial call is let through while the circuit is half open.
+func (c *resilientClient) allow() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    switch c.state {
+    case CircuitOpen:
+        if time.Now().Before(c.retryAt) {
+            return ErrCircuitOpen
+        }
+        c.state = CircuitHalfOpen
+        logger.InfoLogger.Printf("Circuit breaker is half open, trying the OpenAI API again")
+        fallthrough
+    case CircuitHalfOpen:
+        if c.trialActive {
+            return ErrCircuitOpen
+        }
+        c.trialActive = true
+    }
+    return nil
+}
+
+// record updates the circuit breaker with the outcome of a call. Only transient errors
+// count as failures; an invalid request still shows that the API is answering.
+func (c *resilientClient) record(err error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    class := ClassifyError(err)
+    if class == ErrorClassCanceled {
+        // The call was given up on by the caller and says nothing about the API
+        c.trialActive = false
+        return
+    }
+    if err == nil || class == ErrorClassInvalidRequest {
+        if c.state != CircuitClosed {
+            logger.InfoLogger.Printf("Circuit breaker closed, the OpenAI API is answering again")
+        }
+        c.state = CircuitClosed
+        c.failures = 0
+        c.trialActive = false
+        return
+    }
+
+    c.failures++
+    c.lastError = err.Error()
+    if c.state == CircuitHalfOpen || (c.state == CircuitClosed && c.failures >= c.config.GetFailureThreshold()) {
+        c.state = CircuitOpen
+        c.trialActive = false
+        c.openedAt = time.Now()
+        c.retryAt = c.openedAt.Add(c.config.GetOpenDuration())
+        logger.WarnLogger.Printf("Circuit breaker opened after %d consecutive failures, pausing OpenAI API calls until %s: %v",
+            c.failures, c.retryAt.Format(time.RFC3339), err)
+    }
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "testing"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+type testUpstreamConfig struct{}
+
+func (testUpstreamConfig) GetMaxAttempts() int              { return 1 }
+func (testUpstreamConfig) GetInitialBackoff() time.Duration { return time.Millisecond }
+func (testUpstreamConfig) GetMaxBackoff() time.Duration     { return time.Millisecond }
+func (testUpstreamConfig) GetFailureThreshold() int         { return 2 }
+func (testUpstreamConfig) GetOpenDuration() time.Duration   { return time.Hour }
+
+// scriptedClient answers RetrieveBatch with the next error it was given.
+type scriptedClient struct {
+    OpenAIClient
+    next  error
+    calls int
+}
+
+func (c *scriptedClient) RetrieveBatch(ctx context.Context, batchID string) (openai.BatchResponse, error) {
+    c.calls++
+    return openai.BatchResponse{}, c.next
+}
+
+func TestCircuitBreaker(t *testing.T) {
+    serverErr := &openai.APIError{HTTPStatusCode: http.StatusInternalServerError, Message: "server error"}
+    invalidErr := &openai.APIError{HTTPStatusCode: http.StatusBadRequest, Message: "invalid request"}
+    networkErr := errors.New("connection reset by peer")
+
+    // step makes one call answered with result. expire ends the open period before the call.
+    type step struct {
+        result    error
+        expire    bool
+        wantErr   error
+        wantCall  bool
+        wantState string
+    }
+    tests := []struct {
+        name  string
+        steps []step
+    }{
+        {
+            name: "opens after consecutive failures and holds calls back",
+            steps: []step{
+                {result: serverErr, wantErr: serverErr, wantCall: true, wantState: CircuitClosed},
+                {result: networkErr, wantErr: networkErr, wantCall: true, wantState: CircuitOpen},
+                {result: nil, wantErr: ErrCircuitOpen, wantCall: false, wantState: CircuitOpen},
+            },
+        },
+        {
+            name: "successes and invalid requests reset the failures",
+            steps: []step{
+                {result: serverErr, wantErr: serverErr, wantCall: true, wantState: CircuitClosed},
+                {result: invalidErr, wantErr: invalidErr, wantCall: true, wantState: CircuitClosed},
+                {result: serverErr, wantErr: serverErr, wantCall: true, wantState: CircuitClosed},
+                {result: nil, wantErr: nil, wantCall: true, wantState: CircuitClosed},
+                {result: serverErr, wantErr: serverErr, wantCall: true, wantState: CircuitClosed},
+            },
+        },
+        {
+            name: "canceled calls do not count",
+            steps: []step{
+                {result: serverErr, wantErr: serverErr, wantCall: true, wantState: CircuitClosed},
+                {result: context.Canceled, wantErr: context.Canceled, wantCall: true, wantState: CircuitClosed},
+                {result: serverErr, wantErr: serverErr, wantCall: true, wantState: CircuitOpen},
+            },
+        },
+        {
+            name: "a successful trial call closes the circuit",
+            steps: []step{
+                {result: serverErr, wantErr: serverErr, wantCall: true, wantState: CircuitClosed},
+                {result: serverErr, wantErr: serverErr, wantCall: true, wantState: CircuitOpen},
+                {result: nil, expire: true, wantErr: nil, wantCall: true, wantState: CircuitClosed},
+            },
+        },
+        {
+            name: "a failed trial call opens the circuit again",
+            steps: []step{
+                {result: serverErr, wantErr: serverErr, wantCall: true, wantState: CircuitClosed},
+                {result: serverErr, wantErr: serverErr, wantCall: true, wantState: CircuitOpen},
+                {result: serverErr, expire: true, wantErr: serverErr, wantCall: true, wantState: CircuitOpen},
+                {result: nil, wantErr: ErrCircuitOpen, wantCall: false, wantState: CircuitOpen},
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            upstream := &scriptedClient{}
+            c := NewResilientClient(upstream, testUpstreamConfig{}).(*resilientClient)
+
+            for i, s := range tt.steps {
+                if s.expire {
+                    c.mu.Lock()
+                    c.retryAt = time.Now().Add(-time.Second)
+                    c.mu.Unlock()
+                }
+                upstream.next = s.result
+                calls := upstream.calls
+
+                _, err := c.RetrieveBatch(context.Background(), "batch_abc123")
+                if !errors.Is(err, s.wantErr) {
+                    t.Errorf("step %d: error = %v, want %v", i, err, s.wantErr)
+                }
+                if called := upstream.calls > calls; called != s.wantCall {
+                    t.Errorf("step %d: called the API = %v, want %v", i, called, s.wantCall)
+                }
+                health := c.Health()
+                if health.State != s.wantState {
+                    t.Errorf("step %d: state = %s, want %s", i, health.State, s.wantState)
+                }
+                if open := health.State != CircuitClosed; open != (health.RetryAt != nil) {
+                    t.Errorf("step %d: retry_at = %v in state %s", i, health.RetryAt, health.State)
+                }
+            }
+        })
+    }
+}
+
+func TestHalfOpenAllowsOneTrial(t *testing.T) {
+    c := NewResilientClient(&scriptedClient{}, testUpstreamConfig{}).(*resilientClient)
+    c.state = CircuitOpen
+    c.retryAt = time.Now().Add(-time.Second)
+
+    if err := c.allow(); err != nil {
+        t.Fatalf("first call after the open period: allow() = %v, want nil", err)
+    }
+    if c.state != CircuitHalfOpen {
+        t.Errorf("state = %s, want %s", c.state, CircuitHalfOpen)
+    }
+    if err := c.allow(); !errors.Is(err, ErrCircuitOpen) {
+        t.Errorf("second call during the trial: allow() = %v, want %v", err, ErrCircuitOpen)
+    }
+}
+
+func TestCreateIsNotRetriedAfterNetworkErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        err  error
+        want bool
+    }{
+        {name: "rate limit", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, want: true},
+        {name: "server error", err: &openai.APIError{HTTPStatusCode: http.StatusBadGateway}, want: true},
+        {name: "network error", err: errors.New("connection reset by peer"), want: false},
+        {name: "invalid request", err: &openai.APIError{HTTPStatusCode: http.StatusBadRequest}, want: false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := isRetryableCreate(tt.err); got != tt.want {
+                t.Errorf("isRetryableCreate() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// RetryAfterError is returned when the API answered with an error and asked to wait
+// before the next request.
+type RetryAfterError struct {
+    Err        error
+    RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+    return fmt.Sprintf("%v (retry after %s)", e.Err, e.RetryAfter)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+    return e.Err
+}
+
+// RetryAfter returns how long the API asked to wait before retrying the request that failed with err.
+func RetryAfter(err error) (time.Duration, bool) {
+    var retryAfterErr *RetryAfterError
+    if errors.As(err, &retryAfterErr) {
+        return retryAfterErr.RetryAfter, true
+    }
+    return 0, false
+}
+
+type retryAfterKey struct{}
+
+// withRetryAfter returns a context that retryAfterDoer records the Retry-After hint of a failed response in.
+func withRetryAfter(ctx context.Context) (context.Context, *time.Duration) {
+    retryAfter := new(time.Duration)
+    return context.WithValue(ctx, retryAfterKey{}, retryAfter), retryAfter
+}
+
+// wrapRetryAfter attaches the recorded Retry-After hint to err, if the API sent one.
+func wrapRetryAfter(err error, retryAfter time.Duration) error {
+    if err == nil || retryAfter <= 0 {
+        return err
+    }
+    return &RetryAfterError{Err: err, RetryAfter: retryAfter}
+}
+
+// retryAfterDoer is the HTTP client of the OpenAI client. The library turns error responses
+// into errors without their headers, so the Retry-After hint is passed back through the request context.
+type retryAfterDoer struct {
+    client *http.Client
+}
+
+func (d *retryAfterDoer) Do(req *http.Request) (*http.Response, error) {
+    resp, err := d.client.Do(req)
+    if err != nil || resp.StatusCode < http.StatusBadRequest {
+        return resp, err
+    }
+    if retryAfter, ok := req.Context().Value(retryAfterKey{}).(*time.Duration); ok {
+        *retryAfter = parseRetryAfter(resp.Header, time.Now())
+    }
+    return resp, err
+}
+
+// parseRetryAfter reads the retry-after-ms header OpenAI sends along with the standard
+// Retry-After header, which holds either seconds or an HTTP date.
+func parseRetryAfter(header http.Header, now time.Time) time.Duration {
+    if value := header.Get("Retry-After-Ms"); value != "" {
+        if ms, err := strconv.ParseFloat(value, 64); err == nil && ms > 0 {
+            return time.Duration(ms * float64(time.Millisecond))
+        }
+    }
+    value := header.Get("Retry-After")
+    if value == "" {
+        return 0
+    }
+    if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+        if seconds <= 0 {
+            return 0
+        }
+        return time.Duration(seconds * float64(time.Second))
+    }
+    if date, err := http.ParseTime(value); err == nil && date.After(now) {
+        return date.Sub(now)
+    }
+    return 0
+}
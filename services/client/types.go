@@ -11,4 +11,5 @@ type OpenAIClient interface {
 	RetrieveBatch(context.Context, string) (openai.BatchResponse, error)
 	GetFileContent(context.Context, string) (openai.RawResponse, error)
 	CancelBatch(context.Context, string) (openai.BatchResponse, error)
+	ListBatch(ctx context.Context, after *string, limit *int) (openai.ListBatchResponse, error)
 }
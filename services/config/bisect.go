@@ -0,0 +1,47 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "os"
+    "strconv"
+)
+
+// BisectConfig controls how failed batches are split up to isolate the request lines that made them fail.
+type BisectConfig interface {
+    GetMaxDepth() int
+    GetMaxConcurrentBatches() int
+}
+
+type bisectConfig struct {
+    maxDepth             int
+    maxConcurrentBatches int
+}
+
+func NewBisectConfig() BisectConfig {
+    maxDepth, err := strconv.Atoi(os.Getenv("FAILED_BATCH_MAX_BISECT_DEPTH"))
+    if err != nil {
+        // 16 halvings are enough to isolate a single line in a batch of 50,000 requests
+        logger.WarnLogger.Printf("Failed to parse FAILED_BATCH_MAX_BISECT_DEPTH, using default of 16: %v", err)
+        maxDepth = 16
+    } else if maxDepth < 0 {
+        maxDepth = 0
+    }
+
+    maxConcurrentBatches, err := strconv.Atoi(os.Getenv("FAILED_BATCH_MAX_CONCURRENT_BATCHES"))
+    if err != nil || maxConcurrentBatches < 1 {
+        logger.WarnLogger.Printf("Failed to parse FAILED_BATCH_MAX_CONCURRENT_BATCHES, using default of 4: %v", err)
+        maxConcurrentBatches = 4
+    }
+    return &bisectConfig{
+        maxDepth:             maxDepth,
+        maxConcurrentBatches: maxConcurrentBatches,
+    }
+}
+
+func (bc *bisectConfig) GetMaxDepth() int {
+    return bc.maxDepth
+}
+
+func (bc *bisectConfig) GetMaxConcurrentBatches() int {
+    return bc.maxConcurrentBatches
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "os"
+    "strconv"
+    "time"
+)
+
+// BudgetConfig controls how tenant budgets are enforced.
+type BudgetConfig interface {
+    GetRefreshInterval() time.Duration
+    GetSoftLimitPercent() float64
+    GetDefaultCompletionTokens() int
+}
+
+type budgetConfig struct {
+    refreshInterval         time.Duration
+    softLimitPercent        float64
+    defaultCompletionTokens int
+}
+
+func NewBudgetConfig() BudgetConfig {
+    refresh, err := strconv.Atoi(os.Getenv("BUDGET_REFRESH_SECONDS"))
+    if err != nil || refresh <= 0 {
+        logger.WarnLogger.Printf("Failed to parse BUDGET_REFRESH_SECONDS, using default of 30: %v", err)
+        refresh = 30
+    }
+
+    softLimit, err := strconv.ParseFloat(os.Getenv("BUDGET_SOFT_LIMIT_PERCENT"), 64)
+    if err != nil || softLimit <= 0 || softLimit > 100 {
+        logger.WarnLogger.Printf("Failed to parse BUDGET_SOFT_LIMIT_PERCENT, using default of 80: %v", err)
+        softLimit = 80
+    }
+
+    completionTokens, err := strconv.Atoi(os.Getenv("BUDGET_DEFAULT_COMPLETION_TOKENS"))
+    if err != nil || completionTokens < 0 {
+        logger.WarnLogger.Printf("Failed to parse BUDGET_DEFAULT_COMPLETION_TOKENS, using default of 1024: %v", err)
+        completionTokens = 1024
+    }
+
+    return &budgetConfig{
+        refreshInterval:         time.Duration(refresh) * time.Second,
+        softLimitPercent:        softLimit,
+        defaultCompletionTokens: completionTokens,
+    }
+}
+
+// GetRefreshInterval returns how long budgets and the usage counted against them are held
+// in memory before they are read from the store again.
+func (bc *budgetConfig) GetRefreshInterval() time.Duration {
+    return bc.refreshInterval
+}
+
+// GetSoftLimitPercent returns the share of a budget, in percent, from which responses carry a warning.
+func (bc *budgetConfig) GetSoftLimitPercent() float64 {
+    return bc.softLimitPercent
+}
+
+// GetDefaultCompletionTokens returns how many completion tokens are reserved for a request that sets no limit on them.
+func (bc *budgetConfig) GetDefaultCompletionTokens() int {
+    return bc.defaultCompletionTokens
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "encoding/json"
+    "os"
+)
+
+// CacheKeyRules adjust which parts of a request go into its cache key, on top of the
+// fingerprint canonicalization.
+type CacheKeyRules struct {
+    // IgnoreFields lists top-level request fields left out of the key, e.g. "user" or "metadata".
+    IgnoreFields []string `json:"ignore_fields"`
+    // TrimContent trims leading and trailing whitespace from message contents.
+    TrimContent bool `json:"trim_content"`
+    // Defaults lists top-level fields that are left out of the key when they hold the given
+    // value, e.g. {"temperature": 0} to treat an explicit 0 like an omitted temperature.
+    Defaults map[string]json.RawMessage `json:"defaults"`
+}
+
+// CacheKeyConfig picks the cache key rules for a request. Tenant rules take precedence over
+// route rules, which take precedence over the default rules.
+type CacheKeyConfig interface {
+    GetRules(route string, tenant string) CacheKeyRules
+}
+
+type cacheKeyConfig struct {
+    Default CacheKeyRules            `json:"default"`
+    Routes  map[string]CacheKeyRules `json:"routes"`
+    Tenants map[string]CacheKeyRules `json:"tenants"`
+}
+
+// NewCacheKeyConfig loads the rules from the JSON file named by CACHE_KEY_RULES_FILE.
+// Without a rules file, cache keys only use the fingerprint canonicalization.
+func NewCacheKeyConfig() CacheKeyConfig {
+    ckc := &cacheKeyConfig{}
+
+    if path := os.Getenv("CACHE_KEY_RULES_FILE"); path != "" {
+        content, err := os.ReadFile(path)
+        if err != nil {
+            logger.WarnLogger.Printf("Failed to read CACHE_KEY_RULES_FILE, using no cache key rules: %v", err)
+        } else if err := json.Unmarshal(content, ckc); err != nil {
+            logger.WarnLogger.Printf("Failed to parse CACHE_KEY_RULES_FILE, using no cache key rules: %v", err)
+            ckc = &cacheKeyConfig{}
+        }
+    }
+    return ckc
+}
+
+func (ckc *cacheKeyConfig) GetRules(route string, tenant string) CacheKeyRules {
+    if rules, ok := ckc.Tenants[tenant]; ok {
+        return rules
+    }
+    if rules, ok := ckc.Routes[route]; ok {
+        return rules
+    }
+    return ckc.Default
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestCacheKeyConfigGetRules(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "key_rules.json")
+    rules := `{
+        "default": {"ignore_fields": ["user"]},
+        "routes": {"/v1/chat/completions": {"trim_content": true}},
+        "tenants": {"strict-team": {}, "evals": {"defaults": {"temperature": 0}}}
+    }`
+    if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("CACHE_KEY_RULES_FILE", path)
+    ckc := NewCacheKeyConfig()
+
+    tests := []struct {
+        name   string
+        route  string
+        tenant string
+        want   CacheKeyRules
+    }{
+        {
+            name:   "default rules",
+            route:  "/v1/other",
+            tenant: "default",
+            want:   CacheKeyRules{IgnoreFields: []string{"user"}},
+        },
+        {
+            name:   "route rules replace the default",
+            route:  "/v1/chat/completions",
+            tenant: "default",
+            want:   CacheKeyRules{TrimContent: true},
+        },
+        {
+            name:   "tenant rules take precedence over route rules",
+            route:  "/v1/chat/completions",
+            tenant: "evals",
+            want:   CacheKeyRules{Defaults: map[string]json.RawMessage{"temperature": json.RawMessage("0")}},
+        },
+        {
+            name:   "empty tenant rules are not merged with the default",
+            route:  "/v1/other",
+            tenant: "strict-team",
+            want:   CacheKeyRules{},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := ckc.GetRules(tt.route, tt.tenant); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("GetRules(%q, %q) = %+v, want %+v", tt.route, tt.tenant, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestCacheKeyConfigWithoutRulesFile(t *testing.T) {
+    t.Setenv("CACHE_KEY_RULES_FILE", "")
+    if got := NewCacheKeyConfig().GetRules("/v1/chat/completions", "evals"); !reflect.DeepEqual(got, CacheKeyRules{}) {
+        t.Errorf("GetRules() = %+v, want no rules", got)
+    }
+}
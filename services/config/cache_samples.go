@@ -0,0 +1,61 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "os"
+    "strconv"
+)
+
+const (
+    // SampleFirst returns the oldest cached sample of a request.
+    SampleFirst = "first"
+    // SampleRandom returns a random cached sample of a request.
+    SampleRandom = "random"
+)
+
+// CacheSamplingConfig controls how many distinct responses are cached per request and
+// which of them is returned when a request does not ask for a particular one.
+type CacheSamplingConfig interface {
+    GetMaxSamples() int
+    GetSelection() string
+}
+
+type cacheSamplingConfig struct {
+    maxSamples int
+    selection  string
+}
+
+func NewCacheSamplingConfig() CacheSamplingConfig {
+    maxSamples := 1
+    if value := os.Getenv("CACHE_SAMPLES_PER_REQUEST"); value != "" {
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed < 1 {
+            logger.WarnLogger.Printf("Failed to parse CACHE_SAMPLES_PER_REQUEST, using default of 1: %v", err)
+        } else {
+            maxSamples = parsed
+        }
+    }
+
+    selection := os.Getenv("CACHE_SAMPLE_SELECTION")
+    switch selection {
+    case SampleFirst, SampleRandom:
+    case "":
+        selection = SampleFirst
+    default:
+        logger.WarnLogger.Printf("Invalid CACHE_SAMPLE_SELECTION %q, using %s", selection, SampleFirst)
+        selection = SampleFirst
+    }
+
+    return &cacheSamplingConfig{
+        maxSamples: maxSamples,
+        selection:  selection,
+    }
+}
+
+func (csc *cacheSamplingConfig) GetMaxSamples() int {
+    return csc.maxSamples
+}
+
+func (csc *cacheSamplingConfig) GetSelection() string {
+    return csc.selection
+}
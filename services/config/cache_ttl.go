@@ -0,0 +1,131 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "encoding/json"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// CacheTTLConfig controls how long cached responses are kept and how many of them.
+// A TTL of 0 keeps a response until it is evicted or invalidated.
+type CacheTTLConfig interface {
+    GetTTL(model string, tenant string) time.Duration
+    GetMaxEntries() int64
+}
+
+type cacheTTLConfig struct {
+    defaultTTL time.Duration
+    models     map[string]time.Duration
+    tenants    map[string]time.Duration
+    maxEntries int64
+}
+
+// cacheTTLRules is the shape of the CACHE_TTL_RULES_FILE, with TTLs written as Go durations, e.g. "24h".
+type cacheTTLRules struct {
+    Default string            `json:"default"`
+    Models  map[string]string `json:"models"`
+    Tenants map[string]string `json:"tenants"`
+}
+
+// NewCacheTTLConfig loads the TTL rules from the JSON file named by CACHE_TTL_RULES_FILE
+// and the size cap from CACHE_MAX_ENTRIES. Without either, responses are cached forever.
+func NewCacheTTLConfig() CacheTTLConfig {
+    ctc := &cacheTTLConfig{}
+
+    if path := os.Getenv("CACHE_TTL_RULES_FILE"); path != "" {
+        if err := ctc.load(path); err != nil {
+            logger.WarnLogger.Printf("Failed to load CACHE_TTL_RULES_FILE, caching responses without expiry: %v", err)
+            ctc = &cacheTTLConfig{}
+        }
+    }
+
+    if value := os.Getenv("CACHE_MAX_ENTRIES"); value != "" {
+        maxEntries, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || maxEntries < 0 {
+            logger.WarnLogger.Printf("Failed to parse CACHE_MAX_ENTRIES, not capping the cache size: %v", err)
+        } else {
+            ctc.maxEntries = maxEntries
+        }
+    }
+    return ctc
+}
+
+func (ctc *cacheTTLConfig) load(path string) error {
+    content, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+
+    var rules cacheTTLRules
+    if err := json.Unmarshal(content, &rules); err != nil {
+        return err
+    }
+
+    if rules.Default != "" {
+        if ctc.defaultTTL, err = parseTTL(rules.Default); err != nil {
+            return fmt.Errorf("default: %w", err)
+        }
+    }
+    if ctc.models, err = parseTTLs(rules.Models); err != nil {
+        return fmt.Errorf("models: %w", err)
+    }
+    if ctc.tenants, err = parseTTLs(rules.Tenants); err != nil {
+        return fmt.Errorf("tenants: %w", err)
+    }
+    return nil
+}
+
+func parseTTLs(values map[string]string) (map[string]time.Duration, error) {
+    ttls := make(map[string]time.Duration, len(values))
+    for name, value := range values {
+        ttl, err := parseTTL(value)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", name, err)
+        }
+        ttls[name] = ttl
+    }
+    return ttls, nil
+}
+
+func parseTTL(value string) (time.Duration, error) {
+    ttl, err := time.ParseDuration(value)
+    if err != nil {
+        return 0, err
+    }
+    if ttl < 0 {
+        return 0, fmt.Errorf("TTL must not be negative")
+    }
+    return ttl, nil
+}
+
+// GetTTL returns the TTL for a response. Tenant TTLs take precedence over model TTLs,
+// which take precedence over the default. Model names ending in "*" match any model
+// starting with the text before it, with the longest match winning.
+func (ctc *cacheTTLConfig) GetTTL(model string, tenant string) time.Duration {
+    if ttl, ok := ctc.tenants[tenant]; ok {
+        return ttl
+    }
+    if ttl, ok := ctc.models[model]; ok {
+        return ttl
+    }
+
+    var match string
+    for name := range ctc.models {
+        prefix, isPattern := strings.CutSuffix(name, "*")
+        if isPattern && strings.HasPrefix(model, prefix) && len(prefix) >= len(match) {
+            match = name
+        }
+    }
+    if match != "" {
+        return ctc.models[match]
+    }
+    return ctc.defaultTTL
+}
+
+func (ctc *cacheTTLConfig) GetMaxEntries() int64 {
+    return ctc.maxEntries
+}
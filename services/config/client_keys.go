@@ -0,0 +1,60 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "crypto/sha256"
+    "encoding/json"
+    "os"
+)
+
+// ClientKeysConfig maps the API keys clients authenticate with to the tenant each key belongs to.
+type ClientKeysConfig interface {
+    // IsEnabled tells whether clients must authenticate with a key.
+    IsEnabled() bool
+    // GetTenant returns the tenant of a key, or false if the key is unknown.
+    GetTenant(key string) (string, bool)
+}
+
+type clientKeysConfig struct {
+    // tenants is keyed by the SHA-256 of each key, so looking a key up takes no longer
+    // for keys that share a prefix with a valid one
+    tenants map[[sha256.Size]byte]string
+}
+
+// NewClientKeysConfig loads the keys from the JSON file named by CLIENT_KEYS_FILE.
+// Without a keys file, clients are not authenticated.
+func NewClientKeysConfig() ClientKeysConfig {
+    ckc := &clientKeysConfig{tenants: make(map[[sha256.Size]byte]string)}
+
+    if path := os.Getenv("CLIENT_KEYS_FILE"); path != "" {
+        var file struct {
+            Keys map[string]string `json:"keys"`
+        }
+        content, err := os.ReadFile(path)
+        if err != nil {
+            // Starting without the keys would let any client in under any tenant
+            logger.ErrorLogger.Fatalf("Failed to read CLIENT_KEYS_FILE: %v", err)
+        } else if err := json.Unmarshal(content, &file); err != nil {
+            logger.ErrorLogger.Fatalf("Failed to parse CLIENT_KEYS_FILE: %v", err)
+        }
+        for key, tenant := range file.Keys {
+            if err := models.ValidateTenant(tenant); err != nil {
+                logger.ErrorLogger.Fatalf("Invalid tenant in CLIENT_KEYS_FILE: %v", err)
+            }
+            if key != "" {
+                ckc.tenants[sha256.Sum256([]byte(key))] = tenant
+            }
+        }
+    }
+    return ckc
+}
+
+func (ckc *clientKeysConfig) IsEnabled() bool {
+    return len(ckc.tenants) > 0
+}
+
+func (ckc *clientKeysConfig) GetTenant(key string) (string, bool) {
+    tenant, ok := ckc.tenants[sha256.Sum256([]byte(key))]
+    return tenant, ok
+}
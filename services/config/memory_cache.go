@@ -0,0 +1,100 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "os"
+    "strconv"
+    "time"
+)
+
+// MemoryCacheConfig bounds the in-process cache tier in front of the MongoDB cache.
+type MemoryCacheConfig interface {
+    IsEnabled() bool
+    GetMaxEntries() int
+    GetMaxBytes() int64
+    GetTTL() time.Duration
+    GetNegativeTTL() time.Duration
+    UsesChangeStreams() bool
+}
+
+type memoryCacheConfig struct {
+    maxEntries    int
+    maxBytes      int64
+    ttl           time.Duration
+    negativeTTL   time.Duration
+    changeStreams bool
+}
+
+func NewMemoryCacheConfig() MemoryCacheConfig {
+    mcc := &memoryCacheConfig{
+        maxEntries:  10000,    // Default to 10,000 request hashes
+        maxBytes:    64 << 20, // Default to 64 MiB
+        ttl:         30 * time.Second,
+        negativeTTL: 5 * time.Second,
+    }
+
+    if value := os.Getenv("MEMORY_CACHE_MAX_ENTRIES"); value != "" {
+        maxEntries, err := strconv.Atoi(value)
+        if err != nil || maxEntries < 0 {
+            logger.WarnLogger.Printf("Failed to parse MEMORY_CACHE_MAX_ENTRIES, using default of %d: %v", mcc.maxEntries, err)
+        } else {
+            mcc.maxEntries = maxEntries
+        }
+    }
+    if value := os.Getenv("MEMORY_CACHE_MAX_BYTES"); value != "" {
+        maxBytes, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || maxBytes < 0 {
+            logger.WarnLogger.Printf("Failed to parse MEMORY_CACHE_MAX_BYTES, using default of %d: %v", mcc.maxBytes, err)
+        } else {
+            mcc.maxBytes = maxBytes
+        }
+    }
+    if value := os.Getenv("MEMORY_CACHE_TTL_SECONDS"); value != "" {
+        seconds, err := strconv.Atoi(value)
+        if err != nil || seconds < 0 {
+            logger.WarnLogger.Printf("Failed to parse MEMORY_CACHE_TTL_SECONDS, using default of %v: %v", mcc.ttl, err)
+        } else {
+            mcc.ttl = time.Duration(seconds) * time.Second
+        }
+    }
+    if value := os.Getenv("MEMORY_CACHE_NEGATIVE_TTL_SECONDS"); value != "" {
+        seconds, err := strconv.Atoi(value)
+        if err != nil || seconds < 0 {
+            logger.WarnLogger.Printf("Failed to parse MEMORY_CACHE_NEGATIVE_TTL_SECONDS, using default of %v: %v", mcc.negativeTTL, err)
+        } else {
+            mcc.negativeTTL = time.Duration(seconds) * time.Second
+        }
+    }
+    mcc.changeStreams = os.Getenv("MEMORY_CACHE_CHANGE_STREAMS") == "true"
+
+    return mcc
+}
+
+// IsEnabled reports whether the memory tier holds anything at all.
+func (mcc *memoryCacheConfig) IsEnabled() bool {
+    return mcc.maxEntries > 0 && mcc.maxBytes > 0 && mcc.ttl > 0
+}
+
+func (mcc *memoryCacheConfig) GetMaxEntries() int {
+    return mcc.maxEntries
+}
+
+func (mcc *memoryCacheConfig) GetMaxBytes() int64 {
+    return mcc.maxBytes
+}
+
+// GetTTL is how long a cached response is served from memory before MongoDB is asked again.
+func (mcc *memoryCacheConfig) GetTTL() time.Duration {
+    return mcc.ttl
+}
+
+// GetNegativeTTL is how long a cache miss is remembered. 0 disables negative caching.
+func (mcc *memoryCacheConfig) GetNegativeTTL() time.Duration {
+    return mcc.negativeTTL
+}
+
+// UsesChangeStreams reports whether changes made by other replicas are picked up from a
+// MongoDB change stream, which requires a replica set, rather than only by the TTLs.
+func (mcc *memoryCacheConfig) UsesChangeStreams() bool {
+    return mcc.changeStreams
+}
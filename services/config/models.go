@@ -0,0 +1,25 @@
+package config
+
+import "strings"
+
+// lookupModel returns the entry for a model. Names ending in "*" match any model starting
+// with the text before it, and the longest such prefix wins.
+func lookupModel[T any](entries map[string]T, model string) (T, bool) {
+    if entry, ok := entries[model]; ok {
+        return entry, true
+    }
+
+    var match string
+    found := false
+    for name := range entries {
+        prefix, isPattern := strings.CutSuffix(name, "*")
+        if isPattern && strings.HasPrefix(model, prefix) && (!found || len(prefix) > len(match)) {
+            match = prefix
+            found = true
+        }
+    }
+    if !found {
+        return *new(T), false
+    }
+    return entries[match+"*"], true
+}
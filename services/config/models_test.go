@@ -0,0 +1,71 @@
+package config
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestLookupModel(t *testing.T) {
+    entries := map[string]string{
+        "gpt-4*":      "gpt-4 family",
+        "gpt-4o*":     "gpt-4o family",
+        "gpt-4o-mini": "gpt-4o-mini exactly",
+        "o1":          "o1 exactly",
+        "*":           "anything",
+    }
+
+    tests := []struct {
+        model string
+        want  string
+    }{
+        {model: "gpt-4o-mini", want: "gpt-4o-mini exactly"},
+        {model: "gpt-4o-mini-2024-07-18", want: "gpt-4o family"},
+        {model: "gpt-4o", want: "gpt-4o family"},
+        {model: "gpt-4-turbo", want: "gpt-4 family"},
+        {model: "o1", want: "o1 exactly"},
+        {model: "o1-preview", want: "anything"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.model, func(t *testing.T) {
+            if got, ok := lookupModel(entries, tt.model); !ok || got != tt.want {
+                t.Errorf("lookupModel(%q) = %q, %v, want %q", tt.model, got, ok, tt.want)
+            }
+        })
+    }
+
+    delete(entries, "*")
+    if got, ok := lookupModel(entries, "o1-preview"); ok {
+        t.Errorf("lookupModel(o1-preview) = %q, want no match", got)
+    }
+}
+
+func TestPricingConfigGetPrice(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "pricing.json")
+    prices := `{"models": {"gpt-4o*": {"input": 5, "output": 15, "batch_output": 6}, "ft:gpt-4o-mini*": {"input": 0.3, "output": 1.2}}}`
+    if err := os.WriteFile(path, []byte(prices), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("PRICING_FILE", path)
+    pc := NewPricingConfig()
+
+    tests := []struct {
+        model string
+        want  ModelPrice
+    }{
+        {model: "gpt-4o-2024-08-06", want: ModelPrice{Input: 5, Output: 15, BatchInput: 2.5, BatchOutput: 6}},
+        {model: "gpt-4o-mini", want: ModelPrice{Input: 0.15, Output: 0.60, BatchInput: 0.075, BatchOutput: 0.30}},
+        {model: "ft:gpt-4o-mini:acme::abc123", want: ModelPrice{Input: 0.3, Output: 1.2, BatchInput: 0.15, BatchOutput: 0.6}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.model, func(t *testing.T) {
+            if got, ok := pc.GetPrice(tt.model); !ok || got != tt.want {
+                t.Errorf("GetPrice(%q) = %+v, %v, want %+v", tt.model, got, ok, tt.want)
+            }
+        })
+    }
+
+    if _, ok := pc.GetPrice("text-davinci-003"); ok {
+        t.Error("GetPrice(text-davinci-003) found a price, want none")
+    }
+}
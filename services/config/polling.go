@@ -3,28 +3,59 @@ package config
 import (
     "batch-gpt/server/logger"
     "os"
+    "strconv"
     "time"
 )
 
+// PollingConfig controls how the status of submitted batches is polled.
 type PollingConfig interface {
+    GetInitialRetryInterval() time.Duration
     GetMaxRetryInterval() time.Duration
+    GetMaxConcurrency() int
 }
 
 type pollingConfig struct {
-    maxRetryInterval time.Duration
+    initialRetryInterval time.Duration
+    maxRetryInterval     time.Duration
+    maxConcurrency       int
 }
 
 func NewPollingConfig() PollingConfig {
+    initialInterval, err := time.ParseDuration(os.Getenv("COLLECT_BATCH_STATS_POLLING_INITIAL_INTERVAL_SECONDS") + "s")
+    if err != nil || initialInterval <= 0 {
+        logger.WarnLogger.Printf("Failed to parse COLLECT_BATCH_STATS_POLLING_INITIAL_INTERVAL_SECONDS, using default of 5s: %v", err)
+        initialInterval = 5 * time.Second
+    }
     maxInterval, err := time.ParseDuration(os.Getenv("COLLECT_BATCH_STATS_POLLING_MAX_INTERVAL_SECONDS") + "s")
     if err != nil {
         logger.WarnLogger.Printf("Failed to parse COLLECT_BATCH_STATS_POLLING_MAX_INTERVAL_SECONDS, using default of 300s: %v", err)
         maxInterval = 300 * time.Second
     }
+    if maxInterval < initialInterval {
+        maxInterval = initialInterval
+    }
+    maxConcurrency, err := strconv.Atoi(os.Getenv("COLLECT_BATCH_STATS_POLLING_MAX_CONCURRENCY"))
+    if err != nil {
+        logger.WarnLogger.Printf("Failed to parse COLLECT_BATCH_STATS_POLLING_MAX_CONCURRENCY, using default of 4: %v", err)
+        maxConcurrency = 4
+    } else if maxConcurrency < 1 {
+        maxConcurrency = 1
+    }
     return &pollingConfig{
-        maxRetryInterval: maxInterval,
+        initialRetryInterval: initialInterval,
+        maxRetryInterval:     maxInterval,
+        maxConcurrency:       maxConcurrency,
     }
 }
 
+func (pc *pollingConfig) GetInitialRetryInterval() time.Duration {
+    return pc.initialRetryInterval
+}
+
 func (pc *pollingConfig) GetMaxRetryInterval() time.Duration {
     return pc.maxRetryInterval
-}
\ No newline at end of file
+}
+
+func (pc *pollingConfig) GetMaxConcurrency() int {
+    return pc.maxConcurrency
+}
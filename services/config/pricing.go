@@ -0,0 +1,82 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "encoding/json"
+    "os"
+)
+
+// ModelPrice is what a model costs in US dollars per million tokens, through the realtime
+// API and through the Batch API.
+type ModelPrice struct {
+    Input       float64 `json:"input"`
+    Output      float64 `json:"output"`
+    BatchInput  float64 `json:"batch_input"`
+    BatchOutput float64 `json:"batch_output"`
+}
+
+// PricingConfig holds the price table that spend and savings are computed with.
+type PricingConfig interface {
+    GetPrice(model string) (ModelPrice, bool)
+}
+
+type pricingConfig struct {
+    models map[string]ModelPrice
+}
+
+// defaultModelPrices are OpenAI's list prices at the time of writing. PRICING_FILE overrides them.
+var defaultModelPrices = map[string]ModelPrice{
+    "gpt-4o*":        {Input: 2.50, Output: 10.00},
+    "gpt-4o-mini*":   {Input: 0.15, Output: 0.60},
+    "gpt-4-turbo*":   {Input: 10.00, Output: 30.00},
+    "gpt-4*":         {Input: 30.00, Output: 60.00},
+    "gpt-3.5-turbo*": {Input: 0.50, Output: 1.50},
+    "o1*":            {Input: 15.00, Output: 60.00},
+    "o1-mini*":       {Input: 3.00, Output: 12.00},
+    "o3-mini*":       {Input: 1.10, Output: 4.40},
+}
+
+// NewPricingConfig loads model prices from the JSON file named by PRICING_FILE, e.g.
+// {"models": {"gpt-4o*": {"input": 2.5, "output": 10}}}, on top of the default prices.
+// Batch prices that are not given are half the realtime ones, as the Batch API charges.
+func NewPricingConfig() PricingConfig {
+    pc := &pricingConfig{models: make(map[string]ModelPrice)}
+    for name, price := range defaultModelPrices {
+        pc.models[name] = price
+    }
+
+    if path := os.Getenv("PRICING_FILE"); path != "" {
+        var prices struct {
+            Models map[string]ModelPrice `json:"models"`
+        }
+        content, err := os.ReadFile(path)
+        if err == nil {
+            err = json.Unmarshal(content, &prices)
+        }
+        if err != nil {
+            logger.WarnLogger.Printf("Failed to load PRICING_FILE, using the default prices: %v", err)
+            prices.Models = nil
+        }
+        for name, price := range prices.Models {
+            pc.models[name] = price
+        }
+    }
+
+    for name, price := range pc.models {
+        if price.BatchInput == 0 {
+            price.BatchInput = price.Input / 2
+        }
+        if price.BatchOutput == 0 {
+            price.BatchOutput = price.Output / 2
+        }
+        pc.models[name] = price
+    }
+    return pc
+}
+
+// GetPrice returns the price of a model. Model names ending in "*" match any model starting
+// with the text before it, with the longest match winning, so dated snapshots such as
+// gpt-4o-2024-08-06 are priced like their model.
+func (pc *pricingConfig) GetPrice(model string) (ModelPrice, bool) {
+    return lookupModel(pc.models, model)
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "os"
+    "strconv"
+    "time"
+)
+
+// ReconcileConfig controls how batches are tagged when they are created and how often
+// batches that were created upstream but never tracked are looked for.
+type ReconcileConfig interface {
+    GetInstanceID() string
+    GetInterval() time.Duration
+    GetLookback() time.Duration
+}
+
+type reconcileConfig struct {
+    instanceID string
+    interval   time.Duration
+    lookback   time.Duration
+}
+
+func NewReconcileConfig() ReconcileConfig {
+    instanceID := os.Getenv("BATCH_GPT_INSTANCE_ID")
+    if instanceID == "" {
+        hostname, err := os.Hostname()
+        if err != nil || hostname == "" {
+            hostname = "batch-gpt"
+        }
+        instanceID = hostname
+    }
+
+    interval, err := strconv.Atoi(os.Getenv("ORPHANED_BATCHES_RECONCILE_INTERVAL_MINUTES"))
+    if err != nil {
+        logger.WarnLogger.Printf("Failed to parse ORPHANED_BATCHES_RECONCILE_INTERVAL_MINUTES, using default of 15: %v", err)
+        interval = 15
+    } else if interval < 0 {
+        interval = 0
+    }
+
+    lookback, err := strconv.Atoi(os.Getenv("ORPHANED_BATCHES_LOOKBACK_HOURS"))
+    if err != nil || lookback <= 0 {
+        // Batches complete within 24 hours, and their files outlive them
+        logger.WarnLogger.Printf("Failed to parse ORPHANED_BATCHES_LOOKBACK_HOURS, using default of 72: %v", err)
+        lookback = 72
+    }
+
+    return &reconcileConfig{
+        instanceID: instanceID,
+        interval:   time.Duration(interval) * time.Minute,
+        lookback:   time.Duration(lookback) * time.Hour,
+    }
+}
+
+func (rc *reconcileConfig) GetInstanceID() string {
+    return rc.instanceID
+}
+
+// GetInterval returns how often to reconcile after startup, or 0 to reconcile at startup only.
+func (rc *reconcileConfig) GetInterval() time.Duration {
+    return rc.interval
+}
+
+func (rc *reconcileConfig) GetLookback() time.Duration {
+    return rc.lookback
+}
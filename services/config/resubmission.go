@@ -0,0 +1,52 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "os"
+    "strconv"
+)
+
+// ResubmissionConfig controls what happens to requests that were still unfinished
+// when their batch expired or was cancelled.
+type ResubmissionConfig interface {
+    ShouldResubmit() bool
+    GetMaxResubmissions() int
+}
+
+type resubmissionConfig struct {
+    policy           string
+    maxResubmissions int
+}
+
+func NewResubmissionConfig() ResubmissionConfig {
+    policy := os.Getenv("INCOMPLETE_BATCH_POLICY")
+    switch policy {
+    case "":
+        policy = "resubmit" // Default to requeueing unfinished requests
+    case "resubmit", "fail":
+    default:
+        logger.WarnLogger.Printf("Unknown INCOMPLETE_BATCH_POLICY %q, using default of resubmit", policy)
+        policy = "resubmit"
+    }
+
+    maxResubmissions, err := strconv.Atoi(os.Getenv("INCOMPLETE_BATCH_MAX_RESUBMISSIONS"))
+    if err != nil {
+        logger.WarnLogger.Printf("Failed to parse INCOMPLETE_BATCH_MAX_RESUBMISSIONS, using default of 3: %v", err)
+        maxResubmissions = 3
+    } else if maxResubmissions < 0 {
+        maxResubmissions = 0
+    }
+
+    return &resubmissionConfig{
+        policy:           policy,
+        maxResubmissions: maxResubmissions,
+    }
+}
+
+func (rc *resubmissionConfig) ShouldResubmit() bool {
+    return rc.policy == "resubmit"
+}
+
+func (rc *resubmissionConfig) GetMaxResubmissions() int {
+    return rc.maxResubmissions
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// RetryConfig controls how individual batch items that failed upstream are retried.
+type RetryConfig interface {
+    GetMaxAttempts() int
+    IsRetryable(errorClass string) bool
+}
+
+type retryConfig struct {
+    maxAttempts      int
+    retryableClasses map[string]bool
+}
+
+func NewRetryConfig() RetryConfig {
+    maxAttempts, err := strconv.Atoi(os.Getenv("ITEM_RETRY_MAX_ATTEMPTS"))
+    if err != nil {
+        logger.WarnLogger.Printf("Failed to parse ITEM_RETRY_MAX_ATTEMPTS, using default of 3: %v", err)
+        maxAttempts = 3
+    } else if maxAttempts < 1 {
+        maxAttempts = 1
+    }
+
+    classes := os.Getenv("ITEM_RETRY_ERROR_CLASSES")
+    if classes == "" {
+        classes = "rate_limit,server_error,malformed_response" // Default to transient upstream errors
+    }
+    retryableClasses := make(map[string]bool)
+    for _, class := range strings.Split(classes, ",") {
+        if class = strings.TrimSpace(class); class != "" {
+            retryableClasses[class] = true
+        }
+    }
+
+    return &retryConfig{
+        maxAttempts:      maxAttempts,
+        retryableClasses: retryableClasses,
+    }
+}
+
+func (rc *retryConfig) GetMaxAttempts() int {
+    return rc.maxAttempts
+}
+
+func (rc *retryConfig) IsRetryable(errorClass string) bool {
+    return rc.retryableClasses[errorClass]
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "os"
+    "strconv"
+    "time"
+)
+
+// UpstreamConfig controls how calls to the OpenAI API are retried and when the circuit
+// breaker stops sending them while the API is unhealthy.
+type UpstreamConfig interface {
+    GetMaxAttempts() int
+    GetInitialBackoff() time.Duration
+    GetMaxBackoff() time.Duration
+    GetFailureThreshold() int
+    GetOpenDuration() time.Duration
+}
+
+type upstreamConfig struct {
+    maxAttempts      int
+    initialBackoff   time.Duration
+    maxBackoff       time.Duration
+    failureThreshold int
+    openDuration     time.Duration
+}
+
+func NewUpstreamConfig() UpstreamConfig {
+    maxAttempts, err := strconv.Atoi(os.Getenv("UPSTREAM_RETRY_MAX_ATTEMPTS"))
+    if err != nil {
+        logger.WarnLogger.Printf("Failed to parse UPSTREAM_RETRY_MAX_ATTEMPTS, using default of 4: %v", err)
+        maxAttempts = 4
+    } else if maxAttempts < 1 {
+        maxAttempts = 1
+    }
+
+    initialBackoff, err := strconv.Atoi(os.Getenv("UPSTREAM_RETRY_INITIAL_BACKOFF_MS"))
+    if err != nil || initialBackoff <= 0 {
+        logger.WarnLogger.Printf("Failed to parse UPSTREAM_RETRY_INITIAL_BACKOFF_MS, using default of 500ms: %v", err)
+        initialBackoff = 500
+    }
+
+    maxBackoff, err := time.ParseDuration(os.Getenv("UPSTREAM_RETRY_MAX_BACKOFF_SECONDS") + "s")
+    if err != nil || maxBackoff <= 0 {
+        logger.WarnLogger.Printf("Failed to parse UPSTREAM_RETRY_MAX_BACKOFF_SECONDS, using default of 30s: %v", err)
+        maxBackoff = 30 * time.Second
+    }
+
+    failureThreshold, err := strconv.Atoi(os.Getenv("UPSTREAM_CIRCUIT_FAILURE_THRESHOLD"))
+    if err != nil {
+        logger.WarnLogger.Printf("Failed to parse UPSTREAM_CIRCUIT_FAILURE_THRESHOLD, using default of 5: %v", err)
+        failureThreshold = 5
+    } else if failureThreshold < 1 {
+        failureThreshold = 1
+    }
+
+    openDuration, err := time.ParseDuration(os.Getenv("UPSTREAM_CIRCUIT_OPEN_SECONDS") + "s")
+    if err != nil || openDuration <= 0 {
+        logger.WarnLogger.Printf("Failed to parse UPSTREAM_CIRCUIT_OPEN_SECONDS, using default of 60s: %v", err)
+        openDuration = 60 * time.Second
+    }
+
+    return &upstreamConfig{
+        maxAttempts:      maxAttempts,
+        initialBackoff:   time.Duration(initialBackoff) * time.Millisecond,
+        maxBackoff:       max(maxBackoff, time.Duration(initialBackoff)*time.Millisecond),
+        failureThreshold: failureThreshold,
+        openDuration:     openDuration,
+    }
+}
+
+func (uc *upstreamConfig) GetMaxAttempts() int {
+    return uc.maxAttempts
+}
+
+func (uc *upstreamConfig) GetInitialBackoff() time.Duration {
+    return uc.initialBackoff
+}
+
+func (uc *upstreamConfig) GetMaxBackoff() time.Duration {
+    return uc.maxBackoff
+}
+
+func (uc *upstreamConfig) GetFailureThreshold() int {
+    return uc.failureThreshold
+}
+
+func (uc *upstreamConfig) GetOpenDuration() time.Duration {
+    return uc.openDuration
+}
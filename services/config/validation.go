@@ -0,0 +1,68 @@
+package config
+
+import (
+    "batch-gpt/server/logger"
+    "encoding/json"
+    "os"
+)
+
+// ModelValidationRules restricts the requests accepted for a model.
+// Zero values mean no model-specific limit.
+type ModelValidationRules struct {
+    MaxTokens         int      `json:"max_tokens"`
+    MaxN              int      `json:"max_n"`
+    UnsupportedParams []string `json:"unsupported_params"`
+}
+
+// ValidationConfig holds the rules requests are checked against before they are queued.
+type ValidationConfig interface {
+    GetMaxBodyBytes() int64
+    AllowsUnknownModels() bool
+    GetModelRules(model string) (ModelValidationRules, bool)
+}
+
+type validationConfig struct {
+    MaxBodyBytes       int64                           `json:"max_body_bytes"`
+    AllowUnknownModels *bool                           `json:"allow_unknown_models"`
+    Models             map[string]ModelValidationRules `json:"models"`
+}
+
+// NewValidationConfig loads the validation rules from the JSON file named by
+// REQUEST_VALIDATION_RULES_FILE. Without a rules file, any model is accepted and
+// only the Batch API constraints are checked.
+func NewValidationConfig() ValidationConfig {
+    vc := &validationConfig{}
+
+    if path := os.Getenv("REQUEST_VALIDATION_RULES_FILE"); path != "" {
+        content, err := os.ReadFile(path)
+        if err != nil {
+            logger.WarnLogger.Printf("Failed to read REQUEST_VALIDATION_RULES_FILE, using default rules: %v", err)
+        } else if err := json.Unmarshal(content, vc); err != nil {
+            logger.WarnLogger.Printf("Failed to parse REQUEST_VALIDATION_RULES_FILE, using default rules: %v", err)
+            vc = &validationConfig{}
+        }
+    }
+
+    if vc.MaxBodyBytes <= 0 {
+        vc.MaxBodyBytes = 10 << 20 // Default to 10 MiB
+    }
+    if vc.AllowUnknownModels == nil {
+        allowUnknownModels := len(vc.Models) == 0
+        vc.AllowUnknownModels = &allowUnknownModels
+    }
+    return vc
+}
+
+func (vc *validationConfig) GetMaxBodyBytes() int64 {
+    return vc.MaxBodyBytes
+}
+
+func (vc *validationConfig) AllowsUnknownModels() bool {
+    return *vc.AllowUnknownModels
+}
+
+// GetModelRules returns the rules for a model. Rule names ending in "*" match any model
+// starting with the text before it, with the longest match winning over shorter ones.
+func (vc *validationConfig) GetModelRules(model string) (ModelValidationRules, bool) {
+    return lookupModel(vc.Models, model)
+}
@@ -0,0 +1,189 @@
+package export
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/models"
+    "context"
+    "crypto/sha256"
+    "encoding/json"
+    "fmt"
+    "io"
+    "strings"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// Formats of exported datasets. FormatFineTune writes OpenAI fine-tuning chat examples: the
+// request's messages followed by the assistant reply. FormatEval writes the conversation, the
+// reply and what is known about it as separate fields, for evaluation tooling.
+const (
+    FormatFineTune = "fine-tune"
+    FormatEval     = "eval"
+)
+
+// Options select the cached responses to export and how they are written.
+// FinishReasons and Tag are matched on each reply and request; Tag is a key of the request's
+// metadata, or key=value to match its value as well.
+type Options struct {
+    Format        string
+    Filter        models.CacheFilter
+    FinishReasons []string
+    Tag           string
+    Dedupe        bool
+    ScrubPII      bool
+}
+
+// Result counts the examples written by an export and the replies left out of it.
+type Result struct {
+    Exported   int64 `json:"exported"`
+    Duplicates int64 `json:"duplicates"`
+    Skipped    int64 `json:"skipped"`
+}
+
+// Exporter writes cached conversations as a dataset, one JSON example per line.
+type Exporter interface {
+    Export(ctx context.Context, w io.Writer, options Options) (Result, error)
+}
+
+type exporter struct {
+    store db.CacheStore
+}
+
+func NewExporter(store db.CacheStore) Exporter {
+    return &exporter{store: store}
+}
+
+// cachedRequestBody holds the parts of a request body that go into an example.
+type cachedRequestBody struct {
+    Model    string            `json:"model"`
+    Messages []map[string]any  `json:"messages"`
+    Tools    json.RawMessage   `json:"tools,omitempty"`
+    Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type fineTuneExample struct {
+    Messages []map[string]any `json:"messages"`
+    Tools    json.RawMessage  `json:"tools,omitempty"`
+}
+
+type evalExample struct {
+    ID           string            `json:"id"`
+    Model        string            `json:"model"`
+    Tenant       string            `json:"tenant"`
+    Input        []map[string]any  `json:"input"`
+    Tools        json.RawMessage   `json:"tools,omitempty"`
+    Output       map[string]any    `json:"output"`
+    FinishReason string            `json:"finish_reason"`
+    Metadata     map[string]string `json:"metadata,omitempty"`
+    CachedAt     string            `json:"cached_at"`
+}
+
+func (e *exporter) Export(ctx context.Context, w io.Writer, options Options) (Result, error) {
+    var result Result
+    if options.Format != FormatFineTune && options.Format != FormatEval {
+        return result, fmt.Errorf("unknown format %q, expected %s or %s", options.Format, FormatFineTune, FormatEval)
+    }
+
+    finishReasons := make(map[string]bool)
+    for _, reason := range options.FinishReasons {
+        finishReasons[reason] = true
+    }
+    tagKey, tagValue, matchTagValue := strings.Cut(options.Tag, "=")
+    seen := make(map[[sha256.Size]byte]bool)
+
+    err := e.store.ExportCachedResponses(ctx, options.Filter, func(entry models.CachedRequest) error {
+        var request cachedRequestBody
+        if err := json.Unmarshal(entry.Body, &request); err != nil || len(request.Messages) == 0 {
+            result.Skipped++
+            return nil
+        }
+        if options.Tag != "" {
+            value, tagged := request.Metadata[tagKey]
+            if !tagged || (matchTagValue && value != tagValue) {
+                result.Skipped++
+                return nil
+            }
+        }
+
+        for _, response := range entry.Responses {
+            for _, choice := range response.Choices {
+                if len(finishReasons) > 0 && !finishReasons[string(choice.FinishReason)] {
+                    result.Skipped++
+                    continue
+                }
+
+                line, key, err := e.example(options, entry, request, choice)
+                if err != nil {
+                    return err
+                }
+                if options.Dedupe {
+                    if seen[key] {
+                        result.Duplicates++
+                        continue
+                    }
+                    seen[key] = true
+                }
+                if _, err := w.Write(append(line, '\n')); err != nil {
+                    return err
+                }
+                result.Exported++
+            }
+        }
+        return ctx.Err()
+    })
+    return result, err
+}
+
+// example encodes one reply to a cached request in the requested format. The returned key
+// identifies the conversation and reply, so the same example cached for several tenants or
+// under several cache keys is recognized as a duplicate.
+func (e *exporter) example(options Options, entry models.CachedRequest, request cachedRequestBody, choice openai.ChatCompletionChoice) ([]byte, [sha256.Size]byte, error) {
+    var key [sha256.Size]byte
+    // Messages are copied through JSON so scrubbing leaves the request untouched for other replies
+    var messages []map[string]any
+    var reply map[string]any
+    if err := roundTrip(request.Messages, &messages); err != nil {
+        return nil, key, err
+    }
+    if err := roundTrip(choice.Message, &reply); err != nil {
+        return nil, key, err
+    }
+    if options.ScrubPII {
+        scrubMessages(messages)
+        scrubMessages([]map[string]any{reply})
+    }
+
+    conversation, err := json.Marshal(fineTuneExample{
+        Messages: append(messages, reply),
+        Tools:    request.Tools,
+    })
+    if err != nil {
+        return nil, key, err
+    }
+    key = sha256.Sum256(conversation)
+    if options.Format == FormatFineTune {
+        return conversation, key, nil
+    }
+
+    line, err := json.Marshal(evalExample{
+        ID:           entry.Hash,
+        Model:        request.Model,
+        Tenant:       entry.Tenant,
+        Input:        messages,
+        Tools:        request.Tools,
+        Output:       reply,
+        FinishReason: string(choice.FinishReason),
+        Metadata:     request.Metadata,
+        CachedAt:     entry.CachedAt.UTC().Format(time.RFC3339),
+    })
+    return line, key, err
+}
+
+func roundTrip(from any, to any) error {
+    encoded, err := json.Marshal(from)
+    if err != nil {
+        return fmt.Errorf("failed to encode message: %w", err)
+    }
+    return json.Unmarshal(encoded, to)
+}
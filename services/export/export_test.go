@@ -0,0 +1,178 @@
+package export
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/models"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "strings"
+    "testing"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// testCacheStore exports entries, recording the filter it was asked for.
+type testCacheStore struct {
+    db.CacheStore
+    entries []models.CachedRequest
+    filter  models.CacheFilter
+}
+
+func (s *testCacheStore) ExportCachedResponses(ctx context.Context, filter models.CacheFilter, onEntry func(models.CachedRequest) error) error {
+    s.filter = filter
+    for _, entry := range s.entries {
+        if err := onEntry(entry); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func cachedRequest(hash string, tenant string, body string, replies ...openai.ChatCompletionChoice) models.CachedRequest {
+    return models.CachedRequest{
+        Hash:      hash,
+        Tenant:    tenant,
+        Route:     "/v1/chat/completions",
+        Body:      json.RawMessage(body),
+        Responses: []openai.ChatCompletionResponse{{Choices: replies}},
+        CachedAt:  time.Date(2024, 10, 10, 12, 0, 0, 0, time.UTC),
+    }
+}
+
+func reply(content string, finishReason openai.FinishReason) openai.ChatCompletionChoice {
+    return openai.ChatCompletionChoice{
+        Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content},
+        FinishReason: finishReason,
+    }
+}
+
+const (
+    helloBody = `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"Hello from jane@example.com"}],"metadata":{"suite":"greetings"}}`
+    byeBody   = `{"model":"gpt-4o","messages":[{"role":"system","content":"Be brief"},{"role":"user","content":"Bye"}],"metadata":{"suite":"farewells"}}`
+)
+
+func newTestExporter() (*exporter, *testCacheStore) {
+    store := &testCacheStore{entries: []models.CachedRequest{
+        cachedRequest("hash_hello", "acme", helloBody, reply("Hi!", openai.FinishReasonStop), reply("Hello there, how can", openai.FinishReasonLength)),
+        // The same conversation and reply cached for another tenant
+        cachedRequest("hash_hello_globex", "globex", helloBody, reply("Hi!", openai.FinishReasonStop)),
+        cachedRequest("hash_bye", "acme", byeBody, reply("Bye.", openai.FinishReasonStop)),
+        cachedRequest("hash_no_messages", "acme", `{"model":"gpt-4o","messages":[]}`, reply("?", openai.FinishReasonStop)),
+        cachedRequest("hash_invalid", "acme", `not json`, reply("?", openai.FinishReasonStop)),
+    }}
+    return NewExporter(store).(*exporter), store
+}
+
+func exportLines(t *testing.T, options Options) ([]string, Result) {
+    t.Helper()
+    e, _ := newTestExporter()
+    var buffer bytes.Buffer
+    result, err := e.Export(context.Background(), &buffer, options)
+    if err != nil {
+        t.Fatalf("Export() error = %v", err)
+    }
+    return strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n"), result
+}
+
+func TestExportFineTune(t *testing.T) {
+    lines, result := exportLines(t, Options{Format: FormatFineTune})
+    want := []string{
+        `{"messages":[{"content":"Hello from jane@example.com","role":"user"},{"content":"Hi!","role":"assistant"}]}`,
+        `{"messages":[{"content":"Hello from jane@example.com","role":"user"},{"content":"Hello there, how can","role":"assistant"}]}`,
+        `{"messages":[{"content":"Hello from jane@example.com","role":"user"},{"content":"Hi!","role":"assistant"}]}`,
+        `{"messages":[{"content":"Be brief","role":"system"},{"content":"Bye","role":"user"},{"content":"Bye.","role":"assistant"}]}`,
+    }
+    if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+        t.Errorf("Export() wrote\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+    }
+    if result != (Result{Exported: 4, Skipped: 2}) {
+        t.Errorf("Export() = %+v, want 4 exported and 2 skipped", result)
+    }
+}
+
+func TestExportEval(t *testing.T) {
+    lines, _ := exportLines(t, Options{Format: FormatEval, FinishReasons: []string{"stop"}, Tag: "suite=farewells"})
+    want := `{"id":"hash_bye","model":"gpt-4o","tenant":"acme",` +
+        `"input":[{"content":"Be brief","role":"system"},{"content":"Bye","role":"user"}],` +
+        `"output":{"content":"Bye.","role":"assistant"},"finish_reason":"stop",` +
+        `"metadata":{"suite":"farewells"},"cached_at":"2024-10-10T12:00:00Z"}`
+    if len(lines) != 1 || lines[0] != want {
+        t.Errorf("Export() wrote\n%s\nwant\n%s", strings.Join(lines, "\n"), want)
+    }
+}
+
+func TestExportOptions(t *testing.T) {
+    tests := []struct {
+        name    string
+        options Options
+        want    Result
+    }{
+        {name: "finish reasons", options: Options{FinishReasons: []string{"length"}}, want: Result{Exported: 1, Skipped: 5}},
+        {name: "tag key", options: Options{Tag: "suite"}, want: Result{Exported: 4, Skipped: 2}},
+        {name: "tag value", options: Options{Tag: "suite=greetings"}, want: Result{Exported: 3, Skipped: 3}},
+        {name: "missing tag", options: Options{Tag: "owner"}, want: Result{Skipped: 5}},
+        {name: "dedupe", options: Options{Dedupe: true}, want: Result{Exported: 3, Duplicates: 1, Skipped: 2}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for _, format := range []string{FormatFineTune, FormatEval} {
+                tt.options.Format = format
+                if _, result := exportLines(t, tt.options); result != tt.want {
+                    t.Errorf("Export() as %s = %+v, want %+v", format, result, tt.want)
+                }
+            }
+        })
+    }
+}
+
+func TestExportScrubsPII(t *testing.T) {
+    e, store := newTestExporter()
+    var buffer bytes.Buffer
+    if _, err := e.Export(context.Background(), &buffer, Options{Format: FormatFineTune, ScrubPII: true}); err != nil {
+        t.Fatalf("Export() error = %v", err)
+    }
+    if strings.Contains(buffer.String(), "jane@example.com") || !strings.Contains(buffer.String(), "Hello from [EMAIL]") {
+        t.Errorf("Export() wrote\n%s\nwant the email address scrubbed", buffer.String())
+    }
+    if string(store.entries[0].Body) != helloBody {
+        t.Errorf("Export() changed the cached request to %s", store.entries[0].Body)
+    }
+}
+
+func TestExportPassesFilter(t *testing.T) {
+    e, store := newTestExporter()
+    filter := models.CacheFilter{Model: "gpt-4o", Tenant: "acme", From: time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)}
+    if _, err := e.Export(context.Background(), &bytes.Buffer{}, Options{Format: FormatEval, Filter: filter}); err != nil {
+        t.Fatalf("Export() error = %v", err)
+    }
+    if store.filter != filter {
+        t.Errorf("store was asked for %+v, want %+v", store.filter, filter)
+    }
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+    return 0, errors.New("disk full")
+}
+
+func TestExportErrors(t *testing.T) {
+    e, _ := newTestExporter()
+    if _, err := e.Export(context.Background(), &bytes.Buffer{}, Options{Format: "csv"}); err == nil {
+        t.Error("Export() in an unknown format: error = nil, want an error")
+    }
+    if _, err := e.Export(context.Background(), failingWriter{}, Options{Format: FormatFineTune}); err == nil || err.Error() != "disk full" {
+        t.Errorf("Export() to a failing writer: error = %v, want disk full", err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    result, err := e.Export(ctx, &bytes.Buffer{}, Options{Format: FormatFineTune})
+    if !errors.Is(err, context.Canceled) || result.Exported != 2 {
+        t.Errorf("canceled Export() = %+v, %v, want the first entry exported and %v", result, err, context.Canceled)
+    }
+}
@@ -0,0 +1,45 @@
+package export
+
+import "regexp"
+
+// piiPatterns match personal data that is replaced by a placeholder when scrubbing. They are
+// deliberately broad, so scrubbing errs on the side of removing too much.
+var piiPatterns = []struct {
+    pattern     *regexp.Regexp
+    placeholder string
+}{
+    {regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`), "[EMAIL]"},
+    // Card numbers come before phone numbers, which would otherwise match parts of them
+    {regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`), "[CARD_NUMBER]"},
+    {regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), "[SSN]"},
+    {regexp.MustCompile(`(?:\+\d{1,3}[ .\-]?)?\(?\b\d{3}\)?[ .\-]?\d{3}[ .\-]?\d{4}\b`), "[PHONE]"},
+    {regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`), "[IP_ADDRESS]"},
+}
+
+// scrubPII replaces email addresses, card numbers, US social security numbers, phone numbers
+// and IP addresses in text with placeholders.
+func scrubPII(text string) string {
+    for _, pii := range piiPatterns {
+        text = pii.pattern.ReplaceAllString(text, pii.placeholder)
+    }
+    return text
+}
+
+// scrubMessages scrubs the text content of chat messages, which is either a string or a list
+// of content parts. Other fields, such as tool call arguments, are left as they are.
+func scrubMessages(messages []map[string]any) {
+    for _, message := range messages {
+        switch content := message["content"].(type) {
+        case string:
+            message["content"] = scrubPII(content)
+        case []any:
+            for _, part := range content {
+                if part, ok := part.(map[string]any); ok {
+                    if text, ok := part["text"].(string); ok {
+                        part["text"] = scrubPII(text)
+                    }
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,62 @@
+package export
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+func TestScrubPII(t *testing.T) {
+    tests := []struct {
+        name string
+        text string
+        want string
+    }{
+        {name: "email", text: "Mail jane.doe+news@example.co.uk today", want: "Mail [EMAIL] today"},
+        {name: "card number", text: "Card 4111 1111 1111 1111, exp 12/29", want: "Card [CARD_NUMBER], exp 12/29"},
+        {name: "card number with dashes", text: "4111-1111-1111-1111", want: "[CARD_NUMBER]"},
+        {name: "social security number", text: "SSN 123-45-6789.", want: "SSN [SSN]."},
+        {name: "phone number", text: "Call (555) 123-4567", want: "Call [PHONE]"},
+        {name: "international phone number", text: "Call +1 555.123.4567", want: "Call [PHONE]"},
+        {name: "IP address", text: "Seen from 192.168.0.1 twice", want: "Seen from [IP_ADDRESS] twice"},
+        {name: "several", text: "a@b.io or 555-123-4567", want: "[EMAIL] or [PHONE]"},
+        {name: "short numbers", text: "Order 12345 of 3 items, version 1.2", want: "Order 12345 of 3 items, version 1.2"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := scrubPII(tt.text); got != tt.want {
+                t.Errorf("scrubPII(%q) = %q, want %q", tt.text, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestScrubMessages(t *testing.T) {
+    var messages []map[string]any
+    err := json.Unmarshal([]byte(`[
+        {"role": "user", "content": "I am jane@example.com"},
+        {"role": "user", "content": [
+            {"type": "text", "text": "Call 555-123-4567"},
+            {"type": "image_url", "image_url": {"url": "https://example.com/jane@example.com.png"}}
+        ]},
+        {"role": "assistant", "content": null, "tool_calls": [
+            {"type": "function", "function": {"name": "email", "arguments": "{\"to\":\"jane@example.com\"}"}}
+        ]}
+    ]`), &messages)
+    if err != nil {
+        t.Fatalf("json.Unmarshal() error = %v", err)
+    }
+
+    scrubMessages(messages)
+    got, err := json.Marshal(messages)
+    if err != nil {
+        t.Fatalf("json.Marshal() error = %v", err)
+    }
+    // Only text content is scrubbed
+    want := `[{"content":"I am [EMAIL]","role":"user"},` +
+        `{"content":[{"text":"Call [PHONE]","type":"text"},{"image_url":{"url":"https://example.com/jane@example.com.png"},"type":"image_url"}],"role":"user"},` +
+        `{"content":null,"role":"assistant","tool_calls":[{"function":{"arguments":"{\"to\":\"jane@example.com\"}","name":"email"},"type":"function"}]}]`
+    if string(got) != want {
+        t.Errorf("scrubMessages() =\n%s\nwant\n%s", got, want)
+    }
+}
@@ -0,0 +1,182 @@
+package fingerprint
+
+import (
+    "batch-gpt/services/config"
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "strconv"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// CurrentVersion is the canonicalization used for new cache keys. It is stored with every
+// cache entry, so entries keyed by an older version can be found and rehashed.
+const CurrentVersion = 1
+
+// LegacyVersion identifies keys computed before fingerprints were versioned, by hashing
+// json.Marshal of the go-openai request struct. They change whenever go-openai adds a field.
+const LegacyVersion = 0
+
+// canonicalization describes how a request body is normalized before it is hashed.
+// Changing any of it changes cache keys, so it must only ever be done by adding a new version.
+type canonicalization struct {
+    // include, if not empty, lists the only top-level fields that are part of the key.
+    include map[string]bool
+    // exclude lists top-level fields that are never part of the key.
+    exclude map[string]bool
+    // defaults lists top-level fields that are dropped when they hold their default value,
+    // so that sending a default explicitly and omitting it produce the same key.
+    defaults map[string]string
+}
+
+var canonicalizations = map[int]canonicalization{
+    1: {
+        // Every field is part of the key unless excluded, so parameters batch-gpt does not
+        // know about yet still tell requests apart.
+        include: nil,
+        exclude: set("stream", "stream_options"),
+        defaults: map[string]string{
+            "temperature":         "1",
+            "top_p":               "1",
+            "n":                   "1",
+            "presence_penalty":    "0",
+            "frequency_penalty":   "0",
+            "logprobs":            "false",
+            "top_logprobs":        "0",
+            "parallel_tool_calls": "true",
+            "logit_bias":          "{}",
+            "stop":                "[]",
+            "tools":               "[]",
+        },
+    },
+}
+
+func set(fields ...string) map[string]bool {
+    m := make(map[string]bool, len(fields))
+    for _, field := range fields {
+        m[field] = true
+    }
+    return m
+}
+
+// Fingerprint returns the cache key of a JSON request body using the current version.
+func Fingerprint(body []byte) (string, error) {
+    return FingerprintVersion(body, CurrentVersion)
+}
+
+// FingerprintVersion returns the cache key of a JSON request body using the given version.
+func FingerprintVersion(body []byte, version int) (string, error) {
+    return fingerprintWithRules(body, version, config.CacheKeyRules{})
+}
+
+func fingerprintWithRules(body []byte, version int, keyRules config.CacheKeyRules) (string, error) {
+    if version == LegacyVersion {
+        var request openai.ChatCompletionRequest
+        if err := json.Unmarshal(body, &request); err != nil {
+            return "", err
+        }
+        return LegacyFingerprint(request)
+    }
+
+    canonical, err := canonicalize(body, version, keyRules)
+    if err != nil {
+        return "", err
+    }
+    hash := sha256.Sum256(append([]byte(fmt.Sprintf("v%d:", version)), canonical...))
+    return hex.EncodeToString(hash[:]), nil
+}
+
+// LegacyFingerprint reproduces the unversioned keys of earlier batch-gpt releases.
+func LegacyFingerprint(request openai.ChatCompletionRequest) (string, error) {
+    requestJSON, err := json.Marshal(request)
+    if err != nil {
+        return "", err
+    }
+    hash := sha256.Sum256(requestJSON)
+    return hex.EncodeToString(hash[:]), nil
+}
+
+// Canonicalize returns the normalized JSON that FingerprintVersion hashes: object keys are
+// sorted, numbers are written in their shortest form, null fields are dropped, and the
+// version's include, exclude and default rules are applied to the top-level fields.
+func Canonicalize(body []byte, version int) ([]byte, error) {
+    return canonicalize(body, version, config.CacheKeyRules{})
+}
+
+// canonicalize is Canonicalize with configured cache key rules applied before the version's rules.
+func canonicalize(body []byte, version int, keyRules config.CacheKeyRules) ([]byte, error) {
+    rules, ok := canonicalizations[version]
+    if !ok {
+        return nil, fmt.Errorf("unknown fingerprint version %d", version)
+    }
+
+    decoder := json.NewDecoder(bytes.NewReader(body))
+    decoder.UseNumber()
+
+    var request map[string]interface{}
+    if err := decoder.Decode(&request); err != nil {
+        return nil, err
+    }
+
+    for field, value := range request {
+        request[field] = normalizeValue(value)
+    }
+
+    // A single stop sequence is the same as a list holding only that sequence
+    if stop, ok := request["stop"].(string); ok {
+        request["stop"] = []interface{}{stop}
+    }
+
+    if err := applyKeyRules(request, keyRules); err != nil {
+        return nil, err
+    }
+
+    for field, value := range request {
+        if value == nil ||
+            (len(rules.include) > 0 && !rules.include[field]) ||
+            rules.exclude[field] {
+            delete(request, field)
+            continue
+        }
+        if defaultValue, ok := rules.defaults[field]; ok {
+            encoded, err := json.Marshal(value)
+            if err != nil {
+                return nil, err
+            }
+            if string(encoded) == defaultValue {
+                delete(request, field)
+            }
+        }
+    }
+
+    // Maps are marshalled with sorted keys
+    return json.Marshal(request)
+}
+
+// normalizeValue rewrites numbers in their shortest form, so 1, 1.0 and 1e0 are the same.
+func normalizeValue(value interface{}) interface{} {
+    switch v := value.(type) {
+    case json.Number:
+        if i, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+            return json.Number(strconv.FormatInt(i, 10))
+        }
+        if f, err := v.Float64(); err == nil {
+            return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+        }
+        return v
+    case map[string]interface{}:
+        for key, item := range v {
+            v[key] = normalizeValue(item)
+        }
+        return v
+    case []interface{}:
+        for i, item := range v {
+            v[i] = normalizeValue(item)
+        }
+        return v
+    }
+    return value
+}
@@ -0,0 +1,86 @@
+package fingerprint
+
+import (
+    "testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+    tests := []struct {
+        name string
+        body string
+        want string
+    }{
+        {
+            name: "sorts object keys at every level",
+            body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`,
+            want: `{"messages":[{"content":"hi","role":"user"}],"model":"gpt-4o"}`,
+        },
+        {
+            name: "writes numbers in their shortest form",
+            body: `{"model":"gpt-4o","temperature":0.50,"max_tokens":1e2,"seed":12345678901234}`,
+            want: `{"max_tokens":100,"model":"gpt-4o","seed":12345678901234,"temperature":0.5}`,
+        },
+        {
+            name: "drops null fields",
+            body: `{"model":"gpt-4o","user":null}`,
+            want: `{"model":"gpt-4o"}`,
+        },
+        {
+            name: "drops streaming fields",
+            body: `{"model":"gpt-4o","stream":true,"stream_options":{"include_usage":true}}`,
+            want: `{"model":"gpt-4o"}`,
+        },
+        {
+            name: "drops fields holding their default",
+            body: `{"model":"gpt-4o","temperature":1.0,"top_p":1,"n":1,"logprobs":false,"logit_bias":{},"stop":[],"tools":[]}`,
+            want: `{"model":"gpt-4o"}`,
+        },
+        {
+            name: "keeps fields that differ from their default",
+            body: `{"model":"gpt-4o","temperature":0,"n":2}`,
+            want: `{"model":"gpt-4o","n":2,"temperature":0}`,
+        },
+        {
+            name: "turns a single stop sequence into a list",
+            body: `{"model":"gpt-4o","stop":"END"}`,
+            want: `{"model":"gpt-4o","stop":["END"]}`,
+        },
+        {
+            name: "keeps unknown fields",
+            body: `{"model":"gpt-4o","reasoning_effort":"low"}`,
+            want: `{"model":"gpt-4o","reasoning_effort":"low"}`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := Canonicalize([]byte(tt.body), CurrentVersion)
+            if err != nil {
+                t.Fatalf("Canonicalize() error = %v", err)
+            }
+            if string(got) != tt.want {
+                t.Errorf("Canonicalize() = %s, want %s", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestCanonicalizeErrors(t *testing.T) {
+    tests := []struct {
+        name    string
+        body    string
+        version int
+    }{
+        {name: "unknown version", body: `{"model":"gpt-4o"}`, version: 99},
+        {name: "invalid JSON", body: `{"model":`, version: CurrentVersion},
+        {name: "not an object", body: `["gpt-4o"]`, version: CurrentVersion},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, err := Canonicalize([]byte(tt.body), tt.version); err == nil {
+                t.Errorf("Canonicalize() error = nil, want an error")
+            }
+        })
+    }
+}
@@ -0,0 +1,104 @@
+package fingerprint
+
+import (
+    "batch-gpt/server/models"
+    "batch-gpt/services/config"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "strings"
+)
+
+// Fingerprinter computes cache keys with the cache key rules that apply to a request's
+// route and tenant. The cache lookup and the in-flight deduplication of the batch
+// orchestrator share one, so both agree on which requests are the same.
+type Fingerprinter interface {
+    Fingerprint(request models.ChatRequest) (string, error)
+}
+
+type fingerprinter struct {
+    cacheKeyConfig config.CacheKeyConfig
+}
+
+func NewFingerprinter(cacheKeyConfig config.CacheKeyConfig) Fingerprinter {
+    return &fingerprinter{
+        cacheKeyConfig: cacheKeyConfig,
+    }
+}
+
+func (f *fingerprinter) Fingerprint(request models.ChatRequest) (string, error) {
+    rules := f.cacheKeyConfig.GetRules(request.Route, request.Tenant)
+    return fingerprintWithRules(request.Body, CurrentVersion, rules)
+}
+
+// applyKeyRules applies configured cache key rules to a decoded, normalized request.
+func applyKeyRules(request map[string]interface{}, rules config.CacheKeyRules) error {
+    for _, field := range rules.IgnoreFields {
+        delete(request, field)
+    }
+
+    for field, defaultValue := range rules.Defaults {
+        value, present := request[field]
+        if !present {
+            continue
+        }
+        same, err := sameJSON(value, defaultValue)
+        if err != nil {
+            return fmt.Errorf("invalid default for cache key field %s: %w", field, err)
+        }
+        if same {
+            delete(request, field)
+        }
+    }
+
+    if rules.TrimContent {
+        if messages, ok := request["messages"].([]interface{}); ok {
+            for _, message := range messages {
+                trimMessageContent(message)
+            }
+        }
+    }
+    return nil
+}
+
+// sameJSON reports whether a normalized value encodes to the same JSON as a configured one.
+func sameJSON(value interface{}, configured json.RawMessage) (bool, error) {
+    decoder := json.NewDecoder(bytes.NewReader(configured))
+    decoder.UseNumber()
+
+    var configuredValue interface{}
+    if err := decoder.Decode(&configuredValue); err != nil {
+        return false, err
+    }
+
+    encoded, err := json.Marshal(value)
+    if err != nil {
+        return false, err
+    }
+    encodedConfigured, err := json.Marshal(normalizeValue(configuredValue))
+    if err != nil {
+        return false, err
+    }
+    return bytes.Equal(encoded, encodedConfigured), nil
+}
+
+// trimMessageContent trims the content of a message, whether it is a string or a list of text parts.
+func trimMessageContent(message interface{}) {
+    fields, ok := message.(map[string]interface{})
+    if !ok {
+        return
+    }
+
+    switch content := fields["content"].(type) {
+    case string:
+        fields["content"] = strings.TrimSpace(content)
+    case []interface{}:
+        for _, part := range content {
+            if partFields, ok := part.(map[string]interface{}); ok {
+                if text, ok := partFields["text"].(string); ok {
+                    partFields["text"] = strings.TrimSpace(text)
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,148 @@
+package usage
+
+import (
+    "batch-gpt/server/db"
+    "batch-gpt/server/logger"
+    "batch-gpt/server/models"
+    "batch-gpt/services/config"
+    "slices"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// DayFormat is how the days of usage records are written.
+const DayFormat = "2006-01-02"
+
+type tracker struct {
+    store         db.UsageStore
+    pricingConfig config.PricingConfig
+}
+
+func NewTracker(store db.UsageStore, pricingConfig config.PricingConfig) Tracker {
+    return &tracker{
+        store:         store,
+        pricingConfig: pricingConfig,
+    }
+}
+
+func (t *tracker) RecordBatch(requests []models.BatchRequestItem, responses []models.BatchResponseItem) {
+    requestMap := make(map[string]models.ChatRequest, len(requests))
+    for _, req := range requests {
+        requestMap[req.CustomID] = req.Request
+    }
+
+    // Responses are summed up per tenant and model, keyed by their record without counts
+    day := time.Now().UTC().Format(DayFormat)
+    records := make(map[models.UsageRecord]models.UsageRecord)
+    for _, resp := range responses {
+        request, ok := requestMap[resp.CustomID]
+        if !ok {
+            continue
+        }
+        key := newRecord(day, request, models.UsageSourceBatch)
+        record, found := records[key]
+        if !found {
+            record = key
+        }
+        record.Requests++
+        record.PromptTokens += int64(resp.Response.Body.Usage.PromptTokens)
+        record.CompletionTokens += int64(resp.Response.Body.Usage.CompletionTokens)
+        records[key] = record
+    }
+    if len(records) == 0 {
+        return
+    }
+
+    batchRecords := make([]models.UsageRecord, 0, len(records))
+    for _, record := range records {
+        batchRecords = append(batchRecords, record)
+    }
+    if err := t.store.RecordUsage(batchRecords); err != nil {
+        logger.ErrorLogger.Printf("Failed to record usage of %d batch responses: %v", len(responses), err)
+    }
+}
+
+func (t *tracker) RecordCacheHit(request models.ChatRequest, response openai.ChatCompletionResponse) {
+    record := newRecord(time.Now().UTC().Format(DayFormat), request, models.UsageSourceCache)
+    record.Requests = 1
+    record.PromptTokens = int64(response.Usage.PromptTokens)
+    record.CompletionTokens = int64(response.Usage.CompletionTokens)
+    go func() {
+        if err := t.store.RecordUsage([]models.UsageRecord{record}); err != nil {
+            logger.ErrorLogger.Printf("Failed to record usage of a cache hit: %v", err)
+        }
+    }()
+}
+
+// newRecord returns an empty usage record for a request. Requests of batches submitted before
+// a restart do not know their tenant and count for the default one.
+func newRecord(day string, request models.ChatRequest, source string) models.UsageRecord {
+    tenant := request.Tenant
+    if tenant == "" {
+        tenant = models.DefaultTenant
+    }
+    return models.UsageRecord{Day: day, Tenant: tenant, Model: request.Params.Model, Source: source}
+}
+
+func (t *tracker) Report(filter models.UsageFilter) (Report, error) {
+    records, err := t.store.GetUsage(filter)
+    if err != nil {
+        return Report{}, err
+    }
+    return Summarize(records, t.pricingConfig), nil
+}
+
+// Summarize prices usage records, which must be ordered by day, tenant and model, and sums
+// them up per day, tenant and model.
+func Summarize(records []models.UsageRecord, pricingConfig config.PricingConfig) Report {
+    report := Report{Data: make([]Summary, 0), UnpricedModels: make([]string, 0)}
+    for _, record := range records {
+        last := len(report.Data) - 1
+        if last < 0 || report.Data[last].Day != record.Day || report.Data[last].Tenant != record.Tenant || report.Data[last].Model != record.Model {
+            report.Data = append(report.Data, Summary{Day: record.Day, Tenant: record.Tenant, Model: record.Model})
+            last++
+        }
+
+        price, priced := pricingConfig.GetPrice(record.Model)
+        if !priced && !slices.Contains(report.UnpricedModels, record.Model) {
+            report.UnpricedModels = append(report.UnpricedModels, record.Model)
+        }
+        realtimeCost := cost(record.PromptTokens, price.Input) + cost(record.CompletionTokens, price.Output)
+
+        var delta Summary
+        switch record.Source {
+        case models.UsageSourceBatch:
+            delta.BatchRequests = record.Requests
+            delta.BatchPromptTokens = record.PromptTokens
+            delta.BatchCompletionTokens = record.CompletionTokens
+            delta.Spend = cost(record.PromptTokens, price.BatchInput) + cost(record.CompletionTokens, price.BatchOutput)
+            delta.BatchSavings = realtimeCost - delta.Spend
+        case models.UsageSourceCache:
+            delta.CacheHits = record.Requests
+            delta.CachePromptTokens = record.PromptTokens
+            delta.CacheCompletionTokens = record.CompletionTokens
+            delta.CacheSavings = realtimeCost
+        }
+        report.Data[last].add(delta)
+        report.Total.add(delta)
+    }
+    return report
+}
+
+func (s *Summary) add(delta Summary) {
+    s.BatchRequests += delta.BatchRequests
+    s.BatchPromptTokens += delta.BatchPromptTokens
+    s.BatchCompletionTokens += delta.BatchCompletionTokens
+    s.CacheHits += delta.CacheHits
+    s.CachePromptTokens += delta.CachePromptTokens
+    s.CacheCompletionTokens += delta.CacheCompletionTokens
+    s.Spend += delta.Spend
+    s.BatchSavings += delta.BatchSavings
+    s.CacheSavings += delta.CacheSavings
+}
+
+// cost returns what tokens cost at a price per million tokens.
+func cost(tokens int64, pricePerMillion float64) float64 {
+    return float64(tokens) * pricePerMillion / 1e6
+}
@@ -0,0 +1,217 @@
+package usage
+
+import (
+    "batch-gpt/server/models"
+    "batch-gpt/services/config"
+    "errors"
+    "math"
+    "reflect"
+    "slices"
+    "sort"
+    "testing"
+    "time"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// testUsageStore hands the records it is given to recorded and serves usage from records.
+type testUsageStore struct {
+    recorded chan []models.UsageRecord
+    records  []models.UsageRecord
+    filter   models.UsageFilter
+    err      error
+}
+
+func newTestUsageStore() *testUsageStore {
+    return &testUsageStore{recorded: make(chan []models.UsageRecord, 1)}
+}
+
+func (s *testUsageStore) RecordUsage(records []models.UsageRecord) error {
+    s.recorded <- records
+    return s.err
+}
+
+func (s *testUsageStore) GetUsage(filter models.UsageFilter) ([]models.UsageRecord, error) {
+    s.filter = filter
+    return s.records, s.err
+}
+
+// testPricingConfig prices models by exact name.
+type testPricingConfig map[string]config.ModelPrice
+
+func (pc testPricingConfig) GetPrice(model string) (config.ModelPrice, bool) {
+    price, ok := pc[model]
+    return price, ok
+}
+
+var testPrices = testPricingConfig{
+    "gpt-4o": {Input: 2.50, Output: 10.00, BatchInput: 1.25, BatchOutput: 5.00},
+}
+
+func chatRequest(tenant string, model string) models.ChatRequest {
+    return models.ChatRequest{Tenant: tenant, Params: openai.ChatCompletionRequest{Model: model}}
+}
+
+func batchResponse(customID string, promptTokens int, completionTokens int) models.BatchResponseItem {
+    var response models.BatchResponseItem
+    response.CustomID = customID
+    response.Response.Body.Usage = openai.Usage{PromptTokens: promptTokens, CompletionTokens: completionTokens}
+    return response
+}
+
+func TestRecordBatch(t *testing.T) {
+    store := newTestUsageStore()
+    tracker := NewTracker(store, testPrices)
+
+    requests := []models.BatchRequestItem{
+        {CustomID: "request-1", Request: chatRequest("acme", "gpt-4o")},
+        {CustomID: "request-2", Request: chatRequest("acme", "gpt-4o")},
+        {CustomID: "request-3", Request: chatRequest("", "gpt-4o")},
+        {CustomID: "request-4", Request: chatRequest("acme", "gpt-4o-mini")},
+    }
+    responses := []models.BatchResponseItem{
+        batchResponse("request-1", 100, 10),
+        batchResponse("request-2", 200, 20),
+        batchResponse("request-3", 300, 30),
+        batchResponse("request-4", 400, 40),
+        batchResponse("request-unknown", 500, 50),
+    }
+    tracker.RecordBatch(requests, responses)
+
+    day := time.Now().UTC().Format(DayFormat)
+    got := <-store.recorded
+    sort.Slice(got, func(i, j int) bool {
+        return got[i].Tenant+got[i].Model < got[j].Tenant+got[j].Model
+    })
+    // Requests without a tenant count for the default one
+    want := []models.UsageRecord{
+        {Day: day, Tenant: "acme", Model: "gpt-4o", Source: models.UsageSourceBatch, Requests: 2, PromptTokens: 300, CompletionTokens: 30},
+        {Day: day, Tenant: "acme", Model: "gpt-4o-mini", Source: models.UsageSourceBatch, Requests: 1, PromptTokens: 400, CompletionTokens: 40},
+        {Day: day, Tenant: models.DefaultTenant, Model: "gpt-4o", Source: models.UsageSourceBatch, Requests: 1, PromptTokens: 300, CompletionTokens: 30},
+    }
+    sort.Slice(want, func(i, j int) bool {
+        return want[i].Tenant+want[i].Model < want[j].Tenant+want[j].Model
+    })
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("RecordBatch() recorded %+v, want %+v", got, want)
+    }
+}
+
+func TestRecordBatchWithoutMatches(t *testing.T) {
+    store := newTestUsageStore()
+    tracker := NewTracker(store, testPrices)
+
+    tracker.RecordBatch(nil, []models.BatchResponseItem{batchResponse("request-unknown", 100, 10)})
+    select {
+    case records := <-store.recorded:
+        t.Errorf("RecordBatch() recorded %+v, want nothing", records)
+    default:
+    }
+}
+
+func TestRecordCacheHit(t *testing.T) {
+    store := newTestUsageStore()
+    tracker := NewTracker(store, testPrices)
+
+    tracker.RecordCacheHit(chatRequest("acme", "gpt-4o"), openai.ChatCompletionResponse{Usage: openai.Usage{PromptTokens: 100, CompletionTokens: 10}})
+    want := []models.UsageRecord{{
+        Day:              time.Now().UTC().Format(DayFormat),
+        Tenant:           "acme",
+        Model:            "gpt-4o",
+        Source:           models.UsageSourceCache,
+        Requests:         1,
+        PromptTokens:     100,
+        CompletionTokens: 10,
+    }}
+    select {
+    case got := <-store.recorded:
+        if !reflect.DeepEqual(got, want) {
+            t.Errorf("RecordCacheHit() recorded %+v, want %+v", got, want)
+        }
+    case <-time.After(time.Second):
+        t.Error("RecordCacheHit() recorded nothing")
+    }
+}
+
+func TestSummarize(t *testing.T) {
+    records := []models.UsageRecord{
+        {Day: "2024-10-01", Tenant: "acme", Model: "gpt-4o", Source: models.UsageSourceBatch, Requests: 2, PromptTokens: 1_000_000, CompletionTokens: 100_000},
+        {Day: "2024-10-01", Tenant: "acme", Model: "gpt-4o", Source: models.UsageSourceCache, Requests: 3, PromptTokens: 200_000, CompletionTokens: 100_000},
+        {Day: "2024-10-01", Tenant: "acme", Model: "llama", Source: models.UsageSourceBatch, Requests: 1, PromptTokens: 10, CompletionTokens: 1},
+        {Day: "2024-10-02", Tenant: "acme", Model: "gpt-4o", Source: models.UsageSourceCache, Requests: 1, PromptTokens: 400_000, CompletionTokens: 0},
+        {Day: "2024-10-02", Tenant: "acme", Model: "llama", Source: models.UsageSourceCache, Requests: 1, PromptTokens: 10, CompletionTokens: 1},
+    }
+    report := Summarize(records, testPrices)
+
+    // A batch of gpt-4o costs 1.25 + 0.5 instead of 2.5 + 1; the cache hits saved 0.5 + 1 and 1
+    want := []Summary{
+        {Day: "2024-10-01", Tenant: "acme", Model: "gpt-4o", BatchRequests: 2, BatchPromptTokens: 1_000_000, BatchCompletionTokens: 100_000,
+            CacheHits: 3, CachePromptTokens: 200_000, CacheCompletionTokens: 100_000, Spend: 1.75, BatchSavings: 1.75, CacheSavings: 1.5},
+        {Day: "2024-10-01", Tenant: "acme", Model: "llama", BatchRequests: 1, BatchPromptTokens: 10, BatchCompletionTokens: 1},
+        {Day: "2024-10-02", Tenant: "acme", Model: "gpt-4o", CacheHits: 1, CachePromptTokens: 400_000, CacheSavings: 1},
+        {Day: "2024-10-02", Tenant: "acme", Model: "llama", CacheHits: 1, CachePromptTokens: 10, CacheCompletionTokens: 1},
+    }
+    if len(report.Data) != len(want) {
+        t.Fatalf("Summarize() = %d summaries, want %d", len(report.Data), len(want))
+    }
+    for i := range want {
+        if !summariesEqual(report.Data[i], want[i]) {
+            t.Errorf("Summarize() summary %d = %+v, want %+v", i, report.Data[i], want[i])
+        }
+    }
+
+    wantTotal := Summary{BatchRequests: 3, BatchPromptTokens: 1_000_010, BatchCompletionTokens: 100_001,
+        CacheHits: 5, CachePromptTokens: 600_010, CacheCompletionTokens: 100_001, Spend: 1.75, BatchSavings: 1.75, CacheSavings: 2.5}
+    if !summariesEqual(report.Total, wantTotal) {
+        t.Errorf("Summarize() total = %+v, want %+v", report.Total, wantTotal)
+    }
+    if !slices.Equal(report.UnpricedModels, []string{"llama"}) {
+        t.Errorf("Summarize() unpriced models = %v, want [llama]", report.UnpricedModels)
+    }
+}
+
+func TestSummarizeNothing(t *testing.T) {
+    report := Summarize(nil, testPrices)
+    if report.Data == nil || report.UnpricedModels == nil || len(report.Data) != 0 || len(report.UnpricedModels) != 0 {
+        t.Errorf("Summarize(nil) = %+v, want empty lists", report)
+    }
+}
+
+func TestReport(t *testing.T) {
+    store := newTestUsageStore()
+    store.records = []models.UsageRecord{
+        {Day: "2024-10-01", Tenant: "acme", Model: "gpt-4o", Source: models.UsageSourceCache, Requests: 1, PromptTokens: 400_000},
+    }
+    tracker := NewTracker(store, testPrices)
+
+    filter := models.UsageFilter{Tenant: "acme", From: "2024-10-01", To: "2024-10-31"}
+    report, err := tracker.Report(filter)
+    if err != nil {
+        t.Fatalf("Report() error = %v", err)
+    }
+    if store.filter != filter {
+        t.Errorf("store was asked for %+v, want %+v", store.filter, filter)
+    }
+    if len(report.Data) != 1 || !summariesEqual(report.Total, Summary{CacheHits: 1, CachePromptTokens: 400_000, CacheSavings: 1}) {
+        t.Errorf("Report() = %+v, want the stored usage summarized", report)
+    }
+
+    store.err = errors.New("store unavailable")
+    if _, err := tracker.Report(filter); !errors.Is(err, store.err) {
+        t.Errorf("Report() error = %v, want %v", err, store.err)
+    }
+}
+
+// summariesEqual compares summaries, allowing for rounding in their costs.
+func summariesEqual(a Summary, b Summary) bool {
+    const epsilon = 1e-9
+    costs := [][2]float64{{a.Spend, b.Spend}, {a.BatchSavings, b.BatchSavings}, {a.CacheSavings, b.CacheSavings}}
+    for _, c := range costs {
+        if math.Abs(c[0]-c[1]) > epsilon {
+            return false
+        }
+    }
+    a.Spend, a.BatchSavings, a.CacheSavings = 0, 0, 0
+    b.Spend, b.BatchSavings, b.CacheSavings = 0, 0, 0
+    return a == b
+}
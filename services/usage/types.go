@@ -0,0 +1,45 @@
+package usage
+
+import (
+    "batch-gpt/server/models"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// Summary is the usage of a tenant and model on a day, priced with the configured price table.
+// Spend is what the batches cost. BatchSavings is how much more they would have cost through
+// the realtime API, and CacheSavings what the responses served from the cache would have cost
+// there, so realtime cost = Spend + BatchSavings + CacheSavings.
+type Summary struct {
+    Day                   string  `json:"day,omitempty"`
+    Tenant                string  `json:"tenant,omitempty"`
+    Model                 string  `json:"model,omitempty"`
+    BatchRequests         int64   `json:"batch_requests"`
+    BatchPromptTokens     int64   `json:"batch_prompt_tokens"`
+    BatchCompletionTokens int64   `json:"batch_completion_tokens"`
+    CacheHits             int64   `json:"cache_hits"`
+    CachePromptTokens     int64   `json:"cache_prompt_tokens"`
+    CacheCompletionTokens int64   `json:"cache_completion_tokens"`
+    Spend                 float64 `json:"spend_usd"`
+    BatchSavings          float64 `json:"batch_savings_usd"`
+    CacheSavings          float64 `json:"cache_savings_usd"`
+}
+
+// Report holds a Summary per day, tenant and model, and their total.
+// Usage of UnpricedModels is counted but adds nothing to spend or savings.
+type Report struct {
+    Data           []Summary `json:"data"`
+    Total          Summary   `json:"total"`
+    UnpricedModels []string  `json:"unpriced_models"`
+}
+
+// Tracker records the tokens of the responses batch-gpt serves and reports what they cost
+// and saved.
+type Tracker interface {
+    // RecordBatch records the usage of the responses of a batch, matched to requests by custom id.
+    RecordBatch(requests []models.BatchRequestItem, responses []models.BatchResponseItem)
+    // RecordCacheHit records the usage of a response served from the cache. It does not wait
+    // for the store.
+    RecordCacheHit(request models.ChatRequest, response openai.ChatCompletionResponse)
+    Report(filter models.UsageFilter) (Report, error)
+}
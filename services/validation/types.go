@@ -0,0 +1,16 @@
+package validation
+
+import (
+    "batch-gpt/server/models"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// Validator checks chat completion requests before they are queued, so that requests the
+// Batch API would reject are turned away right away instead of failing a whole batch later.
+// Problems are reported as OpenAI invalid_request_error errors.
+type Validator interface {
+    GetMaxBodyBytes() int64
+    ValidateBodySize(size int) *openai.APIError
+    Validate(request models.ChatRequest) *openai.APIError
+}
@@ -0,0 +1,139 @@
+package validation
+
+import (
+    "batch-gpt/server/models"
+    "batch-gpt/services/config"
+    "encoding/json"
+    "fmt"
+
+    openai "github.com/sashabaranov/go-openai"
+)
+
+// Limits of the chat completions endpoint that apply to every model.
+const (
+    maxN           = 128
+    maxTopLogProbs = 20
+)
+
+type validator struct {
+    config config.ValidationConfig
+}
+
+func NewValidator(validationConfig config.ValidationConfig) Validator {
+    return &validator{
+        config: validationConfig,
+    }
+}
+
+func (v *validator) GetMaxBodyBytes() int64 {
+    return v.config.GetMaxBodyBytes()
+}
+
+func (v *validator) ValidateBodySize(size int) *openai.APIError {
+    if int64(size) > v.config.GetMaxBodyBytes() {
+        return invalidRequest("", "request_too_large",
+            fmt.Sprintf("Request body is too large, the maximum size is %d bytes", v.config.GetMaxBodyBytes()))
+    }
+    return nil
+}
+
+func (v *validator) Validate(chatRequest models.ChatRequest) *openai.APIError {
+    if apiErr := v.ValidateBodySize(len(chatRequest.Body)); apiErr != nil {
+        return apiErr
+    }
+
+    request := chatRequest.Params
+    if request.Model == "" {
+        return invalidRequest("model", "missing_required_parameter", "You must provide a model parameter.")
+    }
+    if len(request.Messages) == 0 {
+        return invalidRequest("messages", "missing_required_parameter", "You must provide at least one message.")
+    }
+
+    rules, known := v.config.GetModelRules(request.Model)
+    if !known && !v.config.AllowsUnknownModels() {
+        return invalidRequest("model", "model_not_found",
+            fmt.Sprintf("The model `%s` does not exist or is not supported by this server.", request.Model))
+    }
+
+    if request.Stream || request.StreamOptions != nil {
+        return invalidRequest("stream", "unsupported_parameter", "Streaming is not supported by the Batch API.")
+    }
+
+    if apiErr := validateRanges(request, rules); apiErr != nil {
+        return apiErr
+    }
+
+    if len(rules.UnsupportedParams) > 0 {
+        var fields map[string]json.RawMessage
+        if err := json.Unmarshal(chatRequest.Body, &fields); err != nil {
+            return invalidRequest("", "invalid_json", "The request body is not a valid JSON object.")
+        }
+        for _, param := range rules.UnsupportedParams {
+            if _, present := fields[param]; present {
+                return invalidRequest(param, "unsupported_parameter",
+                    fmt.Sprintf("Unsupported parameter: '%s' is not supported with the model `%s`.", param, request.Model))
+            }
+        }
+    }
+
+    return nil
+}
+
+func validateRanges(request openai.ChatCompletionRequest, rules config.ModelValidationRules) *openai.APIError {
+    nLimit := maxN
+    if rules.MaxN > 0 {
+        nLimit = rules.MaxN
+    }
+    if request.N < 0 || request.N > nLimit {
+        return outOfRange("n", fmt.Sprintf("must be between 1 and %d", nLimit))
+    }
+
+    for _, limit := range []struct {
+        param string
+        value int
+    }{
+        {"max_tokens", request.MaxTokens},
+        {"max_completion_tokens", request.MaxCompletionsTokens},
+    } {
+        if limit.value < 0 {
+            return outOfRange(limit.param, "must be a positive integer")
+        }
+        if rules.MaxTokens > 0 && limit.value > rules.MaxTokens {
+            return outOfRange(limit.param, fmt.Sprintf("must be at most %d for the model `%s`", rules.MaxTokens, request.Model))
+        }
+    }
+
+    switch {
+    case request.Temperature < 0 || request.Temperature > 2:
+        return outOfRange("temperature", "must be between 0 and 2")
+    case request.TopP < 0 || request.TopP > 1:
+        return outOfRange("top_p", "must be between 0 and 1")
+    case request.PresencePenalty < -2 || request.PresencePenalty > 2:
+        return outOfRange("presence_penalty", "must be between -2 and 2")
+    case request.FrequencyPenalty < -2 || request.FrequencyPenalty > 2:
+        return outOfRange("frequency_penalty", "must be between -2 and 2")
+    case request.TopLogProbs < 0 || request.TopLogProbs > maxTopLogProbs:
+        return outOfRange("top_logprobs", fmt.Sprintf("must be between 0 and %d", maxTopLogProbs))
+    case request.TopLogProbs > 0 && !request.LogProbs:
+        return invalidRequest("top_logprobs", "invalid_value", "logprobs must be set to true when top_logprobs is used.")
+    }
+
+    return nil
+}
+
+func outOfRange(param string, constraint string) *openai.APIError {
+    return invalidRequest(param, "invalid_value", fmt.Sprintf("Invalid '%s': %s.", param, constraint))
+}
+
+func invalidRequest(param string, code string, message string) *openai.APIError {
+    apiErr := &openai.APIError{
+        Type:    "invalid_request_error",
+        Code:    code,
+        Message: message,
+    }
+    if param != "" {
+        apiErr.Param = &param
+    }
+    return apiErr
+}
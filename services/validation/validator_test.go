@@ -0,0 +1,84 @@
+package validation
+
+import (
+    "batch-gpt/server/models"
+    "batch-gpt/services/config"
+    "strings"
+    "testing"
+)
+
+type testValidationConfig struct{}
+
+func (testValidationConfig) GetMaxBodyBytes() int64   { return 1024 }
+func (testValidationConfig) AllowsUnknownModels() bool { return false }
+
+func (testValidationConfig) GetModelRules(model string) (config.ModelValidationRules, bool) {
+    switch {
+    case strings.HasPrefix(model, "gpt-4o"):
+        return config.ModelValidationRules{MaxTokens: 16384, MaxN: 8}, true
+    case strings.HasPrefix(model, "o1"):
+        return config.ModelValidationRules{UnsupportedParams: []string{"temperature", "top_p"}}, true
+    }
+    return config.ModelValidationRules{}, false
+}
+
+func TestValidate(t *testing.T) {
+    tests := []struct {
+        name      string
+        body      string
+        wantCode  string
+        wantParam string
+    }{
+        {name: "valid request", body: `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}],"max_tokens":100,"n":2}`},
+        {name: "missing model", body: `{"messages":[{"role":"user","content":"hi"}]}`, wantCode: "missing_required_parameter", wantParam: "model"},
+        {name: "missing messages", body: `{"model":"gpt-4o"}`, wantCode: "missing_required_parameter", wantParam: "messages"},
+        {name: "unknown model", body: `{"model":"gpt-5","messages":[{"role":"user","content":"hi"}]}`, wantCode: "model_not_found", wantParam: "model"},
+        {name: "streaming", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":true}`, wantCode: "unsupported_parameter", wantParam: "stream"},
+        {name: "stream options", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stream_options":{"include_usage":true}}`, wantCode: "unsupported_parameter", wantParam: "stream"},
+        {name: "n over the model limit", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"n":9}`, wantCode: "invalid_value", wantParam: "n"},
+        {name: "negative max_tokens", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"max_tokens":-1}`, wantCode: "invalid_value", wantParam: "max_tokens"},
+        {name: "max_completion_tokens over the model limit", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"max_completion_tokens":20000}`, wantCode: "invalid_value", wantParam: "max_completion_tokens"},
+        {name: "temperature too high", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"temperature":2.5}`, wantCode: "invalid_value", wantParam: "temperature"},
+        {name: "top_p too high", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"top_p":1.5}`, wantCode: "invalid_value", wantParam: "top_p"},
+        {name: "presence_penalty too low", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"presence_penalty":-3}`, wantCode: "invalid_value", wantParam: "presence_penalty"},
+        {name: "frequency_penalty too high", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"frequency_penalty":3}`, wantCode: "invalid_value", wantParam: "frequency_penalty"},
+        {name: "top_logprobs too high", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"logprobs":true,"top_logprobs":21}`, wantCode: "invalid_value", wantParam: "top_logprobs"},
+        {name: "top_logprobs without logprobs", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"top_logprobs":5}`, wantCode: "invalid_value", wantParam: "top_logprobs"},
+        {name: "parameter the model does not support", body: `{"model":"o1-mini","messages":[{"role":"user","content":"hi"}],"top_p":0.5}`, wantCode: "unsupported_parameter", wantParam: "top_p"},
+        {name: "body too large", body: `{"model":"gpt-4o","messages":[{"role":"user","content":"` + strings.Repeat("x", 1024) + `"}]}`, wantCode: "request_too_large"},
+    }
+
+    v := NewValidator(testValidationConfig{})
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            request, err := models.NewChatRequest([]byte(tt.body))
+            if err != nil {
+                t.Fatalf("NewChatRequest() error = %v", err)
+            }
+
+            apiErr := v.Validate(request)
+            if tt.wantCode == "" {
+                if apiErr != nil {
+                    t.Errorf("Validate() = %v, want nil", apiErr.Message)
+                }
+                return
+            }
+            if apiErr == nil {
+                t.Fatalf("Validate() = nil, want %s", tt.wantCode)
+            }
+            if apiErr.Code != tt.wantCode {
+                t.Errorf("code = %v, want %s", apiErr.Code, tt.wantCode)
+            }
+            param := ""
+            if apiErr.Param != nil {
+                param = *apiErr.Param
+            }
+            if param != tt.wantParam {
+                t.Errorf("param = %q, want %q", param, tt.wantParam)
+            }
+            if apiErr.Type != "invalid_request_error" {
+                t.Errorf("type = %s, want invalid_request_error", apiErr.Type)
+            }
+        })
+    }
+}